@@ -0,0 +1,290 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Minimal ACME server validating the requests signatures and nonces, the
+// http-01 challenges are fetched from the handler given by the test
+type fakeCA struct {
+	t       *testing.T
+	server  *httptest.Server
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	handler http.Handler
+
+	mu         sync.Mutex
+	nonce      int
+	nonces     map[string]bool
+	rejectOnce bool
+	account    *ecdsa.PublicKey
+	domains    []string
+	authzValid []bool
+	certDER    []byte
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &fakeCA{t: t, key: key, cert: cert, nonces: make(map[string]bool), rejectOnce: true}
+	ca.server = httptest.NewServer(http.HandlerFunc(ca.serve))
+	return ca
+}
+
+func (ca *fakeCA) newNonce(res http.ResponseWriter) {
+	ca.nonce++
+	n := fmt.Sprintf("nonce%d", ca.nonce)
+	ca.nonces[n] = true
+	res.Header().Set("Replay-Nonce", n)
+}
+
+func (ca *fakeCA) problem(res http.ResponseWriter, status int, typ, detail string) {
+	res.Header().Set("Content-Type", "application/problem+json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(Problem{Type: typ, Detail: detail, Status: status})
+}
+
+// Check the JWS and return its payload
+func (ca *fakeCA) verify(res http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		ca.problem(res, 400, "urn:ietf:params:acme:error:malformed", err.Error())
+		return nil, false
+	}
+	protected, _ := b64.DecodeString(jws.Protected)
+	var header struct {
+		Alg, Nonce, Url, Kid string
+		Jwk                  *struct{ X, Y string }
+	}
+	json.Unmarshal(protected, &header)
+
+	if !ca.nonces[header.Nonce] || (ca.rejectOnce && strings.HasSuffix(req.URL.Path, "/order")) {
+		ca.rejectOnce = false
+		ca.problem(res, 400, badNonce, "bad nonce")
+		return nil, false
+	}
+	delete(ca.nonces, header.Nonce)
+	if header.Url != ca.server.URL+req.URL.Path {
+		ca.problem(res, 401, "urn:ietf:params:acme:error:unauthorized", "url mismatch")
+		return nil, false
+	}
+
+	key := ca.account
+	if header.Jwk != nil {
+		x, _ := b64.DecodeString(header.Jwk.X)
+		y, _ := b64.DecodeString(header.Jwk.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if header.Kid != ca.server.URL+"/account" || key == nil {
+		ca.problem(res, 401, "urn:ietf:params:acme:error:accountDoesNotExist", "unknown kid")
+		return nil, false
+	}
+	sig, _ := b64.DecodeString(jws.Signature)
+	h := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if header.Alg != "ES256" || len(sig) != 64 ||
+		!ecdsa.Verify(key, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		ca.problem(res, 401, "urn:ietf:params:acme:error:unauthorized", "bad signature")
+		return nil, false
+	}
+	if header.Jwk != nil {
+		ca.account = key
+	}
+	payload, _ := b64.DecodeString(jws.Payload)
+	return payload, true
+}
+
+func (ca *fakeCA) serve(res http.ResponseWriter, req *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	u := ca.server.URL
+	if req.URL.Path == "/dir" {
+		json.NewEncoder(res).Encode(directory{u + "/nonce", u + "/account", u + "/order"})
+		return
+	}
+	ca.newNonce(res)
+	if req.URL.Path == "/nonce" {
+		return
+	}
+	payload, ok := ca.verify(res, req)
+	if !ok {
+		return
+	}
+
+	orderStatus := func() order {
+		o := order{Status: "pending", Finalize: u + "/finalize"}
+		for i := range ca.domains {
+			o.Authorizations = append(o.Authorizations, fmt.Sprintf("%s/authz/%d", u, i))
+		}
+		if ca.certDER != nil {
+			o.Status = "valid"
+			o.Certificate = u + "/cert"
+		}
+		return o
+	}
+
+	switch p := req.URL.Path; {
+	case p == "/account":
+		res.Header().Set("Location", u+"/account")
+		res.WriteHeader(http.StatusCreated)
+		res.Write([]byte(`{"status":"valid"}`))
+	case p == "/order":
+		var o struct{ Identifiers []identifier }
+		json.Unmarshal(payload, &o)
+		ca.domains = nil
+		for _, id := range o.Identifiers {
+			ca.domains = append(ca.domains, id.Value)
+		}
+		ca.authzValid = make([]bool, len(ca.domains))
+		ca.certDER = nil
+		res.Header().Set("Location", u+"/order/1")
+		res.WriteHeader(http.StatusCreated)
+		json.NewEncoder(res).Encode(orderStatus())
+	case p == "/order/1":
+		json.NewEncoder(res).Encode(orderStatus())
+	case strings.HasPrefix(p, "/authz/") || strings.HasPrefix(p, "/chal/"):
+		var i int
+		fmt.Sscanf(p[strings.LastIndex(p, "/")+1:], "%d", &i)
+		token := fmt.Sprintf("token%d", i)
+		if strings.HasPrefix(p, "/chal/") {
+			// Fetch the key authorization as the domain
+			rec := httptest.NewRecorder()
+			ca.handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+ca.domains[i]+challengePath+token, nil))
+			thumb, _ := thumbprint(ca.account)
+			ca.authzValid[i] = rec.Body.String() == token+"."+thumb
+		}
+		status := "pending"
+		if ca.authzValid[i] {
+			status = "valid"
+		}
+		json.NewEncoder(res).Encode(authorization{
+			Status:     status,
+			Identifier: identifier{"dns", ca.domains[i]},
+			Challenges: []challenge{
+				{Type: "dns-01", Url: fmt.Sprintf("%s/unused/%d", u, i), Token: "dns"},
+				{Type: "http-01", Url: fmt.Sprintf("%s/chal/%d", u, i), Token: token, Status: status},
+			},
+		})
+	case p == "/finalize":
+		for i, valid := range ca.authzValid {
+			if !valid {
+				ca.problem(res, 403, "urn:ietf:params:acme:error:orderNotReady", ca.domains[i]+" not authorized")
+				return
+			}
+		}
+		var f struct{ Csr string }
+		json.Unmarshal(payload, &f)
+		der, _ := b64.DecodeString(f.Csr)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || strings.Join(csr.DNSNames, ",") != strings.Join(ca.domains, ",") {
+			ca.problem(res, 400, "urn:ietf:params:acme:error:badCSR", fmt.Sprintf("%v", err))
+			return
+		}
+		ca.certDER, _ = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}, ca.cert, csr.PublicKey, ca.key)
+		json.NewEncoder(res).Encode(orderStatus())
+	case p == "/cert":
+		res.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(res, &pem.Block{Type: "CERTIFICATE", Bytes: ca.certDER})
+		pem.Encode(res, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+func TestManager(t *testing.T) {
+	ca := newFakeCA(t)
+	defer ca.server.Close()
+	dir, err := ioutil.TempDir("", "acme-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(ca.server.URL+"/dir", "admin@example.org", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.handler = m.HTTPHandler(http.NotFoundHandler())
+
+	m.SetDomains([][]string{{"example.org", "www.example.org"}})
+	if m.Certificate("example.org") != nil {
+		t.Errorf("certificate before Renew")
+	}
+	if err := m.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	cert := m.Certificate("WWW.example.org")
+	if cert == nil {
+		t.Fatal("no certificate after Renew")
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if err := leaf.VerifyHostname("www.example.org"); err != nil || len(cert.Certificate) != 2 {
+		t.Errorf("certificate: %v, chain of %d", err, len(cert.Certificate))
+	}
+	if len(m.tokens) != 0 {
+		t.Errorf("challenge tokens left: %v", m.tokens)
+	}
+
+	// The certificate is cached, and not renewed until it expires soon
+	m2, err := NewManager(ca.server.URL+"/dir", "admin@example.org", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2.SetDomains([][]string{{"example.org", "www.example.org"}})
+	if c := m2.Certificate("example.org"); c == nil || string(c.Certificate[0]) != string(cert.Certificate[0]) {
+		t.Errorf("certificate not loaded from the cache")
+	}
+	if err := m2.Renew(); err != nil || m2.registered {
+		t.Errorf("certificate renewed too early: %v", err)
+	}
+	m2.RenewBefore = 100 * 24 * time.Hour
+	ca.handler = m2.HTTPHandler(http.NotFoundHandler())
+	if err := m2.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	if c := m2.Certificate("example.org"); string(c.Certificate[0]) == string(cert.Certificate[0]) {
+		t.Errorf("certificate not renewed")
+	}
+
+	// Failed validation
+	m2.SetDomains([][]string{{"other.example.org"}})
+	ca.handler = http.NotFoundHandler()
+	m2.Client.Timeout = time.Second
+	if err := m2.Renew(); err == nil {
+		t.Errorf("certificate obtained without passing the challenge")
+	}
+}
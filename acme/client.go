@@ -0,0 +1,391 @@
+// Package acme obtains certificates from an ACME (RFC 8555) certificate
+// authority such as Let's Encrypt, validating domains with the http-01
+// challenge.
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Error document returned by the ACME server (RFC 7807)
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("ACME error %d %s: %s", p.Status, p.Type, p.Detail)
+}
+
+const badNonce = "urn:ietf:params:acme:error:badNonce"
+
+// Receive the key authorizations to serve for http-01 challenges, at
+// /.well-known/acme-challenge/<token>
+type ChallengeResponder interface {
+	Present(token, keyAuth string)
+	CleanUp(token string)
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Problem `json:"error"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	Url    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type Client struct {
+	DirectoryUrl string
+	Key          *ecdsa.PrivateKey
+	HTTPClient   *http.Client
+	// Maximum time to wait for a challenge validation or an order
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	dir    *directory
+	kid    string
+	nonces []string
+}
+
+func NewClient(directoryUrl string, key *ecdsa.PrivateKey) *Client {
+	return &Client{
+		DirectoryUrl: directoryUrl,
+		Key:          key,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		Timeout:      2 * time.Minute,
+	}
+}
+
+// Trust the PEM encoded roots in addition to the system ones when connecting
+// to the ACME server, for test servers such as pebble
+func (c *Client) AddRoots(pemCerts []byte) error {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return errors.New("No certificate found in the ACME roots")
+	}
+	c.HTTPClient = &http.Client{
+		Timeout:   c.HTTPClient.Timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return nil
+}
+
+func (c *Client) directory() (*directory, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dir != nil {
+		return c.dir, nil
+	}
+	resp, err := c.HTTPClient.Get(c.DirectoryUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACME directory %s: %s", c.DirectoryUrl, resp.Status)
+	}
+	var dir directory
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("ACME directory %s: %v", c.DirectoryUrl, err)
+	}
+	c.dir = &dir
+	return c.dir, nil
+}
+
+func (c *Client) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mu.Unlock()
+	}
+}
+
+func (c *Client) nonce(dir *directory) (string, error) {
+	c.mu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mu.Unlock()
+		return nonce, nil
+	}
+	c.mu.Unlock()
+
+	resp, err := c.HTTPClient.Head(dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("ACME server did not return a nonce")
+	}
+	return nonce, nil
+}
+
+// Send a signed request, retrying on bad nonces. The response body is decoded
+// in result if not nil, and returned otherwise.
+func (c *Client) post(url string, payload, result interface{}) (*http.Response, []byte, error) {
+	dir, err := c.directory()
+	if err != nil {
+		return nil, nil, err
+	}
+	for retry := 0; ; retry++ {
+		nonce, err := c.nonce(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.mu.Lock()
+		kid := c.kid
+		c.mu.Unlock()
+		body, err := signJWS(c.Key, kid, nonce, url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.HTTPClient.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		c.saveNonce(resp)
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode >= 400 {
+			p := &Problem{Status: resp.StatusCode}
+			if json.Unmarshal(data, p) != nil || p.Type == "" {
+				p.Detail = string(data)
+			}
+			if p.Type == badNonce && retry < 5 {
+				continue
+			}
+			return resp, nil, p
+		}
+
+		if result != nil {
+			if err := json.Unmarshal(data, result); err != nil {
+				return resp, nil, fmt.Errorf("ACME response from %s: %v", url, err)
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+// Create the account, or find it if it already exists for the key
+func (c *Client) Register(email string) error {
+	dir, err := c.directory()
+	if err != nil {
+		return err
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	c.mu.Lock()
+	c.kid = ""
+	c.mu.Unlock()
+	resp, _, err := c.post(dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	kid := resp.Header.Get("Location")
+	if kid == "" {
+		return errors.New("ACME server did not return the account URL")
+	}
+	c.mu.Lock()
+	c.kid = kid
+	c.mu.Unlock()
+	return nil
+}
+
+// Wait for the resource at url to leave the pending and processing states
+func (c *Client) poll(url string, result interface{}, status func() string) error {
+	deadline := time.Now().Add(c.Timeout)
+	for {
+		resp, _, err := c.post(url, nil, result)
+		if err != nil {
+			return err
+		}
+		if s := status(); s != "pending" && s != "processing" {
+			return nil
+		}
+		wait := time.Second
+		if ra, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && ra > 0 {
+			wait = time.Duration(ra) * time.Second
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("Timeout waiting for %s", url)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (c *Client) authorize(authzUrl string, responder ChallengeResponder) error {
+	var authz authorization
+	if _, _, err := c.post(authzUrl, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	} else if authz.Status != "pending" {
+		return fmt.Errorf("Authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	}
+
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("No http-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	thumb, err := thumbprint(&c.Key.PublicKey)
+	if err != nil {
+		return err
+	}
+	responder.Present(chal.Token, chal.Token+"."+thumb)
+	defer responder.CleanUp(chal.Token)
+
+	if _, _, err := c.post(chal.Url, struct{}{}, nil); err != nil {
+		return err
+	}
+	err = c.poll(authzUrl, &authz, func() string { return authz.Status })
+	if err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		for _, ch := range authz.Challenges {
+			if ch.Type == "http-01" && ch.Error != nil {
+				return fmt.Errorf("Validation of %s failed: %v", authz.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("Authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	}
+	return nil
+}
+
+// Obtain a certificate for the domains and the key, the account must be
+// registered. Return the certificate chain in DER form.
+func (c *Client) Obtain(domains []string, key *ecdsa.PrivateKey, responder ChallengeResponder) ([][]byte, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("No domain to obtain a certificate for")
+	}
+	dir, err := c.directory()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []identifier
+	for _, d := range domains {
+		ids = append(ids, identifier{"dns", d})
+	}
+	var o order
+	resp, _, err := c.post(dir.NewOrder, map[string]interface{}{"identifiers": ids}, &o)
+	if err != nil {
+		return nil, err
+	}
+	orderUrl := resp.Header.Get("Location")
+
+	for _, authzUrl := range o.Authorizations {
+		if err := c.authorize(authzUrl, responder); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.post(o.Finalize, map[string]string{"csr": b64.EncodeToString(csr)}, &o); err != nil {
+		return nil, err
+	}
+	if o.Status != "valid" {
+		if orderUrl == "" {
+			return nil, errors.New("ACME server did not return the order URL")
+		}
+		if err := c.poll(orderUrl, &o, func() string { return o.Status }); err != nil {
+			return nil, err
+		}
+	}
+	if o.Status != "valid" || o.Certificate == "" {
+		if o.Error != nil {
+			return nil, o.Error
+		}
+		return nil, fmt.Errorf("Order is %s", o.Status)
+	}
+
+	_, data, err := c.post(o.Certificate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseChain(data)
+}
+
+func parseChain(data []byte) ([][]byte, error) {
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("No certificate in the ACME response")
+	}
+	return chain, nil
+}
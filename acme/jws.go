@@ -0,0 +1,96 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var b64 = base64.RawURLEncoding
+
+// Pad a big-endian integer to size bytes
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// JSON Web Key of a P-256 public key, with the members in the order of the
+// thumbprint (RFC 7638)
+func jwk(key *ecdsa.PublicKey) (string, error) {
+	if key.Curve != elliptic.P256() {
+		return "", errors.New("Only P-256 account keys are supported")
+	}
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64.EncodeToString(padded(key.X, 32)),
+		b64.EncodeToString(padded(key.Y, 32))), nil
+}
+
+// Thumbprint of the account key, as used in key authorizations
+func thumbprint(key *ecdsa.PublicKey) (string, error) {
+	k, err := jwk(key)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(k))
+	return b64.EncodeToString(h[:]), nil
+}
+
+// Sign a request in the flattened JWS JSON serialization. The key is
+// identified by kid if not empty, or else embedded as a JWK. A nil payload
+// makes a POST-as-GET request.
+func signJWS(key *ecdsa.PrivateKey, kid, nonce, url string, payload interface{}) ([]byte, error) {
+	header := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if kid != "" {
+		header["kid"] = kid
+	} else {
+		k, err := jwk(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		header["jwk"] = json.RawMessage(k)
+	}
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var encodedPayload string
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = b64.EncodeToString(p)
+	}
+
+	encodedProtected := b64.EncodeToString(protected)
+	h := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": b64.EncodeToString(append(padded(r, 32), padded(s, 32)...)),
+	})
+}
+
+// Generate a P-256 key, for accounts and certificates
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
@@ -0,0 +1,243 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const challengePath = "/.well-known/acme-challenge/"
+
+// Obtain and renew certificates, kept in a cache directory. Each certificate
+// covers a set of domains and is named after the first one.
+type Manager struct {
+	Client *Client
+	Email  string
+	Cache  string
+	// Renew certificates expiring sooner than this
+	RenewBefore time.Duration
+
+	mu         sync.RWMutex
+	sets       map[string][]string
+	certs      map[string]*tls.Certificate // by domain
+	tokens     map[string]string
+	registered bool
+	renewing   sync.Mutex
+}
+
+// Create a manager with the account key stored in the cache directory,
+// generated if missing
+func NewManager(directoryUrl, email, cache string) (*Manager, error) {
+	if err := os.MkdirAll(cache, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadKey(filepath.Join(cache, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		Client:      NewClient(directoryUrl, key),
+		Email:       email,
+		Cache:       cache,
+		RenewBefore: 30 * 24 * time.Hour,
+		sets:        make(map[string][]string),
+		certs:       make(map[string]*tls.Certificate),
+		tokens:      make(map[string]string),
+	}, nil
+}
+
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return key, err
+}
+
+func (m *Manager) certPath(name string) string {
+	return filepath.Join(m.Cache, strings.Replace(name, "/", "_", -1)+".pem")
+}
+
+// Replace the sets of domains to manage, the certificates found in the cache
+// are available immediately
+func (m *Manager) SetDomains(sets [][]string) {
+	named := make(map[string][]string)
+	certs := make(map[string]*tls.Certificate)
+	for _, domains := range sets {
+		if len(domains) == 0 {
+			continue
+		}
+		named[domains[0]] = domains
+		cert, err := tls.LoadX509KeyPair(m.certPath(domains[0]), m.certPath(domains[0]))
+		if err != nil {
+			continue
+		}
+		for _, d := range domains {
+			certs[strings.ToLower(d)] = &cert
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sets = named
+	m.certs = certs
+}
+
+// Certificate for a domain, nil if not yet obtained or not managed
+func (m *Manager) Certificate(domain string) *tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.certs[strings.TrimSuffix(strings.ToLower(domain), ".")]
+}
+
+// Obtain the missing certificates and renew those about to expire
+func (m *Manager) Renew() error {
+	m.renewing.Lock()
+	defer m.renewing.Unlock()
+
+	m.mu.RLock()
+	var due [][]string
+	for _, domains := range m.sets {
+		if cert := m.certs[strings.ToLower(domains[0])]; cert == nil || m.expiresSoon(cert) {
+			due = append(due, domains)
+		}
+	}
+	registered := m.registered
+	m.mu.RUnlock()
+
+	if len(due) == 0 {
+		return nil
+	}
+	if !registered {
+		if err := m.Client.Register(m.Email); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.registered = true
+		m.mu.Unlock()
+	}
+
+	var errs []string
+	for _, domains := range due {
+		log.Printf("ACME: obtaining a certificate for %s\n", strings.Join(domains, ", "))
+		cert, err := m.obtain(domains)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", domains[0], err))
+			continue
+		}
+		m.mu.Lock()
+		if _, ok := m.sets[domains[0]]; ok {
+			for _, d := range domains {
+				m.certs[strings.ToLower(d)] = cert
+			}
+		}
+		m.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("ACME: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m *Manager) expiresSoon(cert *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	return err != nil || time.Now().Add(m.RenewBefore).After(leaf.NotAfter)
+}
+
+func (m *Manager) obtain(domains []string) (*tls.Certificate, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := m.Client.Obtain(domains, key, m)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	if err := ioutil.WriteFile(m.certPath(domains[0]), data, 0600); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	return &cert, err
+}
+
+// Renew certificates every interval, until stop is closed
+func (m *Manager) RenewLoop(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := m.Renew(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (m *Manager) Present(token, keyAuth string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[token] = keyAuth
+}
+
+func (m *Manager) CleanUp(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, token)
+}
+
+// Serve the http-01 challenges and pass the other requests to next
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, challengePath) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[strings.TrimPrefix(req.URL.Path, challengePath)]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		res.Header().Set("Content-Type", "application/octet-stream")
+		res.Write([]byte(keyAuth))
+	})
+}
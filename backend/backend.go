@@ -0,0 +1,80 @@
+// Package backend defines the quad storage used by the servers, with
+// adapters for a remote SPARQL endpoint and the embedded quad store. The
+// Redland adapter is in the rdf package as it requires cgo.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/sparql"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("Operation not supported by the storage backend")
+
+type Backend interface {
+	// Add quads, a nil graph is the default graph
+	AddQuads(quads ...*nquads.Statement) error
+	RemoveQuads(quads ...*nquads.Statement) error
+	// Replace the content of a named graph, the graph of the statements is
+	// ignored
+	ReplaceGraph(graph string, triples []*nquads.Statement) error
+	// Run a SELECT or ASK query
+	Select(query string) (*sparql.Response, error)
+	// Run a CONSTRUCT query, the resulting triples are in the default graph
+	Construct(query string) ([]*nquads.Statement, error)
+	// Run a SPARQL update request
+	Update(update string) error
+}
+
+// Convert a Go value to a RDF node, with the same conversions as
+// sparql.Literal
+func Node(o interface{}) (nquads.Node, error) {
+	switch v := o.(type) {
+	case nquads.Node:
+		return v, nil
+	case *url.URL:
+		return nquads.NewIri(v.String()), nil
+	case string:
+		return nquads.NewLiteral(v, "", ""), nil
+	case bool:
+		return nquads.NewLiteral(strconv.FormatBool(v), nquads.XsdBoolean, ""), nil
+	case int:
+		return nquads.NewLiteral(strconv.Itoa(v), nquads.XsdNamespace+"integer", ""), nil
+	case float32:
+		return nquads.NewLiteral(strconv.FormatFloat(float64(v), 'E', -1, 32), nquads.XsdNamespace+"double", ""), nil
+	case float64:
+		return nquads.NewLiteral(strconv.FormatFloat(v, 'E', -1, 64), nquads.XsdNamespace+"double", ""), nil
+	default:
+		return nil, fmt.Errorf("Could not make a RDF node from %#v", o)
+	}
+}
+
+// Make a quad from Go values converted with Node
+func Quad(context, subject, predicate, object interface{}) (*nquads.Statement, error) {
+	var nodes [4]nquads.Node
+	for i, v := range []interface{}{context, subject, predicate, object} {
+		n, err := Node(v)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = n
+	}
+	return nquads.NewStatement(nodes[1], nodes[2], nodes[3], nodes[0]), nil
+}
+
+var queryFormRegexp = regexp.MustCompile(`(?i)^(\s+|#[^\n]*(\n|$)|PREFIX\s*[^\s:]*:\s*<[^>]*>|BASE\s*<[^>]*>)*(SELECT|ASK|CONSTRUCT|DESCRIBE)\b`)
+
+// Return the form of a query in upper case (SELECT, ASK, CONSTRUCT or
+// DESCRIBE), or an empty string if it cannot be found
+func QueryForm(query string) string {
+	m := queryFormRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return ""
+	}
+	return strings.ToUpper(m[3])
+}
@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mildred/SmartWeb/nquads"
+)
+
+func TestQueryForm(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * WHERE { ?s ?p ?o }": "SELECT",
+		"# comment\nPREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>\nBASE <http://ex.org/>\nconstruct { ?s ?p ?o } WHERE { ?s ?p ?o }": "CONSTRUCT",
+		"PREFIX : <http://ex.org/> ASK { ?s ?p ?o }": "ASK",
+		"INSERT DATA { <a:b> <a:c> <a:d> }":           "",
+	}
+	for query, expected := range tests {
+		if form := QueryForm(query); form != expected {
+			t.Errorf("QueryForm(%q) = %q, expected %q", query, form, expected)
+		}
+	}
+}
+
+func TestQuadData(t *testing.T) {
+	g1, g2 := nquads.NewIri("http://ex.org/g1"), nquads.NewIri("http://ex.org/g2")
+	s, p := nquads.NewIri("http://ex.org/s"), nquads.NewIri("http://ex.org/p")
+	data := quadData([]*nquads.Statement{
+		nquads.NewStatement(s, p, nquads.NewLiteral("a", "", ""), nil),
+		nquads.NewStatement(s, p, nquads.NewLiteral("b", "", ""), g1),
+		nquads.NewStatement(s, p, nquads.NewLiteral("c", "", ""), g1),
+		nquads.NewStatement(s, p, nquads.NewLiteral("d", "", ""), g2),
+	})
+	expected := `<http://ex.org/s> <http://ex.org/p> "a" .
+GRAPH <http://ex.org/g1> {
+<http://ex.org/s> <http://ex.org/p> "b" .
+<http://ex.org/s> <http://ex.org/p> "c" .
+}
+GRAPH <http://ex.org/g2> {
+<http://ex.org/s> <http://ex.org/p> "d" .
+}
+`
+	if data != expected {
+		t.Errorf("quadData:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	// The quad data must be valid for the built-in engine
+	b := NewMemory()
+	if err := b.Update("INSERT DATA {\n" + data + "}"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Store.Len() != 4 {
+		t.Errorf("%d quads inserted", b.Store.Len())
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	b := NewMemory()
+	u, _ := url.Parse("http://ex.org/page")
+	quad, err := Quad(u, u, u, "title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddQuads(quad); err != nil {
+		t.Fatal(err)
+	}
+	res, err := b.Select(`SELECT ?o WHERE { GRAPH <http://ex.org/page> { ?s ?p ?o } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results.Bindings) != 1 || res.Results.Bindings[0]["o"].Value != "title" {
+		t.Errorf("Select: %v", res)
+	}
+
+	err = b.ReplaceGraph("http://ex.org/page", []*nquads.Statement{
+		nquads.NewStatement(nquads.NewIri("http://ex.org/page"), nquads.NewIri("http://ex.org/p"), nquads.NewLiteral("1", nquads.XsdNamespace+"integer", ""), nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	triples, err := b.Construct(`CONSTRUCT { ?s ?p ?o } WHERE { GRAPH <http://ex.org/page> { ?s ?p ?o } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(triples) != 1 || triples[0].String() != `<http://ex.org/page> <http://ex.org/p> "1"^^<http://www.w3.org/2001/XMLSchema#integer> .` {
+		t.Errorf("Construct after ReplaceGraph: %v", triples)
+	}
+}
+
+func TestRebase(t *testing.T) {
+	b := NewMemory()
+	err := b.Update(`INSERT DATA {
+		GRAPH <http://ex.org:8000/page> {
+			<http://ex.org:8000/page> <http://ex.org/p> <http://ex.org:8000/other> , "http://ex.org:8000/literal" .
+			_:b <http://ex.org/p> <http://ex.org:8000/page> .
+			<http://ex.org:8000/> <http://ex.org/p> _:b .
+		}
+		GRAPH <http://other.org/page> { <http://other.org/page> <http://ex.org/p> "o" }
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CountPrefix(b, "http://ex.org:8000/"); err != nil || n != 4 {
+		t.Errorf("CountPrefix: %d, %v", n, err)
+	}
+	if err := Rebase(b, "http://ex.org:8000/", "https://ex.org/"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CountPrefix(b, "http://ex.org:8000/"); err != nil || n != 0 {
+		t.Errorf("CountPrefix after Rebase: %d, %v", n, err)
+	}
+	res, err := b.Select(`ASK { GRAPH <https://ex.org/page> {
+		<https://ex.org/page> <http://ex.org/p> <https://ex.org/other> , "http://ex.org:8000/literal" .
+		?b <http://ex.org/p> <https://ex.org/page> .
+		<https://ex.org/> <http://ex.org/p> ?b .
+	} }`)
+	if err != nil || !res.Boolean || b.Store.Len() != 5 {
+		t.Errorf("Rebase: %v, %d quads", err, b.Store.Len())
+	}
+}
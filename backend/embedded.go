@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/quadstore"
+	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/sparqlengine"
+)
+
+// Embedded quad store, queries are evaluated by the built-in SPARQL engine
+type Embedded struct {
+	Store  *quadstore.Store
+	Engine *sparqlengine.Engine
+}
+
+func NewEmbedded(store *quadstore.Store) *Embedded {
+	return &Embedded{store, sparqlengine.NewEngine(store)}
+}
+
+// Create an embedded store kept in memory only
+func NewMemory() *Embedded {
+	return NewEmbedded(quadstore.NewMemoryStore())
+}
+
+func (e *Embedded) AddQuads(quads ...*nquads.Statement) error {
+	return e.Store.Add(quads...)
+}
+
+func (e *Embedded) RemoveQuads(quads ...*nquads.Statement) error {
+	return e.Store.Remove(quads...)
+}
+
+func (e *Embedded) ReplaceGraph(graph string, triples []*nquads.Statement) error {
+	return e.Store.ReplaceGraph(nquads.NewIri(graph), triples)
+}
+
+func (e *Embedded) Select(query string) (*sparql.Response, error) {
+	res, err := e.Engine.Query(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var response sparql.Response
+	response.Boolean = res.Boolean
+	for _, b := range res.Bindings {
+		binding := make(sparql.Binding, len(b))
+		for k, v := range b {
+			binding[k] = bindingValue(v)
+		}
+		response.Results.Bindings = append(response.Results.Bindings, binding)
+	}
+	return &response, nil
+}
+
+func bindingValue(n nquads.Node) sparql.BindingValue {
+	switch n := n.(type) {
+	case *nquads.IriNode:
+		return sparql.BindingValue{Type: "uri", Value: n.Iri()}
+	case *nquads.BlankNode:
+		return sparql.BindingValue{Type: "bnode", Value: n.Label()}
+	case *nquads.LiteralNode:
+		v := sparql.BindingValue{Type: "literal", Value: n.Value(), Lang: n.Lang}
+		if n.Lang == "" && n.Datatype() != nquads.XsdString {
+			v.Datatype = n.Datatype()
+		}
+		return v
+	}
+	return sparql.BindingValue{}
+}
+
+func (e *Embedded) Construct(query string) ([]*nquads.Statement, error) {
+	res, err := e.Engine.Query(query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Statements, nil
+}
+
+func (e *Embedded) Update(update string) error {
+	return e.Engine.Update(update)
+}
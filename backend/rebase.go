@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/mildred/SmartWeb/sparql"
+	"strconv"
+)
+
+// Quads with an IRI starting with the prefix %1s as graph, subject or object
+const prefixPattern = `
+	GRAPH ?g { ?s ?p ?o }
+	FILTER(STRSTARTS(STR(?g), %1s) ||
+		isIRI(?s) && STRSTARTS(STR(?s), %1s) ||
+		isIRI(?o) && STRSTARTS(STR(?o), %1s))
+`
+
+// Number of quads with an IRI starting with the prefix as graph, subject or
+// object
+func CountPrefix(b Backend, prefix string) (int, error) {
+	res, err := b.Select(sparql.MakeQuery(`SELECT (COUNT(*) AS ?n) WHERE {`+prefixPattern+`}`, prefix))
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Results.Bindings) != 1 {
+		return 0, fmt.Errorf("No count returned by the storage backend")
+	}
+	return strconv.Atoi(res.Results.Bindings[0]["n"].Value)
+}
+
+// Replace the prefix from by to in the IRIs of the graphs, subjects and
+// objects of all the quads
+func Rebase(b Backend, from, to string) error {
+	return b.Update(sparql.MakeQuery(`
+		DELETE { GRAPH ?g { ?s ?p ?o } }
+		INSERT { GRAPH ?g2 { ?s2 ?p ?o2 } }
+		WHERE {`+prefixPattern+`
+			BIND(IF(STRSTARTS(STR(?g), %1s), IRI(CONCAT(%2s, STRAFTER(STR(?g), %1s))), ?g) AS ?g2)
+			BIND(IF(isIRI(?s) && STRSTARTS(STR(?s), %1s), IRI(CONCAT(%2s, STRAFTER(STR(?s), %1s))), ?s) AS ?s2)
+			BIND(IF(isIRI(?o) && STRSTARTS(STR(?o), %1s), IRI(CONCAT(%2s, STRAFTER(STR(?o), %1s))), ?o) AS ?o2)
+		}
+	`, from, to))
+}
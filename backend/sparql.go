@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/sparql"
+	"strings"
+)
+
+// Remote SPARQL endpoint
+type Sparql struct {
+	Client *sparql.Client
+}
+
+func NewSparql(client *sparql.Client) *Sparql {
+	return &Sparql{client}
+}
+
+// Quad data for INSERT DATA and DELETE DATA, grouped by graph
+func quadData(quads []*nquads.Statement) string {
+	var res strings.Builder
+	var graph nquads.Node
+	open := false
+	for _, q := range quads {
+		if open && (q.GraphNode() == nil || graph == nil || q.GraphNode().Encode() != graph.Encode()) {
+			res.WriteString("}\n")
+			open = false
+		}
+		graph = q.GraphNode()
+		if !open && graph != nil {
+			res.WriteString("GRAPH " + graph.Encode() + " {\n")
+			open = true
+		}
+		res.WriteString(q.SubjectNode().Encode() + " " + q.PredicateNode().Encode() + " " + q.ObjectNode().Encode() + " .\n")
+	}
+	if open {
+		res.WriteString("}\n")
+	}
+	return res.String()
+}
+
+func (s *Sparql) AddQuads(quads ...*nquads.Statement) error {
+	if len(quads) == 0 {
+		return nil
+	}
+	return s.Update("INSERT DATA {\n" + quadData(quads) + "}")
+}
+
+func (s *Sparql) RemoveQuads(quads ...*nquads.Statement) error {
+	if len(quads) == 0 {
+		return nil
+	}
+	return s.Update("DELETE DATA {\n" + quadData(quads) + "}")
+}
+
+func (s *Sparql) ReplaceGraph(graph string, triples []*nquads.Statement) error {
+	g := nquads.NewIri(graph)
+	update := "DROP SILENT GRAPH " + g.Encode()
+	if len(triples) > 0 {
+		var quads []*nquads.Statement
+		for _, t := range triples {
+			quads = append(quads, nquads.NewStatement(t.SubjectNode(), t.PredicateNode(), t.ObjectNode(), g))
+		}
+		update += " ;\nINSERT DATA {\n" + quadData(quads) + "}"
+	}
+	return s.Update(update)
+}
+
+func (s *Sparql) Select(query string) (*sparql.Response, error) {
+	return s.Client.Select(query)
+}
+
+func (s *Sparql) Construct(query string) ([]*nquads.Statement, error) {
+	return s.Client.Construct(query)
+}
+
+func (s *Sparql) Update(update string) error {
+	_, err := s.Client.Update(update)
+	return err
+}
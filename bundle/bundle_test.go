@@ -0,0 +1,216 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testFiles = map[string]string{
+	"a.txt":     "A",
+	"sub/b.txt": "B",
+}
+
+func sha1Name(content string) string {
+	return fmt.Sprintf("sha1:%x", sha1.Sum([]byte(content)))
+}
+
+// Write a bundle of testFiles in a file of dir
+func writeBundle(t *testing.T, dir, format string) string {
+	path := filepath.Join(dir, "bundle."+format)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w *Writer
+	switch format {
+	case "zip":
+		w, err = NewWriter(f, "http://example.org/")
+	case "tar":
+		w, err = NewTarWriter(f, "http://example.org/", false)
+	case "tar.gz":
+		w, err = NewTarWriter(f, "http://example.org/", true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range testFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := w.InsertFile("http://example.org/"+name, name, strings.NewReader(testFiles[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Hashes of the files described by the graph of a bundle
+func graphHashes(t *testing.T, r *Reader) map[string]bool {
+	g, err := r.Graph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	statements, err := g.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]bool)
+	for _, st := range statements {
+		if st.Predicate() == "tag:mildred.fr,2015-05:SmartWeb#hash" {
+			hashes[strings.Trim(st.ObjectNode().Encode(), "<>")] = true
+		}
+	}
+	return hashes
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		format    string
+		mediaType string
+		// Name of the first file returned by Next
+		first string
+	}{
+		{"zip", MimeType, "graphs.nq"},
+		{"tar", TarMimeType, sha1Name("A")},
+		{"tar.gz", TarMimeType, sha1Name("A")},
+	}
+	for _, test := range tests {
+		path := writeBundle(t, dir, test.format)
+
+		r, err := OpenReader(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if r.MediaType != test.mediaType {
+			t.Errorf("%s: media type %s", test.format, r.MediaType)
+		}
+		contents := make(map[string]string)
+		var names []string
+		for {
+			f, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", test.format, err)
+			}
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("%s: %v", test.format, err)
+			}
+			names = append(names, f.Name)
+			contents[f.Name] = string(data)
+		}
+		r.Close()
+		if len(names) != 3 || names[0] != test.first {
+			t.Errorf("%s: files %v", test.format, names)
+		}
+		for _, content := range testFiles {
+			if contents[sha1Name(content)] != content {
+				t.Errorf("%s: content of %s: %q", test.format, sha1Name(content), contents[sha1Name(content)])
+			}
+		}
+
+		// graphs.nq is written last, tar readers skip the data files to find it
+		r, err = OpenReader(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		hashes := graphHashes(t, &r.Reader)
+		r.Close()
+		if len(hashes) != 2 || !hashes[sha1Name("A")] || !hashes[sha1Name("B")] {
+			t.Errorf("%s: graph hashes %v", test.format, hashes)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "text"), []byte("not a bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := OpenReader(filepath.Join(dir, "text")); err == nil {
+		r.Close()
+		t.Errorf("text file opened as a bundle")
+	}
+}
+
+// Write a tar archive of the entries, given as name and content pairs
+func writeTar(t *testing.T, gzipped bool, entries ...string) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var z *gzip.Writer
+	if gzipped {
+		z = gzip.NewWriter(&buf)
+		w = z
+	}
+	tw := tar.NewWriter(w)
+	for i := 0; i < len(entries); i += 2 {
+		err := tw.WriteHeader(&tar.Header{Name: entries[i], Mode: 0644, Size: int64(len(entries[i+1])), Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = tw.Write([]byte(entries[i+1]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if z != nil {
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestTarMimetype(t *testing.T) {
+	graph := "<http://example.org/a.txt> <tag:mildred.fr,2015-05:SmartWeb#hash> <" + sha1Name("A") + "> <http://example.org/a.txt> .\n"
+	tests := []struct {
+		name    string
+		gzipped bool
+		entries []string
+		valid   bool
+	}{
+		{"mimetype first", false, []string{"mimetype", TarMimeType, sha1Name("A"), "A", "graphs.nq", graph}, true},
+		{"gzip", true, []string{"mimetype", TarMimeType, sha1Name("A"), "A", "graphs.nq", graph}, true},
+		{"mimetype second", false, []string{sha1Name("A"), "A", "mimetype", TarMimeType, "graphs.nq", graph}, false},
+		{"zip mimetype", false, []string{"mimetype", MimeType, "graphs.nq", graph}, false},
+		{"no mimetype", false, []string{"graphs.nq", graph}, false},
+	}
+	for _, test := range tests {
+		r, err := NewTarReader(bytes.NewReader(writeTar(t, test.gzipped, test.entries...)))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: accepted", test.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if hashes := graphHashes(t, r); len(hashes) != 1 || !hashes[sha1Name("A")] {
+			t.Errorf("%s: graph hashes %v", test.name, hashes)
+		}
+	}
+}
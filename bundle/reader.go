@@ -1,14 +1,44 @@
 package bundle
 
 import (
-	"io"
-	"io/ioutil"
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"github.com/mildred/SmartWeb/nquads"
+	"io"
+	"io/ioutil"
+	"os"
 )
 
+var ErrNoGraph = errors.New("Bundle does not contain graphs.nq")
+
+// A file contained in the bundle. The content must be read before the next
+// file is requested from the Reader.
+type File struct {
+	Name string
+	io.Reader
+}
+
+type archiveReader interface {
+	next() (*File, error)
+	open(name string) (io.ReadCloser, error)
+}
+
 type Reader struct {
-	*zip.Reader
+	MediaType string
+	archive   archiveReader
+
+	// Skip invalid lines in graphs.nq instead of failing, see SkippedLine
+	Lenient bool
+}
+
+// Sent instead of a statement on the statements channel in lenient mode when
+// a line could not be parsed. Reading continues with the next line.
+type SkippedLine struct {
+	*nquads.ParseError
 }
 
 type ReadCloser struct {
@@ -16,52 +46,216 @@ type ReadCloser struct {
 	io.Closer
 }
 
+type zipArchiveReader struct {
+	*zip.Reader
+	files []*zip.File
+	cur   io.ReadCloser
+}
+
+func newZipArchiveReader(z *zip.Reader) *zipArchiveReader {
+	// Walk graphs.nq first so the files can be filtered by the graph content
+	var files []*zip.File
+	for _, f := range z.File {
+		if f.Name == "graphs.nq" {
+			files = append([]*zip.File{f}, files...)
+		} else if f.Name != "mimetype" {
+			files = append(files, f)
+		}
+	}
+	return &zipArchiveReader{z, files, nil}
+}
+
+func (z *zipArchiveReader) next() (*File, error) {
+	if z.cur != nil {
+		z.cur.Close()
+		z.cur = nil
+	}
+	if len(z.files) == 0 {
+		return nil, io.EOF
+	}
+	f := z.files[0]
+	z.files = z.files[1:]
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	z.cur = rc
+	return &File{f.Name, rc}, nil
+}
+
+func (z *zipArchiveReader) open(name string) (io.ReadCloser, error) {
+	for _, f := range z.Reader.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+type tarArchiveReader struct {
+	*tar.Reader
+}
+
+func (t tarArchiveReader) next() (*File, error) {
+	for {
+		hdr, err := t.Reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return &File{hdr.Name, t.Reader}, nil
+		}
+	}
+}
+
+// tar archives can only be read sequentially, skip entries until the requested
+// file is found
+func (t tarArchiveReader) open(name string) (io.ReadCloser, error) {
+	for {
+		f, err := t.next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		} else if err != nil {
+			return nil, err
+		} else if f.Name == name {
+			return ioutil.NopCloser(f), nil
+		}
+	}
+}
+
+// Read a ZIP bundle
 func NewReader(f io.ReaderAt, size int64) (*Reader, error) {
 	z, err := zip.NewReader(f, size)
 	if err != nil {
 		return nil, err
 	}
 
-	r := &Reader{ z }
-	
+	r := &Reader{MediaType: MimeType, archive: newZipArchiveReader(z)}
+
 	return r, nil
 }
 
+// Read a tar bundle from a stream. The stream can be compressed with gzip. The
+// mimetype file must be the first file of the archive.
+func NewTarReader(f io.Reader) (*Reader, error) {
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	var stream io.Reader = br
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		stream, err = gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := tarArchiveReader{tar.NewReader(stream)}
+
+	mimetype, err := t.next()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(mimetype, 256))
+	if err != nil {
+		return nil, err
+	}
+
+	if mimetype.Name != "mimetype" || string(data) != TarMimeType {
+		return nil, fmt.Errorf("Expected mimetype file containing %s as first tar entry", TarMimeType)
+	}
+
+	return &Reader{MediaType: TarMimeType, archive: t}, nil
+}
+
+// Open a bundle file, the container format is detected from the file content.
 func OpenReader(name string) (*ReadCloser, error) {
-	z, err := zip.OpenReader(name)
+	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
 
-	r := &ReadCloser{ Reader{ &z.Reader }, z }
-	
-	return r, nil
+	var magic [4]byte
+	_, err = io.ReadFull(f, magic[:])
+	if err == nil && string(magic[:]) == "PK\x03\x04" {
+		f.Close()
+		z, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		return &ReadCloser{Reader{MediaType: MimeType, archive: newZipArchiveReader(&z.Reader)}, z}, nil
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r, err := NewTarReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &ReadCloser{*r, f}, nil
 }
 
+// Return the next file in the bundle, or io.EOF. The mimetype file is not
+// returned. With ZIP bundles, graphs.nq is always returned first.
+func (r *Reader) Next() (*File, error) {
+	return r.archive.next()
+}
+
+// Open graphs.nq. With tar bundles, this skips over all the files until
+// graphs.nq is found.
 func (r *Reader) Graph() (*nquads.ReadCloser, error) {
-	for _, f := range r.Reader.File {
-		if f.Name == "graphs.nq" {
-			rc, err := f.Open()
-			if err != nil {
-				return nil, err
-			} else {
-				return nquads.NewReadCloser(rc), nil
-			}
-		}
+	rc, err := r.archive.open("graphs.nq")
+	if os.IsNotExist(err) {
+		return nil, ErrNoGraph
+	} else if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	g := nquads.NewReadCloser(rc)
+	g.AllowRelative = true
+	g.Lenient = r.Lenient
+	return g, nil
+}
+
+// Return a reader for graphs.nq when returned by Next
+func (r *Reader) GraphReader(f *File) *nquads.Reader {
+	g := nquads.NewReader(f)
+	g.AllowRelative = true
+	g.Lenient = r.Lenient
+	return g
 }
 
 func (r *Reader) GraphStatements(buffer int) <-chan interface{} {
+	g, err := r.Graph()
+	if err != nil {
+		c := make(chan interface{}, 1)
+		c <- err
+		return c
+	}
+	return Statements(&g.Reader, buffer)
+}
+
+// Read statements from g in a goroutine and send them on the returned channel.
+// The channel receives *nquads.Statement values and is closed at the end. In
+// case of error, the error is sent instead and the channel is not closed. In
+// lenient mode, skipped lines are sent as SkippedLine.
+func Statements(g *nquads.Reader, buffer int) <-chan interface{} {
 	c := make(chan interface{}, buffer)
-	go func(){
-		g, err := r.Graph()
-		if err != nil {
-			c <- err
-			return
-		}
+	go func() {
+		skipped := 0
 		for {
 			st, err := g.ReadStatement()
+			for ; skipped < len(g.Skipped); skipped++ {
+				c <- SkippedLine{g.Skipped[skipped]}
+			}
 			if err != nil {
 				c <- err
 				return
@@ -74,8 +268,3 @@ func (r *Reader) GraphStatements(buffer int) <-chan interface{} {
 	}()
 	return c
 }
-
-func readGraph(r io.Reader) (string, error) {
-	bytes, err := ioutil.ReadAll(r)
-	return string(bytes), err
-}
@@ -1,41 +1,118 @@
 package bundle
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"github.com/mildred/SmartWeb/nquads"
 	"io"
 	"strings"
+	"time"
 )
 
 var MimeType = "application/smartweb-bundle+zip"
+var TarMimeType = "application/smartweb-bundle+tar"
 
-type Writer struct {
+// Returns true if the media type (without parameters) designates a bundle in
+// any of the supported container formats.
+func IsMediaType(mediaType string) bool {
+	return mediaType == MimeType || mediaType == TarMimeType
+}
+
+type archiveWriter interface {
+	create(name string, size int64, compress bool) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
 	*zip.Writer
+}
+
+func (z zipArchiveWriter) create(name string, size int64, compress bool) (io.Writer, error) {
+	method := zip.Store
+	if compress {
+		method = zip.Deflate
+	}
+	return z.Writer.CreateHeader(&zip.FileHeader{
+		Name:   name,
+		Method: method,
+	})
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	gzip *gzip.Writer
+}
+
+func (t tarArchiveWriter) create(name string, size int64, compress bool) (io.Writer, error) {
+	err := t.Writer.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	return t.Writer, err
+}
+
+func (t tarArchiveWriter) Close() error {
+	err := t.Writer.Close()
+	if t.gzip != nil {
+		if e := t.gzip.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type Writer struct {
+	archive archiveWriter
 	nquads.NQuadWriter
-	Graphs *bytes.Buffer
+	Graphs    *bytes.Buffer
+	MediaType string
 }
 
+// Create a ZIP bundle
 func NewWriter(f io.Writer, baseUri string) (*Writer, error) {
+	return newWriter(zipArchiveWriter{zip.NewWriter(f)}, MimeType, baseUri)
+}
+
+// Create a tar bundle, optionally compressed with gzip. Unlike ZIP, the tar
+// container can be read sequentially without having the whole bundle at hand.
+func NewTarWriter(f io.Writer, baseUri string, gzipped bool) (*Writer, error) {
+	var t tarArchiveWriter
+	if gzipped {
+		t.gzip = gzip.NewWriter(f)
+		t.Writer = tar.NewWriter(t.gzip)
+	} else {
+		t.Writer = tar.NewWriter(f)
+	}
+	return newWriter(t, TarMimeType, baseUri)
+}
+
+func newWriter(archive archiveWriter, mediaType, baseUri string) (*Writer, error) {
 	bytesBuffer := &bytes.Buffer{}
-	w := &Writer{ zip.NewWriter(f), nquads.NQuadWriter{bytesBuffer}, bytesBuffer }
+	w := &Writer{
+		archive:     archive,
+		NQuadWriter: nquads.NQuadWriter{Writer: bytesBuffer},
+		Graphs:      bytesBuffer,
+		MediaType:   mediaType,
+	}
 
-	mimetype, err := w.Writer.CreateHeader(&zip.FileHeader{
-		Name:   "mimetype",
-		Method: zip.Store,
-	})
+	mimetype, err := w.archive.create("mimetype", int64(len(mediaType)), false)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = mimetype.Write([]byte(MimeType))
+	_, err = mimetype.Write([]byte(mediaType))
 	if err != nil {
 		return nil, err
 	}
-	
+
 	w.WriteComment(" Relocatable SmartWeb Graph")
 	w.WriteTripleIri(
 		"",
@@ -59,7 +136,7 @@ func (w *Writer) InsertFile(fullUri, name string, f io.ReadSeeker) error {
 
 	h := sha1.New()
 
-	_, err = io.Copy(h, f)
+	size, err := io.Copy(h, f)
 	if err != nil {
 		return err
 	}
@@ -71,19 +148,19 @@ func (w *Writer) InsertFile(fullUri, name string, f io.ReadSeeker) error {
 
 	sha1name := fmt.Sprintf("sha1:%s", strings.ToLower(hex.EncodeToString(h.Sum([]byte{}))))
 
-	datafile, err := w.Writer.Create(sha1name)
+	datafile, err := w.archive.create(sha1name, size, true)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(datafile, f)
+	_, err = io.CopyN(datafile, f, size)
 	if err != nil {
 		return err
 	}
-	
+
 	w.WriteEmptyLine()
 	w.WriteComment(" " + name)
-	
+
 	w.WriteTriple(
 		fullUri,
 		"tag:mildred.fr,2015-05:SmartWeb#relativePath",
@@ -99,7 +176,7 @@ func (w *Writer) InsertFile(fullUri, name string, f io.ReadSeeker) error {
 }
 
 func (w *Writer) Close() error {
-	zgraphs, err := w.Writer.Create("graphs.nq")
+	zgraphs, err := w.archive.create("graphs.nq", int64(w.Graphs.Len()), true)
 	if err != nil {
 		return err
 	}
@@ -109,6 +186,5 @@ func (w *Writer) Close() error {
 		return err
 	}
 
-	w.Writer.Close()
-	return nil
+	return w.archive.Close()
 }
@@ -0,0 +1,335 @@
+// Package clientca is the certificate authority issuing the client
+// certificates of a site, separate from its TLS certificate, with the list of
+// the certificates it revoked.
+package clientca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Validity of a generated CA certificate
+	caLifetime = 20 * 365 * 24 * time.Hour
+	// Validity of the CRL, it is signed again when half of it has passed
+	crlLifetime = 7 * 24 * time.Hour
+)
+
+var ErrNotIssued = errors.New("Certificate not issued by this certificate authority")
+
+// Certificate authority stored in a directory: its certificate (ca.pem), its
+// key (ca-key.pem), its certificate revocation list (crl.pem), and the SHA-256
+// fingerprints of the public keys it issued certificates for (keys) and of the
+// keys of the revoked certificates (revoked-keys)
+type CA struct {
+	Certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	dir         string
+
+	mu          sync.Mutex
+	revoked     []x509.RevocationListEntry
+	serials     map[string]bool
+	keys        map[string]bool
+	revokedKeys map[string]bool
+	number  *big.Int
+	crl     []byte
+	expires time.Time
+}
+
+// Load the certificate authority of a directory, generated if missing, name
+// is the common name of a generated certificate
+func Load(dir, name string) (*CA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ca := &CA{dir: dir, serials: make(map[string]bool), number: big.NewInt(0)}
+	certPEM, err := ioutil.ReadFile(ca.path("ca.pem"))
+	if os.IsNotExist(err) {
+		err = ca.generate(name)
+	} else if err == nil {
+		err = ca.load(certPEM)
+	}
+	if err == nil {
+		ca.keys, err = ca.loadKeys("keys")
+	}
+	if err == nil {
+		ca.revokedKeys, err = ca.loadKeys("revoked-keys")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", dir, err)
+	}
+
+	data, err := ioutil.ReadFile(ca.path("crl.pem"))
+	if os.IsNotExist(err) {
+		return ca, nil
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, fmt.Errorf("%s: no PEM CRL", ca.path("crl.pem"))
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err == nil {
+		err = crl.CheckSignatureFrom(ca.Certificate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ca.path("crl.pem"), err)
+	}
+	ca.revoked = crl.RevokedCertificateEntries
+	for _, entry := range ca.revoked {
+		ca.serials[entry.SerialNumber.String()] = true
+	}
+	ca.number = crl.Number
+	ca.crl, ca.expires = block.Bytes, crl.NextUpdate
+	return ca, nil
+}
+
+func (ca *CA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// Fingerprint identifying the public key of a certificate
+func keyFingerprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", sha256.Sum256(cert.RawSubjectPublicKeyInfo))
+}
+
+// Read a file of key fingerprints, one per line
+func (ca *CA) loadKeys(name string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	data, err := ioutil.ReadFile(ca.path(name))
+	if os.IsNotExist(err) {
+		return keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Fields(string(data)) {
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// Add a key fingerprint to a file and to its set, ca.mu must be held
+func (ca *CA) saveKey(name string, keys map[string]bool, key string) error {
+	if keys[key] {
+		return nil
+	}
+	f, err := os.OpenFile(ca.path(name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, key)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		keys[key] = true
+	}
+	return err
+}
+
+func (ca *CA) load(certPEM []byte) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return errors.New("no PEM certificate in ca.pem")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(ca.path("ca-key.pem"))
+	if err != nil {
+		return err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return errors.New("no PEM key in ca-key.pem")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return errors.New("ca-key.pem is not the key of ca.pem")
+	}
+	ca.Certificate, ca.key = cert, key
+	return nil
+}
+
+func (ca *CA) generate(name string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := SerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"SmartWeb"},
+			CommonName:   name,
+		},
+		NotBefore: now.Add(-1 * time.Hour),
+		NotAfter:  now.Add(caLifetime),
+
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ca.path("ca-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ca.path("ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	ca.Certificate, ca.key = cert, key
+	return nil
+}
+
+// Random 128 bits certificate serial number
+func SerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Pool containing the CA certificate, to verify the client certificates
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// Sign a leaf certificate for the public key, the key is recorded as issued
+func (ca *CA) Issue(template *x509.Certificate, pub interface{}) ([]byte, error) {
+	if template.IsCA {
+		return nil, errors.New("The client certificate authority only issues leaf certificates")
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if err := ca.saveKey("keys", ca.keys, keyFingerprint(cert)); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// Check that the certificate is a leaf certificate signed by the CA
+func (ca *CA) Issued(cert *x509.Certificate) bool {
+	return !cert.IsCA && cert.CheckSignatureFrom(ca.Certificate) == nil
+}
+
+// Check if the CA issued a certificate for the public key of a certificate,
+// which can be signed by anyone
+func (ca *CA) IssuedKey(cert *x509.Certificate) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.keys[keyFingerprint(cert)]
+}
+
+// Check if the certificate was revoked, by its issuer name and serial number,
+// or if it has the public key of a revoked certificate, whoever signed it
+func (ca *CA) Revoked(cert *x509.Certificate) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.revokedKeys[keyFingerprint(cert)] {
+		return true
+	}
+	return bytes.Equal(cert.RawIssuer, ca.Certificate.RawSubject) && ca.serials[cert.SerialNumber.String()]
+}
+
+// Revoke a certificate issued by the CA and its key, and save the new CRL
+func (ca *CA) Revoke(cert *x509.Certificate) error {
+	if !ca.Issued(cert) {
+		return ErrNotIssued
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if err := ca.saveKey("revoked-keys", ca.revokedKeys, keyFingerprint(cert)); err != nil {
+		return err
+	}
+	if ca.serials[cert.SerialNumber.String()] {
+		return nil
+	}
+	ca.revoked = append(ca.revoked, x509.RevocationListEntry{
+		SerialNumber:   cert.SerialNumber,
+		RevocationTime: time.Now().UTC(),
+	})
+	ca.serials[cert.SerialNumber.String()] = true
+	return ca.sign()
+}
+
+// Sign and save the CRL, ca.mu must be held
+func (ca *CA) sign() error {
+	now := time.Now().UTC()
+	number := new(big.Int).Add(ca.number, big.NewInt(1))
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlLifetime),
+		RevokedCertificateEntries: ca.revoked,
+	}, ca.Certificate, ca.key)
+	if err != nil {
+		return err
+	}
+	tmp := ca.path("crl.pem.tmp")
+	if err := ioutil.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ca.path("crl.pem")); err != nil {
+		return err
+	}
+	ca.number, ca.crl, ca.expires = number, crl, now.Add(crlLifetime)
+	return nil
+}
+
+// Current DER encoded CRL, signed again before it expires
+func (ca *CA) CRL() ([]byte, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.crl == nil || time.Until(ca.expires) < crlLifetime/2 {
+		if err := ca.sign(); err != nil {
+			return nil, err
+		}
+	}
+	return ca.crl, nil
+}
@@ -0,0 +1,104 @@
+package clientca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func issue(t *testing.T, ca *CA, name string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := SerialNumber()
+	der, err := ca.Issue(&x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientca-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := Load(filepath.Join(dir, "ca"), "Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := issue(t, ca, "alice"), issue(t, ca, "bob")
+	if _, err := alice.Verify(x509.VerifyOptions{Roots: ca.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if _, err := ca.Issue(&x509.Certificate{SerialNumber: alice.SerialNumber, IsCA: true}, alice.PublicKey); err == nil {
+		t.Errorf("CA certificate issued")
+	}
+
+	other, err := Load(filepath.Join(dir, "other"), "Other CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Revoke(issue(t, other, "alice")); err != ErrNotIssued {
+		t.Errorf("Revoke of a foreign certificate: %v", err)
+	}
+	if err := ca.Revoke(ca.Certificate); err != ErrNotIssued {
+		t.Errorf("Revoke of the CA certificate: %v", err)
+	}
+	if err := ca.Revoke(alice); err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Revoked(alice) || ca.Revoked(bob) {
+		t.Errorf("Revoked: alice %v, bob %v", ca.Revoked(alice), ca.Revoked(bob))
+	}
+	// Certificates of the same key, whoever signed them
+	aliceOther, err := x509.ParseCertificate(alice.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceOther.RawIssuer, aliceOther.SerialNumber = other.Certificate.RawSubject, big.NewInt(1)
+	if !ca.Revoked(aliceOther) || !ca.IssuedKey(aliceOther) || ca.IssuedKey(other.Certificate) {
+		t.Errorf("Revoked or IssuedKey ignore the key")
+	}
+
+	// The same CA and revocations are loaded again
+	ca2, err := Load(filepath.Join(dir, "ca"), "Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca2.Certificate.Equal(ca.Certificate) || !ca2.Revoked(alice) || ca2.Revoked(bob) || !ca2.Revoked(aliceOther) || !ca2.IssuedKey(bob) {
+		t.Errorf("CA not loaded again")
+	}
+	if err := ca2.Revoke(bob); err != nil {
+		t.Fatal(err)
+	}
+	der, err := ca2.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil || crl.CheckSignatureFrom(ca.Certificate) != nil {
+		t.Fatalf("CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 || crl.Number.Int64() != 2 {
+		t.Errorf("CRL %d: %d entries", crl.Number, len(crl.RevokedCertificateEntries))
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"github.com/mildred/SmartWeb/acme"
 	"github.com/mildred/SmartWeb/httpmux"
 	"github.com/mildred/SmartWeb/server"
 	"github.com/mildred/SmartWeb/rdf"
@@ -9,8 +11,12 @@ import (
 	"net"
 	"path/filepath"
 	"crypto/tls"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"net/http"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -31,8 +37,34 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 func main() {
 	var listen = flag.String("listen", ":8000", "Address to listen to")
 	var path = flag.String("path", "./web", "Path to serve")
+	var shutdown_timeout = flag.Duration("shutdown-timeout", 30 * time.Second, "Time to wait for the requests in progress on SIGTERM")
+	var acme_hosts = flag.String("acme-host", "", "Comma separated host names to obtain a certificate for from the ACME CA")
+	var acme_directory = flag.String("acme-directory", acme.LetsEncrypt, "ACME CA directory URL")
+	var acme_email = flag.String("acme-email", "", "Contact email of the ACME account")
+	var acme_cache = flag.String("acme-cache", "", "Directory of the ACME account key and certificates (default: acme in path)")
+	var acme_ca = flag.String("acme-ca", "", "PEM file of additional roots to trust for the ACME CA, for test servers")
+	var plaintext = flag.String("plaintext", "allow", "Plain text requests policy: allow, redirect to TLS or readonly")
+	var hsts_max_age = flag.Duration("hsts-max-age", 0, "Strict-Transport-Security max-age sent on TLS responses")
+	var hsts_subdomains = flag.Bool("hsts-include-subdomains", false, "Apply Strict-Transport-Security to the subdomains")
+	var proxy_protocol = flag.Bool("proxy-protocol", false, "Read the client address from a PROXY protocol header on each connection")
+	var trusted_proxies = flag.String("trusted-proxies", "", "Comma separated addresses and networks of the proxies trusted for the Forwarded headers")
 	flag.Parse()
 
+	plaintextPolicy, err := httpmux.ParsePlaintext(*plaintext)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	proxies := &httpmux.Proxies{}
+	if *trusted_proxies != "" {
+		nets, err := httpmux.ParseNetworks(strings.Split(*trusted_proxies, ","))
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		proxies.Set(nets)
+	}
+
 	dataSet, err := rdf.CreateRedlandDataSet(filepath.Join(*path, "rdf"))
 	if err != nil {
 		log.Fatal(err)
@@ -49,6 +81,7 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+	httpmux.ConfigureServer(s)
 
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
@@ -92,13 +125,68 @@ func main() {
 	}
 
 
+	var handler http.Handler = httpmux.Policy{
+		Plaintext:             plaintextPolicy,
+		HSTSMaxAge:            *hsts_max_age,
+		HSTSIncludeSubdomains: *hsts_subdomains,
+	}.Handler(srv)
+	if *acme_hosts != "" {
+		if *acme_cache == "" {
+			*acme_cache = filepath.Join(*path, "acme")
+		}
+		m, err := acme.NewManager(*acme_directory, *acme_email, *acme_cache)
+		if err == nil && *acme_ca != "" {
+			var roots []byte
+			roots, err = ioutil.ReadFile(*acme_ca)
+			if err == nil {
+				err = m.Client.AddRoots(roots)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		m.SetDomains([][]string{strings.Split(*acme_hosts, ",")})
+		// The self signed certificate is used until the ACME one is obtained
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.Certificate(hello.ServerName), nil
+		}
+		handler = m.HTTPHandler(handler)
+		go func() {
+			if err := m.Renew(); err != nil {
+				log.Println(err)
+			}
+		}()
+		go m.RenewLoop(12 * time.Hour, nil)
+	}
+	s.Handler = proxies.Handler(handler)
+
 	listener := httpmux.NewListenerConfig(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
+	listener.ProxyProtocol = *proxy_protocol
+
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		signal.Stop(stop)
+		log.Printf("%v received, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdown_timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v\n", err)
+			s.Close()
+		}
+		close(stopped)
+	}()
 
 	log.Printf("Listening on %s\n", s.Addr)
 
 	err = s.Serve(listener)
-	if err != nil {
-		log.Fatal(err)
+	if err != http.ErrServerClosed {
+		log.Println(err)
 		return
 	}
+	// Close the data set after the requests in progress
+	<-stopped
 }
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"github.com/mildred/SmartWeb/config"
 	"github.com/mildred/SmartWeb/httpmux"
 	"github.com/mildred/SmartWeb/server2"
 	"log"
 	"net"
-	"path/filepath"
-	"crypto/tls"
 	"os"
+	"os/signal"
+	"strings"
 	"fmt"
 	"net/http"
+	"syscall"
 	"time"
-	"crypto/x509"
 )
 
 type tcpKeepAliveListener struct {
@@ -43,7 +45,20 @@ func main() {
 	var rdf4store_port    = flag.Int("4s-port", -1, "4store HTTP gateway port to autodetect SPARQL endpoints")
 	var sesame_port       = flag.Int("sesame-port", -1, "OpenRDF Sesame HTTP gateway port to autodetect SPARQL endpoints")
 	var sesame_dsname     = flag.String("sesame-datastore", "smartweb", "OpenRDF Sesame datastore name to autodetect SPARQL endpoints")
+	var store_path        = flag.String("store", "", "Directory of the embedded RDF store, used instead of a SPARQL endpoint")
 	var noacl             = flag.Bool("noacl", false, "Disable ACL")
+	var canonical         = flag.String("canonical", "", "Canonical origin of the graphs (default: http:// followed by the request host name)")
+	var noprobe           = flag.Bool("noprobe", false, "Start without checking the SPARQL endpoints")
+	var probe_timeout     = flag.Duration("probe-timeout", 10 * time.Second, "Timeout of the SPARQL endpoints check at startup")
+	var config_path       = flag.String("config", "", "JSON configuration file with virtual hosts, reloaded on SIGHUP (replaces the other flags)")
+	var shutdown_timeout  = flag.Duration("shutdown-timeout", 30 * time.Second, "Time to wait for the requests in progress on SIGTERM")
+	var plaintext         = flag.String("plaintext", "allow", "Plain text requests policy: allow, redirect to TLS or readonly")
+	var hsts_max_age      = flag.Duration("hsts-max-age", 0, "Strict-Transport-Security max-age sent on TLS responses")
+	var hsts_subdomains   = flag.Bool("hsts-include-subdomains", false, "Apply Strict-Transport-Security to the subdomains")
+	var proxy_protocol    = flag.Bool("proxy-protocol", false, "Read the client address from a PROXY protocol header on each connection")
+	var trusted_proxies   = flag.String("trusted-proxies", "", "Comma separated addresses and networks of the proxies trusted for the Forwarded headers")
+	var client_ca         = flag.String("client-ca", "", "Directory of the certificate authority issuing and verifying the client certificates, generated if missing")
+	var webid             = flag.Bool("webid", false, "Authenticate the clients with the WebID of their certificate")
 	flag.Parse()
 	
 	var sparql SparqlEndpoint
@@ -68,64 +83,91 @@ func main() {
 		sparql.update = fmt.Sprintf("http://127.0.0.1:%d/repositories/%s/statements", *sesame_port, *sesame_dsname)
 	}
 	
-	if sparql.query == "" {
-		log.Println("You must specify a SPARQL RDF backend")
-		return;
+	conf := &config.Config{
+		Listen:        *listen,
+		ProxyProtocol: *proxy_protocol,
+		VirtualHosts: []config.VirtualHost{{
+			Hosts:                 []string{config.AnyHost},
+			Path:                  *path,
+			Store:                 *store_path,
+			SparqlQueryUrl:        sparql.query,
+			SparqlUpdateUrl:       sparql.update,
+			NoAcl:                 *noacl,
+			Canonical:             *canonical,
+			Plaintext:             *plaintext,
+			HSTSMaxAge:            int64(*hsts_max_age / time.Second),
+			HSTSIncludeSubdomains: *hsts_subdomains,
+			ClientCA:              *client_ca,
+			WebID:                 *webid,
+		}},
 	}
-	
-	log.Printf("SPARQL Query endpoint %s\n", sparql.query)
-	log.Printf("SPARQL Update endpoint %s\n", sparql.update)
-	
-	keypath := filepath.Join(*path, "key.pem");
-	certpath := filepath.Join(*path, "cert.pem");
-	cert, err := tls.LoadX509KeyPair(certpath, keypath)
-	var config *tls.Config
-	if err == nil {
-		config = httpmux.NewTLSConfig([]tls.Certificate{cert})
-	} else {
-		keyfile, err1 := os.Create(keypath)
-		certfile, err2 := os.Create(certpath)
-		if keyfile != nil  { defer keyfile.Close(); }
-		if certfile != nil { defer certfile.Close(); }
-
-		log.Println(err);
-		log.Println("Generating 2048 bits RSA self signed certificate...")
-	
-		var certBytes []byte
-		var keyBytes  []byte
-		config, certBytes, keyBytes, err = httpmux.NewSelfSignedRSAConfig(2048)
+	if *trusted_proxies != "" {
+		conf.TrustedProxies = strings.Split(*trusted_proxies, ",")
+	}
+	if *config_path != "" {
+		var err error
+		conf, err = config.Load(*config_path)
 		if err != nil {
-			log.Fatalf("Error generating certificate: %v\n", err)
+			log.Fatal(err)
 			return
 		}
-		
-		if err1 == nil && err2 == nil {
-			_, err1 = keyfile.Write(keyBytes);
-			_, err2 = certfile.Write(certBytes);
-		}
-		if err1 != nil {
-			log.Fatalf("%s: %v\n", keypath, err1);
+		if conf.Listen == "" {
+			conf.Listen = *listen
 		}
-		if err2 != nil {
-			log.Fatalf("%s: %v\n", certpath, err2);
+	} else if err := conf.Validate(); err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	for _, vh := range conf.VirtualHosts {
+		n, err := server2.RemoveTempFiles(vh.Path)
+		if err != nil {
+			log.Fatal(err)
+			return
+		} else if n > 0 {
+			log.Printf("Removed %d temporary files left in %s\n", n, vh.Path)
 		}
 	}
-	
-	x509Cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
-	if err != nil {
+
+	sites := newSites(! *noprobe, *probe_timeout)
+	defer sites.close()
+	if err := sites.load(conf); err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	srv := server2.CreateFileServer(*path, x509Cert, config.Certificates[0].PrivateKey, sparql.query, sparql.update, !*noacl)
+	if *config_path != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Printf("Reloading %s\n", *config_path)
+				newConf, err := config.Load(*config_path)
+				if err == nil {
+					err = sites.load(newConf)
+				}
+				if err != nil {
+					log.Printf("Configuration not reloaded: %v\n", err)
+				} else if newConf.Listen != conf.Listen {
+					log.Printf("Listen address change to %s needs a restart\n", newConf.Listen)
+				} else if newConf.ProxyProtocol != conf.ProxyProtocol {
+					log.Printf("PROXY protocol change needs a restart\n")
+				}
+			}
+		}()
+	}
+
+	tlsConfig := httpmux.NewTLSConfig(nil)
+	tlsConfig.GetCertificate = sites.GetCertificate
 
 	s := &http.Server{
-		Addr:           *listen,
-		Handler:        srv,
+		Addr:           conf.Listen,
+		Handler:        sites,
 		ReadTimeout:    0, //10 * time.Second,
 		WriteTimeout:   0, //10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
+	httpmux.ConfigureServer(s)
 
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
@@ -133,13 +175,50 @@ func main() {
 		return
 	}
 
-	listener := httpmux.NewListenerConfig(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
+	listener := httpmux.NewListenerConfig(tcpKeepAliveListener{ln.(*net.TCPListener)}, tlsConfig)
+	listener.ProxyProtocol = conf.ProxyProtocol
+
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		signal.Stop(stop)
+		log.Printf("%v received, shutting down\n", sig)
+		shutdown(s, &sites.background, *shutdown_timeout)
+		close(stopped)
+	}()
 
 	log.Printf("Listening on %s\n", s.Addr)
 
 	err = s.Serve(listener)
-	if err != nil {
-		log.Fatal(err)
+	if err != http.ErrServerClosed {
+		log.Println(err)
 		return
 	}
+	<-stopped
+}
+
+// Stop accepting connections and wait for the requests in progress and their
+// background work, closing the remaining connections after timeout
+func shutdown(s *http.Server, background *server2.Background, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v\n", err)
+		s.Close()
+	}
+
+	// The requests still running after a forced close cannot start more
+	// background work
+	done := make(chan struct{})
+	go func() {
+		background.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Shutdown: background work interrupted")
+	}
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/mildred/SmartWeb/acme"
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/clientca"
+	"github.com/mildred/SmartWeb/config"
+	"github.com/mildred/SmartWeb/httpmux"
+	"github.com/mildred/SmartWeb/quadstore"
+	"github.com/mildred/SmartWeb/server2"
+	sparqlclient "github.com/mildred/SmartWeb/sparql"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Timeout of the requests fetching the WebID profiles
+const webidTimeout = 10 * time.Second
+
+// Virtual hosts served and their certificates, built from the configuration
+type sites struct {
+	mu           sync.Mutex
+	probe        bool
+	probeTimeout time.Duration
+	hosts        *server2.VirtualHosts
+	certs        *httpmux.Certificates
+	proxies      *httpmux.Proxies
+	// Embedded stores by directory, kept open across reloads
+	stores map[string]*quadstore.Store
+	// Client certificate authorities by directory, kept across reloads
+	cas map[string]*clientca.CA
+	// Enrollment keys by content directory, kept across reloads for the
+	// invitations to stay valid
+	enrollKeys map[string][]byte
+	// Background work of all the servers, including replaced ones
+	background server2.Background
+	// Certificates obtained from the ACME CA, nil if not configured. Guarded
+	// by acmeMu as well for the reads while loading.
+	acmeMu   sync.RWMutex
+	acme     *acme.Manager
+	acmeConf config.ACME
+	acmeStop chan struct{}
+}
+
+func newSites(probe bool, probeTimeout time.Duration) *sites {
+	return &sites{
+		probe:        probe,
+		probeTimeout: probeTimeout,
+		hosts:        server2.NewVirtualHosts(),
+		certs:        &httpmux.Certificates{},
+		proxies:      &httpmux.Proxies{},
+		stores:       make(map[string]*quadstore.Store),
+		cas:          make(map[string]*clientca.CA),
+		enrollKeys:   make(map[string][]byte),
+	}
+}
+
+// Build the virtual hosts of the configuration and replace the current ones.
+// On error, the current virtual hosts are kept.
+func (s *sites) load(conf *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stores := make(map[string]*quadstore.Store)
+	cas := make(map[string]*clientca.CA)
+	enrollKeys := make(map[string][]byte)
+	handlers := make(map[string]http.Handler)
+	certs := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	var acmeDomains [][]string
+
+	manager, err := s.acmeManager(conf.ACME)
+	for i := range conf.VirtualHosts {
+		if err != nil {
+			break
+		}
+		vh := &conf.VirtualHosts[i]
+		var srv *server2.SmartServer
+		var cert *tls.Certificate
+		srv, cert, err = s.newServer(vh, stores, cas, enrollKeys)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", vh.Hosts[0], err)
+			break
+		}
+		handler := vh.Policy().Handler(srv)
+		for _, h := range vh.Hosts {
+			handlers[h] = handler
+			certs[h] = cert
+			if h == config.AnyHost || fallback == nil {
+				fallback = cert
+			}
+		}
+		if vh.ACME {
+			acmeDomains = append(acmeDomains, vh.Hosts)
+		}
+	}
+
+	// Close the stores that are not used any more
+	var unused map[string]*quadstore.Store
+	if err != nil {
+		unused = stores
+	} else {
+		s.hosts.Set(handlers)
+		s.certs.Set(certs, fallback)
+		s.proxies.Set(conf.TrustedNetworks())
+		unused = s.stores
+		s.stores = stores
+		s.cas = cas
+		s.enrollKeys = enrollKeys
+		s.setACME(manager, conf.ACME, acmeDomains)
+	}
+	for dir, store := range unused {
+		if s.stores[dir] != store {
+			store.Close()
+		}
+	}
+	return err
+}
+
+// ACME manager for the configuration, reused if the configuration did not
+// change
+func (s *sites) acmeManager(conf *config.ACME) (*acme.Manager, error) {
+	if conf == nil {
+		return nil, nil
+	} else if s.acme != nil && *conf == s.acmeConf {
+		return s.acme, nil
+	}
+	directory := conf.Directory
+	if directory == "" {
+		directory = acme.LetsEncrypt
+	}
+	m, err := acme.NewManager(directory, conf.Email, conf.Cache)
+	if err != nil {
+		return nil, err
+	}
+	if conf.CA != "" {
+		roots, err := ioutil.ReadFile(conf.CA)
+		if err == nil {
+			err = m.Client.AddRoots(roots)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Replace the ACME manager and its domains, and obtain the missing
+// certificates in the background
+func (s *sites) setACME(m *acme.Manager, conf *config.ACME, domains [][]string) {
+	if m != s.acme && s.acmeStop != nil {
+		close(s.acmeStop)
+		s.acmeStop = nil
+	}
+	s.acmeMu.Lock()
+	s.acme = m
+	s.acmeMu.Unlock()
+	if m == nil {
+		return
+	}
+	s.acmeConf = *conf
+	m.SetDomains(domains)
+	if s.acmeStop == nil {
+		s.acmeStop = make(chan struct{})
+		go m.RenewLoop(12*time.Hour, s.acmeStop)
+	}
+	go func() {
+		if err := m.Renew(); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func (s *sites) manager() *acme.Manager {
+	s.acmeMu.RLock()
+	defer s.acmeMu.RUnlock()
+	return s.acme
+}
+
+// Certificate from the ACME CA if obtained, or else the configured one
+func (s *sites) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m := s.manager(); m != nil {
+		if cert := m.Certificate(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+	}
+	return s.certs.GetCertificate(hello)
+}
+
+// Serve the ACME challenges and dispatch the other requests to the virtual
+// hosts, with the origin given by the trusted proxies
+func (s *sites) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.proxies.Handler(http.HandlerFunc(s.dispatch)).ServeHTTP(res, req)
+}
+
+func (s *sites) dispatch(res http.ResponseWriter, req *http.Request) {
+	if m := s.manager(); m != nil {
+		m.HTTPHandler(s.hosts).ServeHTTP(res, req)
+	} else {
+		s.hosts.ServeHTTP(res, req)
+	}
+}
+
+func (s *sites) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setACME(nil, nil, nil)
+	for _, store := range s.stores {
+		store.Close()
+	}
+	s.stores = nil
+}
+
+func (s *sites) newServer(vh *config.VirtualHost, stores map[string]*quadstore.Store, cas map[string]*clientca.CA, enrollKeys map[string][]byte) (*server2.SmartServer, *tls.Certificate, error) {
+	storage, err := s.newBackend(vh, stores)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := loadCertificate(vh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	graphBase, err := vh.GraphBase()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv := server2.NewServer(vh.Path, storage, !vh.NoAcl)
+	srv.GraphBase = graphBase
+	srv.Background = &s.background
+	root, err := filepath.Abs(vh.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key := enrollKeys[root]; key != nil {
+		srv.EnrollKey = key
+	} else if key := s.enrollKeys[root]; key != nil {
+		srv.EnrollKey = key
+	}
+	enrollKeys[root] = srv.EnrollKey
+	if vh.ClientCA != "" {
+		srv.ClientCA, err = s.clientCA(vh, cas)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if vh.WebID {
+		srv.WebIDClient = server2.NewWebIDClient(webidTimeout)
+	}
+	return srv, cert, nil
+}
+
+// Client certificate authority of a virtual host, loaded once per directory
+func (s *sites) clientCA(vh *config.VirtualHost, cas map[string]*clientca.CA) (*clientca.CA, error) {
+	dir, err := filepath.Abs(vh.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	ca := cas[dir]
+	if ca == nil {
+		ca = s.cas[dir]
+	}
+	if ca == nil {
+		ca, err = clientca.Load(dir, "SmartWeb client CA for "+vh.Hosts[0])
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Client certificate authority in %s: %s\n", dir, ca.Certificate.Subject.CommonName)
+	}
+	cas[dir] = ca
+	return ca, nil
+}
+
+func (s *sites) newBackend(vh *config.VirtualHost, stores map[string]*quadstore.Store) (backend.Backend, error) {
+	if vh.Store != "" {
+		dir, err := filepath.Abs(vh.Store)
+		if err != nil {
+			return nil, err
+		}
+		store := stores[dir]
+		if store == nil {
+			store = s.stores[dir]
+		}
+		if store == nil {
+			store, err = quadstore.Open(dir)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Embedded RDF store in %s (%d quads)\n", dir, store.Len())
+		}
+		stores[dir] = store
+		return backend.NewEmbedded(store), nil
+	}
+
+	log.Printf("SPARQL Query endpoint %s\n", vh.QueryUrl())
+	log.Printf("SPARQL Update endpoint %s\n", vh.UpdateUrl())
+	client := sparqlclient.NewClient(vh.QueryUrl(), vh.UpdateUrl())
+	if s.probe {
+		dialect, err := client.Probe(s.probeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("SPARQL endpoint dialect: %s\n", dialect)
+		if !dialect.UnionDefaultGraph() {
+			log.Println("Warning: the default graph may not be the union of all graphs, some lookups will fail (for Fuseki, set tdb:unionDefaultGraph)")
+		}
+	}
+	return backend.NewSparql(client), nil
+}
+
+// Load the certificate of a virtual host, or the self signed certificate in
+// its path, generated if missing
+func loadCertificate(vh *config.VirtualHost) (*tls.Certificate, error) {
+	if vh.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(vh.Cert, vh.Key)
+		return &cert, err
+	}
+
+	keypath := filepath.Join(vh.Path, "key.pem")
+	certpath := filepath.Join(vh.Path, "cert.pem")
+	cert, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err == nil {
+		return &cert, nil
+	}
+
+	log.Println(err)
+	log.Println("Generating 2048 bits RSA self signed certificate...")
+
+	tlsConfig, certBytes, keyBytes, err := httpmux.NewSelfSignedRSAConfig(2048)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating certificate: %v", err)
+	}
+
+	err = ioutil.WriteFile(keypath, keyBytes, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(certpath, certBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsConfig.Certificates[0], nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/mildred/SmartWeb/bundle"
 	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/turtle"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,6 +18,9 @@ import (
 func main() {
 	// FIXME support index file and insert it in graph
 	baseUri := flag.String("base", "", "Base URI")
+	lenient := flag.Bool("lenient", false, "Skip invalid lines in graphs.nq when reading")
+	trig := flag.Bool("trig", false, "Show the bundle graphs in TriG format")
+	hash := flag.Bool("hash", false, "Show the hash of the canonicalized bundle graphs")
 	flag.Parse()
 	bundleFile := flag.Arg(0)
 	source := flag.Arg(1)
@@ -24,7 +29,7 @@ func main() {
 	if source != "" {
 		err = writeBundle(bundleFile, source, *baseUri)
 	} else {
-		err = readBundle(bundleFile)
+		err = readBundle(bundleFile, *lenient, *trig, *hash)
 	}
 
 	if err != nil {
@@ -39,7 +44,15 @@ func writeBundle(bundleFile, sourceDir, baseUri string) error {
 	}
 	defer f.Close()
 	
-	b, err := bundle.NewWriter(f, baseUri)
+	var b *bundle.Writer
+	switch {
+		case strings.HasSuffix(bundleFile, ".tar"):
+			b, err = bundle.NewTarWriter(f, baseUri, false)
+		case strings.HasSuffix(bundleFile, ".tar.gz") || strings.HasSuffix(bundleFile, ".tgz"):
+			b, err = bundle.NewTarWriter(f, baseUri, true)
+		default:
+			b, err = bundle.NewWriter(f, baseUri)
+	}
 	if err != nil {
 		return err
 	}
@@ -53,22 +66,42 @@ func writeBundle(bundleFile, sourceDir, baseUri string) error {
 	return nil
 }
 
-func readBundle(bundleFile string) error {
+func readBundle(bundleFile string, lenient, trig, hash bool) error {
 	r, err := bundle.OpenReader(bundleFile)
 	if err != nil {
 		return err
 	}
 
 	defer r.Close()
+	r.Lenient = lenient
 	
+	var statements []*nquads.Statement
 	for value := range r.GraphStatements(64) {
 		switch st := value.(type) {
+			case bundle.SkippedLine: log.Printf("Skipped %s\n", st.Error())
 			case error: return st
-			case *nquads.Statement: log.Printf("%s\n", st.String())
+			case *nquads.Statement:
+				if trig || hash {
+					statements = append(statements, st)
+				} else {
+					log.Printf("%s\n", st.String())
+				}
 			default: panic(value)
 		}
 	}
 
+	if hash {
+		h, err := nquads.DatasetHash(statements)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("sha256:%s\n", h)
+	}
+
+	if trig {
+		return turtle.NewTriGWriter(os.Stdout, turtle.DefaultPrefixes).WriteStatements(statements)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,164 @@
+// Command swmigrate rewrites the graph IRIs stored under alias origins (other
+// host names, schemes or ports) to the canonical origin of a site:
+//
+//	swmigrate -store ./store -to http://example.org/ http://example.org:8000/ https://www.example.org/
+//
+// With -config, the storage and canonical origin of a virtual host are read
+// from the smartweb2 configuration file, and the aliases default to its host
+// names with the http and https schemes, with and without the listen port.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/config"
+	"github.com/mildred/SmartWeb/quadstore"
+	"github.com/mildred/SmartWeb/sparql"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+func main() {
+	configPath := flag.String("config", "", "smartweb2 configuration file")
+	host := flag.String("host", "", "Virtual host of the configuration file to migrate")
+	storePath := flag.String("store", "", "Directory of the embedded RDF store")
+	sparqlUrl := flag.String("sparql", "", "URL to query and update the RDF DataStore")
+	sparqlQueryUrl := flag.String("sparql-query-url", "", "URL to query the RDF DataStore")
+	sparqlUpdateUrl := flag.String("sparql-update-url", "", "URL to update the RDF DataStore")
+	to := flag.String("to", "", "Canonical origin or graph prefix")
+	dryRun := flag.Bool("n", false, "Only show the number of quads to rewrite")
+	flag.Parse()
+
+	vh := &config.VirtualHost{
+		Store:           *storePath,
+		Sparql:          *sparqlUrl,
+		SparqlQueryUrl:  *sparqlQueryUrl,
+		SparqlUpdateUrl: *sparqlUpdateUrl,
+	}
+	aliases := flag.Args()
+	if *configPath != "" {
+		conf, err := config.Load(*configPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		vh = findHost(conf, *host)
+		if vh == nil {
+			log.Fatalf("No virtual host %s in %s\n", *host, *configPath)
+		}
+		if *to == "" {
+			if base, _ := vh.GraphBase(); base != nil {
+				*to = base.String()
+			}
+		}
+		if len(aliases) == 0 {
+			aliases = hostAliases(vh, conf.Listen)
+		}
+	}
+	if *to == "" || len(aliases) == 0 {
+		log.Fatalln("Usage: swmigrate [-config FILE -host HOST | -store DIR | -sparql URL] [-n] -to CANONICAL ALIAS...")
+	}
+
+	b, err := openBackend(vh)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := migrate(b, aliases, *to, *dryRun); err != nil {
+		log.Fatalln(err)
+	}
+	if e, ok := b.(*backend.Embedded); ok {
+		if err := e.Store.Close(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func findHost(conf *config.Config, host string) *config.VirtualHost {
+	host = config.NormalizeHost(host)
+	for i := range conf.VirtualHosts {
+		for _, h := range conf.VirtualHosts[i].Hosts {
+			if h == host {
+				return &conf.VirtualHosts[i]
+			}
+		}
+	}
+	return nil
+}
+
+func hostAliases(vh *config.VirtualHost, listen string) []string {
+	_, port, _ := net.SplitHostPort(listen)
+	var aliases []string
+	for _, h := range vh.Hosts {
+		if h == config.AnyHost {
+			continue
+		}
+		for _, scheme := range []string{"http", "https"} {
+			aliases = append(aliases, scheme+"://"+h+"/")
+			if port != "" {
+				aliases = append(aliases, scheme+"://"+net.JoinHostPort(h, port)+"/")
+			}
+		}
+	}
+	return aliases
+}
+
+func openBackend(vh *config.VirtualHost) (backend.Backend, error) {
+	if vh.Store != "" {
+		store, err := quadstore.Open(vh.Store)
+		if err != nil {
+			return nil, err
+		}
+		return backend.NewEmbedded(store), nil
+	}
+	if vh.QueryUrl() == "" || vh.UpdateUrl() == "" {
+		return nil, fmt.Errorf("You must specify a SPARQL RDF backend or an embedded store")
+	}
+	return backend.NewSparql(sparql.NewClient(vh.QueryUrl(), vh.UpdateUrl())), nil
+}
+
+// Prefix of the IRIs under an origin or graph prefix, ending with a slash
+func prefix(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%s must be an http or https URL without query", origin)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
+func migrate(b backend.Backend, aliases []string, to string, dryRun bool) error {
+	canonical, err := prefix(to)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		from, err := prefix(alias)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(canonical, from) {
+			// Rewriting would apply to the canonical IRIs as well
+			log.Printf("%s: skipped, the canonical prefix is under it\n", from)
+			continue
+		}
+		n, err := backend.CountPrefix(b, from)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s: %d quads to rewrite to %s\n", from, n, canonical)
+		if n == 0 || dryRun {
+			continue
+		}
+		if err := backend.Rebase(b, from, canonical); err != nil {
+			return fmt.Errorf("%s: %v", from, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+// Package config reads the smartweb2 configuration file, a JSON document
+// describing the virtual hosts served. Keys mirror the command line flags:
+//
+//	{
+//		"listen": ":8000",
+//		"trusted-proxies": ["127.0.0.1", "10.0.0.0/8"],
+//		"acme": {
+//			"email": "admin@example.org",
+//			"cache": "/var/lib/smartweb/acme"
+//		},
+//		"vhosts": [
+//			{
+//				"hosts": ["example.org", "www.example.org"],
+//				"path": "/srv/example.org",
+//				"sparql": "http://localhost:9999/bigdata/namespace/example/sparql",
+//				"canonical": "https://example.org",
+//				"acme": true,
+//				"plaintext": "redirect",
+//				"hsts-max-age": 31536000,
+//				"webid": true
+//			},
+//			{
+//				"hosts": ["*"],
+//				"path": "/srv/default",
+//				"store": "/srv/default/store",
+//				"noacl": true,
+//				"cert": "/etc/ssl/default.pem",
+//				"key": "/etc/ssl/default.key",
+//				"client-ca": "/srv/default/client-ca"
+//			}
+//		]
+//	}
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mildred/SmartWeb/httpmux"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Host name of the virtual host serving the hosts not configured elsewhere
+const AnyHost = "*"
+
+type Config struct {
+	Listen string `json:"listen"`
+	// Connections start with a PROXY protocol header from a load balancer
+	ProxyProtocol bool `json:"proxy-protocol"`
+	// Addresses and networks of the reverse proxies trusted for the
+	// Forwarded and X-Forwarded-* headers
+	TrustedProxies []string      `json:"trusted-proxies"`
+	ACME           *ACME         `json:"acme"`
+	VirtualHosts   []VirtualHost `json:"vhosts"`
+}
+
+// ACME certificate authority issuing the certificates of the virtual hosts
+// with acme set. The http-01 challenge is used, the CA must be able to reach
+// the virtual hosts on port 80.
+type ACME struct {
+	// Directory URL, defaults to Let's Encrypt
+	Directory string `json:"directory"`
+	Email     string `json:"email"`
+	// Directory of the account key and the certificates
+	Cache string `json:"cache"`
+	// PEM file of additional roots to trust when connecting to the directory,
+	// for test servers such as pebble
+	CA string `json:"ca"`
+}
+
+type VirtualHost struct {
+	Hosts []string `json:"hosts"`
+	// Directory of the raw files
+	Path string `json:"path"`
+	// Directory of the embedded RDF store, used instead of a SPARQL endpoint
+	Store           string `json:"store"`
+	Sparql          string `json:"sparql"`
+	SparqlQueryUrl  string `json:"sparql-query-url"`
+	SparqlUpdateUrl string `json:"sparql-update-url"`
+	// Canonical origin of the graphs, such as https://example.org. The
+	// requests on all the hosts, schemes and ports of the virtual host use
+	// the same graphs. Defaults to http:// followed by the first host, or the
+	// request host name without port for *.
+	Canonical string `json:"canonical"`
+	// Base URL of the graphs, for a site served under a path of the
+	// canonical origin
+	GraphPrefix string `json:"graph-prefix"`
+	NoAcl       bool   `json:"noacl"`
+	// TLS certificate and key files, a self signed certificate is generated
+	// in path if not set
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// Obtain the certificate from the ACME CA, the self signed certificate is
+	// used until then
+	ACME bool `json:"acme"`
+	// Directory of the certificate authority issuing the client certificates,
+	// generated if missing. The client certificates are then verified against
+	// it, and any certificate is accepted if not set.
+	ClientCA string `json:"client-ca"`
+	// Authenticate the clients with the WebID of their certificate
+	// (WebID-TLS), the profiles not hosted on the virtual host are fetched
+	// over HTTP
+	WebID bool `json:"webid"`
+	// Plain text requests are served (allow, the default), redirected to TLS
+	// (redirect) or only served if they do not modify resources (readonly)
+	Plaintext string `json:"plaintext"`
+	// Strict-Transport-Security max-age in seconds sent on TLS responses
+	HSTSMaxAge            int64 `json:"hsts-max-age"`
+	HSTSIncludeSubdomains bool  `json:"hsts-include-subdomains"`
+}
+
+// Read and validate a configuration file, relative paths are relative to the
+// directory of the file
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	if c.ACME != nil {
+		for _, p := range []*string{&c.ACME.Cache, &c.ACME.CA} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(dir, *p)
+			}
+		}
+	}
+	for i := range c.VirtualHosts {
+		vh := &c.VirtualHosts[i]
+		for _, p := range []*string{&vh.Path, &vh.Store, &vh.Cert, &vh.Key, &vh.ClientCA} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(dir, *p)
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.VirtualHosts) == 0 {
+		return fmt.Errorf("No virtual host")
+	}
+	seen := make(map[string]bool)
+	for i := range c.VirtualHosts {
+		vh := &c.VirtualHosts[i]
+		if len(vh.Hosts) == 0 {
+			return fmt.Errorf("Virtual host %d has no host name", i)
+		}
+		for j, h := range vh.Hosts {
+			h = NormalizeHost(h)
+			if seen[h] {
+				return fmt.Errorf("Host %s is configured twice", h)
+			}
+			seen[h] = true
+			vh.Hosts[j] = h
+		}
+		if err := vh.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", vh.Hosts[0], err)
+		}
+		if vh.ACME && c.ACME == nil {
+			return fmt.Errorf("%s: No acme section for the certificate authority", vh.Hosts[0])
+		}
+	}
+	if c.ACME != nil && c.ACME.Cache == "" {
+		return fmt.Errorf("No acme cache directory")
+	}
+	if _, err := httpmux.ParseNetworks(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted-proxies: %v", err)
+	}
+	return nil
+}
+
+// Networks of the trusted proxies, the configuration must be valid
+func (c *Config) TrustedNetworks() []*net.IPNet {
+	nets, _ := httpmux.ParseNetworks(c.TrustedProxies)
+	return nets
+}
+
+func (vh *VirtualHost) Validate() error {
+	if vh.Path == "" {
+		return fmt.Errorf("No path to store raw files")
+	}
+	if vh.Store != "" && vh.QueryUrl() != "" {
+		return fmt.Errorf("Both an embedded store and a SPARQL endpoint are configured")
+	} else if vh.Store == "" && (vh.QueryUrl() == "" || vh.UpdateUrl() == "") {
+		return fmt.Errorf("You must specify a SPARQL RDF backend or an embedded store")
+	}
+	if (vh.Cert == "") != (vh.Key == "") {
+		return fmt.Errorf("Both cert and key must be set")
+	}
+	if vh.ACME {
+		if vh.Cert != "" {
+			return fmt.Errorf("Both acme and cert are set")
+		}
+		for _, h := range vh.Hosts {
+			if h == AnyHost {
+				return fmt.Errorf("No ACME certificate can be obtained for %s", AnyHost)
+			}
+		}
+	}
+	if vh.Canonical != "" && vh.GraphPrefix != "" {
+		return fmt.Errorf("Both canonical and graph-prefix are set")
+	}
+	if _, err := vh.GraphBase(); err != nil {
+		return err
+	}
+	if _, err := httpmux.ParsePlaintext(vh.Plaintext); err != nil {
+		return err
+	}
+	if vh.HSTSMaxAge < 0 {
+		return fmt.Errorf("Negative hsts-max-age")
+	}
+	return nil
+}
+
+// Plain text and HSTS policy, the virtual host must be valid
+func (vh *VirtualHost) Policy() httpmux.Policy {
+	plaintext, _ := httpmux.ParsePlaintext(vh.Plaintext)
+	return httpmux.Policy{
+		Plaintext:             plaintext,
+		HSTSMaxAge:            time.Duration(vh.HSTSMaxAge) * time.Second,
+		HSTSIncludeSubdomains: vh.HSTSIncludeSubdomains,
+	}
+}
+
+func (vh *VirtualHost) QueryUrl() string {
+	if vh.SparqlQueryUrl != "" {
+		return vh.SparqlQueryUrl
+	}
+	return vh.Sparql
+}
+
+func (vh *VirtualHost) UpdateUrl() string {
+	if vh.SparqlUpdateUrl != "" {
+		return vh.SparqlUpdateUrl
+	}
+	return vh.Sparql
+}
+
+// Base URL of the graphs from the graph prefix or the canonical origin, nil
+// if the request host is used
+func (vh *VirtualHost) GraphBase() (*url.URL, error) {
+	switch {
+	case vh.GraphPrefix != "":
+		return parseBase("graph prefix", vh.GraphPrefix)
+	case vh.Canonical != "":
+		u, err := parseBase("canonical origin", vh.Canonical)
+		if err == nil && u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("Canonical origin %s must not have a path, use graph-prefix", vh.Canonical)
+		}
+		return u, err
+	case len(vh.Hosts) > 0 && vh.Hosts[0] != AnyHost:
+		host := vh.Hosts[0]
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return &url.URL{Scheme: "http", Host: host, Path: "/"}, nil
+	}
+	return nil, nil
+}
+
+func parseBase(name, base string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("The %s %s must be an http or https URL without query", name, base)
+	}
+	return u, nil
+}
+
+// Lower case host name without port
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"github.com/mildred/SmartWeb/httpmux"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "smartweb.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"listen": ":8443",
+		"trusted-proxies": ["127.0.0.1", "10.0.0.0/8"],
+		"vhosts": [
+			{"hosts": ["Example.org", "www.example.org:8443"], "path": "web", "sparql": "http://localhost/sparql", "graph-prefix": "http://example.org/", "plaintext": "redirect", "hsts-max-age": 3600},
+			{"hosts": ["*"], "path": "/srv/default", "store": "store", "noacl": true, "canonical": "https://example.net"},
+			{"hosts": ["Example.com", "www.example.com"], "path": "web", "store": "store"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh := c.VirtualHosts[0]
+	if vh.Hosts[0] != "example.org" || vh.Hosts[1] != "www.example.org" {
+		t.Errorf("hosts not normalized: %v", vh.Hosts)
+	}
+	if vh.Path != filepath.Join(dir, "web") || c.VirtualHosts[1].Path != "/srv/default" || c.VirtualHosts[1].Store != filepath.Join(dir, "store") {
+		t.Errorf("paths not resolved: %s %s %s", vh.Path, c.VirtualHosts[1].Path, c.VirtualHosts[1].Store)
+	}
+	if vh.QueryUrl() != "http://localhost/sparql" || vh.UpdateUrl() != "http://localhost/sparql" {
+		t.Errorf("SPARQL endpoints %s %s", vh.QueryUrl(), vh.UpdateUrl())
+	}
+	if p := vh.Policy(); p.Plaintext != httpmux.RedirectPlaintext || p.HSTSMaxAge != time.Hour {
+		t.Errorf("policy %+v", p)
+	}
+	for i, expected := range []string{"http://example.org/", "https://example.net", "http://example.com/"} {
+		if u, err := c.VirtualHosts[i].GraphBase(); err != nil || u.String() != expected {
+			t.Errorf("GraphBase of %s: %v, %v", c.VirtualHosts[i].Hosts[0], u, err)
+		}
+	}
+	ipv6 := &Config{VirtualHosts: []VirtualHost{{Hosts: []string{"[2001:DB8::1]:8000"}, Path: "/srv", Store: "/srv/store"}}}
+	if err := ipv6.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := ipv6.VirtualHosts[0].GraphBase(); err != nil || u.String() != "http://[2001:db8::1]/" {
+		t.Errorf("GraphBase of %s: %v, %v", ipv6.VirtualHosts[0].Hosts[0], u, err)
+	}
+	if nets := c.TrustedNetworks(); len(nets) != 2 || !nets[0].Contains(net.ParseIP("127.0.0.1")) || !nets[1].Contains(net.ParseIP("10.1.2.3")) {
+		t.Errorf("trusted proxies %v", nets)
+	}
+	if p := c.VirtualHosts[1].Policy(); p != (httpmux.Policy{}) {
+		t.Errorf("default policy %+v", p)
+	}
+
+	for _, invalid := range []string{
+		`{"vhosts": []}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "sparql": "http://localhost/sparql"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s"}, {"hosts": ["A"], "path": "web", "store": "s"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "graph-prefix": "tag:example"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "cert": "cert.pem"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "canonical": "http://a/site/"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "canonical": "http://a", "graph-prefix": "http://a/"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "unknown": 1}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "acme": true}]}`,
+		`{"acme": {"cache": "acme"}, "vhosts": [{"hosts": ["*"], "path": "web", "store": "s", "acme": true}]}`,
+		`{"acme": {}, "vhosts": [{"hosts": ["a"], "path": "web", "store": "s"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "plaintext": "deny"}]}`,
+		`{"vhosts": [{"hosts": ["a"], "path": "web", "store": "s", "hsts-max-age": -1}]}`,
+		`{"trusted-proxies": ["localhost"], "vhosts": [{"hosts": ["a"], "path": "web", "store": "s"}]}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: no error", invalid)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package httpmux
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Certificates chosen by the server name sent by the client (SNI), that can be
+// replaced while serving. Use GetCertificate in tls.Config.
+type Certificates struct {
+	mu       sync.RWMutex
+	hosts    map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// Replace the certificates, fallback is used for unknown server names and
+// clients not sending one
+func (c *Certificates) Set(hosts map[string]*tls.Certificate, fallback *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts = hosts
+	c.fallback = fallback
+}
+
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if cert, ok := c.hosts[strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")]; ok {
+		return cert, nil
+	}
+	if c.fallback == nil {
+		return nil, errors.New("No certificate for " + hello.ServerName)
+	}
+	return c.fallback, nil
+}
@@ -9,11 +9,18 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"io"
+	"log"
 	"math/big"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 )
 
+// Time allowed to a client to send its first bytes and complete the TLS
+// handshake
+const DefaultHandshakeTimeout = 10 * time.Second
+
 func NewTLSConfig(certificates []tls.Certificate) *tls.Config {
 	config := &tls.Config{
 		Certificates: certificates,
@@ -73,6 +80,20 @@ func NewSelfSignedRSAConfig(rsaBits int) (config *tls.Config, certBytes []byte,
 type Listener struct {
 	net.Listener
 	config *tls.Config
+	// Connections not dispatched within this time are closed
+	HandshakeTimeout time.Duration
+	// Connections start with a PROXY protocol header giving the client address
+	ProxyProtocol bool
+
+	start     sync.Once
+	closeOnce sync.Once
+	accepted  chan accepted
+	closed    chan struct{}
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
 }
 
 func NewListener(listener net.Listener, certFile, keyFile string) (*Listener, error) {
@@ -88,23 +109,89 @@ func NewListener(listener net.Listener, certFile, keyFile string) (*Listener, er
 	return NewListenerConfig(listener, config), nil
 }
 
+// Serve the connections of a Listener with HTTP/2 negotiated with ALPN over
+// TLS, and HTTP/2 with prior knowledge over plain text, in addition to
+// HTTP/1.1
+func ConfigureServer(server *http.Server) {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+}
+
 func NewListenerConfig(listener net.Listener, config *tls.Config) *Listener {
 	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+		config.NextProtos = []string{"h2", "http/1.1"}
 	}
 
 	return &Listener{
-		listener,
-		config,
+		Listener:         listener,
+		config:           config,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		accepted:         make(chan accepted),
+		closed:           make(chan struct{}),
 	}
 }
 
+// Return the next connection ready to be served. Connections are dispatched
+// concurrently so that a slow client does not delay the others.
 func (self *Listener) Accept() (net.Conn, error) {
-	c, err := self.Listener.Accept()
+	self.start.Do(func() { go self.acceptLoop() })
+	select {
+	case a := <-self.accepted:
+		return a.conn, a.err
+	case <-self.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (self *Listener) Close() error {
+	self.closeOnce.Do(func() { close(self.closed) })
+	return self.Listener.Close()
+}
+
+func (self *Listener) acceptLoop() {
+	for {
+		c, err := self.Listener.Accept()
+		if err != nil {
+			select {
+			case self.accepted <- accepted{nil, err}:
+			case <-self.closed:
+				return
+			}
+			continue
+		}
+		go self.dispatch(c)
+	}
+}
+
+func (self *Listener) dispatch(c net.Conn) {
+	if self.ProxyProtocol {
+		c.SetDeadline(time.Now().Add(self.HandshakeTimeout))
+		pc, err := ReadProxyHeader(c)
+		if err != nil {
+			self.drop(c, err)
+			return
+		}
+		c = pc
+	}
+	dc, err := dispatchConnection(c, self.config, self.HandshakeTimeout)
 	if err != nil {
-		return nil, err
+		self.drop(c, err)
+		return
+	}
+	select {
+	case self.accepted <- accepted{dc, nil}:
+	case <-self.closed:
+		dc.Close()
 	}
-	return DispatchConnection(c, self.config)
+}
+
+func (self *Listener) drop(c net.Conn, err error) {
+	if err != io.EOF {
+		log.Printf("httpmux: %s: %v\n", c.RemoteAddr(), err)
+	}
+	c.Close()
 }
 
 type conn struct {
@@ -131,29 +218,24 @@ func (c *conn) WriteTo(w io.Writer) (int64, error) {
 	return n + m, err
 }
 
+// Wait for the first bytes sent by the client and return a TLS connection,
+// with the handshake completed, if they are a TLS handshake record, or else
+// the plain text connection
 func DispatchConnection(c net.Conn, config *tls.Config) (net.Conn, error) {
-	var buf [256]byte
+	return dispatchConnection(c, config, DefaultHandshakeTimeout)
+}
+
+func dispatchConnection(c net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	var buf [3]byte
 	var zeroTime time.Time
 
-	c.SetReadDeadline(zeroTime)
-	m, err := io.ReadFull(c, buf[:1])
-	if err != nil {
+	c.SetDeadline(time.Now().Add(timeout))
+	n, err := io.ReadFull(c, buf[:])
+	if err != nil && !(err == io.ErrUnexpectedEOF && n > 0) {
 		return nil, err
 	}
 
-	c.SetReadDeadline(time.Now())
-	n, err := c.Read(buf[1:])
-	if err != nil {
-		if e, ok := err.(net.Error); !ok || !e.Timeout() {
-			return nil, err
-		}
-	}
-
-	//log.Printf("%v + %v = Read(%v)\n", m, n, buf[:m+n])
-
-	c.SetReadDeadline(zeroTime)
-
-	br := bytes.NewReader(buf[:m+n])
+	br := bytes.NewReader(buf[:n])
 	c = &conn{
 		io.MultiReader(br, c),
 		c,
@@ -161,18 +243,22 @@ func DispatchConnection(c net.Conn, config *tls.Config) (net.Conn, error) {
 		br,
 	}
 
-	if isHttp(buf[:m+n]) {
+	if !isTLSHandshake(buf[:n]) {
+		c.SetDeadline(zeroTime)
 		return c, nil
-	} else {
-		return tls.Server(c, config), nil
 	}
-}
 
-func isHttp(buf []byte) bool {
-	for _, c := range buf {
-		if c != '\t' && (c < 32 || c >= 127) {
-			return false
-		}
+	tc := tls.Server(c, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, err
 	}
-	return true
+	c.SetDeadline(zeroTime)
+	return tc, nil
+}
+
+// Check for the header of a TLS record (RFC 8446 section 5.1) of the
+// handshake type, with a 3.x protocol version. No HTTP request starts with the
+// handshake content type byte (22).
+func isTLSHandshake(buf []byte) bool {
+	return len(buf) == 3 && buf[0] == 22 && buf[1] == 3 && buf[2] <= 4
 }
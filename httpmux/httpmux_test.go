@@ -0,0 +1,150 @@
+package httpmux
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, handshakeTimeout time.Duration) (string, func()) {
+	config, _, _, err := NewSelfSignedRSAConfig(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			res.Write([]byte("tls " + req.Proto))
+		} else {
+			res.Write([]byte("plain " + req.Proto))
+		}
+	})}
+	ConfigureServer(s)
+	l := NewListenerConfig(ln, config)
+	l.HandshakeTimeout = handshakeTimeout
+	go s.Serve(l)
+	return ln.Addr().String(), func() { s.Close() }
+}
+
+func TestProtocols(t *testing.T) {
+	addr, done := serve(t, DefaultHandshakeTimeout)
+	defer done()
+
+	for _, c := range []struct {
+		url       string
+		protocols func(p *http.Protocols)
+		expected  string
+	}{
+		{"http://", func(p *http.Protocols) { p.SetHTTP1(true) }, "plain HTTP/1.1"},
+		{"http://", func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) }, "plain HTTP/2.0"},
+		{"https://", func(p *http.Protocols) { p.SetHTTP1(true) }, "tls HTTP/1.1"},
+		{"https://", func(p *http.Protocols) { p.SetHTTP2(true) }, "tls HTTP/2.0"},
+	} {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Protocols:       new(http.Protocols),
+		}
+		c.protocols(transport.Protocols)
+		resp, err := (&http.Client{Transport: transport}).Get(c.url + addr + "/")
+		if err != nil {
+			t.Errorf("%s %s: %v", c.url, c.expected, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, body)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+// Connection sending its first bytes one at a time
+type slowConn struct {
+	net.Conn
+	slow int
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	n := 0
+	for ; n < len(b) && c.slow > 0; n, c.slow = n+1, c.slow-1 {
+		if _, err := c.Conn.Write(b[n : n+1]); err != nil {
+			return n, err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	m, err := c.Conn.Write(b[n:])
+	return n + m, err
+}
+
+func TestFragmented(t *testing.T) {
+	addr, done := serve(t, DefaultHandshakeTimeout)
+	defer done()
+
+	for _, scheme := range []string{"http", "https"} {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Dial: func(network, addr string) (net.Conn, error) {
+				c, err := net.Dial(network, addr)
+				return &slowConn{c, 8}, err
+			},
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(scheme + "://" + addr + "/")
+		if err != nil {
+			t.Errorf("%s: %v", scheme, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasPrefix(string(body), map[string]string{"http": "plain", "https": "tls"}[scheme]) {
+			t.Errorf("%s: got %q", scheme, body)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	addr, done := serve(t, 200*time.Millisecond)
+	defer done()
+
+	// Silent clients do not block the others, and are disconnected
+	var silent []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		silent = append(silent, c)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "plain HTTP/1.0" {
+		t.Errorf("got %q", body)
+	}
+
+	for _, c := range silent {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("silent connection not closed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package httpmux
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Treatment of the requests received over plain text connections
+type Plaintext int
+
+const (
+	// Serve them as the TLS requests
+	AllowPlaintext Plaintext = iota
+	// Redirect them to the TLS side of the same port
+	RedirectPlaintext
+	// Serve only the requests that do not modify resources
+	ReadOnlyPlaintext
+)
+
+var plaintextNames = []string{"allow", "redirect", "readonly"}
+
+func (p Plaintext) String() string {
+	if p < 0 || int(p) >= len(plaintextNames) {
+		return fmt.Sprintf("Plaintext(%d)", int(p))
+	}
+	return plaintextNames[p]
+}
+
+// Parse allow, redirect or readonly, the empty string is allow
+func ParsePlaintext(name string) (Plaintext, error) {
+	if name == "" {
+		return AllowPlaintext, nil
+	}
+	for i, n := range plaintextNames {
+		if n == name {
+			return Plaintext(i), nil
+		}
+	}
+	return AllowPlaintext, fmt.Errorf("Unknown plaintext policy %q, expected allow, redirect or readonly", name)
+}
+
+// Security policy of a host served both in plain text and TLS
+type Policy struct {
+	Plaintext Plaintext
+	// HTTP Strict Transport Security (RFC 6797) max-age sent on TLS responses,
+	// no header is sent if zero
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+}
+
+func (p Policy) hsts() string {
+	hsts := fmt.Sprintf("max-age=%d", int64(p.HSTSMaxAge/time.Second))
+	if p.HSTSIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	return hsts
+}
+
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Apply the policy before passing the requests to next. The requests forwarded
+// by a trusted proxy over TLS are considered as TLS requests.
+func (p Policy) Handler(next http.Handler) http.Handler {
+	if p == (Policy{}) {
+		return next
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if Scheme(req) == "https" {
+			if p.HSTSMaxAge > 0 {
+				res.Header().Set("Strict-Transport-Security", p.hsts())
+			}
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		switch p.Plaintext {
+		case RedirectPlaintext:
+			status := http.StatusMovedPermanently
+			if !safeMethod(req.Method) {
+				status = http.StatusPermanentRedirect
+			}
+			http.Redirect(res, req, "https://"+req.Host+req.URL.RequestURI(), status)
+		case ReadOnlyPlaintext:
+			if !safeMethod(req.Method) {
+				http.Error(res, "A TLS connection is required to modify resources", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(res, req)
+		default:
+			next.ServeHTTP(res, req)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package httpmux
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	ok := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {})
+	for _, c := range []struct {
+		policy   Policy
+		method   string
+		tls      bool
+		status   int
+		location string
+		hsts     string
+	}{
+		{Policy{}, "PUT", false, 200, "", ""},
+		{Policy{Plaintext: RedirectPlaintext}, "GET", false, 301, "https://example.org:8000/a?b", ""},
+		{Policy{Plaintext: RedirectPlaintext}, "PUT", false, 308, "https://example.org:8000/a?b", ""},
+		{Policy{Plaintext: RedirectPlaintext}, "PUT", true, 200, "", ""},
+		{Policy{Plaintext: ReadOnlyPlaintext}, "GET", false, 200, "", ""},
+		{Policy{Plaintext: ReadOnlyPlaintext}, "DELETE", false, 403, "", ""},
+		{Policy{Plaintext: ReadOnlyPlaintext}, "DELETE", true, 200, "", ""},
+		{Policy{HSTSMaxAge: 24 * time.Hour}, "GET", false, 200, "", ""},
+		{Policy{HSTSMaxAge: 24 * time.Hour}, "GET", true, 200, "", "max-age=86400"},
+		{Policy{HSTSMaxAge: time.Hour, HSTSIncludeSubdomains: true}, "GET", true, 200, "", "max-age=3600; includeSubDomains"},
+	} {
+		req := httptest.NewRequest(c.method, "http://example.org:8000/a?b", nil)
+		if c.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		c.policy.Handler(ok).ServeHTTP(rec, req)
+		if rec.Code != c.status || rec.Header().Get("Location") != c.location || rec.Header().Get("Strict-Transport-Security") != c.hsts {
+			t.Errorf("%+v %s tls=%v: got %d %q %q", c.policy, c.method, c.tls,
+				rec.Code, rec.Header().Get("Location"), rec.Header().Get("Strict-Transport-Security"))
+		}
+	}
+
+	for _, name := range []string{"", "allow", "redirect", "readonly"} {
+		if p, err := ParsePlaintext(name); err != nil || (name != "" && p.String() != name) {
+			t.Errorf("ParsePlaintext(%q) = %v, %v", name, p, err)
+		}
+	}
+	if _, err := ParsePlaintext("deny"); err == nil {
+		t.Errorf("ParsePlaintext(deny) did not fail")
+	}
+}
@@ -0,0 +1,305 @@
+package httpmux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Signature of the PROXY protocol version 2 header
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// Connection with the addresses given by the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr  { return c.local }
+
+// Read the PROXY protocol (version 1 or 2) header sent by a load balancer at
+// the beginning of the connection, and return a connection with the client
+// address as remote address. The connection is returned unchanged if the
+// header does not give the addresses (LOCAL or UNKNOWN).
+func ReadProxyHeader(c net.Conn) (net.Conn, error) {
+	// The shortest header is "PROXY UNKNOWN\r\n", and the header must not be
+	// read past its end
+	var buf [16]byte
+	if _, err := io.ReadFull(c, buf[:12]); err != nil {
+		return nil, err
+	}
+
+	var remote, local net.Addr
+	var err error
+	if string(buf[:12]) == proxyV2Signature {
+		remote, local, err = readProxyV2(c, buf[:])
+	} else if string(buf[:6]) == "PROXY " {
+		remote, local, err = readProxyV1(c, buf[:12])
+	} else {
+		return nil, errors.New("No PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return c, nil
+	}
+	return &proxyConn{c, remote, local}, nil
+}
+
+func readProxyV1(c net.Conn, start []byte) (remote, local net.Addr, err error) {
+	line := append([]byte(nil), start...)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, nil, errors.New("PROXY protocol header too long")
+		}
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol header %q", line)
+	}
+	src, err1 := proxyAddr(fields[2], fields[4])
+	dst, err2 := proxyAddr(fields[3], fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol header %q", line)
+	}
+	return src, dst, nil
+}
+
+func proxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, errors.New("Invalid address")
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyV2(c net.Conn, buf []byte) (remote, local net.Addr, err error) {
+	if _, err := io.ReadFull(c, buf[12:16]); err != nil {
+		return nil, nil, err
+	}
+	if buf[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("Unsupported PROXY protocol version %d", buf[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(buf[14:16]))
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, nil, err
+	}
+
+	command, family := buf[12]&0xf, buf[13]
+	if command == 0 {
+		// LOCAL: health check from the proxy itself
+		return nil, nil, nil
+	} else if command != 1 {
+		return nil, nil, fmt.Errorf("Unknown PROXY protocol command %d", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(data) < 2*size+4 {
+		return nil, nil, errors.New("Truncated PROXY protocol addresses")
+	}
+	src := &net.TCPAddr{IP: net.IP(data[:size]), Port: int(binary.BigEndian.Uint16(data[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(data[size : 2*size]), Port: int(binary.BigEndian.Uint16(data[2*size+2:]))}
+	return src, dst, nil
+}
+
+// Parse IP addresses and CIDR networks
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %s", n)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+type schemeKey struct{}
+
+// Scheme of the request as sent by the client, https if it was received over
+// TLS by the server or a trusted proxy
+func Scheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if scheme, ok := req.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	return "http"
+}
+
+// Reverse proxies trusted to give the client address, host and scheme in the
+// Forwarded (RFC 7239) or X-Forwarded-For, -Host and -Proto headers. They can
+// be replaced while serving.
+type Proxies struct {
+	mu      sync.RWMutex
+	trusted []*net.IPNet
+}
+
+func (p *Proxies) Set(trusted []*net.IPNet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trusted = trusted
+}
+
+func (p *Proxies) Trusted(ip net.IP) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, n := range p.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxies) trustedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && p.Trusted(ip)
+}
+
+// Hop of a forwarded request, as seen by a proxy
+type forwardedHop struct {
+	For, Host, Proto string
+}
+
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				i := strings.Index(pair, "=")
+				if i < 0 {
+					continue
+				}
+				value := strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+				switch strings.ToLower(strings.TrimSpace(pair[:i])) {
+				case "for":
+					hop.For = value
+				case "host":
+					hop.Host = value
+				case "proto":
+					hop.Proto = strings.ToLower(value)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	list := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(list[len(list)-1])
+}
+
+// Hop describing the request received by the outermost trusted proxy, nil if
+// the request does not come from a trusted proxy
+func (p *Proxies) forwarded(req *http.Request) *forwardedHop {
+	if !p.trustedAddr(req.RemoteAddr) {
+		return nil
+	}
+
+	hops := parseForwarded(req.Header["Forwarded"])
+	xforwarded := len(hops) == 0
+	if xforwarded {
+		for _, v := range req.Header["X-Forwarded-For"] {
+			for _, f := range strings.Split(v, ",") {
+				hops = append(hops, forwardedHop{For: strings.TrimSpace(f)})
+			}
+		}
+		if len(hops) == 0 {
+			hops = append(hops, forwardedHop{})
+		}
+	}
+
+	// Each proxy appends the hop it received, skip the trusted proxies
+	i := len(hops) - 1
+	for i > 0 && p.trustedAddr(hops[i].For) {
+		i--
+	}
+	hop := hops[i]
+	if xforwarded {
+		hop.Host = lastValue(req.Header["X-Forwarded-Host"])
+		hop.Proto = strings.ToLower(lastValue(req.Header["X-Forwarded-Proto"]))
+	}
+	return &hop
+}
+
+// Use the client address, host and scheme given by trusted proxies in the
+// requests passed to next
+func (p *Proxies) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		hop := p.forwarded(req)
+		if hop == nil {
+			next.ServeHTTP(res, req)
+			return
+		}
+		req = req.Clone(req.Context())
+		if hop.For != "" {
+			if _, _, err := net.SplitHostPort(hop.For); err == nil {
+				req.RemoteAddr = hop.For
+			} else {
+				req.RemoteAddr = net.JoinHostPort(strings.Trim(hop.For, "[]"), "0")
+			}
+		}
+		if hop.Host != "" {
+			req.Host = hop.Host
+		}
+		if hop.Proto == "http" || hop.Proto == "https" {
+			req = req.WithContext(context.WithValue(req.Context(), schemeKey{}, hop.Proto))
+		}
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,102 @@
+package httpmux
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func proxyV2(command, family byte, addrs []byte) string {
+	header := []byte(proxyV2Signature)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x01, 0xbb)
+	for _, c := range []struct {
+		header string
+		remote string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", "pipe"},
+		{proxyV2(1, 0x11, v4), "192.0.2.1:56324"},
+		{proxyV2(1, 0x21, v6), "[2001:db8::1]:56324"},
+		{proxyV2(1, 0x11, append(v4, 1, 0, 1, 'x')), "192.0.2.1:56324"},
+		{proxyV2(0, 0x00, nil), "pipe"},
+		{"GET / HTTP/1.1\r\n", ""},
+		{"PROXY TCP4 192.0.2.1\r\n", ""},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443 and a very long header that does not end with a line feed soon enough\r\n", ""},
+		{proxyV2(1, 0x11, v4[:8]), ""},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(c.header + "request"))
+			client.Close()
+		}()
+		conn, err := ReadProxyHeader(server)
+		if c.remote == "" {
+			if err == nil {
+				t.Errorf("%q: no error", c.header)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.header, err)
+			server.Close()
+			continue
+		}
+		rest, _ := ioutil.ReadAll(conn)
+		if conn.RemoteAddr().String() != c.remote || string(rest) != "request" {
+			t.Errorf("%q: got %s and %q", c.header, conn.RemoteAddr(), rest)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxies(t *testing.T) {
+	nets, err := ParseNetworks([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies := &Proxies{}
+	proxies.Set(nets)
+
+	var got string
+	h := proxies.Handler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		got = req.RemoteAddr + " " + Scheme(req) + "://" + req.Host
+	}))
+	for _, c := range []struct {
+		remote   string
+		headers  map[string]string
+		expected string
+	}{
+		{"192.0.2.9:1234", map[string]string{"Forwarded": "for=192.0.2.1;host=example.org;proto=https"}, "192.0.2.9:1234 http://local"},
+		{"127.0.0.1:1234", nil, "127.0.0.1:1234 http://local"},
+		{"127.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";host=example.org;proto=https`}, "[2001:db8::1]:4711 https://example.org"},
+		{"[::1]:1234", map[string]string{"Forwarded": "for=192.0.2.1;host=example.org, for=10.0.0.2;host=internal"}, "192.0.2.1:0 http://example.org"},
+		{"127.0.0.1:1234", map[string]string{"Forwarded": "for=10.0.0.3;host=spoofed, for=192.0.2.1;host=example.org, for=10.0.0.2;host=internal"}, "192.0.2.1:0 http://example.org"},
+		{"127.0.0.1:1234", map[string]string{"X-Forwarded-For": "192.0.2.1, 10.0.0.2", "X-Forwarded-Host": "example.org", "X-Forwarded-Proto": "https"}, "192.0.2.1:0 https://example.org"},
+	} {
+		req := httptest.NewRequest("GET", "http://local/", nil)
+		req.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != c.expected {
+			t.Errorf("%s %v: expected %s, got %s", c.remote, c.headers, c.expected, got)
+		}
+	}
+
+	if _, err := ParseNetworks([]string{"localhost"}); err == nil {
+		t.Errorf("ParseNetworks(localhost) did not fail")
+	}
+}
@@ -0,0 +1,285 @@
+package jsonld
+
+import (
+	"github.com/mildred/SmartWeb/turtle"
+	"sort"
+	"strings"
+)
+
+// Compact a document in expanded form using the active context ctx. The
+// result contains the context definition in its @context key.
+func Compact(expanded []interface{}, ctx *Context) map[string]interface{} {
+	var nodes []interface{}
+	for _, node := range expanded {
+		if m, ok := node.(map[string]interface{}); ok {
+			nodes = append(nodes, ctx.compactNode(m))
+		}
+	}
+
+	var res map[string]interface{}
+	if len(nodes) == 1 {
+		res = nodes[0].(map[string]interface{})
+	} else {
+		res = map[string]interface{}{"@graph": nodes}
+		if nodes == nil {
+			res["@graph"] = []interface{}{}
+		}
+	}
+	if len(ctx.definition) > 0 {
+		res["@context"] = ctx.definition
+	}
+	return res
+}
+
+func (c *Context) compactNode(node map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{})
+	for key, value := range node {
+		switch key {
+		case "@id":
+			res["@id"] = c.compactIri(value.(string), false)
+		case "@type":
+			var types []interface{}
+			for _, t := range asArray(value) {
+				types = append(types, c.compactIri(t.(string), true))
+			}
+			if len(types) == 1 {
+				res["@type"] = types[0]
+			} else {
+				res["@type"] = types
+			}
+		case "@graph":
+			var nodes []interface{}
+			for _, n := range asArray(value) {
+				if m, ok := n.(map[string]interface{}); ok {
+					nodes = append(nodes, c.compactNode(m))
+				}
+			}
+			if nodes == nil {
+				nodes = []interface{}{}
+			}
+			res["@graph"] = nodes
+		default:
+			values := asArray(value)
+			term := c.selectTerm(key, values)
+			res[term] = c.compactValues(term, values)
+		}
+	}
+	return res
+}
+
+// Select the term used to compact the property iri with the given values.
+// Terms that coerce all the values are preferred, then terms without
+// coercion, then compact IRIs.
+func (c *Context) selectTerm(iri string, values []interface{}) string {
+	var candidates []string
+	for name, def := range c.terms {
+		if def != nil && def.iri == iri && !strings.Contains(name, ":") {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if len(candidates[i]) != len(candidates[j]) {
+			return len(candidates[i]) < len(candidates[j])
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	for _, name := range candidates {
+		def := c.terms[name]
+		if def.typ == "" && !def.hasLang && def.container == "" {
+			continue
+		}
+		matches := len(values) > 0
+		for _, v := range values {
+			if !c.coerces(def, v, len(values)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return name
+		}
+	}
+	for _, name := range candidates {
+		def := c.terms[name]
+		if def.typ == "" && !def.hasLang && def.container == "" {
+			return name
+		}
+	}
+	return c.compactIri(iri, true)
+}
+
+// Tell if the term definition can represent the expanded value without
+// keywords
+func (c *Context) coerces(def *termDefinition, value interface{}, count int) bool {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if def.container == "@list" {
+		_, isList := v["@list"]
+		return isList && count == 1 && def.typ == "" && !def.hasLang
+	}
+	if def.container == "@language" {
+		_, isLang := v["@language"]
+		return isLang
+	}
+	if id, ok := v["@id"]; ok {
+		_, isString := id.(string)
+		return len(v) == 1 && isString && (def.typ == "@id" || def.typ == "@vocab")
+	}
+	if _, ok := v["@value"]; !ok {
+		return false
+	}
+	typ, _ := v["@type"].(string)
+	lang, _ := v["@language"].(string)
+	if def.typ != "" {
+		return typ == def.typ
+	}
+	if def.hasLang {
+		return typ == "" && lang == def.lang
+	}
+	return false
+}
+
+func (c *Context) compactValues(term string, values []interface{}) interface{} {
+	def := c.terms[term]
+	if def != nil && def.container == "@language" {
+		res := make(map[string]interface{})
+		for _, v := range values {
+			m := v.(map[string]interface{})
+			lang := m["@language"].(string)
+			if previous, ok := res[lang]; ok {
+				res[lang] = append(asArray(previous), m["@value"])
+			} else {
+				res[lang] = m["@value"]
+			}
+		}
+		return res
+	}
+	if def != nil && def.container == "@list" && len(values) == 1 {
+		var items []interface{}
+		for _, item := range asArray(values[0].(map[string]interface{})["@list"]) {
+			items = append(items, c.compactValue(nil, item))
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items
+	}
+
+	var res []interface{}
+	for _, v := range values {
+		res = append(res, c.compactValue(def, v))
+	}
+	if len(res) == 1 && (def == nil || def.container != "@set") {
+		return res[0]
+	}
+	return res
+}
+
+func (c *Context) compactValue(def *termDefinition, value interface{}) interface{} {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	if def != nil && c.coerces(def, v, 1) {
+		if id, ok := v["@id"]; ok {
+			return c.compactIri(id.(string), def.typ == "@vocab")
+		}
+		return v["@value"]
+	}
+	if list, ok := v["@list"]; ok {
+		var items []interface{}
+		for _, item := range asArray(list) {
+			items = append(items, c.compactValue(nil, item))
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		return map[string]interface{}{"@list": items}
+	}
+	if id, ok := v["@id"]; ok && len(v) == 1 {
+		return map[string]interface{}{"@id": c.compactIri(id.(string), false)}
+	}
+	if val, ok := v["@value"]; ok {
+		typ, hasType := v["@type"].(string)
+		lang, hasLang := v["@language"].(string)
+		if !hasType && !hasLang {
+			defaultLang := c.Lang
+			if def != nil && def.hasLang {
+				defaultLang = def.lang
+			}
+			if defaultLang == "" {
+				return val
+			}
+		}
+		res := map[string]interface{}{"@value": val}
+		if hasType {
+			res["@type"] = c.compactIri(typ, true)
+		}
+		if hasLang {
+			res["@language"] = lang
+		}
+		return res
+	}
+	return c.compactNode(v)
+}
+
+// Compact an IRI using terms (if vocab is set), compact IRIs or a relative
+// IRI against the base.
+func (c *Context) compactIri(iri string, vocab bool) string {
+	if vocab {
+		var best string
+		for name, def := range c.terms {
+			if def != nil && def.iri == iri && def.typ == "" && !def.hasLang && def.container == "" && !strings.Contains(name, ":") {
+				if best == "" || len(name) < len(best) || len(name) == len(best) && name < best {
+					best = name
+				}
+			}
+		}
+		if best != "" {
+			return best
+		}
+	}
+
+	var best string
+	for name, def := range c.terms {
+		if def == nil || strings.Contains(name, ":") || def.iri == iri || !strings.HasPrefix(iri, def.iri) {
+			continue
+		}
+		if !strings.HasSuffix(def.iri, "/") && !strings.HasSuffix(def.iri, "#") && !strings.HasSuffix(def.iri, ":") {
+			continue
+		}
+		candidate := name + ":" + iri[len(def.iri):]
+		if _, conflict := c.terms[candidate]; conflict || strings.HasPrefix(iri[len(def.iri):], "//") {
+			continue
+		}
+		if best == "" || len(candidate) < len(best) || len(candidate) == len(best) && candidate < best {
+			best = candidate
+		}
+	}
+	if best != "" {
+		return best
+	}
+
+	if vocab && c.Vocab != "" && strings.HasPrefix(iri, c.Vocab) && len(iri) > len(c.Vocab) {
+		suffix := iri[len(c.Vocab):]
+		if _, conflict := c.terms[suffix]; !conflict && !strings.Contains(suffix, ":") {
+			return suffix
+		}
+	}
+
+	if !vocab && c.Base != "" {
+		if i := strings.LastIndexByte(c.Base, '/'); i >= 0 && strings.HasPrefix(iri, c.Base[:i+1]) {
+			rel := iri[len(c.Base[:i+1]):]
+			if rel == "" {
+				rel = "./"
+			}
+			if !strings.HasPrefix(rel, "//") && !strings.Contains(strings.SplitN(rel, "/", 2)[0], ":") && turtle.ResolveIri(c.Base, rel) == iri {
+				return rel
+			}
+		}
+	}
+	return iri
+}
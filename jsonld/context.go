@@ -0,0 +1,274 @@
+package jsonld
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mildred/SmartWeb/turtle"
+	"strings"
+)
+
+var ErrRemoteContext = errors.New("Remote contexts are not supported")
+var ErrInvalidContext = errors.New("Invalid local context")
+var ErrCyclicIriMapping = errors.New("Cyclic IRI mapping")
+var ErrInvalidTermDefinition = errors.New("Invalid term definition")
+
+type termDefinition struct {
+	iri       string
+	typ       string // "@id", "@vocab" or a datatype IRI
+	lang      string
+	hasLang   bool
+	container string // "@list", "@set" or "@language"
+}
+
+// Active context used to expand and compact documents. The zero value is not
+// usable, use NewContext.
+type Context struct {
+	Base  string
+	Vocab string
+	Lang  string
+
+	terms      map[string]*termDefinition
+	definition map[string]interface{}
+}
+
+func NewContext(base string) *Context {
+	return &Context{
+		Base:       base,
+		terms:      make(map[string]*termDefinition),
+		definition: make(map[string]interface{}),
+	}
+}
+
+// Create a new context from the SmartWeb context
+func NewSmartWebContext(base string) *Context {
+	ctx, err := NewContext(base).Parse(SmartWebContext)
+	if err != nil {
+		panic(err)
+	}
+	return ctx
+}
+
+func (c *Context) clone() *Context {
+	res := &Context{
+		Base:       c.Base,
+		Vocab:      c.Vocab,
+		Lang:       c.Lang,
+		terms:      make(map[string]*termDefinition, len(c.terms)),
+		definition: make(map[string]interface{}, len(c.definition)),
+	}
+	for k, v := range c.terms {
+		res.terms[k] = v
+	}
+	for k, v := range c.definition {
+		res.definition[k] = v
+	}
+	return res
+}
+
+// JSON form of the context, suitable for the @context key of a document
+func (c *Context) Definition() map[string]interface{} {
+	return c.definition
+}
+
+// Process a local context (the value of a @context key) and return the
+// resulting active context. The only remote context recognized is
+// SmartWebContextIri.
+func (c *Context) Parse(local interface{}) (*Context, error) {
+	res := c
+	var locals []interface{}
+	if l, ok := local.([]interface{}); ok {
+		locals = l
+	} else {
+		locals = []interface{}{local}
+	}
+
+	for _, l := range locals {
+		switch l := l.(type) {
+		case nil:
+			res = NewContext(c.Base)
+		case string:
+			if l != SmartWebContextIri {
+				return nil, fmt.Errorf("%s: %s", ErrRemoteContext, l)
+			}
+			var err error
+			res, err = res.Parse(SmartWebContext)
+			if err != nil {
+				return nil, err
+			}
+		case map[string]interface{}:
+			res = res.clone()
+			if err := res.parseLocal(l); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrInvalidContext
+		}
+	}
+	return res, nil
+}
+
+func (c *Context) parseLocal(local map[string]interface{}) error {
+	if v, ok := local["@base"]; ok {
+		switch v := v.(type) {
+		case nil:
+			c.Base = ""
+		case string:
+			c.Base = turtle.ResolveIri(c.Base, v)
+		default:
+			return ErrInvalidContext
+		}
+	}
+	if v, ok := local["@vocab"]; ok {
+		switch v := v.(type) {
+		case nil:
+			c.Vocab = ""
+		case string:
+			c.Vocab = c.expandIri(v, true, true, nil, nil)
+		default:
+			return ErrInvalidContext
+		}
+	}
+	if v, ok := local["@language"]; ok {
+		switch v := v.(type) {
+		case nil:
+			c.Lang = ""
+		case string:
+			c.Lang = strings.ToLower(v)
+		default:
+			return ErrInvalidContext
+		}
+	}
+
+	defined := make(map[string]bool)
+	for term := range local {
+		if err := c.defineTerm(local, term, defined); err != nil {
+			return err
+		}
+	}
+	for k, v := range local {
+		c.definition[k] = v
+	}
+	return nil
+}
+
+// JSON-LD 1.0 Create Term Definition algorithm
+func (c *Context) defineTerm(local map[string]interface{}, term string, defined map[string]bool) error {
+	if done, ok := defined[term]; ok {
+		if done {
+			return nil
+		}
+		return fmt.Errorf("%s: %s", ErrCyclicIriMapping, term)
+	}
+	if term == "@base" || term == "@vocab" || term == "@language" {
+		return nil
+	}
+	if strings.HasPrefix(term, "@") {
+		return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+	}
+	defined[term] = false
+
+	var def termDefinition
+	switch value := local[term].(type) {
+	case nil:
+		c.terms[term] = nil
+		defined[term] = true
+		return nil
+	case string:
+		def.iri = c.expandIri(value, false, true, local, defined)
+	case map[string]interface{}:
+		if id, ok := value["@id"]; ok {
+			s, ok := id.(string)
+			if !ok {
+				return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+			}
+			def.iri = c.expandIri(s, false, true, local, defined)
+		} else if strings.Contains(term, ":") {
+			def.iri = c.expandIri(term, false, true, local, defined)
+		} else if c.Vocab != "" {
+			def.iri = c.Vocab + term
+		} else {
+			return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+		}
+		if typ, ok := value["@type"]; ok {
+			s, ok := typ.(string)
+			if !ok {
+				return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+			}
+			if s == "@id" || s == "@vocab" {
+				def.typ = s
+			} else {
+				def.typ = c.expandIri(s, false, true, local, defined)
+			}
+		}
+		if lang, ok := value["@language"]; ok {
+			switch lang := lang.(type) {
+			case nil:
+			case string:
+				def.lang = strings.ToLower(lang)
+			default:
+				return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+			}
+			def.hasLang = true
+		}
+		if container, ok := value["@container"]; ok {
+			switch container {
+			case "@list", "@set", "@language":
+				def.container = container.(string)
+			default:
+				return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+			}
+		}
+	default:
+		return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+	}
+	if def.iri == "" || (!strings.Contains(def.iri, ":") && !strings.HasPrefix(def.iri, "@")) {
+		return fmt.Errorf("%s: %s", ErrInvalidTermDefinition, term)
+	}
+
+	c.terms[term] = &def
+	defined[term] = true
+	return nil
+}
+
+func (c *Context) term(name string) *termDefinition {
+	return c.terms[name]
+}
+
+// JSON-LD 1.0 IRI Expansion algorithm. Terms are only looked up if vocab is
+// set, relative IRIs are resolved against the base if documentRelative is set.
+// While processing a local context, terms are defined on demand.
+func (c *Context) expandIri(value string, documentRelative, vocab bool, local map[string]interface{}, defined map[string]bool) string {
+	if strings.HasPrefix(value, "@") {
+		return value
+	}
+	if local != nil {
+		if _, ok := local[value]; ok {
+			c.defineTerm(local, value, defined)
+		}
+	}
+	if def := c.terms[value]; vocab && def != nil {
+		return def.iri
+	}
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		prefix, suffix := value[:i], value[i+1:]
+		if prefix == "_" || strings.HasPrefix(suffix, "//") {
+			return value
+		}
+		if local != nil {
+			if _, ok := local[prefix]; ok {
+				c.defineTerm(local, prefix, defined)
+			}
+		}
+		if def := c.terms[prefix]; def != nil {
+			return def.iri + suffix
+		}
+		return value
+	}
+	if vocab && c.Vocab != "" {
+		return c.Vocab + value
+	}
+	if documentRelative {
+		return turtle.ResolveIri(c.Base, value)
+	}
+	return value
+}
@@ -0,0 +1,273 @@
+package jsonld
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidValueObject = errors.New("Invalid value object")
+var ErrInvalidIdValue = errors.New("Invalid @id value")
+var ErrInvalidTypeValue = errors.New("Invalid @type value")
+var ErrInvalidLanguageMap = errors.New("Invalid language map")
+var ErrUnsupportedKeyword = errors.New("Unsupported keyword")
+
+// Expand a JSON document (as decoded by encoding/json, preferably with
+// UseNumber) using the active context ctx. The result is a list of node
+// objects in JSON-LD expanded form.
+func Expand(doc interface{}, ctx *Context) ([]interface{}, error) {
+	res, err := expandElement(ctx, "", doc)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := res.(map[string]interface{}); ok {
+		if g, ok := m["@graph"]; ok && len(m) == 1 {
+			res = g
+		}
+	}
+	switch res := res.(type) {
+	case nil:
+		return []interface{}{}, nil
+	case []interface{}:
+		return res, nil
+	default:
+		return []interface{}{res}, nil
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func asArray(v interface{}) []interface{} {
+	if a, ok := v.([]interface{}); ok {
+		return a
+	}
+	return []interface{}{v}
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, json.Number, float64:
+		return true
+	}
+	return false
+}
+
+func expandElement(ctx *Context, prop string, element interface{}) (interface{}, error) {
+	switch element := element.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		res := []interface{}{}
+		for _, item := range element {
+			expanded, err := expandElement(ctx, prop, item)
+			if err != nil {
+				return nil, err
+			}
+			if a, ok := expanded.([]interface{}); ok {
+				res = append(res, a...)
+			} else if expanded != nil {
+				res = append(res, expanded)
+			}
+		}
+		return res, nil
+	case map[string]interface{}:
+		return expandObject(ctx, prop, element)
+	default:
+		if !isScalar(element) {
+			return nil, fmt.Errorf("Unexpected JSON value %#v", element)
+		}
+		if prop == "" || prop == "@graph" {
+			return nil, nil
+		}
+		return expandValue(ctx, prop, element), nil
+	}
+}
+
+func expandValue(ctx *Context, prop string, value interface{}) interface{} {
+	def := ctx.term(prop)
+	if s, ok := value.(string); ok && def != nil {
+		switch def.typ {
+		case "@id":
+			return map[string]interface{}{"@id": ctx.expandIri(s, true, false, nil, nil)}
+		case "@vocab":
+			return map[string]interface{}{"@id": ctx.expandIri(s, true, true, nil, nil)}
+		}
+	}
+	res := map[string]interface{}{"@value": value}
+	if def != nil && def.typ != "" && def.typ != "@id" && def.typ != "@vocab" {
+		res["@type"] = def.typ
+	} else if _, ok := value.(string); ok {
+		if def != nil && def.hasLang {
+			if def.lang != "" {
+				res["@language"] = def.lang
+			}
+		} else if ctx.Lang != "" {
+			res["@language"] = ctx.Lang
+		}
+	}
+	return res
+}
+
+func expandObject(ctx *Context, prop string, element map[string]interface{}) (interface{}, error) {
+	if local, ok := element["@context"]; ok {
+		var err error
+		ctx, err = ctx.Parse(local)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make(map[string]interface{})
+	for _, key := range sortedKeys(element) {
+		value := element[key]
+		if key == "@context" {
+			continue
+		}
+		iri := ctx.expandIri(key, false, true, nil, nil)
+		if !strings.HasPrefix(iri, "@") && !strings.Contains(iri, ":") {
+			// Terms that do not expand to an IRI are dropped
+			continue
+		}
+
+		switch iri {
+		case "@id":
+			s, ok := value.(string)
+			if !ok {
+				return nil, ErrInvalidIdValue
+			}
+			res["@id"] = ctx.expandIri(s, true, false, nil, nil)
+		case "@type":
+			var types []interface{}
+			for _, t := range asArray(value) {
+				s, ok := t.(string)
+				if !ok {
+					return nil, ErrInvalidTypeValue
+				}
+				types = append(types, ctx.expandIri(s, true, true, nil, nil))
+			}
+			if _, isValue := element["@value"]; isValue && len(types) == 1 {
+				res["@type"] = types[0]
+			} else {
+				res["@type"] = types
+			}
+		case "@value":
+			if value != nil && !isScalar(value) {
+				return nil, ErrInvalidValueObject
+			}
+			res["@value"] = value
+		case "@language":
+			s, ok := value.(string)
+			if !ok {
+				return nil, ErrInvalidValueObject
+			}
+			res["@language"] = strings.ToLower(s)
+		case "@list", "@set":
+			expanded, err := expandElement(ctx, prop, value)
+			if err != nil {
+				return nil, err
+			}
+			if expanded == nil {
+				expanded = []interface{}{}
+			}
+			res[iri] = asArray(expanded)
+		case "@graph":
+			expanded, err := expandElement(ctx, "@graph", value)
+			if err != nil {
+				return nil, err
+			}
+			if expanded == nil {
+				expanded = []interface{}{}
+			}
+			res["@graph"] = asArray(expanded)
+		default:
+			if strings.HasPrefix(iri, "@") {
+				return nil, fmt.Errorf("%s: %s", ErrUnsupportedKeyword, iri)
+			}
+			var expanded interface{}
+			def := ctx.term(key)
+			if m, ok := value.(map[string]interface{}); ok && def != nil && def.container == "@language" {
+				var values []interface{}
+				for _, lang := range sortedKeys(m) {
+					for _, v := range asArray(m[lang]) {
+						s, ok := v.(string)
+						if !ok {
+							return nil, ErrInvalidLanguageMap
+						}
+						values = append(values, map[string]interface{}{"@value": s, "@language": strings.ToLower(lang)})
+					}
+				}
+				expanded = values
+			} else {
+				var err error
+				expanded, err = expandElement(ctx, key, value)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if expanded == nil {
+				continue
+			}
+			values := asArray(expanded)
+			if def != nil && def.container == "@list" && !isList(expanded) {
+				values = []interface{}{map[string]interface{}{"@list": values}}
+			}
+			if previous, ok := res[iri].([]interface{}); ok {
+				values = append(previous, values...)
+			}
+			res[iri] = values
+		}
+	}
+
+	if v, ok := res["@value"]; ok {
+		if v == nil {
+			return nil, nil
+		}
+		if _, hasLang := res["@language"]; hasLang {
+			if _, ok := v.(string); !ok {
+				return nil, ErrInvalidValueObject
+			}
+			if _, hasType := res["@type"]; hasType {
+				return nil, ErrInvalidValueObject
+			}
+		}
+		if t, hasType := res["@type"]; hasType {
+			if _, ok := t.(string); !ok {
+				return nil, ErrInvalidValueObject
+			}
+		}
+		for k := range res {
+			if k != "@value" && k != "@type" && k != "@language" {
+				return nil, ErrInvalidValueObject
+			}
+		}
+		return res, nil
+	}
+	if set, ok := res["@set"]; ok && len(res) == 1 {
+		return set, nil
+	}
+	if _, ok := res["@list"]; ok && len(res) > 1 {
+		return nil, fmt.Errorf("%s: @list with other keys", ErrUnsupportedKeyword)
+	}
+	if _, ok := res["@language"]; ok && len(res) == 1 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func isList(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = m["@list"]
+	return ok
+}
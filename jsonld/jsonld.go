@@ -0,0 +1,68 @@
+// Package jsonld reads and writes JSON-LD 1.0 documents as nquads statements.
+//
+// Only the subset of JSON-LD used by the SmartWeb front-end is implemented:
+// local contexts (with the built-in SmartWeb context as the only remote
+// context), expansion, compaction and RDF conversion. Framing, @reverse and
+// @index are not supported.
+package jsonld
+
+import (
+	"encoding/json"
+	"github.com/mildred/SmartWeb/nquads"
+	"io"
+)
+
+const MediaType = "application/ld+json"
+
+// Profiles for the media type parameter profile
+const (
+	ProfileExpanded  = "http://www.w3.org/ns/json-ld#expanded"
+	ProfileCompacted = "http://www.w3.org/ns/json-ld#compacted"
+)
+
+// IRI that can be used as a @context value to refer to SmartWebContext
+const SmartWebContextIri = "tag:mildred.fr,2015-05:SmartWeb#context"
+
+// Context for the SmartWeb vocabulary
+var SmartWebContext = map[string]interface{}{
+	"sw":           "tag:mildred.fr,2015-05:SmartWeb#",
+	"rdf":          nquads.RdfNamespace,
+	"rdfs":         "http://www.w3.org/2000/01/rdf-schema#",
+	"xsd":          nquads.XsdNamespace,
+	"label":        "rdfs:label",
+	"hash":         map[string]interface{}{"@id": "sw:hash", "@type": "@id"},
+	"contentType":  "sw:contentType",
+	"child":        map[string]interface{}{"@id": "sw:child", "@type": "@id"},
+	"relativePath": "sw:relativePath",
+	"hasReferer":   map[string]interface{}{"@id": "sw:hasReferer", "@type": "@id"},
+}
+
+// Parse a JSON-LD document and return its statements. Relative IRIs are
+// resolved against base and the SmartWeb context is active unless the document
+// resets it with a null @context.
+func Decode(r io.Reader, base string) ([]*nquads.Statement, error) {
+	var doc interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	expanded, err := Expand(doc, NewSmartWebContext(base))
+	if err != nil {
+		return nil, err
+	}
+	return ToRDF(expanded)
+}
+
+// Write statements as a JSON-LD document, compacted with ctx or in expanded
+// form if ctx is nil.
+func Encode(w io.Writer, statements []*nquads.Statement, ctx *Context) error {
+	var doc interface{} = FromRDF(statements)
+	if ctx != nil {
+		doc = Compact(doc.([]interface{}), ctx)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,158 @@
+package jsonld
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/turtle"
+)
+
+func encodeAll(sts []*nquads.Statement) string {
+	var res []string
+	for _, st := range sts {
+		res = append(res, st.String())
+	}
+	sort.Strings(res)
+	return strings.Join(res, "\n")
+}
+
+func TestDecode(t *testing.T) {
+	input := `{
+		"@context": {"ex": "http://example.org/", "title": {"@id": "ex:title", "@language": "en"}},
+		"@id": "page.html",
+		"@type": "ex:Page",
+		"contentType": "text/html",
+		"hash": "sha1:0123",
+		"title": "Hello",
+		"ex:count": 3,
+		"ex:ratio": 1.5,
+		"ex:ok": true,
+		"ex:typed": {"@value": "2015-05-01", "@type": "xsd:date"},
+		"ex:list": {"@list": ["a", {"@id": "ex:b"}]},
+		"ex:author": {"ex:name": {"@value": "Moi", "@language": "FR"}},
+		"unknown": "dropped",
+		"@graph": [{"@id": "_:x", "ex:p": {"@id": "_:x"}}]
+	}`
+	sts, err := Decode(strings.NewReader(input), "http://example.org/dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`<http://example.org/dir/page.html> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <http://example.org/Page> .`,
+		`<http://example.org/dir/page.html> <tag:mildred.fr,2015-05:SmartWeb#contentType> "text/html" .`,
+		`<http://example.org/dir/page.html> <tag:mildred.fr,2015-05:SmartWeb#hash> <sha1:0123> .`,
+		`<http://example.org/dir/page.html> <http://example.org/title> "Hello"@en .`,
+		`<http://example.org/dir/page.html> <http://example.org/count> "3"^^<http://www.w3.org/2001/XMLSchema#integer> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ratio> "1.5E0"^^<http://www.w3.org/2001/XMLSchema#double> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ok> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .`,
+		`<http://example.org/dir/page.html> <http://example.org/typed> "2015-05-01"^^<http://www.w3.org/2001/XMLSchema#date> .`,
+		`<http://example.org/dir/page.html> <http://example.org/list> _:b3 .`,
+		`_:b3 <http://www.w3.org/1999/02/22-rdf-syntax-ns#first> "a" .`,
+		`_:b3 <http://www.w3.org/1999/02/22-rdf-syntax-ns#rest> _:b4 .`,
+		`_:b4 <http://www.w3.org/1999/02/22-rdf-syntax-ns#first> <http://example.org/b> .`,
+		`_:b4 <http://www.w3.org/1999/02/22-rdf-syntax-ns#rest> <http://www.w3.org/1999/02/22-rdf-syntax-ns#nil> .`,
+		`<http://example.org/dir/page.html> <http://example.org/author> _:b2 .`,
+		`_:b2 <http://example.org/name> "Moi"@fr .`,
+		`_:b1 <http://example.org/p> _:b1 <http://example.org/dir/page.html> .`,
+	}
+	sort.Strings(expected)
+	if res := encodeAll(sts); res != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s", res, strings.Join(expected, "\n"))
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []string{
+		`{"@context": "http://example.org/context.jsonld", "@id": "a"}`,
+		`{"@id": 42}`,
+		`{"@id": "a", "sw:p": {"@value": "x", "@language": "en", "@type": "xsd:string"}}`,
+		`{"@context": {"a": {"@id": "b"}, "b": {"@id": "a"}}, "a": "x"}`,
+		`{"@id": "a"`,
+	}
+	for _, input := range tests {
+		if _, err := Decode(strings.NewReader(input), "http://example.org/"); err == nil {
+			t.Errorf("%s: expected error", input)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	sts, err := turtle.NewTriGReader(strings.NewReader(`
+		@prefix sw: <tag:mildred.fr,2015-05:SmartWeb#> .
+		@prefix ex: <http://example.org/> .
+		<http://example.org/dir/page.html> {
+			<http://example.org/dir/page.html> a ex:Page ;
+				sw:hash <sha1:0123> ;
+				sw:contentType "text/html" ;
+				sw:child <http://example.org/dir/page.html#a>, <http://example.org/other> ;
+				ex:title "Hello"@en ;
+				ex:count 3 .
+		}
+	`), "").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, sts, NewSmartWebContext("http://example.org/dir/page.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	node := doc["@graph"].([]interface{})[0].(map[string]interface{})
+	checks := map[string]interface{}{
+		"@id":         "page.html",
+		"@type":       "http://example.org/Page",
+		"hash":        "sha1:0123",
+		"contentType": "text/html",
+	}
+	for k, v := range checks {
+		if node[k] != v {
+			t.Errorf("%s: got %#v, expected %#v\n%s", k, node[k], v, buf.String())
+		}
+	}
+	var children []string
+	for _, c := range asArray(node["child"]) {
+		s, _ := c.(string)
+		children = append(children, s)
+	}
+	sort.Strings(children)
+	if strings.Join(children, " ") != "http://example.org/other page.html#a" {
+		t.Errorf("child: got %#v", node["child"])
+	}
+	if doc["@id"] != "page.html" || doc["@context"] == nil {
+		t.Errorf("unexpected document %s", buf.String())
+	}
+
+	// Decoding the compacted document gives back the same statements
+	sts2, err := Decode(&buf, "http://example.org/dir/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeAll(sts) != encodeAll(sts2) {
+		t.Errorf("round trip failed:\n%s\n%s", encodeAll(sts), encodeAll(sts2))
+	}
+}
+
+func TestExpanded(t *testing.T) {
+	st := nquads.NewStatement(nquads.NewIri("http://example.org/s"), nquads.NewIri("http://example.org/p"), nquads.NewLiteral("v", "", "en"), nil)
+	var buf bytes.Buffer
+	if err := Encode(&buf, []*nquads.Statement{st}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var doc []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	v, _ := doc[0]["http://example.org/p"].([]interface{})[0].(map[string]interface{})
+	if doc[0]["@id"] != "http://example.org/s" || v["@value"] != "v" || v["@language"] != "en" {
+		t.Errorf("unexpected document %s", buf.String())
+	}
+}
@@ -0,0 +1,292 @@
+package jsonld
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/turtle"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type rdfConverter struct {
+	statements []*nquads.Statement
+	bnodes     map[string]*nquads.BlankNode
+}
+
+// Convert an expanded document to RDF statements. Blank nodes are relabeled
+// b1, b2, ... and statements that are not valid RDF (blank node predicates,
+// relative IRIs) are dropped.
+func ToRDF(expanded []interface{}) ([]*nquads.Statement, error) {
+	c := &rdfConverter{bnodes: make(map[string]*nquads.BlankNode)}
+	for _, node := range expanded {
+		if _, err := c.node(node, nil); err != nil {
+			return nil, err
+		}
+	}
+	return c.statements, nil
+}
+
+func (c *rdfConverter) blank(label string) *nquads.BlankNode {
+	if label != "" {
+		if bn, ok := c.bnodes[label]; ok {
+			return bn
+		}
+	}
+	bn := nquads.NewBlank(fmt.Sprintf("b%d", len(c.bnodes)+1))
+	if label == "" {
+		label = "@" + bn.Label()
+	}
+	c.bnodes[label] = bn
+	return bn
+}
+
+func (c *rdfConverter) iri(id string) nquads.Node {
+	if strings.HasPrefix(id, "_:") {
+		return c.blank(id)
+	}
+	if !isAbsoluteIri(id) {
+		return nil
+	}
+	return nquads.NewIri(id)
+}
+
+func isAbsoluteIri(iri string) bool {
+	i := strings.IndexByte(iri, ':')
+	return i > 0 && !strings.ContainsAny(iri[:i], "/?#")
+}
+
+func (c *rdfConverter) add(s, p, o, g nquads.Node) {
+	if s == nil || p == nil || o == nil {
+		return
+	}
+	if _, ok := p.(*nquads.IriNode); !ok {
+		return
+	}
+	c.statements = append(c.statements, nquads.NewStatement(s, p, o, g))
+}
+
+// Generate the statements for a node object and return its subject
+func (c *rdfConverter) node(element interface{}, graph nquads.Node) (nquads.Node, error) {
+	node, ok := element.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected node object, got %#v", element)
+	}
+	if _, ok := node["@value"]; ok {
+		return nil, nil
+	}
+
+	var subject nquads.Node
+	if id, ok := node["@id"].(string); ok {
+		subject = c.iri(id)
+		if subject == nil {
+			return nil, nil
+		}
+	} else {
+		subject = c.blank("")
+	}
+
+	for _, key := range sortedKeys(node) {
+		switch key {
+		case "@id":
+		case "@graph":
+			for _, n := range asArray(node[key]) {
+				if _, err := c.node(n, subject); err != nil {
+					return nil, err
+				}
+			}
+		case "@type":
+			for _, t := range asArray(node[key]) {
+				s, _ := t.(string)
+				c.add(subject, nquads.NewIri(turtle.RdfType), c.iri(s), graph)
+			}
+		default:
+			if strings.HasPrefix(key, "@") {
+				continue
+			}
+			predicate := c.iri(key)
+			for _, item := range asArray(node[key]) {
+				object, err := c.object(item, graph)
+				if err != nil {
+					return nil, err
+				}
+				c.add(subject, predicate, object, graph)
+			}
+		}
+	}
+	return subject, nil
+}
+
+func (c *rdfConverter) object(item interface{}, graph nquads.Node) (nquads.Node, error) {
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected object, got %#v", item)
+	}
+	if value, ok := obj["@value"]; ok {
+		typ, _ := obj["@type"].(string)
+		lang, _ := obj["@language"].(string)
+		return literal(value, typ, lang), nil
+	}
+	if list, ok := obj["@list"]; ok {
+		return c.list(asArray(list), graph)
+	}
+	return c.node(obj, graph)
+}
+
+func (c *rdfConverter) list(items []interface{}, graph nquads.Node) (nquads.Node, error) {
+	var head, last nquads.Node = nquads.NewIri(turtle.RdfNil), nil
+	for _, item := range items {
+		object, err := c.object(item, graph)
+		if err != nil {
+			return nil, err
+		}
+		cell := c.blank("")
+		if last == nil {
+			head = cell
+		} else {
+			c.add(last, nquads.NewIri(turtle.RdfRest), cell, graph)
+		}
+		c.add(cell, nquads.NewIri(turtle.RdfFirst), object, graph)
+		last = cell
+	}
+	if last != nil {
+		c.add(last, nquads.NewIri(turtle.RdfRest), nquads.NewIri(turtle.RdfNil), graph)
+	}
+	return head, nil
+}
+
+// Convert native JSON values following the JSON-LD 1.0 Object to RDF
+// Conversion algorithm
+func literal(value interface{}, typ, lang string) nquads.Node {
+	switch v := value.(type) {
+	case bool:
+		if typ == "" {
+			typ = nquads.XsdBoolean
+		}
+		return nquads.NewLiteral(strconv.FormatBool(v), typ, "")
+	case json.Number:
+		s := string(v)
+		if !strings.ContainsAny(s, ".eE") && typ != turtle.XsdDouble {
+			if typ == "" {
+				typ = turtle.XsdInteger
+			}
+			return nquads.NewLiteral(s, typ, "")
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nquads.NewLiteral(s, typ, "")
+		}
+		return literal(f, typ, lang)
+	case float64:
+		if typ == "" {
+			typ = turtle.XsdDouble
+		}
+		return nquads.NewLiteral(canonicalDouble(v), typ, "")
+	case string:
+		return nquads.NewLiteral(v, typ, lang)
+	}
+	return nil
+}
+
+// Canonical lexical form of xsd:double, such as 1.5E1
+func canonicalDouble(f float64) string {
+	s := strconv.FormatFloat(f, 'E', -1, 64)
+	i := strings.IndexByte(s, 'E')
+	if i < 0 {
+		return s
+	}
+	mantissa, exponent := s[:i], s[i+1:]
+	if !strings.Contains(mantissa, ".") {
+		mantissa += ".0"
+	}
+	exp, _ := strconv.Atoi(exponent)
+	return fmt.Sprintf("%sE%d", mantissa, exp)
+}
+
+// Convert RDF statements to a JSON-LD document in expanded form. Statements in
+// named graphs are grouped in a node object of the graph IRI containing a
+// @graph key.
+func FromRDF(statements []*nquads.Statement) []interface{} {
+	graphs := make(map[string]map[string]map[string]interface{})
+	for _, st := range statements {
+		g := ""
+		if st.GraphNode() != nil {
+			g = nodeId(st.GraphNode())
+		}
+		nodes, ok := graphs[g]
+		if !ok {
+			nodes = make(map[string]map[string]interface{})
+			graphs[g] = nodes
+		}
+		s := nodeId(st.SubjectNode())
+		node, ok := nodes[s]
+		if !ok {
+			node = map[string]interface{}{"@id": s}
+			nodes[s] = node
+		}
+		p := nodeId(st.PredicateNode())
+		o := st.ObjectNode()
+		if iri, ok := o.(*nquads.IriNode); ok && p == turtle.RdfType {
+			types, _ := node["@type"].([]interface{})
+			node["@type"] = append(types, iri.Iri())
+			continue
+		}
+		values, _ := node[p].([]interface{})
+		node[p] = append(values, objectValue(o))
+	}
+
+	defaultGraph, ok := graphs[""]
+	if !ok {
+		defaultGraph = make(map[string]map[string]interface{})
+	}
+	for g, nodes := range graphs {
+		if g == "" {
+			continue
+		}
+		node, ok := defaultGraph[g]
+		if !ok {
+			node = map[string]interface{}{"@id": g}
+			defaultGraph[g] = node
+		}
+		node["@graph"] = sortedNodes(nodes)
+	}
+	return sortedNodes(defaultGraph)
+}
+
+func sortedNodes(nodes map[string]map[string]interface{}) []interface{} {
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	res := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, nodes[id])
+	}
+	return res
+}
+
+func nodeId(n nquads.Node) string {
+	switch n := n.(type) {
+	case *nquads.IriNode:
+		return n.Iri()
+	case *nquads.BlankNode:
+		return "_:" + n.Label()
+	}
+	return n.Encode()
+}
+
+func objectValue(o nquads.Node) interface{} {
+	lit, ok := o.(*nquads.LiteralNode)
+	if !ok {
+		return map[string]interface{}{"@id": nodeId(o)}
+	}
+	res := map[string]interface{}{"@value": lit.Value()}
+	if lit.Lang != "" {
+		res["@language"] = lit.Lang
+	} else if typ := lit.Datatype(); typ != "" && typ != nquads.XsdString {
+		res["@type"] = typ
+	}
+	return res
+}
@@ -0,0 +1,420 @@
+package nquads
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RDF Dataset Canonicalization (RDFC-1.0, formerly URDNA2015)
+// https://www.w3.org/TR/rdf-canon/
+
+// Maximum number of permutations and N-degree hashes computed for a dataset.
+// Some small datasets with many indistinguishable blank nodes need an
+// exponential work (poison graphs), they are rejected instead.
+const maxCanonicalWork = 100000
+
+var ErrCanonicalWork = errors.New("Dataset too complex to canonicalize")
+
+type identifierIssuer struct {
+	prefix  string
+	counter int
+	issued  map[string]string
+	order   []string
+}
+
+func newIdentifierIssuer(prefix string) *identifierIssuer {
+	return &identifierIssuer{prefix: prefix, issued: make(map[string]string)}
+}
+
+func (i *identifierIssuer) issue(id string) string {
+	if res, ok := i.issued[id]; ok {
+		return res
+	}
+	res := fmt.Sprintf("%s%d", i.prefix, i.counter)
+	i.counter++
+	i.issued[id] = res
+	i.order = append(i.order, id)
+	return res
+}
+
+func (i *identifierIssuer) clone() *identifierIssuer {
+	res := &identifierIssuer{
+		prefix:  i.prefix,
+		counter: i.counter,
+		issued:  make(map[string]string, len(i.issued)),
+		order:   append([]string(nil), i.order...),
+	}
+	for k, v := range i.issued {
+		res.issued[k] = v
+	}
+	return res
+}
+
+type canonicalizer struct {
+	blankQuads map[string][]*Statement
+	canonical  *identifierIssuer
+	// Remaining work, see maxCanonicalWork
+	work int
+}
+
+func (c *canonicalizer) spend() error {
+	if c.work <= 0 {
+		return ErrCanonicalWork
+	}
+	c.work--
+	return nil
+}
+
+func blankLabel(n Node) (string, bool) {
+	switch n := n.(type) {
+	case *BlankNode:
+		return n.string, true
+	}
+	return "", false
+}
+
+// Escape a literal following the canonical N-Quads form
+func escapeCanonical(s string) string {
+	var res strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\b':
+			res.WriteString(`\b`)
+		case r == '\t':
+			res.WriteString(`\t`)
+		case r == '\n':
+			res.WriteString(`\n`)
+		case r == '\f':
+			res.WriteString(`\f`)
+		case r == '\r':
+			res.WriteString(`\r`)
+		case r == '"':
+			res.WriteString(`\"`)
+		case r == '\\':
+			res.WriteString(`\\`)
+		case r < 0x20 || r == 0x7F:
+			fmt.Fprintf(&res, `\u%04X`, r)
+		default:
+			res.WriteRune(r)
+		}
+	}
+	return res.String()
+}
+
+// Encode a node in canonical N-Quads form, blank node labels are mapped with
+// label
+func canonicalTerm(n Node, label func(string) string) string {
+	switch n := n.(type) {
+	case *BlankNode:
+		return "_:" + label(n.string)
+	case *IriNode:
+		return "<" + n.string + ">"
+	case IriNode:
+		return "<" + n.string + ">"
+	case *LiteralNode:
+		return canonicalLiteral(*n)
+	case LiteralNode:
+		return canonicalLiteral(n)
+	}
+	return n.Encode()
+}
+
+func canonicalLiteral(lit LiteralNode) string {
+	res := `"` + escapeCanonical(lit.string) + `"`
+	if lit.Lang != "" {
+		return res + "@" + lit.Lang
+	} else if lit.Type.string != "" && lit.Type.string != XsdString {
+		return res + "^^<" + lit.Type.string + ">"
+	}
+	return res
+}
+
+func canonicalLine(st *Statement, label func(string) string) string {
+	line := canonicalTerm(st.subject, label) + " " + canonicalTerm(st.predicate, label) + " " + canonicalTerm(st.object, label)
+	if st.graph != nil {
+		line += " " + canonicalTerm(st.graph, label)
+	}
+	return line + " .\n"
+}
+
+func hashString(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *canonicalizer) hashFirstDegree(ref string) string {
+	var lines []string
+	for _, st := range c.blankQuads[ref] {
+		lines = append(lines, canonicalLine(st, func(label string) string {
+			if label == ref {
+				return "a"
+			}
+			return "z"
+		}))
+	}
+	sort.Strings(lines)
+	return hashString(strings.Join(lines, ""))
+}
+
+func (c *canonicalizer) hashRelated(related string, st *Statement, issuer *identifierIssuer, position string) string {
+	var id string
+	if cid, ok := c.canonical.issued[related]; ok {
+		id = "_:" + cid
+	} else if tid, ok := issuer.issued[related]; ok {
+		id = "_:" + tid
+	} else {
+		id = c.hashFirstDegree(related)
+	}
+	input := position
+	if position != "g" {
+		input += canonicalTerm(st.predicate, nil)
+	}
+	return hashString(input + id)
+}
+
+// Iterate over the permutations of a list, in lexicographic order of the
+// positions, without building them all. The list is modified.
+type permutation struct {
+	list  []string
+	index []int
+	first bool
+}
+
+func newPermutation(list []string) *permutation {
+	index := make([]int, len(list))
+	for i := range index {
+		index[i] = i
+	}
+	return &permutation{list, index, true}
+}
+
+func (p *permutation) next() bool {
+	if p.first {
+		p.first = false
+		return true
+	}
+	i := len(p.index) - 2
+	for i >= 0 && p.index[i] >= p.index[i+1] {
+		i--
+	}
+	if i < 0 {
+		return false
+	}
+	j := len(p.index) - 1
+	for p.index[j] <= p.index[i] {
+		j--
+	}
+	p.swap(i, j)
+	for i, j = i+1, len(p.index)-1; i < j; i, j = i+1, j-1 {
+		p.swap(i, j)
+	}
+	return true
+}
+
+func (p *permutation) swap(i, j int) {
+	p.index[i], p.index[j] = p.index[j], p.index[i]
+	p.list[i], p.list[j] = p.list[j], p.list[i]
+}
+
+func (c *canonicalizer) hashNDegree(ref string, issuer *identifierIssuer) (string, *identifierIssuer, error) {
+	if err := c.spend(); err != nil {
+		return "", nil, err
+	}
+	hashToRelated := make(map[string][]string)
+	for _, st := range c.blankQuads[ref] {
+		for _, component := range []struct {
+			node     Node
+			position string
+		}{{st.subject, "s"}, {st.object, "o"}, {st.graph, "g"}} {
+			label, ok := blankLabel(component.node)
+			if !ok || label == ref {
+				continue
+			}
+			h := c.hashRelated(label, st, issuer, component.position)
+			hashToRelated[h] = append(hashToRelated[h], label)
+		}
+	}
+
+	var hashes []string
+	for h := range hashToRelated {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	var data string
+	for _, h := range hashes {
+		data += h
+		var chosenPath string
+		var chosenIssuer *identifierIssuer
+		perm := newPermutation(hashToRelated[h])
+	permutation:
+		for perm.next() {
+			if err := c.spend(); err != nil {
+				return "", nil, err
+			}
+			issuerCopy := issuer.clone()
+			var path string
+			var recursion []string
+			for _, related := range perm.list {
+				if cid, ok := c.canonical.issued[related]; ok {
+					path += "_:" + cid
+				} else {
+					if _, ok := issuerCopy.issued[related]; !ok {
+						recursion = append(recursion, related)
+					}
+					path += "_:" + issuerCopy.issue(related)
+				}
+				if chosenPath != "" && len(path) >= len(chosenPath) && path > chosenPath {
+					continue permutation
+				}
+			}
+			for _, related := range recursion {
+				hash, resultIssuer, err := c.hashNDegree(related, issuerCopy)
+				if err != nil {
+					return "", nil, err
+				}
+				path += "_:" + issuerCopy.issue(related)
+				path += "<" + hash + ">"
+				issuerCopy = resultIssuer
+				if chosenPath != "" && len(path) >= len(chosenPath) && path > chosenPath {
+					continue permutation
+				}
+			}
+			if chosenPath == "" || path < chosenPath {
+				chosenPath = path
+				chosenIssuer = issuerCopy
+			}
+		}
+		data += chosenPath
+		issuer = chosenIssuer
+	}
+	return hashString(data), issuer, nil
+}
+
+// Canonicalize an RDF dataset. Blank nodes are relabeled c14n0, c14n1, ...
+// so that isomorphic datasets give the same statements. Duplicate statements
+// are removed and the result is sorted in canonical N-Quads order. Fails with
+// ErrCanonicalWork when the dataset needs too much work.
+func Canonicalize(statements []*Statement) ([]*Statement, error) {
+	c := &canonicalizer{
+		blankQuads: make(map[string][]*Statement),
+		canonical:  newIdentifierIssuer("c14n"),
+		work:       maxCanonicalWork,
+	}
+
+	seen := make(map[string]bool)
+	var quads []*Statement
+	for _, st := range statements {
+		key := canonicalLine(st, identity)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		quads = append(quads, st)
+		for _, n := range []Node{st.subject, st.object, st.graph} {
+			if label, ok := blankLabel(n); ok {
+				list := c.blankQuads[label]
+				if len(list) == 0 || list[len(list)-1] != st {
+					c.blankQuads[label] = append(list, st)
+				}
+			}
+		}
+	}
+
+	hashToBlanks := make(map[string][]string)
+	var blanks []string
+	for label := range c.blankQuads {
+		blanks = append(blanks, label)
+	}
+	sort.Strings(blanks)
+	for _, label := range blanks {
+		h := c.hashFirstDegree(label)
+		hashToBlanks[h] = append(hashToBlanks[h], label)
+	}
+
+	var hashes []string
+	for h := range hashToBlanks {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	var shared []string
+	for _, h := range hashes {
+		if len(hashToBlanks[h]) > 1 {
+			shared = append(shared, h)
+			continue
+		}
+		c.canonical.issue(hashToBlanks[h][0])
+	}
+
+	for _, h := range shared {
+		type result struct {
+			hash   string
+			issuer *identifierIssuer
+		}
+		var results []result
+		for _, label := range hashToBlanks[h] {
+			if _, ok := c.canonical.issued[label]; ok {
+				continue
+			}
+			issuer := newIdentifierIssuer("b")
+			issuer.issue(label)
+			hash, resultIssuer, err := c.hashNDegree(label, issuer)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result{hash, resultIssuer})
+		}
+		sort.SliceStable(results, func(i, j int) bool { return results[i].hash < results[j].hash })
+		for _, r := range results {
+			for _, label := range r.issuer.order {
+				c.canonical.issue(label)
+			}
+		}
+	}
+
+	relabel := func(n Node) Node {
+		if label, ok := blankLabel(n); ok {
+			return &BlankNode{c.canonical.issued[label]}
+		}
+		return n
+	}
+	res := make([]*Statement, 0, len(quads))
+	for _, st := range quads {
+		res = append(res, &Statement{relabel(st.subject), st.predicate, relabel(st.object), relabel(st.graph)})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return canonicalLine(res[i], identity) < canonicalLine(res[j], identity)
+	})
+	return res, nil
+}
+
+func identity(label string) string {
+	return label
+}
+
+// Serialize a dataset in canonical N-Quads form
+func CanonicalNQuads(statements []*Statement) (string, error) {
+	canonical, err := Canonicalize(statements)
+	if err != nil {
+		return "", err
+	}
+	var res strings.Builder
+	for _, st := range canonical {
+		res.WriteString(canonicalLine(st, identity))
+	}
+	return res.String(), nil
+}
+
+// SHA-256 hash (hexadecimal) of the canonical form of a dataset
+func DatasetHash(statements []*Statement) (string, error) {
+	canonical, err := CanonicalNQuads(statements)
+	if err != nil {
+		return "", err
+	}
+	return hashString(canonical), nil
+}
@@ -0,0 +1,104 @@
+package nquads
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readDataset(t *testing.T, input string) []*Statement {
+	sts, err := NewReader(strings.NewReader(input)).ReadAll()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, input)
+	}
+	return sts
+}
+
+func canonicalForm(t *testing.T, input string) string {
+	res, err := CanonicalNQuads(readDataset(t, input))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, input)
+	}
+	return res
+}
+
+func TestCanonicalize(t *testing.T) {
+	input := `
+<http://example.com/#p> <http://example.com/#q> _:e0 .
+<http://example.com/#p> <http://example.com/#r> _:e1 .
+_:e0 <http://example.com/#s> <http://example.com/#u> .
+_:e1 <http://example.com/#t> <http://example.com/#u> .
+`
+	expected := `<http://example.com/#p> <http://example.com/#q> _:c14n0 .
+<http://example.com/#p> <http://example.com/#r> _:c14n1 .
+_:c14n0 <http://example.com/#s> <http://example.com/#u> .
+_:c14n1 <http://example.com/#t> <http://example.com/#u> .
+`
+	if res := canonicalForm(t, input); res != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", res, expected)
+	}
+}
+
+func TestCanonicalLiterals(t *testing.T) {
+	input := `<http://a> <http://b> "tab\there \"q\" é\u0001" <http://g> .
+<http://a> <http://b> "x"^^<http://www.w3.org/2001/XMLSchema#string> .
+<http://a> <http://b> "x" .
+`
+	expected := `<http://a> <http://b> "tab\there \"q\" é\u0001" <http://g> .
+<http://a> <http://b> "x" .
+`
+	if res := canonicalForm(t, input); res != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", res, expected)
+	}
+}
+
+// Isomorphic datasets, including ones where blank nodes can only be told apart
+// by their neighbours, must give the same canonical form.
+func TestCanonicalIsomorphism(t *testing.T) {
+	datasets := []string{
+		`_:a <http://p> _:b . _:b <http://p> _:c . _:c <http://p> _:a .
+		 _:d <http://p> _:e . _:e <http://p> _:d .`,
+		`_:a <http://p> _:b . _:b <http://p> _:a . _:a <http://q> "x" _:g .
+		 _:g <http://r> _:b _:g .`,
+		`_:a <http://p> _:b . _:a <http://p> _:c . _:b <http://p> _:d .
+		 _:c <http://p> _:d . _:d <http://p> _:a .`,
+	}
+	rnd := rand.New(rand.NewSource(42))
+	for _, dataset := range datasets {
+		lines := strings.Split(strings.Replace(dataset, " .", " .\n", -1), "\n")
+		expected := canonicalForm(t, strings.Join(lines, "\n"))
+		for i := 0; i < 10; i++ {
+			rnd.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+			doc := strings.Join(lines, "\n")
+			for _, label := range []string{"a", "b", "c", "d", "e", "g"} {
+				doc = strings.Replace(doc, "_:"+label+" ", "_:x"+string(rune('a'+rnd.Intn(26)))+label+" ", -1)
+			}
+			if res := canonicalForm(t, doc); res != expected {
+				t.Errorf("got:\n%s\nexpected:\n%s", res, expected)
+			}
+		}
+	}
+
+	a, _ := DatasetHash(readDataset(t, "_:a <http://p> _:b .\n_:b <http://p> _:a ."))
+	b, _ := DatasetHash(readDataset(t, "_:a <http://p> _:b .\n_:b <http://p> _:b ."))
+	if a == b {
+		t.Errorf("different datasets have the same hash")
+	}
+}
+
+// Blank nodes that can only be told apart by trying all their permutations
+func TestCanonicalPoison(t *testing.T) {
+	var lines []string
+	for i := 0; i < 9; i++ {
+		lines = append(lines, fmt.Sprintf("_:x <http://p> _:b%d .\n_:y <http://p> _:b%d .", i, i))
+	}
+	start := time.Now()
+	if _, err := DatasetHash(readDataset(t, strings.Join(lines, "\n"))); err != ErrCanonicalWork {
+		t.Errorf("poison graph: %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("poison graph rejected after %v", d)
+	}
+}
@@ -2,7 +2,6 @@ package nquads
 
 import (
 	"fmt"
-	"github.com/mildred/SmartWeb/turtle"
 	"net/url"
 )
 
@@ -10,6 +9,9 @@ var XsdNamespace = `http://www.w3.org/2001/XMLSchema#`
 var XsdString    = XsdNamespace + "string"
 var XsdBoolean   = XsdNamespace + "boolean"
 
+var RdfNamespace  = `http://www.w3.org/1999/02/22-rdf-syntax-ns#`
+var RdfLangString = RdfNamespace + "langString"
+
 type Node interface {
 	Encode() string
 }
@@ -22,6 +24,10 @@ func (blank *BlankNode) Encode() string {
 	return EncodeBlank(blank.string)
 }
 
+func (blank *BlankNode) Label() string {
+	return blank.string
+}
+
 type IriNode struct {
 	string
 }
@@ -30,12 +36,24 @@ func (iri IriNode) Encode() string {
 	return EncodeIri(iri.string)
 }
 
+func (iri IriNode) Iri() string {
+	return iri.string
+}
+
 type LiteralNode struct {
 	string
 	Lang string
 	Type IriNode
 }
 
+func (lit LiteralNode) Value() string {
+	return lit.string
+}
+
+func (lit LiteralNode) Datatype() string {
+	return lit.Type.string
+}
+
 func (lit LiteralNode) Encode() string {
 	if lit.Lang != "" {
 		return EncodeLocString(lit.string, lit.Lang)
@@ -59,11 +77,11 @@ func (str TypedStringNode) Encode() string {
 }
 
 func EscapeString (s string) string {
-	return turtle.Escape(s, turtle.EscapeStringMoreChars)
+	return Escape(s, EscapeStringMoreChars)
 }
 
 func EscapeIri (s string) string {
-	return turtle.Escape(s, turtle.EscapeIriChars)
+	return Escape(s, EscapeIriChars)
 }
 
 func EncodeString(s string) string {
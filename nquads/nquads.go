@@ -11,6 +11,45 @@ type Statement struct {
 	graph     Node
 }
 
+// Create a statement, graph can be nil for a triple in the default graph.
+// Subject and graph must be *IriNode or *BlankNode and predicate an *IriNode.
+func NewStatement(subject, predicate, object, graph Node) *Statement {
+	return &Statement{subject, predicate, object, graph}
+}
+
+func NewIri(iri string) *IriNode {
+	return &IriNode{iri}
+}
+
+func NewBlank(label string) *BlankNode {
+	return &BlankNode{label}
+}
+
+// Create a literal, an empty type means xsd:string, or rdf:langString if lang
+// is set.
+func NewLiteral(value, typ, lang string) *LiteralNode {
+	if lang != "" {
+		typ = RdfLangString
+	} else if typ == "" {
+		typ = XsdString
+	}
+	return &LiteralNode{value, lang, IriNode{typ}}
+}
+
+func (st *Statement) SubjectNode() Node   { return st.subject }
+func (st *Statement) PredicateNode() Node { return st.predicate }
+func (st *Statement) ObjectNode() Node    { return st.object }
+func (st *Statement) GraphNode() Node     { return st.graph }
+
+// Blank node label of the graph, if the graph is a blank node
+func (st *Statement) GraphBlank() (string, bool) {
+	if bn, ok := st.graph.(*BlankNode); ok {
+		return bn.string, true
+	} else {
+		return "", false
+	}
+}
+
 const (
 	TypeNone = iota
 	TypeBlank
@@ -2,9 +2,12 @@ package nquads
 
 import (
 	"bufio"
-	"io"
 	"errors"
+	"fmt"
+	"io"
 	l "log"
+	"strings"
+	"unicode/utf8"
 )
 
 var ErrExpectedStatement = errors.New("Expected statement")
@@ -16,6 +19,16 @@ var ErrExpectedObject = errors.New("Expected object")
 var ErrExpectedLiteralType = errors.New("Expected IRI for literal type after ^^")
 var ErrInvalidCharacterInLanguageTag = errors.New("Invalid character in language tag")
 var ErrExpectedFinalDot = errors.New("Expected final dot")
+var ErrExpectedSubject = errors.New("Expected subject")
+var ErrExpectedEndOfLine = errors.New("Expected end of line after final dot")
+var ErrUnterminatedIri = errors.New("Unterminated IRI")
+var ErrInvalidCharacterInIri = errors.New("Invalid character in IRI")
+var ErrRelativeIri = errors.New("Relative IRI")
+var ErrUnterminatedString = errors.New("Unterminated string")
+var ErrInvalidCharacterInString = errors.New("Invalid character in string")
+var ErrInvalidBlankNodeLabel = errors.New("Invalid blank node label")
+var ErrInvalidUTF8 = errors.New("Invalid UTF-8 sequence")
+var ErrUnexpectedGraph = errors.New("Graph label not allowed in N-Triples")
 
 var EnableLogs = false
 
@@ -31,10 +44,35 @@ func logf(format string, args ...interface{}) {
 	}
 }
 
+// Syntax error located in the input. Line and Column start at 1, Column counts
+// characters and not bytes.
+type ParseError struct {
+	Line   int
+	Column int
+	Err    error
+	Text   string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d column %d: %s", e.Line, e.Column, e.Err.Error())
+}
 
 type Reader struct {
 	*bufio.Reader
-	eofIsError bool
+
+	// Skip lines that cannot be parsed instead of returning an error. The
+	// errors are appended to Skipped.
+	Lenient bool
+	Skipped []*ParseError
+
+	// Parse N-Triples, graph labels are rejected
+	Triples bool
+
+	// Accept relative IRIs. They are returned as is, without resolution.
+	AllowRelative bool
+
+	line  int
+	lines []string
 }
 
 type ReadCloser struct {
@@ -43,371 +81,447 @@ type ReadCloser struct {
 }
 
 func NewReader(r io.Reader) *Reader {
-	return &Reader{bufio.NewReader(r), false}
+	return &Reader{Reader: bufio.NewReader(r)}
 }
 
 func NewReadCloser(rc io.ReadCloser) *ReadCloser {
-	return &ReadCloser{Reader{bufio.NewReader(rc), false}, rc}
+	return &ReadCloser{Reader{Reader: bufio.NewReader(rc)}, rc}
 }
 
+// Read the next statement, returns nil at the end of the input. Syntax errors
+// are returned as *ParseError.
 func (r *Reader) ReadStatement() (*Statement, error) {
-	st, err := r.readStatement()
-	if err == io.EOF && r.eofIsError == false {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	} else if st == nil {
-		return nil, ErrExpectedStatement
-	} else {
-		return st, nil
+	for {
+		line, err := r.nextLine()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		st, perr := r.parseLine(line)
+		if perr != nil {
+			if r.Lenient {
+				log(perr)
+				r.Skipped = append(r.Skipped, perr)
+				continue
+			}
+			return nil, perr
+		} else if st != nil {
+			return st, nil
+		}
 	}
 }
 
-func (p *Reader) readStatement() (*Statement, error) {
-	var statement Statement
-	var err error
-	p.eofIsError = false
-
-	statement.subject, err = p.readSubject()
-	if err != nil {
-		return nil, err
-	} else if statement.subject == nil {
-		return nil, nil
-	}
-	
-	logf("Read subject %s", statement.String())
-	
-	p.eofIsError = true;
-	
-	statement.predicate, err = p.readIri()
-	if err != nil {
-		return nil, err
-	} else if statement.predicate == nil {
-		return nil, ErrExpectedPredicate
+func (r *Reader) ReadAll() ([]*Statement, error) {
+	var res []*Statement
+	for {
+		st, err := r.ReadStatement()
+		if err != nil {
+			return res, err
+		} else if st == nil {
+			return res, nil
+		}
+		res = append(res, st)
 	}
-	
-	logf("Read predicate %s", statement.String())
-	
-	statement.object, err = p.readObject()
-	if err != nil {
-		return nil, err
-	} else if statement.object == nil {
-		return nil, ErrExpectedObject
+}
+
+// Return the next line, EOL being any sequence of CR and LF
+func (r *Reader) nextLine() (string, error) {
+	for len(r.lines) == 0 {
+		s, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || s == "") {
+			return "", err
+		}
+		s = strings.TrimRight(s, "\r\n")
+		r.lines = strings.Split(s, "\r")
 	}
+	line := r.lines[0]
+	r.lines = r.lines[1:]
+	r.line++
+	return line, nil
+}
+
+type lineParser struct {
+	*Reader
+	s   string
+	pos int
+}
 
-	logf("Read object %s", statement.String())
-	
-	err = p.readSpaces()
+func (r *Reader) parseLine(line string) (*Statement, *ParseError) {
+	p := &lineParser{r, line, 0}
+	st, err := p.statement()
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{
+			Line:   r.line,
+			Column: utf8.RuneCountInString(line[:p.pos]) + 1,
+			Err:    err,
+			Text:   line,
+		}
 	}
-	
-	_, err = p.Peek(1)
-	if err != nil {
-		return nil, err
+	return st, nil
+}
+
+func (p *lineParser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
 	}
-	
-	statement.graph, err = p.readIri()
-	if err != nil {
-		return nil, err
+	return 0
+}
+
+func (p *lineParser) eol() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *lineParser) rune() (rune, error) {
+	r, n := utf8.DecodeRuneInString(p.s[p.pos:])
+	if r == utf8.RuneError && n <= 1 {
+		return 0, ErrInvalidUTF8
 	}
+	p.pos += n
+	return r, nil
+}
 
-	logf("Read graph %s", statement.String())
-	
-	err = p.readSpaces()
-	if err != nil {
-		return nil, err
+func (p *lineParser) spaces() {
+	for !p.eol() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
 	}
-	
-	c, err := p.ReadByte()
-	if err != nil {
-		return nil, err
-	} else if c != '.' {
-		return &statement, ErrExpectedFinalDot
+}
+
+// Skip spaces and an optional comment, and check nothing else is on the line
+func (p *lineParser) endOfLine() bool {
+	p.spaces()
+	if p.peek() == '#' {
+		p.pos = len(p.s)
 	}
-	
-	p.eofIsError = false
-	
-	return &statement, nil
+	return p.eol()
 }
 
-func (p *Reader) readSubject() (Node, error) {
-	err := p.readSpaces()
-	if err != nil {
-		return nil, err
+func (p *lineParser) statement() (*Statement, error) {
+	var st Statement
+	var err error
+
+	if p.endOfLine() {
+		return nil, nil
 	}
-	
-	iri, err := p.readIri()
-	if err != nil {
-		return nil, err
-	} else if iri != nil {
-		return iri, nil
+
+	switch p.peek() {
+	case '<':
+		st.subject, err = p.iri()
+	case '_':
+		st.subject, err = p.blank()
+	default:
+		err = ErrExpectedSubject
 	}
-	
-	blank, err := p.readBlank()
 	if err != nil {
 		return nil, err
-	} else {
-		return blank, nil
 	}
-}
+	logf("Read subject %s", st.String())
 
-func (p *Reader) readObject() (Node, error) {
-	node, err := p.readSubject()
-	if err != nil {
-		return nil, err
-	} else if node != nil {
-		return node, nil
+	p.spaces()
+	if p.peek() != '<' {
+		return nil, ErrExpectedPredicate
 	}
-	
-	return p.readLiteral()
-}
-
-func (p *Reader) readBlank() (Node, error) {
-	err := p.readSpaces()
+	st.predicate, err = p.iri()
 	if err != nil {
 		return nil, err
 	}
-	
-	prefix, err := p.Peek(2)
-	if err != nil {
-		return nil, err
-	} else if string(prefix) != "_:" {
-		return nil, nil
+	logf("Read predicate %s", st.String())
+
+	p.spaces()
+	switch p.peek() {
+	case '<':
+		st.object, err = p.iri()
+	case '_':
+		st.object, err = p.blank()
+	case '"':
+		st.object, err = p.literal()
+	default:
+		err = ErrExpectedObject
 	}
-	
-	_, err = p.ReadBytes(':')
 	if err != nil {
 		return nil, err
 	}
-	
-	var res string
-	
-	for {
-		r, _, err := p.ReadRune()
+	logf("Read object %s", st.String())
+
+	p.spaces()
+	if c := p.peek(); c == '<' || c == '_' {
+		if p.Triples {
+			return nil, ErrUnexpectedGraph
+		}
+		if c == '<' {
+			st.graph, err = p.iri()
+		} else {
+			st.graph, err = p.blank()
+		}
 		if err != nil {
 			return nil, err
 		}
-		
-		switch r {
-			case '\t': fallthrough
-			case '\r': fallthrough
-			case '\n': fallthrough
-			case ' ':
-				p.UnreadRune()
-				return &BlankNode{res}, nil
-			default:
-				res += string(r)
-				continue
-		}
+		logf("Read graph %s", st.String())
 	}
-}
 
-func (p *Reader) readLiteral() (Node, error) {
-	err := p.readSpaces()
-	if err != nil {
-		return nil, err
+	p.spaces()
+	if p.peek() != '.' {
+		return nil, ErrExpectedFinalDot
 	}
-	
-	r, _, err := p.ReadRune()
-	if err != nil {
-		return nil, err
-	} else if r != '"' {
-		p.UnreadRune()
-		return nil, nil
+	p.pos++
+
+	if !p.endOfLine() {
+		return nil, ErrExpectedEndOfLine
 	}
-	
-	var content string
-	
+
+	return &st, nil
+}
+
+// IRIREF ::= '<' ([^#x00-#x20<>"{}|^`\] | UCHAR)* '>'
+func (p *lineParser) iri() (Node, error) {
+	p.pos++ // '<'
+	var iri []rune
 	for {
-		r, _, err = p.ReadRune()
+		if p.eol() {
+			return nil, ErrUnterminatedIri
+		}
+		start := p.pos
+		r, err := p.rune()
 		if err != nil {
 			return nil, err
-		} else if r == '"' {
+		}
+		if r == '>' {
 			break
 		} else if r == '\\' {
-			r, err = p.readEscapeSeq()
+			r, err = p.uchar()
 			if err != nil {
 				return nil, err
 			}
+		} else if r <= 0x20 || strings.ContainsRune("<\"{}|^`", r) {
+			p.pos = start
+			return nil, ErrInvalidCharacterInIri
 		}
-		content += string(r)
+		iri = append(iri, r)
 	}
-	
-	var stringNode LiteralNode = LiteralNode{content, "", IriNode{XsdString}}
-	
-	err = p.readSpaces()
-	if err != nil {
-		return nil, err
+	s := string(iri)
+	if !p.AllowRelative && !isAbsoluteIri(s) {
+		p.pos--
+		return nil, ErrRelativeIri
 	}
-	
-	buf, err := p.Peek(2)
+	return &IriNode{s}, nil
+}
+
+// scheme ::= ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ) followed by ':'
+func isAbsoluteIri(iri string) bool {
+	for i := 0; i < len(iri); i++ {
+		c := iri[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		case i > 0 && c == ':':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// BLANK_NODE_LABEL ::= '_:' (PN_CHARS_U | [0-9]) ((PN_CHARS | '.')* PN_CHARS)?
+func (p *lineParser) blank() (Node, error) {
+	if !strings.HasPrefix(p.s[p.pos:], "_:") {
+		return nil, ErrInvalidBlankNodeLabel
+	}
+	p.pos += 2
+	start := p.pos
+
+	r, err := p.rune()
 	if err != nil {
 		return nil, err
-	} else if string(buf) == "^^" {
-		
-		err = p.readSpaces()
+	} else if !isPnCharsU(r) && !(r >= '0' && r <= '9') {
+		p.pos = start
+		return nil, ErrInvalidBlankNodeLabel
+	}
+
+	end := p.pos
+	for !p.eol() {
+		pos := p.pos
+		r, err := p.rune()
 		if err != nil {
 			return nil, err
 		}
-		
-		iri, err := p.readIri()
-		if err != nil {
-			return nil, err
-		} else if iri, ok := iri.(*IriNode); ok {
-			stringNode.Type = *iri
-		} else {
-			return nil, ErrExpectedLiteralType
+		if isPnChars(r) {
+			end = p.pos
+		} else if r != '.' {
+			p.pos = pos
+			break
 		}
-		
-	} else if buf[0] == '@' {
-		
-		err = p.readSpaces()
+	}
+	// A label cannot end with a dot
+	p.pos = end
+	return &BlankNode{p.s[start:end]}, nil
+}
+
+// STRING_LITERAL_QUOTE ::= '"' ([^#x22#x5C#xA#xD] | ECHAR | UCHAR)* '"'
+func (p *lineParser) literal() (Node, error) {
+	p.pos++ // '"'
+	var content []rune
+	for {
+		if p.eol() {
+			return nil, ErrUnterminatedString
+		}
+		r, err := p.rune()
 		if err != nil {
 			return nil, err
 		}
-		
-		var langTag string
-		
-		loop:
-		for {
-			c, err := p.ReadByte()
+		if r == '"' {
+			break
+		} else if r == '\\' {
+			r, err = p.echar()
 			if err != nil {
 				return nil, err
 			}
-			switch {
-				default:
-					if len(langTag) == 0 || langTag[len(langTag)-1] == '-' {
-						return nil, ErrInvalidCharacterInLanguageTag
-					}
-					break loop
-				case c >= 'A' && c <= 'Z':
-				case c >= 'a' && c <= 'z':
-				case c >= '0' && c <= '9':
-				case c == '-':
-					langTag += string(c)
-					continue
-			}
+		} else if r == '\r' || r == '\n' {
+			return nil, ErrInvalidCharacterInString
 		}
-		
-		stringNode.Lang = langTag
-		
+		content = append(content, r)
 	}
-	
-	return &stringNode, nil
-}
 
-func (p *Reader) readIri() (Node, error) {
-	err := p.readSpaces()
-	if err != nil {
-		return nil, err
-	}
-	
-	r, _, err := p.ReadRune()
-	if err != nil {
-		return nil, err
-	} else if r != '<' {
-		p.UnreadRune()
-		return nil, nil
+	stringNode := &LiteralNode{string(content), "", IriNode{XsdString}}
+
+	p.spaces()
+	if p.peek() == '@' {
+		p.pos++
+		lang, err := p.langTag()
+		if err != nil {
+			return nil, err
+		}
+		stringNode.Lang = lang
+		stringNode.Type = IriNode{RdfLangString}
+		return stringNode, nil
 	}
-	
-	var uri []rune
-	
-	for {
-		r, _, err = p.ReadRune()
+
+	if strings.HasPrefix(p.s[p.pos:], "^^") {
+		p.pos += 2
+		p.spaces()
+		if p.peek() != '<' {
+			return nil, ErrExpectedLiteralType
+		}
+		iri, err := p.iri()
 		if err != nil {
 			return nil, err
-		} else if r == '>' {
-			break
-		} else if r == '\\' {
-			r, err = p.readEscapeSeq()
-			if err != nil {
-				return nil, err
-			}
 		}
-		uri = append(uri, r)
+		stringNode.Type = *iri.(*IriNode)
 	}
-	var s string = string(uri)
-	logf("Read IRI <%s>", s)
-	return &IriNode{s}, nil
+
+	return stringNode, nil
 }
 
-// Assume \ has already been read
-func (p *Reader) readEscapeSeq() (rune, error) {
-	r, _, err := p.ReadRune()
-	if err != nil {
-		return 0, err
+// LANGTAG ::= '@' [a-zA-Z]+ ('-' [a-zA-Z0-9]+)*
+func (p *lineParser) langTag() (string, error) {
+	start := p.pos
+	subtag := 0
+	first := true
+	for !p.eol() {
+		c := p.s[p.pos]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9' {
+			subtag++
+		} else if c == '-' && subtag > 0 {
+			subtag = 0
+			first = false
+		} else {
+			break
+		}
+		p.pos++
 	}
-	
-	switch r {
-		default:    return 0, ErrUnexpectedEscapeSequence
-		case 't':	return 0x0009, nil
-		case 'b':	return 0x0008, nil
-		case 'n':	return 0x000A, nil
-		case 'r':	return 0x000D, nil
-		case 'f':	return 0x000C, nil
-		case '"':	return 0x0022, nil
-		case '\'':	return 0x0027, nil
-		case '\\':	return 0x005C, nil
-		case 'U':   fallthrough
-		case 'u':
-			var numDigits int
-			if r == 'u' {
-				numDigits = 4
-			} else {
-				numDigits = 8
-			}
-			var res uint64 = 0
-			for i := 0; i < numDigits; i++ {
-				c, err := p.ReadByte()
-				if err != nil {
-					return 0, err
-				}
-				var h byte
-				if c >= '0' && c <= '9' {
-					h = c - '0'
-				} else if c >= 'a' && c <= 'f' {
-					h = c - 'a' + 10
-				} else if c >= 'A' || c <= 'F' {
-					h = c - 'A' + 10
-				} else {
-					return 0, ErrUnexpectedCharInEscapeSequence
-				}
-				res = res | (uint64(h) << uint(numDigits-1-i)*8)
-			}
-			if res > 0xFFFFFFFF {
-				return 0, ErrUnsupported64bitsRune
-			} else {
-				return rune(res), nil
-			}
+	if subtag == 0 {
+		return "", ErrInvalidCharacterInLanguageTag
 	}
+	return p.s[start:p.pos], nil
 }
 
-func (p *Reader) readSpaces() error {
-	inComment := false
-	for {
-		r, _, err := p.ReadRune()
-		if err != nil {
-			return err
+// Assume \ has already been read. Only UCHAR is allowed.
+func (p *lineParser) uchar() (rune, error) {
+	if c := p.peek(); c != 'u' && c != 'U' {
+		return 0, ErrUnexpectedEscapeSequence
+	}
+	return p.echar()
+}
+
+// Assume \ has already been read. ECHAR or UCHAR.
+func (p *lineParser) echar() (rune, error) {
+	if p.eol() {
+		return 0, ErrUnexpectedEscapeSequence
+	}
+	r := p.s[p.pos]
+	p.pos++
+
+	switch r {
+	default:
+		p.pos--
+		return 0, ErrUnexpectedEscapeSequence
+	case 't':
+		return 0x0009, nil
+	case 'b':
+		return 0x0008, nil
+	case 'n':
+		return 0x000A, nil
+	case 'r':
+		return 0x000D, nil
+	case 'f':
+		return 0x000C, nil
+	case '"':
+		return 0x0022, nil
+	case '\'':
+		return 0x0027, nil
+	case '\\':
+		return 0x005C, nil
+	case 'u', 'U':
+		numDigits := 4
+		if r == 'U' {
+			numDigits = 8
 		}
-		
-		if inComment {
-			inComment = (r != '\r' && r != '\n')
-			continue
+		var res uint64 = 0
+		for i := 0; i < numDigits; i++ {
+			c := p.peek()
+			var h byte
+			if c >= '0' && c <= '9' {
+				h = c - '0'
+			} else if c >= 'a' && c <= 'f' {
+				h = c - 'a' + 10
+			} else if c >= 'A' && c <= 'F' {
+				h = c - 'A' + 10
+			} else {
+				return 0, ErrUnexpectedCharInEscapeSequence
+			}
+			p.pos++
+			res = res<<4 | uint64(h)
 		}
-		
-		switch r {
-			default:
-				p.UnreadRune()
-				return nil
-			case '#':
-				inComment = true
-				continue
-			case ' ':  fallthrough
-			case '\t': fallthrough
-			case '\r': fallthrough
-			case '\n':
-				continue
+		if res > utf8.MaxRune {
+			return 0, ErrUnsupported64bitsRune
 		}
+		return rune(res), nil
 	}
 }
+
+func isPnCharsBase(r rune) bool {
+	return r >= 'A' && r <= 'Z' ||
+		r >= 'a' && r <= 'z' ||
+		r >= 0x00C0 && r <= 0x00D6 ||
+		r >= 0x00D8 && r <= 0x00F6 ||
+		r >= 0x00F8 && r <= 0x02FF ||
+		r >= 0x0370 && r <= 0x037D ||
+		r >= 0x037F && r <= 0x1FFF ||
+		r >= 0x200C && r <= 0x200D ||
+		r >= 0x2070 && r <= 0x218F ||
+		r >= 0x2C00 && r <= 0x2FEF ||
+		r >= 0x3001 && r <= 0xD7FF ||
+		r >= 0xF900 && r <= 0xFDCF ||
+		r >= 0xFDF0 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0xEFFFF
+}
+
+func isPnCharsU(r rune) bool {
+	return isPnCharsBase(r) || r == '_' || r == ':'
+}
+
+func isPnChars(r rune) bool {
+	return isPnCharsU(r) || r == '-' || r >= '0' && r <= '9' || r == 0x00B7 ||
+		r >= 0x0300 && r <= 0x036F || r >= 0x203F && r <= 0x2040
+}
@@ -0,0 +1,202 @@
+package nquads
+
+import (
+	"strings"
+	"testing"
+)
+
+// Syntax tests adapted from the W3C N-Triples and N-Quads test suites
+var positiveSyntaxTests = []struct {
+	name  string
+	input string
+}{
+	{"nt-syntax-file-01", ``},
+	{"nt-syntax-file-02", "#Empty file.\n"},
+	{"nt-syntax-file-03", "#One comment, one empty line.\n\n"},
+	{"nt-syntax-uri-01", "<http://example/s> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-uri-02", "<http://example/\\u0053> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-uri-03", "<http://example/\\U00000053> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-uri-04", "<scheme:!$%25&'()*+,-./0123456789:/@ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz~?#> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-string-01", "<http://example/s> <http://example/p> \"string\" .\n"},
+	{"nt-syntax-string-02", "<http://example/s> <http://example/p> \"string\"@en .\n"},
+	{"nt-syntax-string-03", "<http://example/s> <http://example/p> \"string\"@en-uk .\n"},
+	{"nt-syntax-str-esc-01", "<http://example/s> <http://example/p> \"a\\n\" .\n"},
+	{"nt-syntax-str-esc-02", "<http://example/s> <http://example/p> \"a\\u0020b\" .\n"},
+	{"nt-syntax-str-esc-03", "<http://example/s> <http://example/p> \"a\\U00000020b\" .\n"},
+	{"nt-syntax-bnode-01", "_:a  <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bnode-02", "<http://example/s> <http://example/p> _:a .\n_:a  <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bnode-03", "<http://example/s> <http://example/p> _:1a .\n_:1a  <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-datatypes-01", "<http://example/s> <http://example/p> \"123\"^^<http://www.w3.org/2001/XMLSchema#byte> .\n"},
+	{"nt-syntax-datatypes-02", "<http://example/s> <http://example/p> \"123\"^^<http://www.w3.org/2001/XMLSchema#string> .\n"},
+	{"comment_following_triple", "<http://example/s> <http://example/p> <http://example/o> . # comment\n<http://example/s> <http://example/p> _:o . # comment\n<http://example/s> <http://example/p> \"o\" . # comment\n"},
+	{"literal_ascii_boundaries", "<http://a.example/s> <http://a.example/p> \"\x00\t\x0b\x0c\x0e&([]\x7f\" .\n"},
+	{"literal_with_UTF8_boundaries", "<http://a.example/s> <http://a.example/p> \"\u0080\u07ff\u0800\u0fff\u1000\ucfff\ud000\ud7ff\ue000\ufffd\U00010000\U0003ffff\U00040000\U000fffff\U00100000\U0010ffff\" .\n"},
+	{"langtagged_string", "<http://a.example/s> <http://a.example/p> \"chat\"@en .\n"},
+	{"lantag_with_subtag", "<http://example.org/ex#a> <http://example.org/ex#b> \"Cheers\"@en-UK .\n"},
+	{"minimal_whitespace", "<http://example/s><http://example/p><http://example/o>.\n<http://example/s><http://example/p>\"Alice\".\n<http://example/s><http://example/p>_:o.\n_:s<http://example/p><http://example/o>.\n"},
+	{"bnode_with_dots", "_:a.b.c <http://example/p> <http://example/o> .\n"},
+	{"crlf_eol", "<http://example/s> <http://example/p> <http://example/o> .\r\n<http://example/s> <http://example/p> <http://example/o> .\r"},
+	{"nq-syntax-uri-01", "<http://example/s> <http://example/p> <http://example/o> <http://example/g> .\n"},
+	{"nq-syntax-bnode-01", "<http://example/s> <http://example/p> <http://example/o> _:g .\n"},
+	{"nq-syntax-bnode-02", "<http://example/s> <http://example/p> _:o _:g .\n"},
+	{"nq-syntax-bnode-03", "_:s <http://example/p> \"o\"@en _:g .\n"},
+	{"nq-syntax-bnode-06", "_:s <http://example/p> \"o\"^^<http://example/dt> <http://example/g> .\n"},
+}
+
+var negativeSyntaxTests = []struct {
+	name  string
+	input string
+}{
+	{"nt-syntax-bad-uri-01", "<http://example/ space> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-02", "<http://example/\\u00ZZ11> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-03", "<http://example/\\U00ZZ1111> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-04", "<http://example/\\n> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-05", "<http://example/\\/> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-06", "<s> <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-07", "<http://example/s> <p> <http://example/o> .\n"},
+	{"nt-syntax-bad-uri-08", "<http://example/s> <http://example/p> <o> .\n"},
+	{"nt-syntax-bad-uri-09", "<http://example/s> <http://example/p> \"foo\"^^<dt> .\n"},
+	{"nt-syntax-bad-prefix-01", "@prefix : <http://example/> .\n"},
+	{"nt-syntax-bad-base-01", "@base <http://example/> .\n"},
+	{"nt-syntax-bad-struct-01", "<http://example/s> <http://example/p> <http://example/o>, <http://example/o2> .\n"},
+	{"nt-syntax-bad-struct-02", "<http://example/s> <http://example/p> <http://example/o>; <http://example/p2>, <http://example/o2> .\n"},
+	{"nt-syntax-bad-lang-01", "<http://example/s> <http://example/p> \"string\"@1 .\n"},
+	{"nt-syntax-bad-esc-01", "<http://example/s> <http://example/p> \"a\\zb\" .\n"},
+	{"nt-syntax-bad-esc-02", "<http://example/s> <http://example/p> \"\\uWXYZ\" .\n"},
+	{"nt-syntax-bad-esc-03", "<http://example/s> <http://example/p> \"\\U0000WXYZ\" .\n"},
+	{"nt-syntax-bad-string-01", "<http://example/s> <http://example/p> \"abc' .\n"},
+	{"nt-syntax-bad-string-02", "<http://example/s> <http://example/p> 1.0 .\n"},
+	{"nt-syntax-bad-string-03", "<http://example/s> <http://example/p> 1.0e1 .\n"},
+	{"nt-syntax-bad-string-04", "<http://example/s> <http://example/p> '''abc''' .\n"},
+	{"nt-syntax-bad-string-05", "<http://example/s> <http://example/p> \"\"\"abc\"\"\" .\n"},
+	{"nt-syntax-bad-string-06", "<http://example/s> <http://example/p> \"abc .\n"},
+	{"nt-syntax-bad-string-07", "<http://example/s> <http://example/p> abc\" .\n"},
+	{"nt-syntax-bad-num-01", "<http://example/s> <http://example/p> 1 .\n"},
+	{"nt-syntax-bad-num-02", "<http://example/s> <http://example/p> 1.0 .\n"},
+	{"nt-syntax-bad-num-03", "<http://example/s> <http://example/p> 1.0e0 .\n"},
+	{"bad-bnode-empty", "_: <http://example/p> <http://example/o> .\n"},
+	{"bad-bnode-start", "_:-a <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-missing-dot", "<http://example/s> <http://example/p> <http://example/o>\n"},
+	{"nt-syntax-bad-literal-subject", "\"s\" <http://example/p> <http://example/o> .\n"},
+	{"nt-syntax-bad-bnode-predicate", "<http://example/s> _:p <http://example/o> .\n"},
+	{"nt-syntax-bad-multiline", "<http://example/s> <http://example/p>\n<http://example/o> .\n"},
+	{"nq-syntax-bad-literal-01", "<http://example/s> <http://example/p> <http://example/o> \"o\" .\n"},
+	{"nq-syntax-bad-literal-02", "<http://example/s> <http://example/p> <http://example/o> \"o\"@en .\n"},
+	{"nq-syntax-bad-uri-01", "<http://example/s> <http://example/p> <http://example/o> <g> .\n"},
+	{"nq-syntax-bad-quint-01", "<http://example/s> <http://example/p> <http://example/o> <http://example/g> <http://example/g> .\n"},
+}
+
+func readAll(r *Reader) ([]*Statement, error) {
+	var res []*Statement
+	for {
+		st, err := r.ReadStatement()
+		if err != nil {
+			return res, err
+		} else if st == nil {
+			return res, nil
+		}
+		res = append(res, st)
+	}
+}
+
+func TestPositiveSyntax(t *testing.T) {
+	for _, test := range positiveSyntaxTests {
+		_, err := readAll(NewReader(strings.NewReader(test.input)))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestNegativeSyntax(t *testing.T) {
+	for _, test := range negativeSyntaxTests {
+		_, err := readAll(NewReader(strings.NewReader(test.input)))
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if _, ok := err.(*ParseError); !ok {
+			t.Errorf("%s: expected *ParseError, got %#v", test.name, err)
+		}
+	}
+}
+
+func TestNTriplesRejectsGraph(t *testing.T) {
+	r := NewReader(strings.NewReader("<http://example/s> <http://example/p> <http://example/o> <http://example/g> .\n"))
+	r.Triples = true
+	_, err := readAll(r)
+	if perr, ok := err.(*ParseError); !ok || perr.Err != ErrUnexpectedGraph {
+		t.Errorf("expected ErrUnexpectedGraph, got %v", err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	input := "_:b1 <http://example/p> \"a\\tb\\u00e9\\U0001F600\\\"\"@en-GB <http://example/g> .\n" +
+		"<http://example/\\u00E9> <http://example/p> \"1\"^^<http://www.w3.org/2001/XMLSchema#integer> _:g .\n"
+	sts, err := readAll(NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(sts))
+	}
+
+	if s, typ := sts[0].Subject(); s != "b1" || typ != TypeBlank {
+		t.Errorf("subject %#v %d", s, typ)
+	}
+	if v, typ, lang, ok := sts[0].ObjectLiteral(); !ok || v != "a\tb\u00e9\U0001F600\"" || typ != RdfLangString || lang != "en-GB" {
+		t.Errorf("literal %#v %#v %#v", v, typ, lang)
+	}
+	if g, ok := sts[0].Graph(); !ok || g != "http://example/g" {
+		t.Errorf("graph %#v", g)
+	}
+
+	if s, _ := sts[1].Subject(); s != "http://example/\u00e9" {
+		t.Errorf("subject %#v", s)
+	}
+	if v, typ, _, _ := sts[1].ObjectLiteral(); v != "1" || typ != XsdNamespace+"integer" {
+		t.Errorf("literal %#v %#v", v, typ)
+	}
+	if !sts[1].HasGraph() {
+		t.Errorf("expected blank graph label")
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	input := "<http://example/s> <http://example/p> <http://example/o> .\n" +
+		"<http://example/s> <http://example/p> \"\u00e9\u00e9\"@ .\n"
+	_, err := readAll(NewReader(strings.NewReader(input)))
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected *ParseError, got %#v", err)
+	}
+	if perr.Line != 2 || perr.Column != 44 || perr.Err != ErrInvalidCharacterInLanguageTag {
+		t.Errorf("unexpected error %v", perr)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	input := "<http://example/s> <http://example/p> <http://example/o1> .\n" +
+		"<http://example/s> <http://example/p> bad .\n" +
+		"<http://example/s> <http://example/p> <http://example/o2> .\n" +
+		"<s> <http://example/p> <http://example/o3> .\n"
+	r := NewReader(strings.NewReader(input))
+	r.Lenient = true
+	sts, err := readAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 2 {
+		t.Errorf("expected 2 statements, got %d", len(sts))
+	}
+	if len(r.Skipped) != 2 || r.Skipped[0].Line != 2 || r.Skipped[1].Line != 4 {
+		t.Errorf("unexpected skipped lines %v", r.Skipped)
+	}
+}
+
+func TestRelativeIri(t *testing.T) {
+	r := NewReader(strings.NewReader("<> <http://example/p> <b.css> <b.css> .\n"))
+	r.AllowRelative = true
+	sts, err := readAll(r)
+	if err != nil || len(sts) != 1 {
+		t.Fatalf("%v %v", sts, err)
+	}
+}
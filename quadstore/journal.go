@@ -0,0 +1,212 @@
+package quadstore
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	opAdd    = 'A'
+	opRemove = 'D'
+)
+
+const snapshotName = "data.nq"
+const journalName = "journal"
+
+type journal struct {
+	dir string
+	f   *os.File
+	w   *bufio.Writer
+}
+
+// Open or create a store persisted in dir. The snapshot is loaded and the
+// journal replayed, then compacted in a new snapshot.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := NewMemoryStore()
+
+	if f, err := os.Open(filepath.Join(dir, snapshotName)); err == nil {
+		r := nquads.NewReader(f)
+		r.AllowRelative = true
+		for {
+			q, err := r.ReadStatement()
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			} else if q == nil {
+				break
+			}
+			s.addQuad(q)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	replayed, err := s.replay(filepath.Join(dir, journalName))
+	if err != nil {
+		return nil, err
+	}
+
+	s.journal = &journal{dir: dir}
+	if replayed {
+		if err := s.Compact(); err != nil {
+			return nil, err
+		}
+	} else if err := s.journal.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) replay(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	replayed := false
+	var size int64
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// An incomplete last line comes from an interrupted write, it is
+			// removed so that the next entries start on their own line
+			if line != "" {
+				if err := os.Truncate(path, size); err != nil {
+					return replayed, err
+				}
+			}
+			return replayed, nil
+		} else if err != nil {
+			return replayed, err
+		}
+		size += int64(len(line))
+		line = strings.TrimRight(line, "\n")
+		if len(line) < 2 {
+			return replayed, fmt.Errorf("%s:%d: invalid journal entry", path, n)
+		}
+		qr := nquads.NewReader(strings.NewReader(line[2:]))
+		qr.AllowRelative = true
+		q, err := qr.ReadStatement()
+		if err != nil || q == nil {
+			return replayed, fmt.Errorf("%s:%d: invalid journal entry %v", path, n, err)
+		}
+		switch line[0] {
+		case opAdd:
+			s.addQuad(q)
+		case opRemove:
+			s.removeQuad(q)
+		default:
+			return replayed, fmt.Errorf("%s:%d: invalid journal entry", path, n)
+		}
+		replayed = true
+	}
+}
+
+func (j *journal) open() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, journalName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.w = bufio.NewWriter(f)
+	return nil
+}
+
+func (j *journal) close() error {
+	if j.f == nil {
+		return nil
+	}
+	err := j.w.Flush()
+	if err2 := j.f.Close(); err == nil {
+		err = err2
+	}
+	j.f, j.w = nil, nil
+	return err
+}
+
+// Append operations to the journal, the caller holds the write lock
+func (s *Store) log(op byte, quads []*nquads.Statement) error {
+	if s.journal == nil || len(quads) == 0 {
+		return nil
+	}
+	if s.journal.f == nil {
+		return ErrClosed
+	}
+	for _, q := range quads {
+		if _, err := fmt.Fprintf(s.journal.w, "%c %s\n", op, q.String()); err != nil {
+			return err
+		}
+	}
+	if err := s.journal.w.Flush(); err != nil {
+		return err
+	}
+	return s.journal.f.Sync()
+}
+
+// Write all the quads in a new snapshot and empty the journal
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	if err := s.journal.close(); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.journal.dir, snapshotName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, q := range s.match(nil, nil, nil, nil) {
+		if _, err = fmt.Fprintln(w, q.String()); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.journal.dir, snapshotName))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Truncate(filepath.Join(s.journal.dir, journalName), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.journal.open()
+}
+
+// Close the journal, the store is still readable but cannot be modified
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.close()
+}
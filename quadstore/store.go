@@ -0,0 +1,382 @@
+// Package quadstore is an embedded quad store. Quads are kept in memory,
+// indexed in SPOG, POSG and GSPO order, and persisted in a directory as an
+// N-Quads snapshot and an append-only journal.
+package quadstore
+
+import (
+	"errors"
+	"github.com/mildred/SmartWeb/nquads"
+	"sync"
+)
+
+var ErrClosed = errors.New("Store is closed")
+var ErrInvalidQuad = errors.New("Invalid quad")
+
+type defaultGraph struct{}
+
+func (defaultGraph) Encode() string { return "" }
+
+// Graph pattern matching only the default graph, a nil graph pattern matches
+// any graph including the default graph.
+var DefaultGraph nquads.Node = defaultGraph{}
+
+type termId uint32
+
+// Three levels of maps followed by a set
+type index map[termId]map[termId]map[termId]map[termId]struct{}
+
+func (idx index) add(a, b, c, d termId) bool {
+	l1, ok := idx[a]
+	if !ok {
+		l1 = make(map[termId]map[termId]map[termId]struct{})
+		idx[a] = l1
+	}
+	l2, ok := l1[b]
+	if !ok {
+		l2 = make(map[termId]map[termId]struct{})
+		l1[b] = l2
+	}
+	l3, ok := l2[c]
+	if !ok {
+		l3 = make(map[termId]struct{})
+		l2[c] = l3
+	}
+	if _, ok := l3[d]; ok {
+		return false
+	}
+	l3[d] = struct{}{}
+	return true
+}
+
+func (idx index) remove(a, b, c, d termId) bool {
+	l3 := idx[a][b][c]
+	if _, ok := l3[d]; !ok {
+		return false
+	}
+	delete(l3, d)
+	if len(l3) == 0 {
+		delete(idx[a][b], c)
+		if len(idx[a][b]) == 0 {
+			delete(idx[a], b)
+			if len(idx[a]) == 0 {
+				delete(idx, a)
+			}
+		}
+	}
+	return true
+}
+
+// Iterate over the entries matching the bound (non zero) keys. Stops when f
+// returns false.
+func (idx index) each(a, b, c, d termId, f func(a, b, c, d termId) bool) bool {
+	eachKey := func(key termId, m map[termId]map[termId]map[termId]struct{}, f func(termId, map[termId]map[termId]struct{}) bool) bool {
+		if key != 0 {
+			if v, ok := m[key]; ok {
+				return f(key, v)
+			}
+			return true
+		}
+		for k, v := range m {
+			if !f(k, v) {
+				return false
+			}
+		}
+		return true
+	}
+	l1f := func(ka termId, l1 map[termId]map[termId]map[termId]struct{}) bool {
+		var kb termId
+		l2f := func(k termId, l2 map[termId]map[termId]struct{}) bool {
+			kb = k
+			l3f := func(kc termId, l3 map[termId]struct{}) bool {
+				if d != 0 {
+					if _, ok := l3[d]; ok {
+						return f(ka, kb, kc, d)
+					}
+					return true
+				}
+				for kd := range l3 {
+					if !f(ka, kb, kc, kd) {
+						return false
+					}
+				}
+				return true
+			}
+			if c != 0 {
+				if l3, ok := l2[c]; ok {
+					return l3f(c, l3)
+				}
+				return true
+			}
+			for kc, l3 := range l2 {
+				if !l3f(kc, l3) {
+					return false
+				}
+			}
+			return true
+		}
+		return eachKey(b, l1, l2f)
+	}
+	if a != 0 {
+		if l1, ok := idx[a]; ok {
+			return l1f(a, l1)
+		}
+		return true
+	}
+	for ka, l1 := range idx {
+		if !l1f(ka, l1) {
+			return false
+		}
+	}
+	return true
+}
+
+type Store struct {
+	mu      sync.RWMutex
+	journal *journal
+
+	ids   map[string]termId
+	terms []nquads.Node // indexed by termId, terms[0] is the default graph
+
+	spog index
+	posg index
+	gspo index
+	size int
+}
+
+// Create an empty store kept in memory only
+func NewMemoryStore() *Store {
+	return &Store{
+		ids:   map[string]termId{"": 0},
+		terms: []nquads.Node{nil},
+		spog:  make(index),
+		posg:  make(index),
+		gspo:  make(index),
+	}
+}
+
+// Number of quads in the store
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+func (s *Store) intern(n nquads.Node) termId {
+	if n == nil {
+		return 0
+	}
+	key := n.Encode()
+	if id, ok := s.ids[key]; ok {
+		return id
+	}
+	id := termId(len(s.terms))
+	s.ids[key] = id
+	s.terms = append(s.terms, n)
+	return id
+}
+
+// Return the term id of a pattern node, 0 and false if the node is not in
+// the store
+func (s *Store) lookup(n nquads.Node) (termId, bool) {
+	if n == nil {
+		return 0, true
+	}
+	id, ok := s.ids[n.Encode()]
+	return id, ok
+}
+
+func validQuad(q *nquads.Statement) bool {
+	if q.SubjectNode() == nil || q.PredicateNode() == nil || q.ObjectNode() == nil {
+		return false
+	}
+	if _, ok := q.PredicateNode().(*nquads.IriNode); !ok {
+		return false
+	}
+	return q.GraphNode() != DefaultGraph
+}
+
+func (s *Store) addQuad(q *nquads.Statement) bool {
+	sid, pid, oid := s.intern(q.SubjectNode()), s.intern(q.PredicateNode()), s.intern(q.ObjectNode())
+	gid := s.intern(q.GraphNode())
+	if !s.spog.add(sid, pid, oid, gid) {
+		return false
+	}
+	s.posg.add(pid, oid, sid, gid)
+	s.gspo.add(gid, sid, pid, oid)
+	s.size++
+	return true
+}
+
+func (s *Store) removeQuad(q *nquads.Statement) bool {
+	sid, ok1 := s.lookup(q.SubjectNode())
+	pid, ok2 := s.lookup(q.PredicateNode())
+	oid, ok3 := s.lookup(q.ObjectNode())
+	gid, ok4 := s.lookup(q.GraphNode())
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return false
+	}
+	if !s.spog.remove(sid, pid, oid, gid) {
+		return false
+	}
+	s.posg.remove(pid, oid, sid, gid)
+	s.gspo.remove(gid, sid, pid, oid)
+	s.size--
+	return true
+}
+
+// Add quads to the store, a nil graph is the default graph. Blank node labels
+// are used as is and are shared with the quads already in the store.
+func (s *Store) Add(quads ...*nquads.Statement) error {
+	for _, q := range quads {
+		if !validQuad(q) {
+			return ErrInvalidQuad
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var added []*nquads.Statement
+	for _, q := range quads {
+		if s.addQuad(q) {
+			added = append(added, q)
+		}
+	}
+	return s.log(opAdd, added)
+}
+
+// Remove quads from the store
+func (s *Store) Remove(quads ...*nquads.Statement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []*nquads.Statement
+	for _, q := range quads {
+		if s.removeQuad(q) {
+			removed = append(removed, q)
+		}
+	}
+	return s.log(opRemove, removed)
+}
+
+// Remove all the quads of a graph (nil or DefaultGraph for the default graph)
+func (s *Store) ClearGraph(graph nquads.Node) error {
+	if graph == nil {
+		graph = DefaultGraph
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := s.match(nil, nil, nil, graph)
+	for _, q := range removed {
+		s.removeQuad(q)
+	}
+	return s.log(opRemove, removed)
+}
+
+// Replace the content of a graph
+func (s *Store) ReplaceGraph(graph nquads.Node, quads []*nquads.Statement) error {
+	var g nquads.Node = graph
+	if graph == DefaultGraph {
+		g = nil
+	}
+	var replaced []*nquads.Statement
+	for _, q := range quads {
+		if !validQuad(q) {
+			return ErrInvalidQuad
+		}
+		replaced = append(replaced, nquads.NewStatement(q.SubjectNode(), q.PredicateNode(), q.ObjectNode(), g))
+	}
+	if graph == nil {
+		graph = DefaultGraph
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := s.match(nil, nil, nil, graph)
+	for _, q := range removed {
+		s.removeQuad(q)
+	}
+	var added []*nquads.Statement
+	for _, q := range replaced {
+		if s.addQuad(q) {
+			added = append(added, q)
+		}
+	}
+	if err := s.log(opRemove, removed); err != nil {
+		return err
+	}
+	return s.log(opAdd, added)
+}
+
+// Return the quads matching the pattern, nil nodes match anything. Use
+// DefaultGraph to match only the default graph.
+func (s *Store) Match(subject, predicate, object, graph nquads.Node) []*nquads.Statement {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.match(subject, predicate, object, graph)
+}
+
+// Tell if the store contains a quad
+func (s *Store) Contains(q *nquads.Statement) bool {
+	graph := q.GraphNode()
+	if graph == nil {
+		graph = DefaultGraph
+	}
+	return len(s.Match(q.SubjectNode(), q.PredicateNode(), q.ObjectNode(), graph)) > 0
+}
+
+func (s *Store) match(subject, predicate, object, graph nquads.Node) []*nquads.Statement {
+	var gid termId
+	var anyGraph bool
+	var ok bool
+	if graph == nil {
+		anyGraph = true
+	} else if graph != DefaultGraph {
+		if gid, ok = s.lookup(graph); !ok {
+			return nil
+		}
+	}
+	sid, ok1 := s.lookup(subject)
+	pid, ok2 := s.lookup(predicate)
+	oid, ok3 := s.lookup(object)
+	if !ok1 || !ok2 || !ok3 {
+		return nil
+	}
+
+	var res []*nquads.Statement
+	emit := func(sid, pid, oid, g termId) bool {
+		if !anyGraph && g != gid {
+			return true
+		}
+		res = append(res, nquads.NewStatement(s.terms[sid], s.terms[pid], s.terms[oid], s.terms[g]))
+		return true
+	}
+
+	// With a default graph pattern, gid is 0 and cannot be used as a key
+	graphKey := gid
+	switch {
+	case sid != 0:
+		s.spog.each(sid, pid, oid, graphKey, func(a, b, c, d termId) bool { return emit(a, b, c, d) })
+	case pid != 0:
+		s.posg.each(pid, oid, 0, graphKey, func(a, b, c, d termId) bool { return emit(c, a, b, d) })
+	case !anyGraph && gid != 0:
+		s.gspo.each(gid, 0, 0, oid, func(a, b, c, d termId) bool { return emit(b, c, d, a) })
+	case !anyGraph:
+		if l1, ok := s.gspo[0]; ok {
+			index{0: l1}.each(0, 0, 0, oid, func(a, b, c, d termId) bool { return emit(b, c, d, a) })
+		}
+	default:
+		s.posg.each(0, oid, 0, graphKey, func(a, b, c, d termId) bool { return emit(c, a, b, d) })
+	}
+	return res
+}
+
+// List the named graphs in the store
+func (s *Store) Graphs() []nquads.Node {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []nquads.Node
+	for gid := range s.gspo {
+		if gid != 0 {
+			res = append(res, s.terms[gid])
+		}
+	}
+	return res
+}
@@ -0,0 +1,179 @@
+package quadstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mildred/SmartWeb/nquads"
+)
+
+func iri(s string) nquads.Node {
+	return nquads.NewIri("http://example.org/" + s)
+}
+
+func quad(s, p, o, g string) *nquads.Statement {
+	var graph nquads.Node
+	if g != "" {
+		graph = iri(g)
+	}
+	return nquads.NewStatement(iri(s), iri(p), iri(o), graph)
+}
+
+func encode(quads []*nquads.Statement) string {
+	var res []string
+	for _, q := range quads {
+		res = append(res, strings.Replace(q.String(), "http://example.org/", "", -1))
+	}
+	sort.Strings(res)
+	return strings.Join(res, "\n")
+}
+
+func fill(t *testing.T, s *Store) {
+	err := s.Add(
+		quad("s1", "p1", "o1", ""),
+		quad("s1", "p1", "o1", "g1"),
+		quad("s1", "p2", "o2", "g1"),
+		quad("s2", "p1", "o2", "g2"),
+		quad("s2", "p1", "o2", "g2"),
+		nquads.NewStatement(iri("s3"), iri("p3"), nquads.NewLiteral("lit", "", "en"), iri("g2")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	s := NewMemoryStore()
+	fill(t, s)
+	if s.Len() != 5 {
+		t.Errorf("Len() = %d", s.Len())
+	}
+
+	tests := []struct {
+		s, p, o, g nquads.Node
+		expected   string
+	}{
+		{nil, nil, nil, nil, "<s1> <p1> <o1> .\n<s1> <p1> <o1> <g1> .\n<s1> <p2> <o2> <g1> .\n<s2> <p1> <o2> <g2> .\n<s3> <p3> \"lit\"@en <g2> ."},
+		{iri("s1"), nil, nil, nil, "<s1> <p1> <o1> .\n<s1> <p1> <o1> <g1> .\n<s1> <p2> <o2> <g1> ."},
+		{iri("s1"), nil, nil, DefaultGraph, "<s1> <p1> <o1> ."},
+		{nil, iri("p1"), nil, nil, "<s1> <p1> <o1> .\n<s1> <p1> <o1> <g1> .\n<s2> <p1> <o2> <g2> ."},
+		{nil, nil, iri("o2"), nil, "<s1> <p2> <o2> <g1> .\n<s2> <p1> <o2> <g2> ."},
+		{nil, nil, nil, iri("g2"), "<s2> <p1> <o2> <g2> .\n<s3> <p3> \"lit\"@en <g2> ."},
+		{nil, nil, nil, DefaultGraph, "<s1> <p1> <o1> ."},
+		{nil, nil, iri("o2"), iri("g1"), "<s1> <p2> <o2> <g1> ."},
+		{nil, nil, nquads.NewLiteral("lit", "", "en"), nil, "<s3> <p3> \"lit\"@en <g2> ."},
+		{iri("s1"), iri("p2"), iri("o2"), iri("g2"), ""},
+		{iri("unknown"), nil, nil, nil, ""},
+	}
+	for _, test := range tests {
+		if res := encode(s.Match(test.s, test.p, test.o, test.g)); res != test.expected {
+			t.Errorf("Match(%v, %v, %v, %v):\n%s\nexpected:\n%s", test.s, test.p, test.o, test.g, res, test.expected)
+		}
+	}
+}
+
+func TestModify(t *testing.T) {
+	s := NewMemoryStore()
+	fill(t, s)
+
+	s.Remove(quad("s1", "p1", "o1", "g1"), quad("s1", "p1", "o1", "g3"))
+	if res := encode(s.Match(nil, nil, nil, iri("g1"))); res != "<s1> <p2> <o2> <g1> ." {
+		t.Errorf("after Remove: %s", res)
+	}
+
+	s.ClearGraph(iri("g2"))
+	if res := encode(s.Match(nil, nil, nil, iri("g2"))); res != "" {
+		t.Errorf("after ClearGraph: %s", res)
+	}
+
+	s.ReplaceGraph(iri("g1"), []*nquads.Statement{quad("s4", "p4", "o4", "")})
+	if res := encode(s.Match(nil, nil, nil, nil)); res != "<s1> <p1> <o1> .\n<s4> <p4> <o4> <g1> ." {
+		t.Errorf("after ReplaceGraph: %s", res)
+	}
+	if len(s.Graphs()) != 1 || s.Len() != 2 {
+		t.Errorf("Graphs() = %v, Len() = %d", s.Graphs(), s.Len())
+	}
+
+	if err := s.Add(nquads.NewStatement(iri("s"), nquads.NewLiteral("p", "", ""), iri("o"), nil)); err != ErrInvalidQuad {
+		t.Errorf("literal predicate: %v", err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quadstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, s)
+	s.Remove(quad("s1", "p1", "o1", ""))
+	expected := encode(s.Match(nil, nil, nil, nil))
+	s.Close()
+
+	// Interrupted write at the end of the journal
+	f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("A <http://example.org/s")
+	f.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := encode(s.Match(nil, nil, nil, nil)); res != expected {
+		t.Errorf("after reopen:\n%s\nexpected:\n%s", res, expected)
+	}
+	s.Add(quad("s5", "p5", "o5", "g5"))
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if res := encode(s.Match(nil, nil, nil, iri("g5"))); res != "<s5> <p5> <o5> <g5> ." {
+		t.Errorf("after second reopen: %s", res)
+	}
+}
+
+// A journal holding only an interrupted write is not compacted, the next
+// entries must not be appended to the incomplete line
+func TestPartialJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quadstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, journalName), []byte("A <http://s> <http:"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(quad("s", "p", "o", "g")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if res := encode(s.Match(nil, nil, nil, nil)); res != "<s> <p> <o> <g> ." {
+		t.Errorf("after reopen: %s", res)
+	}
+}
@@ -1,21 +1,30 @@
 package rdf
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/turtle"
 	"github.com/mildred/golibrdf"
 	"log"
-	"net/url"
 	"os"
 	"path/filepath"
 )
 
+// Redland storage used as backend. It cannot evaluate SPARQL updates and
+// only stores IRIs and plain literals.
 type RedlandDataSet struct {
 	World   *golibrdf.World
 	Storage *golibrdf.Storage
 	Model   *golibrdf.Model
 }
 
+var _ backend.Backend = (*RedlandDataSet)(nil)
+
 func logMessage(message string) int {
 	log.Println(message)
 	return 1
@@ -98,36 +107,42 @@ func CreateRedlandDataSet(directory string) (*RedlandDataSet, error) {
 	}, nil
 }
 
-func (ds *RedlandDataSet) makeNode(o interface{}) (*golibrdf.Node, error) {
-	if u, ok := o.(*url.URL); ok {
-		return golibrdf.NewNodeFromUriString(ds.World, u.String())
-	} else if s, ok := o.(string); ok {
-		return golibrdf.NewNodeFromLiteral(ds.World, s)
-	} else {
-		return nil, fmt.Errorf("Could not make a node from %#v", o)
+func (ds *RedlandDataSet) makeNode(n nquads.Node) (*golibrdf.Node, error) {
+	switch n := n.(type) {
+	case *nquads.IriNode:
+		return golibrdf.NewNodeFromUriString(ds.World, n.Iri())
+	case *nquads.LiteralNode:
+		if n.Lang == "" && n.Datatype() == nquads.XsdString {
+			return golibrdf.NewNodeFromLiteral(ds.World, n.Value())
+		}
 	}
+	return nil, fmt.Errorf("Could not make a node from %s: %v", n.Encode(), backend.ErrUnsupported)
 }
 
-func (ds *RedlandDataSet) AddQuad(context, subject, predicate, object interface{}) error {
-	nContext, err := ds.makeNode(context)
+func (ds *RedlandDataSet) addQuad(quad *nquads.Statement) error {
+	if quad.GraphNode() == nil {
+		return fmt.Errorf("Quad without graph: %v", backend.ErrUnsupported)
+	}
+
+	nContext, err := ds.makeNode(quad.GraphNode())
 	if err != nil {
 		return err
 	}
 
-	nSubject, err := ds.makeNode(subject)
+	nSubject, err := ds.makeNode(quad.SubjectNode())
 	if err != nil {
 		nContext.Free()
 		return err
 	}
 
-	nPredicate, err := ds.makeNode(predicate)
+	nPredicate, err := ds.makeNode(quad.PredicateNode())
 	if err != nil {
 		nSubject.Free()
 		nContext.Free()
 		return err
 	}
 
-	nObject, err := ds.makeNode(object)
+	nObject, err := ds.makeNode(quad.ObjectNode())
 	if err != nil {
 		nPredicate.Free()
 		nSubject.Free()
@@ -154,6 +169,62 @@ func (ds *RedlandDataSet) AddQuad(context, subject, predicate, object interface{
 	return nil
 }
 
+// Add quads, only IRIs and plain literals in named graphs are supported
+func (ds *RedlandDataSet) AddQuads(quads ...*nquads.Statement) error {
+	for _, quad := range quads {
+		if err := ds.addQuad(quad); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *RedlandDataSet) RemoveQuads(quads ...*nquads.Statement) error {
+	return backend.ErrUnsupported
+}
+
+func (ds *RedlandDataSet) ReplaceGraph(graph string, triples []*nquads.Statement) error {
+	return backend.ErrUnsupported
+}
+
+func (ds *RedlandDataSet) Update(update string) error {
+	return backend.ErrUnsupported
+}
+
+func (ds *RedlandDataSet) Select(query string) (*sparql.Response, error) {
+	q, err := golibrdf.NewQuery(ds.World, "sparql", query, "")
+	if err != nil {
+		return nil, err
+	}
+	defer q.Free()
+
+	res, err := ds.Model.Execute(q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Free()
+
+	data, err := res.ToString2("", "application/sparql-results+json", "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var result sparql.Response
+	err = json.Unmarshal([]byte(data), &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (ds *RedlandDataSet) Construct(query string) ([]*nquads.Statement, error) {
+	data, _, err, _ := ds.QueryGraph(query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return turtle.NewReader(bytes.NewReader(data), "").ReadAll()
+}
+
 func (ds *RedlandDataSet) Close() {
 	ds.Model.Free()
 	ds.Storage.Free()
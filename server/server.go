@@ -1,7 +1,11 @@
 package server
 
 import (
+	"encoding/json"
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/nquads"
 	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/turtle"
 	"io"
 	"io/ioutil"
 	"strings"
@@ -12,23 +16,18 @@ import (
 	"mime"
 )
 
-type DataSet interface {
-	AddQuad(context, subject, predicate, object interface{}) error
-	QueryGraph(query, baseUri string, accept_types []string) (data []byte, content_type string, err error, status int)
-}
-
 var SmartWeb_hasReferer, _ = url.Parse("tag:mildred.fr,2015-05:SmartWeb#hasReferer")
 
 type SmartServer struct {
 	Root    Entry
-	DataSet DataSet
+	Backend backend.Backend
 	auth    Authenticator
 }
 
-func CreateFileServer(path string, dataSet DataSet) *SmartServer {
+func CreateFileServer(path string, b backend.Backend) *SmartServer {
 	return &SmartServer{
 		Root:    CreateFSEntry(path),
-		DataSet: dataSet,
+		Backend: b,
 		auth:    CreateAuthenticator(),
 	}
 }
@@ -159,31 +158,50 @@ func (server SmartServer) serveRDFGraph(res http.ResponseWriter, req *http.Reque
 	var graphURL url.URL = *curUrl
 	graph := sparql.IRILiteral(graphURL.String())
 	q := `CONSTRUCT { ?s ?p ?o } WHERE { GRAPH ` + graph + ` { ?s ?p ?o } . }`
-	data, content_type, err, status := server.DataSet.QueryGraph(q, curUrl.String(), splitHeader(req.Header.Get("Accept")))
+	triples, err := server.Backend.Construct(q)
 	if err != nil {
 		res.Header().Set("Content-Type", "text/plain")
-		res.WriteHeader(status)
+		res.WriteHeader(http.StatusInternalServerError)
 		res.Write([]byte(err.Error()))
-	} else {
-		res.Header().Set("Content-Type", content_type)
-		res.Header().Add("Vary", "Accept")
-		res.WriteHeader(status)
-		res.Write(data)
+		return
+	}
+	writeTurtle(res, curUrl, triples)
+}
+
+func writeTurtle(res http.ResponseWriter, base *url.URL, triples []*nquads.Statement) {
+	res.Header().Set("Content-Type", "text/turtle")
+	res.Header().Add("Vary", "Accept")
+	res.WriteHeader(http.StatusOK)
+	w := turtle.NewWriter(res, turtle.DefaultPrefixes)
+	w.Base = base.String()
+	if err := w.WriteStatements(triples); err != nil {
+		log.Println(err)
 	}
 }
 
 func (server SmartServer) serveRDFQuery(res http.ResponseWriter, req *http.Request, curUrl *url.URL, query string) {
 	log.Printf("RDF QUERY <%s>: %s\n", curUrl.String(), query)
-	data, content_type, err, status := server.DataSet.QueryGraph(query, curUrl.String(), splitHeader(req.Header.Get("Accept")))
+	var triples []*nquads.Statement
+	var result *sparql.Response
+	var err error
+	switch backend.QueryForm(query) {
+	case "CONSTRUCT", "DESCRIBE":
+		triples, err = server.Backend.Construct(query)
+	default:
+		result, err = server.Backend.Select(query)
+	}
 	if err != nil {
 		res.Header().Set("Content-Type", "text/plain")
-		res.WriteHeader(status)
+		res.WriteHeader(http.StatusBadRequest)
 		res.Write([]byte(err.Error()))
+	} else if result == nil {
+		writeTurtle(res, curUrl, triples)
 	} else {
-		res.Header().Set("Content-Type", content_type)
-		res.Header().Add("Vary", "Accept")
-		res.WriteHeader(status)
-		res.Write(data)
+		res.Header().Set("Content-Type", "application/sparql-results+json")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(result); err != nil {
+			log.Println(err)
+		}
 	}
 }
 
@@ -257,7 +275,10 @@ func (server SmartServer) ServeHTTP(res http.ResponseWriter, req *http.Request)
 		}
 		// Add the referrer in storage
 		log.Printf("Add quad: %v %v %v %v\n", &context, curUrl, SmartWeb_hasReferer, referrer)
-		err = server.DataSet.AddQuad(&context, curUrl, SmartWeb_hasReferer, referrer)
+		quad, err := backend.Quad(&context, curUrl, SmartWeb_hasReferer, referrer)
+		if err == nil {
+			err = server.Backend.AddQuads(quad)
+		}
 		if err != nil {
 			log.Println(err)
 		}
@@ -0,0 +1,83 @@
+package server2
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Lifetime of a cached ACL decision, for the changes made to the store
+	// without going through the server
+	aclCacheTTL = 30 * time.Second
+	// Maximum number of cached decisions, the cache is emptied when full
+	aclCacheSize = 10000
+)
+
+type aclKey struct {
+	page, actions, user string
+}
+
+type aclEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+// Cache of the ACL decisions by page, actions and user, and of the WebID
+// verifications, emptied when the server changes a graph that may hold ACL or
+// a WebID profile
+type aclCache struct {
+	mu         sync.Mutex
+	entries    map[aclKey]aclEntry
+	generation uint64
+}
+
+func newACLCache() *aclCache {
+	return &aclCache{entries: make(map[aclKey]aclEntry)}
+}
+
+func newACLKey(page string, actions []string, user string) aclKey {
+	return aclKey{page, strings.Join(actions, " "), user}
+}
+
+// Cached decision and the current generation, to pass to set
+func (c *aclCache) get(key aclKey, now time.Time) (allow, ok bool, generation uint64) {
+	if c == nil {
+		return false, false, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return e.allow, ok, c.generation
+}
+
+// Cache a decision until expires, unless the cache was invalidated since the
+// generation was read
+func (c *aclCache) set(key aclKey, allow bool, expires time.Time, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= aclCacheSize {
+		c.entries = make(map[aclKey]aclEntry)
+	}
+	c.entries[key] = aclEntry{allow, expires}
+}
+
+func (c *aclCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[aclKey]aclEntry)
+	c.generation++
+}
@@ -3,69 +3,380 @@ package server2
 import (
 	"crypto/sha256"
 	"crypto/x509"
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/nquads"
 	"github.com/mildred/SmartWeb/sparql"
+	"mime"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
-func checkAuth(dataSet *sparql.Client, u *url.URL, method, user string) (bool, error) {
-	var parentChain string
-	var defaultGraph []string
-	for _, url := range urlParents(u) {
-		parentChain = parentChain + sparql.MakeQuery(" %1u", url.String())
-		defaultGraph = append(defaultGraph, sparql.MakeQuery("FROM %1u", url.String()))
+const (
+	SmartWeb_ACL       = "tag:mildred.fr,2015-05:SmartWeb#ACL"
+	SmartWeb_about     = "tag:mildred.fr,2015-05:SmartWeb#about"
+	SmartWeb_user      = "tag:mildred.fr,2015-05:SmartWeb#user"
+	SmartWeb_allow     = "tag:mildred.fr,2015-05:SmartWeb#allow"
+	SmartWeb_deny      = "tag:mildred.fr,2015-05:SmartWeb#deny"
+	SmartWeb_inherit   = "tag:mildred.fr,2015-05:SmartWeb#inherit"
+	SmartWeb_override  = "tag:mildred.fr,2015-05:SmartWeb#override"
+	SmartWeb_notBefore = "tag:mildred.fr,2015-05:SmartWeb#notBefore"
+	SmartWeb_expires   = "tag:mildred.fr,2015-05:SmartWeb#expires"
+	SmartWeb_Default   = "tag:mildred.fr,2015-05:SmartWeb#Default"
+	SmartWeb_Read      = "tag:mildred.fr,2015-05:SmartWeb#Read"
+	SmartWeb_Write     = "tag:mildred.fr,2015-05:SmartWeb#Write"
+	SmartWeb_Anonymous = "tag:mildred.fr,2015-05:SmartWeb#Anonymous"
+	rdf_type           = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+	rdfs_label         = "http://www.w3.org/2000/01/rdf-schema#label"
+
+	// ACL action required to manage the users of a page
+	aclAction = "ACL"
+)
+
+// Predicates of the ACL vocabulary, only written by the clients allowed the ACL
+// action on the page
+var aclPredicates = map[string]bool{
+	SmartWeb_about:     true,
+	SmartWeb_user:      true,
+	SmartWeb_allow:     true,
+	SmartWeb_deny:      true,
+	SmartWeb_inherit:   true,
+	SmartWeb_override:  true,
+	SmartWeb_notBefore: true,
+	SmartWeb_expires:   true,
+}
+
+// Check if a statement belongs to the ACL vocabulary
+func isACLStatement(st *nquads.Statement) bool {
+	if st.Predicate() == rdf_type {
+		o, ok := st.ObjectIri()
+		return ok && o == SmartWeb_ACL
+	}
+	return aclPredicates[st.Predicate()]
+}
+
+// Rule of a sw:ACL node about a page of the parent chain
+type aclRule struct {
+	node string
+	// Position of the page in the parent chain
+	page int
+	// The page is the requested resource, not one of its parents
+	self     bool
+	allow    bool
+	action   string
+	inherit  bool
+	override bool
+}
+
+// Node of the ACL graph: a sw:ACL node or a group, with its members and its
+// validity
+type aclNode struct {
+	users     []string
+	notBefore time.Time
+	expires   time.Time
+	// A time bound could not be parsed, the node is never valid
+	invalid bool
+}
+
+func (n *aclNode) valid(now time.Time) bool {
+	return n == nil || !n.invalid &&
+		(n.notBefore.IsZero() || !now.Before(n.notBefore)) &&
+		(n.expires.IsZero() || now.Before(n.expires))
+}
+
+// Actions of a request from the most to the least specific: its method and
+// its class. The SPARQL queries are reads even when posted.
+func requestActions(req *http.Request) []string {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return []string{req.Method, SmartWeb_Read}
+	case "POST":
+		mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediatype == "application/sparql-query" || mediatype == "application/x-www-form-urlencoded" {
+			return []string{req.Method, SmartWeb_Read}
+		}
+	}
+	return []string{req.Method, SmartWeb_Write}
+}
+
+// ACL statement read from a graph
+type aclRow struct {
+	graph string
+	page  string
+	rule  aclRule
+	// Node statement
+	node      string
+	user      string
+	notBefore string
+	expires   string
+}
+
+// Graphs holding the ACL of a page given its parent chain: the graphs of the
+// page and its parents, and their users graphs
+func aclGraphs(parents []url.URL) []string {
+	var graphs []string
+	for _, p := range parents {
+		graphs = append(graphs, p.String())
+		if p.RawQuery == "" && p.Fragment == "" {
+			graphs = append(graphs, usersGraph(&p).String())
+		}
 	}
+	return graphs
+}
 
-	res, err := dataSet.Select(sparql.MakeQuery(`
+// Check if the user may perform the actions on each page, see resolveAuth.
+// The ACL of a page are read from the graphs of the page and its parents and
+// from their users graphs, with two queries for all the pages. A rule is only
+// read from the graphs of the page it is about. Also returns
+// the next time a decision can change because of a time bound, zero if none.
+func checkAuth(b backend.Backend, pages []*url.URL, actions []string, user string, now time.Time) ([]bool, time.Time, error) {
+	allowed := make([]bool, len(pages))
+	chains := make([][]url.URL, len(pages))
+	seenGraphs, seenParents := make(map[string]bool), make(map[string]bool)
+	var graphs, parents []string
+	for i, u := range pages {
+		chains[i] = urlParents(u)
+		for _, g := range aclGraphs(chains[i]) {
+			if !seenGraphs[g] {
+				seenGraphs[g] = true
+				graphs = append(graphs, g)
+			}
+		}
+		for _, p := range chains[i] {
+			if !seenParents[p.String()] {
+				seenParents[p.String()] = true
+				parents = append(parents, sparql.MakeQuery("%1u", p.String()))
+			}
+		}
+	}
+	var from []string
+	for _, g := range graphs {
+		from = append(from, sparql.MakeQuery("FROM NAMED %1u", g))
+	}
+
+	res, err := b.Select(sparql.MakeQuery(`
 		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 
-		SELECT ?page ?acl ?user ?auth ?act
+		SELECT ?g ?page ?acl ?auth ?act ?inherit ?override
 		%1q
 		WHERE {
 			VALUES ?page { %2q }
-			?acl
-				a        sw:ACL ;
-				sw:about ?page ;
-				sw:user+ ?user ;
-				?auth    ?act .
-			VALUES ?user { %4u sw:Anonymous }
 			VALUES ?auth { sw:allow sw:deny }
-			VALUES ?act { %3s sw:Default }
+			GRAPH ?g {
+				?acl
+					a        sw:ACL ;
+					sw:about ?page ;
+					?auth    ?act .
+				OPTIONAL { ?acl sw:inherit ?inherit }
+				OPTIONAL { ?acl sw:override ?override }
+			}
 		}
-	`, strings.Join(defaultGraph, "\n		"), parentChain, method, user))
+	`, strings.Join(from, "\n		"), strings.Join(parents, " ")))
 	if err != nil {
-		return false, err
+		return nil, time.Time{}, err
+	}
+	var rules []aclRow
+	for _, binding := range res.Results.Bindings {
+		rules = append(rules, aclRow{
+			graph: binding["g"].Value,
+			page:  binding["page"].Value,
+			rule: aclRule{
+				node:     binding["acl"].Value,
+				allow:    binding["auth"].Value == SmartWeb_allow,
+				action:   binding["act"].Value,
+				inherit:  binding["inherit"].Value != "false",
+				override: binding["override"].Value == "true",
+			},
+		})
 	}
+	if len(rules) == 0 {
+		return allowed, time.Time{}, nil
+	}
+
+	res, err = b.Select(sparql.MakeQuery(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 
-	var firstPage string = ""
-	var defaultAuth, actionAuth, auth string
+		SELECT ?g ?node ?user ?notBefore ?expires
+		%1q
+		WHERE {
+			GRAPH ?g {
+				{ ?node sw:user ?user }
+				UNION { ?node sw:notBefore ?notBefore }
+				UNION { ?node sw:expires ?expires }
+			}
+		}
+	`, strings.Join(from, "\n		")))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var nodeRows []aclRow
+	var until time.Time
 	for _, binding := range res.Results.Bindings {
-		if firstPage != "" && firstPage != binding["page"].Value {
-			break
-		}
-		firstPage = binding["page"].Value
-		auth := binding["auth"].Value
-		act := binding["act"].Value
-		if act == "tag:mildred.fr,2015-05:SmartWeb#Default" {
-			if defaultAuth != "" && defaultAuth != auth {
-				defaultAuth = "deny"
-			} else {
-				defaultAuth = auth
+		row := aclRow{
+			graph:     binding["g"].Value,
+			node:      binding["node"].Value,
+			user:      binding["user"].Value,
+			notBefore: binding["notBefore"].Value,
+			expires:   binding["expires"].Value,
+		}
+		for _, bound := range []string{row.notBefore, row.expires} {
+			if t, err := time.Parse(time.RFC3339, bound); err == nil && t.After(now) && (until.IsZero() || t.Before(until)) {
+				until = t
 			}
-		} else {
-			if actionAuth != "" && actionAuth != auth {
-				actionAuth = "deny"
-			} else {
-				actionAuth = auth
+		}
+		nodeRows = append(nodeRows, row)
+	}
+
+	for i, u := range pages {
+		index := make(map[string]int)
+		for j := len(chains[i]) - 1; j >= 0; j-- {
+			index[chains[i][j].String()] = j
+		}
+
+		// A rule is only honored in the graphs of the page it is about, so
+		// that writing a graph of the chain does not give rights on the
+		// other pages
+		var pageRules []aclRule
+		ruleGraphs := make(map[string]bool)
+		for _, row := range rules {
+			j, ok := index[row.page]
+			if !ok || !ownGraph(row.graph, chains[i][j]) {
+				continue
 			}
+			r := row.rule
+			r.page, r.self = j, chains[i][j].Path == u.Path
+			pageRules = append(pageRules, r)
+			ruleGraphs[row.graph] = true
+		}
+		nodes := make(map[string]*aclNode)
+		for _, row := range nodeRows {
+			if g := userGraph(row.node); g != "" && row.graph == g || g == "" && ruleGraphs[row.graph] {
+				row.addTo(nodes)
+			}
+		}
+		allowed[i] = resolveAuth(pageRules, nodes, user, actions, now)
+	}
+	return allowed, until, nil
+}
+
+// Check that a graph is the graph of a page or its users graph
+func ownGraph(graph string, page url.URL) bool {
+	for _, g := range aclGraphs([]url.URL{page}) {
+		if g == graph {
+			return true
 		}
 	}
-	if actionAuth != "" {
-		auth = actionAuth
-	} else {
-		auth = defaultAuth
+	return false
+}
+
+// Users graph holding a user IRI <page?users=id>, empty for the other nodes.
+// The members and validity of a user are only read from this graph, those of
+// the other nodes from the graphs of the rules.
+func userGraph(node string) string {
+	u, err := url.Parse(node)
+	if err != nil || u.Scheme == "" || !strings.HasPrefix(u.RawQuery, "users=") {
+		return ""
+	}
+	return usersGraph(u).String()
+}
+
+func (row aclRow) addTo(nodes map[string]*aclNode) {
+	n := nodes[row.node]
+	if n == nil {
+		n = &aclNode{}
+		nodes[row.node] = n
+	}
+	if row.user != "" {
+		n.users = append(n.users, row.user)
+	}
+	for _, bound := range []struct {
+		value string
+		t     *time.Time
+	}{{row.notBefore, &n.notBefore}, {row.expires, &n.expires}} {
+		if bound.value != "" {
+			t, err := time.Parse(time.RFC3339, bound.value)
+			*bound.t = t
+			n.invalid = n.invalid || err != nil
+		}
+	}
+}
+
+// Check if a rule applies to the user, directly or as a member of a group.
+// Groups are the nodes with sw:user members, including other sw:ACL nodes, and
+// can be nested. Expired groups are ignored. sw:Anonymous matches any user.
+func (n *aclNode) hasMember(nodes map[string]*aclNode, user string, now time.Time, seen map[*aclNode]bool) bool {
+	if n == nil || seen[n] || !n.valid(now) {
+		return false
+	}
+	seen[n] = true
+	for _, u := range n.users {
+		if u == user || u == SmartWeb_Anonymous || nodes[u].hasMember(nodes, user, now, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide if the user may perform the action, given from the most to the least
+// specific (such as PUT and sw:Write), sw:Default is always last:
+//
+//  1. The rules considered are about the requested page or its parents,
+//     valid at the time, and apply to the user directly or through groups.
+//     The rules with sw:inherit false only apply to their own page.
+//  2. The rules with sw:override true come first, from the root down to the
+//     requested page, then the other rules from the requested page up to the
+//     root. The first page with a rule for one of the actions decides.
+//  3. On a page, the rules for the most specific action decide, and deny
+//     wins over allow.
+//  4. Without any rule, the action is denied.
+func resolveAuth(rules []aclRule, nodes map[string]*aclNode, user string, actions []string, now time.Time) bool {
+	actions = append(actions[:len(actions):len(actions)], SmartWeb_Default)
+	specificity := func(action string) int {
+		for i, a := range actions {
+			if a == action {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// Best rule on each page: lowest specificity, deny preferred
+	type decision struct {
+		specificity int
+		allow       bool
+	}
+	var overrides, normal = map[int]decision{}, map[int]decision{}
+	maxPage := 0
+	for _, r := range rules {
+		s := specificity(r.action)
+		if s < 0 || !r.self && !r.inherit || !nodes[r.node].hasMember(nodes, user, now, map[*aclNode]bool{}) {
+			continue
+		}
+		decisions := normal
+		if r.override {
+			decisions = overrides
+		}
+		d, ok := decisions[r.page]
+		if !ok || s < d.specificity || s == d.specificity && !r.allow {
+			decisions[r.page] = decision{s, r.allow}
+		}
+		if r.page > maxPage {
+			maxPage = r.page
+		}
+	}
+
+	for page := maxPage; page >= 0; page-- {
+		if d, ok := overrides[page]; ok {
+			return d.allow
+		}
+	}
+	for page := 0; page <= maxPage; page++ {
+		if d, ok := normal[page]; ok {
+			return d.allow
+		}
 	}
-	return auth == "tag:mildred.fr,2015-05:SmartWeb#allow", nil
+	return false
 }
 
 func SHA256Fingerprint(cert x509.Certificate) []byte {
@@ -1,7 +1,6 @@
 package server2
 
 import (
-	"archive/zip"
 	"github.com/mildred/SmartWeb/bundle"
 	"github.com/mildred/SmartWeb/nquads"
 	"github.com/mildred/SmartWeb/sparql"
@@ -15,7 +14,9 @@ import (
 	"strings"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"log"
+	"mime"
 	"time"
 )
 
@@ -24,104 +25,156 @@ func (server SmartServer) handlePOSTBundle(u *url.URL, res http.ResponseWriter,
 	start_time := time.Now()
 	log.Println("POST Bundle")
 	
-	f, err := ioutil.TempFile(server.Root, "temp:")
-	if err != nil {
-		handleError(res, 500, err.Error())
-		return
-	}
-	defer f.Close()
+	mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
 	
-	_, err = io.Copy(f, req.Body)
-	if err != nil {
-		handleError(res, 500, err.Error())
+	var b *bundle.Reader
+	var err error
+	if mediatype == bundle.MimeType {
+		// ZIP files need random access to read the central directory
+		f, err := ioutil.TempFile(server.Root, tempPrefix)
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		
+		size, err := io.Copy(f, req.Body)
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		
+		b, err = bundle.NewReader(f, size)
+		if err != nil {
+			handleError(res, 400, err.Error())
+			return
+		}
+	} else if mediatype == bundle.TarMimeType {
+		// tar bundles are streamed from the request body
+		b, err = bundle.NewTarReader(req.Body)
+		if err != nil {
+			handleError(res, 400, err.Error())
+			return
+		}
+	} else {
+		handleError(res, 400, fmt.Sprintf("Expected payload with type %s or %s", bundle.MimeType, bundle.TarMimeType))
 		return
 	}
 	
 	after_download := time.Now()
 	duration_download := after_download.Sub(start_time)
 	
-	_, err = f.Seek(0, 0)
-	if err != nil {
-		handleError(res, 500, err.Error())
-		return
-	}
-	
-	if req.Header.Get("Content-Type") != bundle.MimeType {
-		handleError(res, 400, fmt.Sprintf("Expected payload with type %s", bundle.MimeType))
-		return
-	}
-	
-	b, err := bundle.NewReader(f, req.ContentLength)
-	if err != nil {
-		handleError(res, 500, err.Error())
-		return
-	}
-	
-	before_read_graph := time.Now()
-	log.Println("POST Bundle: read Graph")
+	log.Println("POST Bundle: read files")
 	
-	statements, wantedHashes, logs, err := makeStatements(u, b.GraphStatements(0))
-	if err != nil {
-		handleError(res, 400, err.Error())
-		return
-	}
+	var statements string
+	var wantedHashes map[string]bool
+	var logs []string
+	var aclPages []*url.URL
+	var hasGraph bool
+	var duration_statements_creation, duration_copy_files time.Duration
 	
-	after_read_graph := time.Now()
-	duration_statements_creation := after_read_graph.Sub(before_read_graph)
-	log.Println("POST Bundle: read ZIP file")
+	// Files stored before graphs.nq was read, to remove if not wanted
+	var unchecked []string
+	// Files created by the request, removed if it fails
+	var created []string
+	success := false
+	defer func() {
+		if ! success {
+			for _, hash := range created {
+				os.Remove(path.Join(server.Root, hash))
+			}
+		}
+	}()
 	
-	for _, zipfile := range b.Reader.File {
-		if strings.HasPrefix(zipfile.Name, "sha1:") {
-			hash, err := getBundleSHA1(zipfile)
+	for {
+		file, err := b.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			handleError(res, 400, err.Error())
+			return
+		}
+		
+		if file.Name == "graphs.nq" {
+			before_read_graph := time.Now()
+			log.Println("POST Bundle: read Graph")
+			
+			statements, wantedHashes, logs, aclPages, err = makeStatements(u, bundle.Statements(b.GraphReader(file), 0))
 			if err != nil {
-				handleError(res, 500, err.Error())
+				handleError(res, 400, err.Error())
 				return
 			}
-			if ! wantedHashes[hash] {
+			
+			hasGraph = true
+			duration_statements_creation += time.Since(before_read_graph)
+		} else if strings.HasPrefix(file.Name, "sha1:") {
+			if hasGraph && ! wantedHashes[file.Name] {
 				continue
 			}
 			
-			zf, err := zipfile.Open()
-			if err != nil {
-				handleError(res, 500, err.Error())
-				return
-			}
-			defer zf.Close()
+			before_copy := time.Now()
 			
-			f, err := ioutil.TempFile(server.Root, "temp:")
-			if err != nil {
+			_, err := os.Stat(path.Join(server.Root, file.Name))
+			existed := err == nil
+			
+			err = server.storeBundleFile(file)
+			if errors.Is(err, errBundleHash) {
+				handleError(res, 400, err.Error())
+				return
+			} else if err != nil {
 				handleError(res, 500, err.Error())
 				return
 			}
-			defer f.Close()
 			
-			_, err = io.Copy(f, zf)
-			if err != nil {
-				go os.Remove(f.Name())
-				handleError(res, 500, err.Error())
-				return
+			if ! existed {
+				created = append(created, file.Name)
+				if ! hasGraph {
+					unchecked = append(unchecked, file.Name)
+				}
 			}
 			
-			err = os.Rename(f.Name(), path.Join(server.Root, hash))
-			if err != nil {
-				go os.Remove(f.Name())
-				handleError(res, 500, err.Error())
+			duration_copy_files += time.Since(before_copy)
+		}
+	}
+	
+	if ! hasGraph {
+		handleError(res, 400, bundle.ErrNoGraph.Error())
+		return
+	}
+	
+	// Writing users graphs or ACL statements requires the ACL action
+	if server.useAcl && len(aclPages) > 0 {
+		allowed, err := server.allowedPages(req, aclPages, aclAction)
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		for i, page := range aclPages {
+			if ! allowed[i] && ! server.authorize(res, req, page, aclAction) {
 				return
 			}
 		}
 	}
 	
+	for _, hash := range unchecked {
+		if ! wantedHashes[hash] {
+			os.Remove(path.Join(server.Root, hash))
+		}
+	}
+	
 	after_copy_files := time.Now()
-	duration_copy_files := after_copy_files.Sub(after_read_graph)
 	log.Println("POST Bundle: written all files")
 	
 	log.Println(strings.Join(logs, "\n"))
 	
-	_, err = server.dataSet.Update(string(statements))
+	err = server.backend.Update(string(statements))
+	server.acl.invalidate()
 	if err != nil {
 		handleError(res, 500, err.Error())
 		return
 	}
+	success = true
 	
 	after_update := time.Now()
 	duration_update := after_update.Sub(after_copy_files)
@@ -143,18 +196,37 @@ func (server SmartServer) handlePOSTBundle(u *url.URL, res http.ResponseWriter,
 	log.Printf("POST Bundle: response %d %v\n", n, err)
 }
 
-func getBundleSHA1(zipfile *zip.File) (string, error) {
-	h := sha1.New()
-	f, err := zipfile.Open()
+var errBundleHash = errors.New("Bundle file content does not match its name")
+
+// Store a file from the bundle in the root directory, the file name must match
+// its SHA1 hash.
+func (server SmartServer) storeBundleFile(file *bundle.File) error {
+	f, err := ioutil.TempFile(server.Root, tempPrefix)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(h, f)
+	
+	h := sha1.New()
+	_, err = io.Copy(f, io.TeeReader(file, h))
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	
+	hash := "sha1:" + strings.ToLower(hex.EncodeToString(h.Sum([]byte{})))
+	if hash != file.Name {
+		os.Remove(f.Name())
+		return fmt.Errorf("%w: %s has hash %s", errBundleHash, file.Name, hash)
+	}
+	
+	err = os.Rename(f.Name(), path.Join(server.Root, hash))
 	if err != nil {
-		return "", err
+		os.Remove(f.Name())
+		return err
 	}
-	return "sha1:" + strings.ToLower(hex.EncodeToString(h.Sum([]byte{}))), nil
+	
+	return nil
 }
 
 var RdfNamespace   = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
@@ -179,15 +251,46 @@ func isSubUrl(base, u *url.URL) bool {
 	return strings.HasPrefix(u.Path, basePath)
 }
 
-func makeStatements(baseUri *url.URL, ch <-chan interface{}) (string, map[string]bool, []string, error) {
+// Page whose ACL action is required to write the ACL of a graph: the graph IRI
+// without query
+func aclPage(graphUri *url.URL) *url.URL {
+	page := *graphUri
+	page.RawQuery = ""
+	page.Fragment = ""
+	return &page
+}
+
+// Check if a graph IRI is a users graph or the IRI of a user, written with the
+// ACL action only
+func isUsersGraph(graphUri *url.URL) bool {
+	return graphUri.RawQuery == "users" || strings.HasPrefix(graphUri.RawQuery, "users=")
+}
+
+// Make the SPARQL update of the bundle graphs. Also returns the hashes of the
+// files to store, the logs, and the pages whose ACL are written: the pages of
+// the users graphs and of the graphs with ACL statements.
+func makeStatements(baseUri *url.URL, ch <-chan interface{}) (string, map[string]bool, []string, []*url.URL, error) {
 	graphsRelUri := make(map[string]*url.URL)
 	var drop, ins inserter
 	var logs []string
 	var wantedHashes map[string]bool = make(map[string]bool)
+	var aclPages []*url.URL
+	seenACLPages := make(map[string]bool)
+	addACLPage := func(graphUri *url.URL) {
+		page := aclPage(graphUri)
+		if !seenACLPages[page.String()] {
+			seenACLPages[page.String()] = true
+			aclPages = append(aclPages, page)
+		}
+	}
 	for value := range ch {
+		if skipped, ok := value.(bundle.SkippedLine); ok {
+			logs = append(logs, fmt.Sprintf("Skipped graphs.nq %s", skipped.Error()))
+			continue
+		}
 		st, is_st := value.(*nquads.Statement)
 		if !is_st {
-			return "", wantedHashes, logs, value.(error)
+			return "", wantedHashes, logs, nil, value.(error)
 		}
 		
 		graph, has_graph := st.Graph()
@@ -198,19 +301,25 @@ func makeStatements(baseUri *url.URL, ch <-chan interface{}) (string, map[string
 			graphUri, err := baseUri.Parse(relUri)
 			if err != nil {
 				logs = append(logs, fmt.Sprintf(
-					"Could not insert graph <%s>, its URI <%> is cannot be parsed: %s",
+					"Could not insert graph <%s>, its URI <%s> is cannot be parsed: %s",
 					graph, relUri, err.Error()))
 				continue
 			}
 			if ! isSubUrl(baseUri, graphUri) {
 				logs = append(logs, fmt.Sprintf(
-					"Could not insert graph <%s>, its URI <%> is outside of out base <%s>",
+					"Could not insert graph <%s>, its URI <%s> is outside of out base <%s>",
 					graph, relUri, baseUri.String()))
 				continue
 			}
 			graphsRelUri[graph] = graphUri
+			if isUsersGraph(graphUri) {
+				addACLPage(graphUri)
+			}
 			drop.deleteGraph(graphUri)
 		} else if graphUri, ok := graphsRelUri[graph]; has_graph && ok && graphUri != nil {
+			if isACLStatement(st) {
+				addACLPage(graphUri)
+			}
 			if st.Predicate() == SwHash {
 				hash, is_hash := st.ObjectIri()
 				if is_hash {
@@ -264,7 +373,7 @@ func makeStatements(baseUri *url.URL, ch <-chan interface{}) (string, map[string
 		statements += "\n"
 	}
 	statements += ins.terminate()
-	return statements, wantedHashes, logs, nil
+	return statements, wantedHashes, logs, aclPages, nil
 }
 
 
@@ -0,0 +1,100 @@
+package server2
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Serve the certificate revocation list of the client CA on ?crl, and revoke
+// the PEM certificates posted there. Certificates can be revoked by their
+// holder, or by the users allowed the ACL action on the root of the site.
+func (server SmartServer) handleCRL(u *url.URL, res http.ResponseWriter, req *http.Request) {
+	if server.ClientCA == nil {
+		handleError(res, 404, "No client certificate authority")
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		crl, err := server.ClientCA.CRL()
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/pkix-crl")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(http.StatusOK)
+		if req.Method != "HEAD" {
+			res.Write(crl)
+		}
+	case "POST":
+		server.handlePOSTCRL(res, req)
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server SmartServer) handlePOSTCRL(res http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxRequestSize))
+	if err != nil {
+		handleError(res, 400, err.Error())
+		return
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			handleError(res, 400, err.Error())
+			return
+		}
+		if cert.IsCA {
+			// Chain returned on ?enroll
+			continue
+		}
+		if !server.ClientCA.Issued(cert) {
+			handleError(res, 400, "Certificate "+cert.SerialNumber.String()+" not issued by the client certificate authority")
+			return
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		handleError(res, 400, "No PEM certificate to revoke")
+		return
+	}
+
+	if server.useAcl && !presented(req, certs) {
+		root := server.requestUrl(&http.Request{URL: &url.URL{Path: "/"}, Host: req.Host})
+		if !server.authorize(res, req, root, aclAction) {
+			return
+		}
+	}
+
+	for _, cert := range certs {
+		if err := server.ClientCA.Revoke(cert); err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// Check that the client authenticated with all the certificates. Only the
+// first peer certificate is proven by the handshake, the others are its chain.
+func presented(req *http.Request, certs []*x509.Certificate) bool {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	for _, cert := range certs {
+		if !bytes.Equal(req.TLS.PeerCertificates[0].Raw, cert.Raw) {
+			return false
+		}
+	}
+	return true
+}
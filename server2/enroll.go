@@ -0,0 +1,378 @@
+package server2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/mildred/SmartWeb/clientca"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Validity of the enrollment challenges
+	challengeLifetime = 10 * time.Minute
+	// Default and maximum validity of the issued certificates
+	defaultCertificateDays = 365
+	maxCertificateDays     = 3650
+	maxRequestSize         = 64 * 1024
+)
+
+// PKCS#9 challengePassword attribute of a certificate request
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+// CertificationRequestInfo (RFC 2986), parsed again as the standard library
+// ignores the attributes that are not sets of name attributes
+type tbsCertificateRequest struct {
+	Raw           asn1.RawContent
+	Version       int
+	Subject       asn1.RawValue
+	PublicKey     asn1.RawValue
+	RawAttributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+type csrAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// Challenge valid for a limited time to enroll on a page: its expiry time and
+// a random nonce, authenticated with the server enrollment key
+func (server SmartServer) newChallenge(page *url.URL) string {
+	payload := make([]byte, 24)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().Add(challengeLifetime).Unix()))
+	rand.Read(payload[8:])
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + server.challengeMac(page, payload)
+}
+
+func (server SmartServer) challengeMac(page *url.URL, payload []byte) string {
+	mac := hmac.New(sha256.New, server.EnrollKey)
+	mac.Write([]byte(page.String()))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (server SmartServer) checkChallenge(page *url.URL, challenge string) error {
+	parts := strings.Split(challenge, ".")
+	var payload []byte
+	var err error
+	if len(parts) == 2 {
+		payload, err = base64.RawURLEncoding.DecodeString(parts[0])
+	}
+	if len(parts) != 2 || err != nil || len(payload) != 24 || !hmac.Equal([]byte(parts[1]), []byte(server.challengeMac(page, payload))) {
+		return errors.New("Invalid challenge")
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(payload)) {
+		return errors.New("Expired challenge")
+	}
+	return nil
+}
+
+// Challenge password of a certificate request, empty if there is none
+func challengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs tbsCertificateRequest
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", err
+	}
+	for _, raw := range tbs.RawAttributes {
+		var attr csrAttribute
+		if _, err := asn1.Unmarshal(raw.FullBytes, &attr); err != nil {
+			return "", err
+		}
+		if !attr.Type.Equal(oidChallengePassword) || len(attr.Values) == 0 {
+			continue
+		}
+		var challenge string
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &challenge); err != nil {
+			return "", err
+		}
+		return challenge, nil
+	}
+	return "", nil
+}
+
+// Parse a PEM or DER PKCS#10 certificate request
+func parseCertificateRequest(data []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("Unexpected PEM block %s", block.Type)
+		}
+		data = block.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// Client certificate for the key of the request, with its common name only
+func (server SmartServer) issueCertificate(csr *x509.CertificateRequest, days int) ([]byte, error) {
+	serialNumber, err := clientca.SerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	switch csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	case *ecdsa.PublicKey:
+	default:
+		return nil, errors.New("Expect a RSA or ECDSA public key")
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: csr.Subject.CommonName,
+		},
+		NotBefore: now.Add(-1 * time.Hour),
+		NotAfter:  now.Add(time.Duration(days) * 24 * time.Hour),
+
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	return server.ClientCA.Issue(&template, csr.PublicKey)
+}
+
+// Register the holder of a new certificate as a user of the page without any
+// right. They are named after the certificate fingerprint, so that they never
+// share the rights of an existing user.
+func (server SmartServer) registerCertificate(page *url.URL, cert *x509.Certificate) (string, error) {
+	user := CertificateUser(cert)
+	id := "key-" + strings.TrimPrefix(user, certificateUserPrefix)
+	existing, err := server.getUser(page, id)
+	if err != nil || existing != nil {
+		return id, err
+	}
+	expires := cert.NotAfter.UTC().Truncate(time.Second)
+	return id, server.putUser(page, &User{
+		Id:           id,
+		Label:        cert.Subject.CommonName,
+		Expires:      &expires,
+		Certificates: []string{user},
+	})
+}
+
+func (server SmartServer) handlePOSTEnroll(page *url.URL, res http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxRequestSize))
+	if err != nil {
+		handleError(res, 400, err.Error())
+		return
+	}
+	csr, err := parseCertificateRequest(data)
+	if err != nil {
+		handleError(res, 400, err.Error())
+		return
+	}
+	challenge, err := challengePassword(csr)
+	if err != nil {
+		handleError(res, 400, err.Error())
+		return
+	}
+	if err := server.checkChallenge(page, challenge); err != nil {
+		handleError(res, 403, err.Error())
+		return
+	}
+
+	days := defaultCertificateDays
+	if d := req.URL.Query().Get("days"); d != "" {
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 1 || days > maxCertificateDays {
+			handleError(res, 400, fmt.Sprintf("days must be between 1 and %d", maxCertificateDays))
+			return
+		}
+	}
+
+	der, err := server.issueCertificate(csr, days)
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+	id, err := server.registerCertificate(page, cert)
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+
+	res.Header().Set("Location", userIri(page, id))
+	if strings.Contains(req.Header.Get("Accept"), "application/pkix-cert") {
+		res.Header().Set("Content-Type", "application/pkix-cert")
+		res.WriteHeader(http.StatusCreated)
+		res.Write(der)
+		return
+	}
+
+	// The certificate followed by its issuer, as expected by
+	// openssl pkcs12 -export -in
+	var chain bytes.Buffer
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: server.ClientCA.Certificate.Raw})
+	res.Header().Set("Content-Type", "application/x-pem-file")
+	res.WriteHeader(http.StatusCreated)
+	res.Write(chain.Bytes())
+}
+
+// Enroll a client on ?enroll: GET returns a page generating a key and a
+// certificate request in the browser, GET ?enroll=challenge a challenge for
+// requests made with other tools, and POST issues a client certificate for a
+// PKCS#10 request containing a valid challenge as challengePassword.
+//
+// With ACL, the challenges are only given to the users allowed the ACL action
+// on the page, who can invite others with a link to ?enroll=<challenge>.
+func (server SmartServer) handleEnroll(u *url.URL, res http.ResponseWriter, req *http.Request) {
+	page := *u
+	page.RawQuery = ""
+	page.Fragment = ""
+
+	if server.ClientCA == nil {
+		handleError(res, 404, "No client certificate authority")
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		res.Header().Set("Cache-Control", "no-store")
+		challenge := u.Query().Get("enroll")
+		if challenge == "" || challenge == "challenge" {
+			if server.useAcl && !server.authorize(res, req, &page, aclAction) {
+				return
+			}
+			challenge = server.newChallenge(&page)
+			if u.Query().Get("enroll") == "challenge" {
+				res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				res.Write([]byte(challenge + "\n"))
+				return
+			}
+		} else if err := server.checkChallenge(&page, challenge); err != nil {
+			handleError(res, 403, err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		enrollForm.Execute(res, challenge)
+	case "POST":
+		server.handlePOSTEnroll(&page, res, req)
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+var enrollForm = template.Must(template.New("enroll").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>Client certificate enrollment</title>
+	</head>
+	<body>
+		<form id="enroll">
+			<input type="text" name="name" placeholder="Common Name" required>
+			valid
+			<input type="number" name="days" value="365" min="1" max="3650">
+			days
+			<input type="submit" value="Generate">
+		</form>
+		<p>Save the private key and the certificate, then import them in the
+		browser after converting them with
+		<code>openssl pkcs12 -export -in cert.pem -inkey key.pem -out client-cert.p12</code></p>
+		<textarea id="key" rows="8" cols="66" readonly></textarea>
+		<textarea id="cert" rows="8" cols="66" readonly></textarea>
+		<p>With openssl, add <code>challengePassword = {{.}}</code> to the
+		request attributes and POST the PEM request here.</p>
+		<script>
+var challenge = {{.}}
+
+function derLength(n) {
+	if (n < 128) return [n]
+	var b = []
+	for (; n > 0; n >>= 8) b.unshift(n & 255)
+	return [0x80 | b.length].concat(b)
+}
+function der(tag) {
+	var content = [].concat.apply([], [].slice.call(arguments, 1))
+	return [tag].concat(derLength(content.length), content)
+}
+function derOid(s) {
+	var p = s.split(".").map(Number), b = [40 * p[0] + p[1]]
+	p.slice(2).forEach(function(n) {
+		var e = [n & 127]
+		for (n >>= 7; n > 0; n >>= 7) e.unshift(0x80 | (n & 127))
+		b = b.concat(e)
+	})
+	return der(0x06, b)
+}
+function derUtf8(s) { return der(0x0c, Array.from(new TextEncoder().encode(s))) }
+function derInteger(b) {
+	while (b.length > 1 && b[0] == 0 && b[1] < 128) b = b.slice(1)
+	return der(0x02, b[0] >= 128 ? [0].concat(b) : b)
+}
+function pem(type, bytes) {
+	var b64 = btoa(String.fromCharCode.apply(null, bytes)).replace(/.{64}/g, "$&\n")
+	return "-----BEGIN " + type + "-----\n" + b64.replace(/\n?$/, "\n") + "-----END " + type + "-----\n"
+}
+
+document.getElementById("enroll").onsubmit = async function(e) {
+	e.preventDefault()
+	var alg = {name: "ECDSA", namedCurve: "P-256", hash: "SHA-256"}
+	var key = await crypto.subtle.generateKey(alg, true, ["sign", "verify"])
+	var spki = Array.from(new Uint8Array(await crypto.subtle.exportKey("spki", key.publicKey)))
+	var info = der(0x30,
+		derInteger([0]),
+		der(0x30, der(0x31, der(0x30, derOid("2.5.4.3"), derUtf8(this.name.value)))),
+		spki,
+		der(0xa0, der(0x30, derOid("1.2.840.113549.1.9.7"), der(0x31, derUtf8(challenge)))))
+	var sig = new Uint8Array(await crypto.subtle.sign(alg, key.privateKey, new Uint8Array(info)))
+	var csr = der(0x30, info,
+		der(0x30, derOid("1.2.840.10045.4.3.2")),
+		der(0x03, [0], der(0x30, derInteger(Array.from(sig.slice(0, 32))), derInteger(Array.from(sig.slice(32))))))
+
+	var res = await fetch("?enroll&days=" + encodeURIComponent(this.days.value), {
+		method: "POST",
+		headers: {"Content-Type": "application/pkcs10"},
+		body: pem("CERTIFICATE REQUEST", csr)
+	})
+	if (!res.ok) {
+		alert(await res.text())
+		return
+	}
+	var pkcs8 = new Uint8Array(await crypto.subtle.exportKey("pkcs8", key.privateKey))
+	document.getElementById("key").value = pem("PRIVATE KEY", pkcs8)
+	document.getElementById("cert").value = await res.text()
+}
+		</script>
+	</body>
+</html>
+`))
@@ -0,0 +1,54 @@
+package server2
+
+import (
+	"encoding/json"
+	"github.com/mildred/SmartWeb/backend"
+	"log"
+	"net/http"
+	"time"
+)
+
+type health struct {
+	Backend   string `json:"backend"`
+	Reachable bool   `json:"reachable"`
+	Latency   string `json:"latency"`
+	Error     string `json:"error,omitempty"`
+}
+
+func backendName(b backend.Backend) string {
+	switch b.(type) {
+	case *backend.Embedded:
+		return "embedded"
+	case *backend.Sparql:
+		return "sparql"
+	}
+	return "other"
+}
+
+// Report if the storage backend answers queries, with status 503 if not. It is
+// not subject to ACL so that load balancers and monitoring can use it.
+func (server SmartServer) handleHealthz(res http.ResponseWriter, req *http.Request) {
+	h := health{Backend: backendName(server.backend)}
+	start := time.Now()
+	_, err := server.backend.Select("ASK {}")
+	h.Latency = time.Since(start).String()
+	if err != nil {
+		// The details of the backend are only logged, the callers are
+		// anonymous
+		log.Printf("Healthz: %v", err)
+		h.Error = "Backend unavailable"
+	} else {
+		h.Reachable = true
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-cache")
+	if h.Reachable {
+		res.WriteHeader(http.StatusOK)
+	} else {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if req.Method != "HEAD" {
+		json.NewEncoder(res).Encode(h)
+	}
+}
@@ -0,0 +1,272 @@
+package server2
+
+import (
+	"fmt"
+	"github.com/mildred/SmartWeb/jsonld"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/turtle"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var SmartWeb_hash = "tag:mildred.fr,2015-05:SmartWeb#hash"
+var SmartWeb_contentType = "tag:mildred.fr,2015-05:SmartWeb#contentType"
+var SmartWeb_child = "tag:mildred.fr,2015-05:SmartWeb#child"
+
+// Media types served on ?rdf, the first one is the default
+var rdfMediaTypes = []string{
+	jsonld.MediaType,
+	"text/turtle",
+	"application/trig",
+	"application/n-quads",
+	"application/n-triples",
+}
+
+// Choose the RDF serialization from the Accept header. Returns an empty media
+// type if none is acceptable.
+func negotiateRDF(accept string) (string, map[string]string) {
+	if strings.TrimSpace(accept) == "" {
+		return rdfMediaTypes[0], nil
+	}
+	var best string
+	var bestParams map[string]string
+	var bestQ float64
+	for _, value := range splitHeader(accept) {
+		mediatype, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qs, 64)
+			if err != nil {
+				continue
+			}
+		}
+		var match string
+		if mediatype == "*/*" || mediatype == "application/*" {
+			match = rdfMediaTypes[0]
+		} else {
+			for _, mt := range rdfMediaTypes {
+				if mt == mediatype {
+					match = mt
+				}
+			}
+		}
+		if match != "" && q > bestQ {
+			best, bestParams, bestQ = match, params, q
+		}
+	}
+	return best, bestParams
+}
+
+func (server SmartServer) handleGETRDF(u *url.URL, res http.ResponseWriter, req *http.Request) {
+	graph := *u
+	graph.RawQuery = ""
+
+	mediatype, params := negotiateRDF(req.Header.Get("Accept"))
+	res.Header().Set("Vary", "Accept")
+	if mediatype == "" {
+		handleError(res, http.StatusNotAcceptable, fmt.Sprintf("Supported media types: %s", strings.Join(rdfMediaTypes, ", ")))
+		return
+	}
+
+	triples, err := server.backend.Construct(sparql.MakeQuery(`
+		CONSTRUCT { ?s ?p ?o }
+		WHERE { GRAPH %1u { ?s ?p ?o } }
+	`, &graph))
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+	if len(triples) == 0 {
+		handleError(res, 404, "Not Found")
+		return
+	}
+
+	var quads []*nquads.Statement
+	for _, st := range triples {
+		quads = append(quads, nquads.NewStatement(st.SubjectNode(), st.PredicateNode(), st.ObjectNode(), nquads.NewIri(graph.String())))
+	}
+
+	// The Etag identifies the graph, not its serialization, hence weak. There
+	// is none when the graph is too complex to canonicalize.
+	if hash, err := nquads.DatasetHash(quads); err != nil {
+		log.Printf("%s: %v", graph.String(), err)
+	} else {
+		etag := fmt.Sprintf(`W/"sha256:%s"`, hash)
+		res.Header().Set("Etag", etag)
+		for _, match := range splitHeader(req.Header.Get("If-None-Match")) {
+			if match = strings.TrimSpace(match); match == "*" || strings.TrimPrefix(match, "W/") == strings.TrimPrefix(etag, "W/") {
+				res.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	res.Header().Set("Content-Type", mediatype)
+	res.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if err := writeRDF(res, mediatype, params, graph.String(), triples); err != nil {
+		log.Println(err)
+	}
+}
+
+// Serialize triples in a negotiated media type. If graph is set, the triples
+// belong to this graph and relative IRIs are made relative to it.
+func writeRDF(w io.Writer, mediatype string, params map[string]string, graph string, triples []*nquads.Statement) error {
+	quads := triples
+	if graph != "" {
+		quads = nil
+		for _, st := range triples {
+			quads = append(quads, nquads.NewStatement(st.SubjectNode(), st.PredicateNode(), st.ObjectNode(), nquads.NewIri(graph)))
+		}
+	}
+
+	switch mediatype {
+	case jsonld.MediaType:
+		var ctx *jsonld.Context
+		if params["profile"] != jsonld.ProfileExpanded {
+			ctx = jsonld.NewSmartWebContext(graph)
+		}
+		return jsonld.Encode(w, triples, ctx)
+	case "text/turtle":
+		tw := turtle.NewWriter(w, turtle.DefaultPrefixes)
+		tw.Base = graph
+		return tw.WriteStatements(triples)
+	case "application/trig":
+		return turtle.NewTriGWriter(w, turtle.DefaultPrefixes).WriteStatements(quads)
+	case "application/n-quads":
+		return writeStatements(w, quads)
+	case "application/n-triples":
+		return writeStatements(w, triples)
+	}
+	return nil
+}
+
+func writeStatements(w io.Writer, statements []*nquads.Statement) error {
+	for _, st := range statements {
+		if _, err := fmt.Fprintln(w, st.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse the request body according to its content type
+func readRDF(req *http.Request, base string) ([]*nquads.Statement, error) {
+	return parseRDF(req.Body, req.Header.Get("Content-Type"), base)
+}
+
+func parseRDF(body io.Reader, contentType, base string) ([]*nquads.Statement, error) {
+	mediatype, _, _ := mime.ParseMediaType(contentType)
+	switch mediatype {
+	case jsonld.MediaType, "application/json":
+		return jsonld.Decode(body, base)
+	case "text/turtle":
+		return turtle.NewReader(body, base).ReadAll()
+	case "application/trig":
+		return turtle.NewTriGReader(body, base).ReadAll()
+	case "application/n-triples":
+		r := nquads.NewReader(body)
+		r.Triples = true
+		return r.ReadAll()
+	case "application/n-quads":
+		return nquads.NewReader(body).ReadAll()
+	default:
+		return nil, errUnsupportedMediaType
+	}
+}
+
+var errUnsupportedMediaType = fmt.Errorf("Supported media types: %s", strings.Join(rdfMediaTypes, ", "))
+
+// Replace the metadata of a page. The statements managed by the server (the
+// page hash and the sw:child hierarchy) are kept, and so is the content type
+// unless a new one is provided.
+func (server SmartServer) handlePUTRDF(u *url.URL, res http.ResponseWriter, req *http.Request) {
+	graph := *u
+	graph.RawQuery = ""
+	graphIri := graph.String()
+
+	statements, err := readRDF(req, graphIri)
+	if err == errUnsupportedMediaType {
+		handleError(res, http.StatusUnsupportedMediaType, err.Error())
+		return
+	} else if err != nil {
+		handleError(res, 400, err.Error())
+		return
+	}
+
+	// Without the ACL action, the ACL statements of the graph are kept and
+	// none can be written
+	manageACL := true
+	if server.useAcl {
+		manageACL, err = server.allowed(req, &graph, aclAction)
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+	}
+
+	var data []string
+	var hasContentType bool
+	for _, st := range statements {
+		if g, ok := st.GraphNode().(*nquads.IriNode); st.GraphNode() != nil && (!ok || g.Iri() != graphIri) {
+			handleError(res, 400, fmt.Sprintf("Statement outside of graph <%s>: %s", graphIri, st.String()))
+			return
+		}
+		if !manageACL && isACLStatement(st) && !server.authorize(res, req, &graph, aclAction) {
+			return
+		}
+		s, _ := st.SubjectNode().(*nquads.IriNode)
+		p := st.PredicateNode().(*nquads.IriNode).Iri()
+		if p == SmartWeb_child || s != nil && s.Iri() == graphIri && p == SmartWeb_hash {
+			continue
+		}
+		if s != nil && s.Iri() == graphIri && p == SmartWeb_contentType {
+			hasContentType = true
+		}
+		data = append(data, nquads.NewStatement(st.SubjectNode(), st.PredicateNode(), st.ObjectNode(), nil).String())
+	}
+
+	keep := "sw:hash, sw:contentType"
+	if hasContentType {
+		keep = "sw:hash"
+	}
+	keepACL := "false"
+	if !manageACL {
+		keepACL = "?p IN (sw:about, sw:user, sw:allow, sw:deny, sw:inherit, sw:override, sw:notBefore, sw:expires) || ?p = rdf:type && sameTerm(?o, sw:ACL)"
+	}
+
+	err = server.backend.Update(sparql.MakeQuery(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		PREFIX rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#>
+
+		DELETE { GRAPH %1u { ?s ?p ?o } }
+		WHERE {
+			GRAPH %1u { ?s ?p ?o }
+			FILTER (!(?p = sw:child || sameTerm(?s, %1u) && ?p IN (%2q) || %4q))
+		};
+		INSERT DATA {
+			GRAPH %1u {
+				%3q
+			}
+		}
+	`, graphIri, keep, strings.Join(data, "\n\t\t\t\t"), keepACL))
+	server.acl.invalidate()
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -1,12 +1,14 @@
 package server2
 
 import (
-	"crypto"
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
+	"github.com/mildred/SmartWeb/backend"
 	"github.com/mildred/SmartWeb/bundle"
+	"github.com/mildred/SmartWeb/clientca"
+	"github.com/mildred/SmartWeb/config"
 	"github.com/mildred/SmartWeb/sparql"
 	"io"
 	"io/ioutil"
@@ -18,6 +20,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"mime"
 )
 
@@ -25,19 +28,36 @@ var SmartWeb_hasReferer, _ = url.Parse("tag:mildred.fr,2015-05:SmartWeb#hasRefer
 
 type SmartServer struct {
 	Root        string
-	Certificate *x509.Certificate
-	PrivateKey  crypto.PrivateKey
-	dataSet     *sparql.Client
+	// Certificate authority issuing the client certificates on ?enroll and
+	// revoking them on ?crl, both are disabled if nil
+	ClientCA    *clientca.CA
+	// Base URL of the graphs, the request host is used if nil
+	GraphBase   *url.URL
+	// HTTP client fetching the WebID profiles of the client certificates,
+	// WebID authentication is disabled if nil
+	WebIDClient *http.Client
+	// Work started by requests that continues after the response
+	Background  *Background
+	// Key authenticating the enrollment challenges, random by default. Keep
+	// it to accept the challenges given by a previous server.
+	EnrollKey   []byte
+	backend     backend.Backend
 	useAcl      bool
+	acl         *aclCache
 }
 
-func CreateFileServer(path string, Certificate *x509.Certificate, PrivateKey crypto.PrivateKey, query, update string, useAcl bool) *SmartServer {
+func CreateFileServer(path string, query, update string, useAcl bool) *SmartServer {
+	return NewServer(path, backend.NewSparql(sparql.NewClient(query, update)), useAcl)
+}
+
+func NewServer(path string, b backend.Backend, useAcl bool) *SmartServer {
 	return &SmartServer{
 		Root:        path,
-		Certificate: Certificate,
-		PrivateKey:  PrivateKey,
-		dataSet:     sparql.NewClient(query, update),
+		Background:  &Background{},
+		backend:     b,
+		EnrollKey:   randomKey(),
 		useAcl:      useAcl,
+		acl:         newACLCache(),
 	}
 }
 
@@ -48,7 +68,7 @@ func handleError(res http.ResponseWriter, status int, err string) {
 }
 
 func (server SmartServer) handleGET(u *url.URL, res http.ResponseWriter, req *http.Request) {
-	result, err := server.dataSet.Select(sparql.MakeQuery(`
+	result, err := server.backend.Select(sparql.MakeQuery(`
 		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 		SELECT ?hash ?type
 		WHERE {
@@ -93,7 +113,7 @@ func (server SmartServer) handleGET(u *url.URL, res http.ResponseWriter, req *ht
 
 func (server SmartServer) handlePUT(u *url.URL, res http.ResponseWriter, req *http.Request) {
 
-	f, err := ioutil.TempFile(server.Root, "temp:")
+	f, err := ioutil.TempFile(server.Root, tempPrefix)
 	if err != nil {
 		handleError(res, 500, err.Error())
 		return
@@ -103,6 +123,7 @@ func (server SmartServer) handlePUT(u *url.URL, res http.ResponseWriter, req *ht
 	hash := sha1.New()
 	_, err = io.Copy(f, io.TeeReader(req.Body, hash))
 	if err != nil {
+		os.Remove(f.Name())
 		handleError(res, 500, err.Error())
 		return
 	}
@@ -114,7 +135,7 @@ func (server SmartServer) handlePUT(u *url.URL, res http.ResponseWriter, req *ht
 
 	err = os.Rename(f.Name(), filepath.Join(server.Root, uri))
 	if err != nil {
-		go os.Remove(f.Name())
+		os.Remove(f.Name())
 		handleError(res, 500, err.Error())
 		return
 	}
@@ -125,7 +146,7 @@ func (server SmartServer) handlePUT(u *url.URL, res http.ResponseWriter, req *ht
 		parentChain += sparql.MakeQuery(" %2u sw:child %1u .", &urls[i-1], &urls[i])
 	}
 
-	_, err = server.dataSet.Update(sparql.MakeQuery(`
+	err = server.backend.Update(sparql.MakeQuery(`
 		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 		
 		CLEAR SILENT GRAPH %1u;
@@ -138,6 +159,7 @@ func (server SmartServer) handlePUT(u *url.URL, res http.ResponseWriter, req *ht
 			}
 		}
 	`, u, uri, req.Header.Get("Content-Type"), parentChain))
+	server.acl.invalidate()
 
 	if err != nil {
 		handleError(res, 500, err.Error())
@@ -175,7 +197,7 @@ func urlParents(u *url.URL) []url.URL {
 }
 
 func (server SmartServer) handleDELETE(u *url.URL, res http.ResponseWriter, req *http.Request) {
-	result, err := server.dataSet.Select(sparql.MakeQuery(`
+	result, err := server.backend.Select(sparql.MakeQuery(`
 		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 		SELECT ?hash
 		WHERE { %1u sw:hash ?hash . }
@@ -191,10 +213,11 @@ func (server SmartServer) handleDELETE(u *url.URL, res http.ResponseWriter, req
 	}
 
 	hash := result.Results.Bindings[0]["hash"].Value
-	_, err = server.dataSet.Update(sparql.MakeQuery(`
+	err = server.backend.Update(sparql.MakeQuery(`
 		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 		DROP SILENT GRAPH %1u
 	`, u))
+	server.acl.invalidate()
 	if err != nil {
 		handleError(res, 500, err.Error())
 		return
@@ -202,14 +225,15 @@ func (server SmartServer) handleDELETE(u *url.URL, res http.ResponseWriter, req
 	
 	res.WriteHeader(http.StatusNoContent)
 	
-	go func(){
-		result, err = server.dataSet.Select(sparql.MakeQuery(`
+	server.background(func(){
+		result, err := server.backend.Select(sparql.MakeQuery(`
 			PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
 			SELECT (count(?subj) AS ?count)
 			WHERE { ?subj sw:hash %1u . }
 		`, hash))
 		if err != nil {
 			log.Println(err)
+			return
 		}
 	
 		count, err := strconv.ParseInt(result.Results.Bindings[0]["count"].Value, 10, 0)
@@ -219,7 +243,7 @@ func (server SmartServer) handleDELETE(u *url.URL, res http.ResponseWriter, req
 				log.Println(err)
 			}
 		}
-	}()
+	})
 }
 
 func (server SmartServer) handlePOSTForm(u *url.URL, res http.ResponseWriter, req *http.Request) {
@@ -236,78 +260,206 @@ func (server SmartServer) handlePOSTForm(u *url.URL, res http.ResponseWriter, re
 	}
 }
 
+// URL of the requested resource, naming its graph
+func (server SmartServer) requestUrl(req *http.Request) *url.URL {
+	u := *req.URL
+	u.Scheme = ""
+	u.Host = ""
+	if server.GraphBase == nil {
+		// The same graphs are used whatever the scheme and port
+		host := config.NormalizeHost(req.Host)
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return (&url.URL{
+			Scheme: "http",
+			Host:   host,
+		}).ResolveReference(&u)
+	}
+	u.Path = strings.TrimSuffix(server.GraphBase.Path, "/") + req.URL.Path
+	u.RawPath = ""
+	return server.GraphBase.ResolveReference(&u)
+}
+
+// Users of the client: the verified WebIDs and the certificate it presented,
+// or sw:Anonymous if it presented none or a revoked one. The certificate chain
+// is not verified at the handshake, only the client certificate itself is
+// authenticated.
+func (server SmartServer) clientUsers(req *http.Request) []string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return []string{SmartWeb_Anonymous}
+	}
+	clientCert := req.TLS.PeerCertificates[0]
+	if !server.validClientCert(clientCert) {
+		return []string{SmartWeb_Anonymous}
+	}
+	return append(server.webIDs(req, clientCert), CertificateUser(clientCert))
+}
+
+// Check a client certificate against the client CA. A certificate with a key
+// the CA issued certificates for must be a valid client certificate of the CA,
+// and a revoked key is refused whoever signed the certificate. Any other
+// certificate is accepted as is, it only identifies its key.
+func (server SmartServer) validClientCert(cert *x509.Certificate) bool {
+	if server.ClientCA == nil {
+		return true
+	} else if server.ClientCA.Revoked(cert) {
+		return false
+	} else if !server.ClientCA.Issued(cert) {
+		return !server.ClientCA.IssuedKey(cert)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     server.ClientCA.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// Check that the client may perform one of the actions on each page, given
+// from the most to the least specific, as one of its users. The decisions are
+// cached.
+func (server SmartServer) allowedPages(req *http.Request, pages []*url.URL, actions ...string) ([]bool, error) {
+	allowed := make([]bool, len(pages))
+	now := time.Now()
+	for _, user := range server.clientUsers(req) {
+		var missing []*url.URL
+		var keys []aclKey
+		var index []int
+		var generation uint64
+		for i, u := range pages {
+			if allowed[i] {
+				continue
+			}
+			key := newACLKey(u.String(), actions, user)
+			allow, ok, gen := server.acl.get(key, now)
+			if ok {
+				allowed[i] = allow
+				continue
+			} else if len(missing) == 0 {
+				generation = gen
+			}
+			missing = append(missing, u)
+			keys = append(keys, key)
+			index = append(index, i)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		res, until, err := checkAuth(server.backend, missing, actions, user, now)
+		if err != nil {
+			return nil, err
+		}
+		expires := now.Add(aclCacheTTL)
+		if !until.IsZero() && until.Before(expires) {
+			expires = until
+		}
+		for j, i := range index {
+			allowed[i] = res[j]
+			server.acl.set(keys[j], res[j], expires, generation)
+		}
+	}
+	return allowed, nil
+}
+
+// Check that the client may perform one of the actions on u, see allowedPages
+func (server SmartServer) allowed(req *http.Request, u *url.URL, actions ...string) (bool, error) {
+	allowed, err := server.allowedPages(req, []*url.URL{u}, actions...)
+	if err != nil {
+		return false, err
+	}
+	return allowed[0], nil
+}
+
+// Check that the client may perform one of the actions on u. Responds with an
+// error and returns false if not.
+func (server SmartServer) authorize(res http.ResponseWriter, req *http.Request, u *url.URL, actions ...string) bool {
+	auth, err := server.allowed(req, u, actions...)
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return false
+	}
+
+	if !auth {
+		// RFC 6797: HTTP Strict Transport Security (HSTS), unless the
+		// host policy already sets it
+		if res.Header().Get("Strict-Transport-Security") == "" {
+			res.Header().Set("Strict-Transport-Security", "max-age=1")
+		}
+		handleError(res, 403, "Unauthorized")
+	}
+	return auth
+}
+
 func (server SmartServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	curUrl := (&url.URL{
-		Scheme: "http", // Ignore https to avoid breaking links
-		Host:   req.Host,
-	}).ResolveReference(req.URL)
+	curUrl := server.requestUrl(req)
 	
 	res.Header().Set("Access-Control-Allow-Origin", "*")
 	res.Header().Set("Access-Control-Allow-Method", "*")
 
 	log.Println(req.Method + " " + curUrl.String())
 
+	if _, ok := req.URL.Query()["enroll"]; ok {
+		server.handleEnroll(curUrl, res, req)
+		return
+	}
+
+	if req.URL.RawQuery == "crl" {
+		server.handleCRL(curUrl, res, req)
+		return
+	}
+
 	if req.URL.RawQuery == "keygen" {
-		server.handleKeygen(res, req)
+		// <keygen> is no longer supported by browsers
+		http.Redirect(res, req, "?enroll", http.StatusMovedPermanently)
+		return
+	}
+
+	if req.URL.RawQuery == "healthz" && (req.Method == "GET" || req.Method == "HEAD") {
+		server.handleHealthz(res, req)
 		return
 	}
 	
-	if server.useAcl {
-		auth := false
-		if req.TLS != nil {
-			for _, clientCert := range req.TLS.PeerCertificates {
-				var err error
-				userid := fmt.Sprintf("x509-certificate-fingerprint:sha256:%s", strings.ToLower(hex.EncodeToString(SHA256Fingerprint(*clientCert))))
-				auth, err = checkAuth(server.dataSet, curUrl, req.Method, userid)
-				if err != nil {
-					handleError(res, 500, err.Error())
-					return
-				}
-				if auth {
-					break
-				}
-			}
-		} else {
-			var err error
-			auth, err = checkAuth(server.dataSet, curUrl, req.Method, "tag:mildred.fr,2015-05:SmartWeb#Anonymous")
-			if err != nil {
-				handleError(res, 500, err.Error())
-				return
-			}
-		}
-	
-		if !auth {
-			// RFC 6797: HTTP Strict Transport Security (HSTS)
-			res.Header().Set("Strict-Transport-Security", "max-age=1")
-			handleError(res, 403, "Unauthorized")
-			return
-		}
+	if _, ok := req.URL.Query()["users"]; ok {
+		server.handleUsers(curUrl, res, req)
+		return
 	}
 
-	go func() {
+	if server.useAcl && !server.authorize(res, req, curUrl, requestActions(req)...) {
+		return
+	}
+
+	server.background(func() {
 		referrer, err := url.Parse(req.Referer())
 		if err != nil {
 			return
 		}
 		referrer = curUrl.ResolveReference(referrer)
 		// Add the referrer in storage
-		err = server.dataSet.AddQuad(curUrl, curUrl, SmartWeb_hasReferer, referrer)
+		quad, err := backend.Quad(curUrl, curUrl, SmartWeb_hasReferer, referrer)
+		if err == nil {
+			err = server.backend.AddQuads(quad)
+		}
 		if err != nil {
 			log.Println(err)
 		}
-	}()
+	})
 
 	if req.Method == "GET" || req.Method == "HEAD" {
-		if curUrl.Query().Get("query") != "" {
+		if req.URL.RawQuery == "rdf" {
+			server.handleGETRDF(curUrl, res, req)
+		} else if curUrl.Query().Get("query") != "" {
 			server.handleGETSPARQLQuery(curUrl, res, req)
 		} else {
 			server.handleGET(curUrl, res, req)
 		}
+	} else if req.Method == "PUT" && req.URL.RawQuery == "rdf" {
+		server.handlePUTRDF(curUrl, res, req)
 	} else if req.Method == "PUT" {
 		server.handlePUT(curUrl, res, req)
 	} else if req.Method == "POST" {
 		mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"));
-		if mediatype == bundle.MimeType {
+		if bundle.IsMediaType(mediatype) {
 			server.handlePOSTBundle(curUrl, res, req)
 		} else if mediatype == "application/sparql-query" {
 			server.handlePOSTSPARQLQuery(curUrl, res, req)
@@ -0,0 +1,1372 @@
+package server2
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/bundle"
+	"github.com/mildred/SmartWeb/clientca"
+	"github.com/mildred/SmartWeb/sparqltest"
+	"github.com/mildred/SmartWeb/turtle"
+)
+
+// Server storing files in a temporary directory and its graphs in a fake
+// SPARQL endpoint, call the returned function when done
+func newTestServer(t *testing.T, useAcl bool) (*SmartServer, *sparqltest.Server, func()) {
+	dir, err := ioutil.TempDir("", "server2-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := sparqltest.NewServer()
+	server := NewServer(dir, backend.NewSparql(endpoint.SparqlClient()), useAcl)
+	return server, endpoint, func() {
+		server.Background.Close()
+		endpoint.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(server *SmartServer, method, path, contentType string, body io.Reader, tlsState *tls.ConnectionState) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.org"+path, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.TLS = tlsState
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	return res
+}
+
+func ask(t *testing.T, endpoint *sparqltest.Server, query string) bool {
+	res, err := endpoint.Backend.Select(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Boolean
+}
+
+func TestPutGetDelete(t *testing.T) {
+	server, endpoint, done := newTestServer(t, false)
+	defer done()
+
+	res := do(server, "PUT", "/dir/page.html", "text/html", strings.NewReader("<p>Hello</p>"), nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", res.Code, res.Body)
+	}
+	hash := res.Header().Get("Hash")
+	if hash != fmt.Sprintf("sha1:%x", sha1.Sum([]byte("<p>Hello</p>"))) {
+		t.Errorf("PUT: Hash %s", hash)
+	}
+	if _, err := os.Stat(filepath.Join(server.Root, hash)); err != nil {
+		t.Errorf("PUT: %v", err)
+	}
+	if !ask(t, endpoint, `ASK { GRAPH <http://example.org/dir/page.html> {
+		<http://example.org/> <tag:mildred.fr,2015-05:SmartWeb#child> <http://example.org/dir/> .
+		<http://example.org/dir/> <tag:mildred.fr,2015-05:SmartWeb#child> <http://example.org/dir/page.html> } }`) {
+		t.Errorf("PUT: parent chain not stored")
+	}
+
+	res = do(server, "GET", "/dir/page.html", "", nil, nil)
+	if res.Code != http.StatusOK || res.Body.String() != "<p>Hello</p>" {
+		t.Errorf("GET: %d %s", res.Code, res.Body)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "text/html" {
+		t.Errorf("GET: Content-Type %s", ct)
+	}
+	if etag := res.Header().Get("Etag"); etag != hash {
+		t.Errorf("GET: Etag %s", etag)
+	}
+
+	res = do(server, "DELETE", "/dir/page.html", "", nil, nil)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("DELETE: %d %s", res.Code, res.Body)
+	}
+	res = do(server, "GET", "/dir/page.html", "", nil, nil)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: %d", res.Code)
+	}
+	server.Background.Wait()
+	if _, err := os.Stat(filepath.Join(server.Root, hash)); !os.IsNotExist(err) {
+		t.Errorf("DELETE: unreferenced file %s not removed", hash)
+	}
+}
+
+func TestRDFEtag(t *testing.T) {
+	server, endpoint, done := newTestServer(t, false)
+	defer done()
+
+	var poison []string
+	for i := 0; i < 9; i++ {
+		poison = append(poison, fmt.Sprintf("_:x <http://p> _:b%d . _:y <http://p> _:b%d .", i, i))
+	}
+	err := endpoint.Backend.Update(`INSERT DATA {
+		GRAPH <http://example.org/page> { <http://example.org/page> <http://p> "x" }
+		GRAPH <http://example.org/poison> { ` + strings.Join(poison, " ") + ` }
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := do(server, "GET", "/page?rdf", "", nil, nil)
+	etag := res.Header().Get("Etag")
+	if res.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"sha256:`) {
+		t.Fatalf("GET: %d Etag %s", res.Code, etag)
+	}
+	req := httptest.NewRequest("GET", "http://example.org/page?rdf", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d", rec.Code)
+	}
+
+	start := time.Now()
+	res = do(server, "GET", "/poison?rdf", "", nil, nil)
+	if res.Code != http.StatusOK || res.Header().Get("Etag") != "" {
+		t.Errorf("GET poison graph: %d Etag %s", res.Code, res.Header().Get("Etag"))
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("GET poison graph: %v", d)
+	}
+}
+
+func TestReferrer(t *testing.T) {
+	server, endpoint, done := newTestServer(t, false)
+	defer done()
+
+	req := httptest.NewRequest("GET", "http://example.org/page", nil)
+	req.Header.Set("Referer", "/index.html")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+
+	server.Background.Wait()
+	if !ask(t, endpoint, `ASK { GRAPH <http://example.org/page> {
+		<http://example.org/page> <tag:mildred.fr,2015-05:SmartWeb#hasReferer> <http://example.org/index.html> } }`) {
+		t.Errorf("referrer not recorded")
+	}
+}
+
+func TestAcl(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	cert := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("alice")}
+	alice := "x509-certificate-fingerprint:sha256:" + hex.EncodeToString(SHA256Fingerprint(*cert))
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:anon a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user sw:Anonymous ;
+					sw:allow "GET" .
+				_:alice a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user _:editors ;
+					sw:allow sw:Default .
+				_:editors sw:user <` + alice + `> .
+			}
+			GRAPH <http://example.org/private/> {
+				_:private a sw:ACL ;
+					sw:about <http://example.org/private/> ;
+					sw:user sw:Anonymous ;
+					sw:deny "GET" .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	tests := []struct {
+		method, path string
+		tls          *tls.ConnectionState
+		expected     int
+	}{
+		{"GET", "/page", nil, http.StatusNotFound},
+		{"PUT", "/page", nil, http.StatusForbidden},
+		{"DELETE", "/page", nil, http.StatusForbidden},
+		{"GET", "/private/page", nil, http.StatusForbidden},
+		{"PUT", "/page", aliceTLS, http.StatusCreated},
+		{"GET", "/page", aliceTLS, http.StatusOK},
+		{"GET", "/page", nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		res := do(server, test.method, test.path, "text/plain", strings.NewReader("content"), test.tls)
+		if res.Code != test.expected {
+			t.Errorf("%s %s (authenticated: %v): %d, expected %d", test.method, test.path, test.tls != nil, res.Code, test.expected)
+		}
+	}
+}
+
+// Rules and groups written in the graph of a page do not apply to its parents
+func TestAclGraphs(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:anon a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user sw:Anonymous ;
+					sw:override true ;
+					sw:allow "GET", "PUT" ;
+					sw:deny sw:Write .
+			}
+			GRAPH <http://example.org/?users> {
+				<http://example.org/?users=admins> a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:override true ;
+					sw:allow "DELETE" .
+			}
+			GRAPH <http://example.org/bob/page> {
+				<http://example.org/bob/page> <http://p> "x" .
+				[] a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user sw:Anonymous ;
+					sw:override true ;
+					sw:allow "DELETE" .
+				<http://example.org/?users=admins> sw:user sw:Anonymous .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := do(server, "DELETE", "/bob/page", "", nil, nil); res.Code != http.StatusForbidden {
+		t.Errorf("DELETE: %d", res.Code)
+	}
+	if res := do(server, "GET", "/bob/page?rdf", "", nil, nil); res.Code != http.StatusOK {
+		t.Errorf("GET: %d", res.Code)
+	}
+}
+
+// Writing ACL statements and users graphs requires the ACL action
+func TestAclWrite(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	editor := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("editor")}
+	admin := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("admin")}
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:editor a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user <` + CertificateUser(editor) + `> ;
+					sw:allow sw:Read, sw:Write .
+				_:admin a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user <` + CertificateUser(admin) + `> ;
+					sw:allow sw:Default .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editorTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{editor}}
+	adminTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{admin}}
+
+	acl := `<http://example.org/page> <http://p> "x" .
+		[] a <tag:mildred.fr,2015-05:SmartWeb#ACL> ;
+			<tag:mildred.fr,2015-05:SmartWeb#about> <http://example.org/page> ;
+			<tag:mildred.fr,2015-05:SmartWeb#user> <tag:mildred.fr,2015-05:SmartWeb#Anonymous> ;
+			<tag:mildred.fr,2015-05:SmartWeb#allow> "DELETE" .`
+	if res := do(server, "PUT", "/page?rdf", "text/turtle", strings.NewReader(acl), editorTLS); res.Code != http.StatusForbidden {
+		t.Errorf("PUT ACL as editor: %d %s", res.Code, res.Body)
+	}
+	if res := do(server, "PUT", "/page?rdf", "text/turtle", strings.NewReader(acl), adminTLS); res.Code != http.StatusNoContent {
+		t.Errorf("PUT ACL as administrator: %d %s", res.Code, res.Body)
+	}
+	res := do(server, "PUT", "/page?rdf", "text/turtle", strings.NewReader(`<http://example.org/page> <http://p> "y" .`), editorTLS)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("PUT as editor: %d %s", res.Code, res.Body)
+	}
+	if !ask(t, endpoint, `ASK { GRAPH <http://example.org/page> {
+		?acl a <tag:mildred.fr,2015-05:SmartWeb#ACL> ; <tag:mildred.fr,2015-05:SmartWeb#allow> "DELETE" .
+		<http://example.org/page> <http://p> "y" } }`) {
+		t.Errorf("PUT as editor: ACL not kept or data not replaced")
+	}
+
+	newBundle := func(relativePath string, acl bool) *bytes.Buffer {
+		var buf bytes.Buffer
+		w, err := bundle.NewWriter(&buf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteTriple("g", "tag:mildred.fr,2015-05:SmartWeb#relativePath", relativePath)
+		w.WriteQuad("g", "http://www.w3.org/2000/01/rdf-schema#label", "label", "g")
+		if acl {
+			w.WriteQuadIri("g", "tag:mildred.fr,2015-05:SmartWeb#user", "tag:mildred.fr,2015-05:SmartWeb#Anonymous", "g")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	tests := []struct {
+		relativePath string
+		acl          bool
+		tls          *tls.ConnectionState
+		expected     int
+	}{
+		{"page", false, editorTLS, http.StatusOK},
+		{"page", true, editorTLS, http.StatusForbidden},
+		{"?users", false, editorTLS, http.StatusForbidden},
+		{"page?users=alice", false, editorTLS, http.StatusForbidden},
+		{"page", true, adminTLS, http.StatusOK},
+		{"?users", false, adminTLS, http.StatusOK},
+	}
+	for _, test := range tests {
+		res := do(server, "POST", "/import/", bundle.MimeType, newBundle(test.relativePath, test.acl), test.tls)
+		if res.Code != test.expected {
+			t.Errorf("POST bundle %s (ACL %v): %d, expected %d: %s", test.relativePath, test.acl, res.Code, test.expected, res.Body)
+		}
+	}
+}
+
+func TestCheckAuthBatch(t *testing.T) {
+	_, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expires := now.Add(time.Hour)
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		PREFIX xsd: <http://www.w3.org/2001/XMLSchema#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:anon a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user sw:Anonymous ;
+					sw:allow sw:Read ;
+					sw:expires "` + expires.Format(time.RFC3339) + `"^^xsd:dateTime .
+			}
+			GRAPH <http://example.org/b> {
+				_:foreign a sw:ACL ;
+					sw:about <http://example.org/a> ;
+					sw:user sw:Anonymous ;
+					sw:deny sw:Default .
+			}
+			GRAPH <http://example.org/private/> {
+				_:private a sw:ACL ;
+					sw:about <http://example.org/private/> ;
+					sw:user sw:Anonymous ;
+					sw:deny sw:Default .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages []*url.URL
+	for _, p := range []string{"http://example.org/a", "http://example.org/b", "http://example.org/private/c", "http://example.org/private/"} {
+		u, _ := url.Parse(p)
+		pages = append(pages, u)
+	}
+	expected := []bool{true, true, false, false}
+	actions := []string{"GET", SmartWeb_Read}
+	allowed, until, err := checkAuth(endpoint.Backend, pages, actions, SmartWeb_Anonymous, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.Equal(expires) {
+		t.Errorf("until %v, expected %v", until, expires)
+	}
+	for i, u := range pages {
+		if allowed[i] != expected[i] {
+			t.Errorf("%s: %v in batch, expected %v", u, allowed[i], expected[i])
+		}
+		single, _, err := checkAuth(endpoint.Backend, pages[i:i+1], actions, SmartWeb_Anonymous, now)
+		if err != nil || single[0] != expected[i] {
+			t.Errorf("%s: %v alone, expected %v: %v", u, single, expected[i], err)
+		}
+	}
+	if allowed, _, _ := checkAuth(endpoint.Backend, pages[:1], actions, SmartWeb_Anonymous, expires); allowed[0] {
+		t.Errorf("allowed after expiry")
+	}
+}
+
+func TestAclCache(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	alice := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("alice")}
+	aliceTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{alice}}
+	insert := func(auth string) {
+		err := endpoint.Backend.Update(`
+			PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+			INSERT DATA {
+				GRAPH <http://example.org/> {
+					[] a sw:ACL ;
+						sw:about <http://example.org/> ;
+						sw:user <` + CertificateUser(alice) + `> ;
+						sw:allow sw:Default .
+				}
+				GRAPH <http://example.org/dir/> {
+					[] a sw:ACL ;
+						sw:about <http://example.org/dir/> ;
+						sw:user sw:Anonymous ;
+						` + auth + ` "GET" .
+				}
+			}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("sw:allow")
+
+	tests := []struct {
+		method, path string
+		tls          *tls.ConnectionState
+		update       func()
+		expected     int
+	}{
+		{"GET", "/dir/page", nil, nil, http.StatusNotFound},
+		// Changed without the server, the decision is cached
+		{"GET", "/dir/page", nil, func() { insert("sw:deny") }, http.StatusNotFound},
+		// Changed through the server
+		{"PUT", "/dir/other", aliceTLS, nil, http.StatusCreated},
+		{"GET", "/dir/page", nil, nil, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if test.update != nil {
+			test.update()
+		}
+		res := do(server, test.method, test.path, "text/plain", strings.NewReader("content"), test.tls)
+		if res.Code != test.expected {
+			t.Errorf("%s %s: %d, expected %d", test.method, test.path, res.Code, test.expected)
+		}
+	}
+
+	c := newACLCache()
+	key := newACLKey("http://example.org/", []string{"GET"}, SmartWeb_Anonymous)
+	now := time.Now()
+	_, _, generation := c.get(key, now)
+	c.set(key, true, now.Add(time.Second), generation)
+	if allow, ok, _ := c.get(key, now); !allow || !ok {
+		t.Errorf("cached decision: %v %v", allow, ok)
+	}
+	if _, ok, _ := c.get(key, now.Add(time.Second)); ok {
+		t.Errorf("expired decision returned")
+	}
+	c.invalidate()
+	c.set(key, true, now.Add(time.Second), generation)
+	if _, ok, _ := c.get(key, now); ok {
+		t.Errorf("decision of a previous generation cached")
+	}
+}
+
+// HTTP transport serving Turtle documents by URL and counting the requests
+type profileTransport struct {
+	profiles map[string]string
+	requests map[string]int
+}
+
+func (p *profileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.requests[req.URL.String()]++
+	res := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}
+	if profile, ok := p.profiles[req.URL.String()]; ok {
+		res.StatusCode = http.StatusOK
+		res.Header.Set("Content-Type", "text/turtle")
+		res.Body = ioutil.NopCloser(strings.NewReader(profile))
+	}
+	return res, nil
+}
+
+func TestWebID(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	newCert := func(webid string) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(webid)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), URIs: []*url.URL{u}, NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert, key
+	}
+	profile := func(webid string, key *rsa.PrivateKey) string {
+		return `@prefix cert: <http://www.w3.org/ns/auth/cert#> .
+			@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+			<` + webid + `> cert:key [
+				cert:modulus "00` + strings.ToUpper(key.N.Text(16)) + `"^^xsd:hexBinary ;
+				cert:exponent ` + strconv.Itoa(key.E) + `
+			] .`
+	}
+
+	alice, aliceKey := newCert("https://profiles.test/alice#me")
+	impostor, _ := newCert("https://profiles.test/alice#me")
+	bob, bobKey := newCert("https://example.org/bob#me")
+	carol, carolKey := newCert("https://profiles.test/carol#me")
+	transport := &profileTransport{
+		profiles: map[string]string{
+			"https://profiles.test/alice": profile("https://profiles.test/alice#me", aliceKey),
+			"https://profiles.test/carol": profile("https://profiles.test/carol#other", carolKey),
+		},
+		requests: map[string]int{},
+	}
+	server.WebIDClient = &http.Client{Transport: transport}
+
+	quads, err := turtle.NewReader(strings.NewReader(profile("http://example.org/bob#me", bobKey)), "").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := endpoint.Backend.ReplaceGraph("http://example.org/bob", quads); err != nil {
+		t.Fatal(err)
+	}
+	err = endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:acl a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user <https://profiles.test/alice#me>, <https://example.org/bob#me>, <https://profiles.test/carol#me> ;
+					sw:allow "GET" .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		expected int
+	}{
+		{"remote profile", alice, http.StatusNotFound},
+		{"cached", alice, http.StatusNotFound},
+		{"other key", impostor, http.StatusForbidden},
+		{"local profile", bob, http.StatusNotFound},
+		{"key of another WebID", carol, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		res := do(server, "GET", "/page", "", nil, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}})
+		if res.Code != test.expected {
+			t.Errorf("%s: %d, expected %d", test.name, res.Code, test.expected)
+		}
+	}
+	if n := transport.requests["https://profiles.test/alice"]; n != 2 {
+		t.Errorf("alice profile fetched %d times, expected once per certificate", n)
+	}
+	if n := transport.requests["https://example.org/bob"]; n != 0 {
+		t.Errorf("local profile fetched %d times", n)
+	}
+}
+
+// HTTP transport counting the requests and answering none before they are
+// canceled
+type hangingTransport struct {
+	requests int
+}
+
+func (h *hangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.requests++
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestWebIDLimits(t *testing.T) {
+	server, _, done := newTestServer(t, true)
+	defer done()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uris []*url.URL
+	for _, webid := range []string{"urn:x:me", "https://a.test/#me", "https://b.test/#me", "https://c.test/#me"} {
+		u, _ := url.Parse(webid)
+		uris = append(uris, u)
+	}
+	cert := &x509.Certificate{Raw: []byte("limits"), PublicKey: &key.PublicKey, URIs: uris}
+	req := httptest.NewRequest("GET", "http://example.org/page", nil)
+
+	transport := &profileTransport{profiles: map[string]string{}, requests: map[string]int{}}
+	server.WebIDClient = &http.Client{Transport: transport}
+	server.webIDs(req, cert)
+	if len(transport.requests) != maxCertificateWebIDs || transport.requests["https://c.test/"] != 0 {
+		t.Errorf("profiles fetched: %v", transport.requests)
+	}
+
+	// The WebIDs share the client timeout, and are not cached when it expires
+	server.acl.invalidate()
+	hanging := &hangingTransport{}
+	server.WebIDClient = &http.Client{Transport: hanging, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	server.webIDs(req, cert)
+	if elapsed := time.Since(start); elapsed > time.Second || hanging.requests != 1 {
+		t.Errorf("%d profiles fetched in %v", hanging.requests, elapsed)
+	}
+	server.webIDs(req, cert)
+	if hanging.requests != 2 {
+		t.Errorf("timed out verification cached")
+	}
+}
+
+func TestWebIDClient(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"0.1.2.3:80", false},
+		{"255.255.255.255:80", false},
+		{"[64:ff9b::7f00:1]:80", false},
+	}
+	for _, test := range tests {
+		if err := checkPublicAddress("tcp", test.address, nil); (err == nil) != test.public {
+			t.Errorf("%s: %v", test.address, err)
+		}
+	}
+
+	requests := 0
+	profile := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer profile.Close()
+	if _, err := NewWebIDClient(time.Second).Get(profile.URL + "/profile"); err == nil || requests != 0 {
+		t.Errorf("loopback profile fetched: %v", err)
+	}
+}
+
+func TestSPARQLQueryAcl(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:anon a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user sw:Anonymous ;
+					sw:allow sw:Read .
+			}
+			GRAPH <http://example.org/dir/public> {
+				<http://example.org/dir/public> <http://example.org/title> "public" .
+			}
+			GRAPH <http://example.org/dir/private> {
+				<http://example.org/dir/private> <http://example.org/title> "private" .
+				_:private a sw:ACL ;
+					sw:about <http://example.org/dir/private> ;
+					sw:user sw:Anonymous ;
+					sw:deny sw:Default .
+			}
+			GRAPH <http://example.org/dir/?users> {
+				<http://example.org/dir/?users=bob> <http://example.org/title> "users" .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+		titles   string
+	}{
+		{"query=" + url.QueryEscape(`SELECT ?t WHERE { ?s <http://example.org/title> ?t }`), http.StatusOK, "public"},
+		{"query=" + url.QueryEscape(`SELECT ?t WHERE { GRAPH ?g { ?s <http://example.org/title> ?t } }`), http.StatusBadRequest, ""},
+		{"query=" + url.QueryEscape(`SELECT ?t WHERE { SERVICE <http://example.org/sparql> { ?s ?p ?t } }`), http.StatusBadRequest, ""},
+		{"query=" + url.QueryEscape(`SELECT ?t WHERE { GRAPH <http://example.org/dir/private> { ?s <http://example.org/title> ?t } }`), http.StatusBadRequest, ""},
+		{"query=" + url.QueryEscape(`SELECT ?t FROM <http://example.org/dir/private> WHERE { ?s <http://example.org/title> ?t }`), http.StatusBadRequest, ""},
+		{"query=" + url.QueryEscape(`SELECT ?t FROM NAMED <http://example.org/dir/private> WHERE { GRAPH <http://example.org/dir/public> { ?s <http://example.org/title> ?t } }`), http.StatusBadRequest, ""},
+		{"default-graph-uri=" + url.QueryEscape("http://example.org/dir/private") + "&query=" + url.QueryEscape(`SELECT ?t WHERE { ?s ?p ?t }`), http.StatusBadRequest, ""},
+		{"named-graph-uri=" + url.QueryEscape("http://example.org/dir/public") + "&query=" + url.QueryEscape(`SELECT ?t WHERE { GRAPH <http://example.org/dir/public> { ?s <http://example.org/title> ?t } }`), http.StatusOK, "public"},
+	}
+	for _, test := range tests {
+		res := do(server, "POST", "/dir/", "application/x-www-form-urlencoded", strings.NewReader(test.query), nil)
+		if res.Code != test.expected {
+			t.Errorf("%s: %d, expected %d: %s", test.query, res.Code, test.expected, res.Body)
+			continue
+		} else if res.Code != http.StatusOK {
+			continue
+		}
+		var results struct {
+			Results struct {
+				Bindings []map[string]struct{ Value string }
+			}
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v", res.Body, err)
+		}
+		var titles []string
+		for _, b := range results.Results.Bindings {
+			titles = append(titles, b["t"].Value)
+		}
+		if strings.Join(titles, " ") != test.titles {
+			t.Errorf("%s: %v, expected %s", test.query, titles, test.titles)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	admin := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("admin")}
+	bob := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("bob")}
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:admin a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user <` + CertificateUser(admin) + `> ;
+					sw:allow sw:Default .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{admin}}
+	bobTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{bob}}
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		method, path string
+		body         string
+		tls          *tls.ConnectionState
+		expected     int
+	}{
+		{"GET", "/dir/?users", "", nil, http.StatusForbidden},
+		{"PUT", "/dir/?users=bob", `{"label": "Bob", "allow": ["GET", "PUT"], "certificates": ["` + CertificateUser(bob) + `"]}`, adminTLS, http.StatusCreated},
+		{"PUT", "/dir/page", "content", bobTLS, http.StatusCreated},
+		{"PUT", "/page", "content", bobTLS, http.StatusForbidden},
+		{"GET", "/dir/?users", "", bobTLS, http.StatusForbidden},
+		{"PUT", "/dir/", "index", adminTLS, http.StatusCreated},
+		{"GET", "/dir/page", "", bobTLS, http.StatusOK},
+		{"PUT", "/dir/?users=bob", `{"allow": ["GET"], "expires": "` + past + `", "certificates": ["` + CertificateUser(bob) + `"]}`, adminTLS, http.StatusNoContent},
+		{"GET", "/dir/page", "", bobTLS, http.StatusForbidden},
+		{"PUT", "/dir/?users=team", `{"certificates": ["` + CertificateUser(bob) + `"]}`, adminTLS, http.StatusCreated},
+		{"PUT", "/dir/?users=readers", `{"allow": ["Read"], "members": ["team"]}`, adminTLS, http.StatusCreated},
+		{"GET", "/dir/page", "", bobTLS, http.StatusOK},
+		{"PUT", "/dir/page", "content", bobTLS, http.StatusForbidden},
+		{"DELETE", "/dir/?users=team", "", adminTLS, http.StatusNoContent},
+		{"GET", "/dir/page", "", bobTLS, http.StatusForbidden},
+		{"DELETE", "/dir/?users=readers", "", adminTLS, http.StatusNoContent},
+		{"PUT", "/dir/?users=bad", `{"members": ["ftp://example.org/?users=bob"]}`, adminTLS, http.StatusBadRequest},
+		{"PUT", "/dir/?users=other", `{"id": "bob"}`, adminTLS, http.StatusBadRequest},
+		{"PUT", "/dir/?users=bad%20id", `{}`, adminTLS, http.StatusBadRequest},
+		{"PUT", "/dir/?users=bad", `{"allow": ["get"]}`, adminTLS, http.StatusBadRequest},
+		{"PUT", "/dir/?users=bad", `{"certificates": ["bob"]}`, adminTLS, http.StatusBadRequest},
+		{"PUT", "/dir/?users=bad", `{"webids": ["mailto:bob@example.org"]}`, adminTLS, http.StatusBadRequest},
+		{"DELETE", "/dir/?users=bob", "", adminTLS, http.StatusNoContent},
+		{"GET", "/dir/?users=bob", "", adminTLS, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		res := do(server, test.method, test.path, "application/json", strings.NewReader(test.body), test.tls)
+		if res.Code != test.expected {
+			t.Errorf("%s %s %s: %d, expected %d: %s", test.method, test.path, test.body, res.Code, test.expected, res.Body)
+		}
+	}
+
+	page, _ := url.Parse("http://example.org/dir/")
+	if _, err := server.registerCertificate(page, &x509.Certificate{RawSubjectPublicKeyInfo: []byte("carol"), NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+	res := do(server, "GET", "/dir/?users", "", nil, adminTLS)
+	var users []User
+	if err := json.Unmarshal(res.Body.Bytes(), &users); err != nil || len(users) != 1 {
+		t.Fatalf("GET ?users: %v %s", err, res.Body)
+	}
+	if u := users[0]; !strings.HasPrefix(u.Id, "key-") || len(u.Allow) != 0 || u.Expires == nil || u.Expires.Year() != 2030 || len(u.Certificates) != 1 {
+		t.Errorf("user registered by keygen: %#v", u)
+	}
+}
+
+func TestResolveAuth(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	nodes := map[string]*aclNode{
+		"alice":   {users: []string{"alice-cert"}},
+		"bob":     {users: []string{"bob-cert"}},
+		"anon":    {users: []string{SmartWeb_Anonymous}},
+		"staff":   {users: []string{"alice", "bob"}},
+		"admins":  {users: []string{"alice"}},
+		"expired": {users: []string{"bob-cert"}, expires: now.Add(-time.Hour)},
+		"future":  {users: []string{"bob-cert"}, notBefore: now.Add(time.Hour)},
+		"window":  {users: []string{"bob-cert"}, notBefore: now.Add(-time.Hour), expires: now.Add(time.Hour)},
+		"invalid": {users: []string{"bob-cert"}, invalid: true},
+		"old":     {users: []string{"staff"}, expires: now.Add(-time.Hour)},
+		"viaOld":  {users: []string{"old"}},
+		"cycle1":  {users: []string{"cycle2"}},
+		"cycle2":  {users: []string{"cycle1"}},
+	}
+	// Pages: 0 is the requested page, 1 its directory and 2 the root
+	rule := func(node string, page int, allow bool, action string) aclRule {
+		return aclRule{node: node, page: page, self: page == 0, allow: allow, action: action, inherit: true}
+	}
+	noInherit := func(r aclRule) aclRule { r.inherit = false; return r }
+	override := func(r aclRule) aclRule { r.override = true; return r }
+	get := []string{"GET", SmartWeb_Read}
+	put := []string{"PUT", SmartWeb_Write}
+
+	tests := []struct {
+		name     string
+		rules    []aclRule
+		user     string
+		actions  []string
+		expected bool
+	}{
+		{"no rule", nil, "alice-cert", get, false},
+		{"direct", []aclRule{rule("alice", 2, true, "GET")}, "alice-cert", get, true},
+		{"other user", []aclRule{rule("alice", 2, true, "GET")}, "bob-cert", get, false},
+		{"other action", []aclRule{rule("alice", 2, true, "GET")}, "alice-cert", put, false},
+		{"anonymous", []aclRule{rule("anon", 2, true, SmartWeb_Default)}, "bob-cert", put, true},
+		{"group", []aclRule{rule("staff", 1, true, SmartWeb_Read)}, "bob-cert", get, true},
+		{"read class", []aclRule{rule("staff", 1, true, SmartWeb_Read)}, "bob-cert", put, false},
+		{"write class", []aclRule{rule("staff", 1, true, SmartWeb_Write)}, "bob-cert", put, true},
+		{"group cycle", []aclRule{rule("cycle1", 1, true, SmartWeb_Default)}, "bob-cert", get, false},
+		{"method over class", []aclRule{rule("staff", 0, true, "GET"), rule("staff", 0, false, SmartWeb_Read)}, "bob-cert", get, true},
+		{"class over default", []aclRule{rule("staff", 0, false, SmartWeb_Write), rule("staff", 0, true, SmartWeb_Default)}, "bob-cert", put, false},
+		{"deny wins", []aclRule{rule("staff", 0, true, "GET"), rule("bob", 0, false, "GET")}, "bob-cert", get, false},
+		{"nearest page", []aclRule{rule("staff", 2, false, "GET"), rule("bob", 1, true, SmartWeb_Default)}, "bob-cert", get, true},
+		{"nearest deny", []aclRule{rule("staff", 2, true, "GET"), rule("bob", 1, false, SmartWeb_Default)}, "bob-cert", get, false},
+		{"no inherit", []aclRule{noInherit(rule("bob", 1, true, "GET"))}, "bob-cert", get, false},
+		{"no inherit self", []aclRule{noInherit(rule("bob", 0, true, "GET"))}, "bob-cert", get, true},
+		{"no inherit skipped", []aclRule{rule("bob", 2, true, "GET"), noInherit(rule("bob", 1, false, "GET"))}, "bob-cert", get, true},
+		{"override", []aclRule{override(rule("bob", 2, false, SmartWeb_Default)), rule("bob", 0, true, "GET")}, "bob-cert", get, false},
+		{"override from the root", []aclRule{override(rule("bob", 2, true, "GET")), override(rule("bob", 1, false, "GET"))}, "bob-cert", get, true},
+		{"override other user", []aclRule{override(rule("alice", 2, false, SmartWeb_Default)), rule("bob", 0, true, "GET")}, "bob-cert", get, true},
+		{"expired", []aclRule{rule("expired", 0, true, "GET")}, "bob-cert", get, false},
+		{"not yet valid", []aclRule{rule("future", 0, true, "GET")}, "bob-cert", get, false},
+		{"time window", []aclRule{rule("window", 0, true, "GET")}, "bob-cert", get, true},
+		{"invalid time", []aclRule{rule("invalid", 0, true, "GET")}, "bob-cert", get, false},
+		{"expired group", []aclRule{rule("viaOld", 0, true, "GET")}, "bob-cert", get, false},
+		{"expired deny", []aclRule{rule("bob", 1, true, "GET"), rule("expired", 0, false, "GET")}, "bob-cert", get, true},
+		{"acl action", []aclRule{rule("admins", 2, true, aclAction), rule("bob", 2, true, "GET")}, "bob-cert", []string{aclAction}, false},
+		{"acl default", []aclRule{rule("admins", 2, true, SmartWeb_Default)}, "alice-cert", []string{aclAction}, true},
+	}
+	for _, test := range tests {
+		if auth := resolveAuth(test.rules, nodes, test.user, test.actions, now); auth != test.expected {
+			t.Errorf("%s: %v, expected %v", test.name, auth, test.expected)
+		}
+	}
+}
+
+func TestRequestActions(t *testing.T) {
+	tests := []struct {
+		method, contentType string
+		expected            string
+	}{
+		{"GET", "", SmartWeb_Read},
+		{"HEAD", "", SmartWeb_Read},
+		{"POST", "application/sparql-query", SmartWeb_Read},
+		{"POST", "application/x-www-form-urlencoded; charset=utf-8", SmartWeb_Read},
+		{"POST", "text/plain", SmartWeb_Write},
+		{"PUT", "", SmartWeb_Write},
+		{"DELETE", "", SmartWeb_Write},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/", nil)
+		req.Header.Set("Content-Type", test.contentType)
+		if actions := requestActions(req); actions[0] != test.method || actions[1] != test.expected {
+			t.Errorf("%s %s: %v, expected %s", test.method, test.contentType, actions, test.expected)
+		}
+	}
+}
+
+// Client CA stored in the server root
+func newTestCA(t *testing.T, server *SmartServer) *clientca.CA {
+	ca, err := clientca.Load(filepath.Join(server.Root, "ca"), "Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// PKCS#10 request with a challenge password, as generated by the enrollment
+// page
+func challengeRequest(t *testing.T, key *ecdsa.PrivateKey, name, challenge string) []byte {
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := asn1.Marshal(pkix.Name{CommonName: name}.ToRDNSequence())
+	value, _ := asn1.MarshalWithParams(challenge, "utf8")
+	attr, _ := asn1.Marshal(csrAttribute{oidChallengePassword, []asn1.RawValue{{FullBytes: value}}})
+	tbs, err := asn1.Marshal(tbsCertificateRequest{
+		Subject:       asn1.RawValue{FullBytes: subject},
+		PublicKey:     asn1.RawValue{FullBytes: spki},
+		RawAttributes: []asn1.RawValue{{FullBytes: attr}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	csr, _ := asn1.Marshal(struct {
+		Info      asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}{asn1.RawValue{FullBytes: tbs}, pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}}, asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}})
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+}
+
+func TestEnroll(t *testing.T) {
+	server, _, done := newTestServer(t, false)
+	defer done()
+	if res := do(server, "GET", "/dir/?enroll", "", nil, nil); res.Code != http.StatusNotFound {
+		t.Errorf("enrollment without client CA: %d", res.Code)
+	}
+	server.ClientCA = newTestCA(t, server)
+
+	if res := do(server, "GET", "/dir/?keygen", "", nil, nil); res.Code != http.StatusMovedPermanently || res.Header().Get("Location") != "/dir/?enroll" {
+		t.Errorf("keygen: %d %s", res.Code, res.Header().Get("Location"))
+	}
+	if res := do(server, "GET", "/dir/?enroll", "", nil, nil); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "crypto.subtle") {
+		t.Errorf("enrollment page: %d %s", res.Code, res.Body)
+	}
+	challenge := strings.TrimSpace(do(server, "GET", "/dir/?enroll=challenge", "", nil, nil).Body.String())
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, c := range []struct {
+		path, challenge string
+		expected        int
+	}{
+		{"/dir/?enroll", "", http.StatusForbidden},
+		{"/dir/?enroll", challenge + "x", http.StatusForbidden},
+		{"/other/?enroll", challenge, http.StatusForbidden},
+		{"/dir/?enroll&days=0", challenge, http.StatusBadRequest},
+		{"/dir/?enroll", challenge, http.StatusCreated},
+	} {
+		res := do(server, "POST", c.path, "application/pkcs10", bytes.NewReader(challengeRequest(t, key, "Alice", c.challenge)), nil)
+		if res.Code != c.expected {
+			t.Errorf("POST %s with challenge %q: %d, expected %d: %s", c.path, c.challenge, res.Code, c.expected, res.Body)
+			continue
+		}
+		if res.Code != http.StatusCreated {
+			continue
+		}
+		block, rest := pem.Decode(res.Body.Bytes())
+		if block == nil || !strings.Contains(string(rest), "CERTIFICATE") {
+			t.Fatalf("POST: no certificate chain: %s", res.Body)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(server.ClientCA.Certificate)
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+			t.Errorf("certificate: %v", err)
+		}
+		if cert.Subject.CommonName != "Alice" || cert.IsCA {
+			t.Errorf("certificate: %v CA: %v", cert.Subject, cert.IsCA)
+		}
+		if loc := res.Header().Get("Location"); loc != "http://example.org/dir/?users=key-"+strings.TrimPrefix(CertificateUser(cert), certificateUserPrefix) {
+			t.Errorf("user: %s", loc)
+		}
+	}
+}
+
+func TestEnrollAcl(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+	server.ClientCA = newTestCA(t, server)
+
+	admin := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("admin")}
+	err := endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/> {
+				_:admin a sw:ACL ;
+					sw:about <http://example.org/> ;
+					sw:user <` + CertificateUser(admin) + `> ;
+					sw:allow "ACL" .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{admin}}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, path := range []string{"/dir/?enroll", "/dir/?enroll=challenge", "/dir/?enroll=forged.challenge"} {
+		if res := do(server, "GET", path, "", nil, nil); res.Code != http.StatusForbidden {
+			t.Errorf("anonymous GET %s: %d", path, res.Code)
+		}
+	}
+	forged := (&SmartServer{EnrollKey: randomKey()}).newChallenge(&url.URL{Scheme: "http", Host: "example.org", Path: "/dir/"})
+	for _, challenge := range []string{"", forged} {
+		res := do(server, "POST", "/dir/?enroll", "application/pkcs10", bytes.NewReader(challengeRequest(t, key, "Mallory", challenge)), nil)
+		if res.Code != http.StatusForbidden {
+			t.Errorf("anonymous enrollment with challenge %q: %d", challenge, res.Code)
+		}
+	}
+	if users, _ := server.listUsers(&url.URL{Scheme: "http", Host: "example.org", Path: "/dir/"}); len(users) != 0 {
+		t.Errorf("users registered: %v", users)
+	}
+
+	res := do(server, "GET", "/dir/?enroll=challenge", "", nil, adminTLS)
+	challenge := strings.TrimSpace(res.Body.String())
+	if res.Code != http.StatusOK {
+		t.Fatalf("challenge for the administrator: %d %s", res.Code, res.Body)
+	}
+	if res := do(server, "GET", "/dir/?enroll="+challenge, "", nil, nil); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), challenge) {
+		t.Errorf("invitation: %d", res.Code)
+	}
+	page := &url.URL{Scheme: "http", Host: "example.org", Path: "/dir/"}
+	if err := (&SmartServer{EnrollKey: server.EnrollKey}).checkChallenge(page, challenge); err != nil {
+		t.Errorf("invitation with the same key: %v", err)
+	}
+	if err := (&SmartServer{EnrollKey: randomKey()}).checkChallenge(page, challenge); err == nil {
+		t.Errorf("invitation accepted with another key")
+	}
+	res = do(server, "POST", "/dir/?enroll", "application/pkcs10", bytes.NewReader(challengeRequest(t, key, "Alice", challenge)), nil)
+	if res.Code != http.StatusCreated {
+		t.Errorf("invited enrollment: %d %s", res.Code, res.Body)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+	server.ClientCA = newTestCA(t, server)
+
+	var certs []*x509.Certificate
+	var pems [][]byte
+	var users []string
+	var keys []*ecdsa.PrivateKey
+	selfSigned := func(key *ecdsa.PrivateKey) *x509.Certificate {
+		serial, _ := clientca.SerialNumber()
+		template := &x509.Certificate{SerialNumber: serial, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+	for _, name := range []string{"alice", "bob", "expired", "self-signed", "mallory"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		keys = append(keys, key)
+		serial, _ := clientca.SerialNumber()
+		template := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if name == "expired" {
+			template.NotAfter = time.Now().Add(-time.Minute)
+		}
+		var der []byte
+		var err error
+		if name == "self-signed" || name == "mallory" {
+			der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		} else {
+			der, err = server.ClientCA.Issue(template, &key.PublicKey)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		certs = append(certs, cert)
+		pems = append(pems, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		if name != "mallory" {
+			users = append(users, CertificateUser(cert))
+		}
+	}
+	page, _ := url.Parse("http://example.org/")
+	err := server.putUser(page, &User{Id: "users", Allow: []string{"GET"}, Certificates: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = endpoint.Backend.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		INSERT DATA {
+			GRAPH <http://example.org/public> {
+				_:acl a sw:ACL ;
+					sw:about <http://example.org/public> ;
+					sw:user sw:Anonymous ;
+					sw:allow "GET" .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceTLS := &tls.ConnectionState{PeerCertificates: certs[:1]}
+	bobTLS := &tls.ConnectionState{PeerCertificates: certs[1:2]}
+	expiredTLS := &tls.ConnectionState{PeerCertificates: certs[2:3]}
+	selfSignedTLS := &tls.ConnectionState{PeerCertificates: certs[3:4]}
+	// Bob's certificate in the chain is not proven by the handshake
+	malloryTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certs[4], certs[1]}}
+	// The keys of CA-issued certificates in self-signed certificates
+	aliceSelfTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{selfSigned(keys[0])}}
+	bobSelfTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{selfSigned(keys[1])}}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.ClientCA.Certificate.Raw})
+
+	tests := []struct {
+		method, path string
+		body         []byte
+		tls          *tls.ConnectionState
+		expected     int
+	}{
+		{"GET", "/page", nil, aliceTLS, http.StatusNotFound},
+		{"GET", "/page", nil, expiredTLS, http.StatusForbidden},
+		{"GET", "/page", nil, selfSignedTLS, http.StatusNotFound},
+		{"GET", "/page", nil, malloryTLS, http.StatusForbidden},
+		{"GET", "/page", nil, bobSelfTLS, http.StatusForbidden},
+		{"POST", "/?crl", pems[1], aliceTLS, http.StatusForbidden},
+		{"POST", "/?crl", pems[1], malloryTLS, http.StatusForbidden},
+		{"POST", "/?crl", caPEM, aliceTLS, http.StatusBadRequest},
+		{"POST", "/?crl", append(pems[0], caPEM...), aliceTLS, http.StatusNoContent},
+		{"GET", "/page", nil, aliceTLS, http.StatusForbidden},
+		{"GET", "/public", nil, aliceTLS, http.StatusNotFound},
+		{"GET", "/page", nil, aliceSelfTLS, http.StatusForbidden},
+		{"GET", "/public", nil, aliceSelfTLS, http.StatusNotFound},
+		{"GET", "/public", nil, expiredTLS, http.StatusNotFound},
+		{"GET", "/page", nil, bobTLS, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		res := do(server, test.method, test.path, "application/x-pem-file", bytes.NewReader(test.body), test.tls)
+		if res.Code != test.expected {
+			t.Errorf("%s %s: %d, expected %d: %s", test.method, test.path, res.Code, test.expected, res.Body)
+		}
+	}
+
+	res := do(server, "GET", "/?crl", "", nil, nil)
+	crl, err := x509.ParseRevocationList(res.Body.Bytes())
+	if err != nil || crl.CheckSignatureFrom(server.ClientCA.Certificate) != nil {
+		t.Fatalf("CRL: %d %v", res.Code, err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(certs[0].SerialNumber) != 0 {
+		t.Errorf("CRL entries: %v", crl.RevokedCertificateEntries)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	server, endpoint, done := newTestServer(t, false)
+	defer done()
+
+	var buf bytes.Buffer
+	w, err := bundle.NewWriter(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"a.txt": "A", "sub/b.txt": "B"} {
+		if err := w.InsertFile(name, name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteQuad(name, "tag:mildred.fr,2015-05:SmartWeb#contentType", "text/plain", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := do(server, "POST", "/import/", bundle.MimeType, &buf, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST bundle: %d %s", res.Code, res.Body)
+	}
+	for path, content := range map[string]string{"/import/a.txt": "A", "/import/sub/b.txt": "B"} {
+		res = do(server, "GET", path, "", nil, nil)
+		if res.Code != http.StatusOK || res.Body.String() != content || res.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("GET %s: %d %s %s", path, res.Code, res.Header().Get("Content-Type"), res.Body)
+		}
+	}
+	if !ask(t, endpoint, `ASK { GRAPH <http://example.org/import/sub/b.txt> {
+		<http://example.org/import/sub/b.txt> <tag:mildred.fr,2015-05:SmartWeb#hash> ?hash } }`) {
+		t.Errorf("POST bundle: graph not relocated under the base URI")
+	}
+
+	res = do(server, "POST", "/import/", bundle.MimeType, strings.NewReader("not a zip"), nil)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("POST invalid bundle: %d", res.Code)
+	}
+}
+
+// Files stored from a tar bundle before graphs.nq are removed if it fails
+func TestBundleCleanup(t *testing.T) {
+	server, _, done := newTestServer(t, false)
+	defer done()
+
+	newTar := func(entries ...string) *bytes.Buffer {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		entries = append([]string{"mimetype", bundle.TarMimeType}, entries...)
+		for i := 0; i < len(entries); i += 2 {
+			err := w.WriteHeader(&tar.Header{Name: entries[i], Mode: 0644, Size: int64(len(entries[i+1])), Typeflag: tar.TypeReg})
+			if err == nil {
+				_, err = w.Write([]byte(entries[i+1]))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	hash := fmt.Sprintf("sha1:%x", sha1.Sum([]byte("A")))
+	tests := []struct {
+		name    string
+		entries []string
+	}{
+		{"no graphs.nq", []string{hash, "A"}},
+		{"invalid graphs.nq", []string{hash, "A", "graphs.nq", "<g> <p> ."}},
+		{"hash mismatch", []string{hash, "A", fmt.Sprintf("sha1:%x", sha1.Sum([]byte("B"))), "C", "graphs.nq", ""}},
+	}
+	for _, test := range tests {
+		res := do(server, "POST", "/import/", bundle.TarMimeType, newTar(test.entries...), nil)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", test.name, res.Code, res.Body)
+		}
+		if _, err := os.Stat(filepath.Join(server.Root, hash)); !os.IsNotExist(err) {
+			t.Errorf("%s: %s not removed", test.name, hash)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	server, endpoint, done := newTestServer(t, true)
+	defer done()
+
+	res := do(server, "GET", "/?healthz", "", nil, nil)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"reachable":true`) {
+		t.Errorf("healthz: %d %s", res.Code, res.Body)
+	}
+
+	endpoint.Close()
+	res = do(server, "GET", "/?healthz", "", nil, nil)
+	if res.Code != http.StatusServiceUnavailable || !strings.Contains(res.Body.String(), `"reachable":false,"latency":`) || !strings.HasSuffix(res.Body.String(), `,"error":"Backend unavailable"}`+"\n") {
+		t.Errorf("healthz with the endpoint down: %d %s", res.Code, res.Body)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	server, endpoint, done := newTestServer(t, false)
+	defer done()
+	server.GraphBase, _ = url.Parse("http://example.org/site/")
+
+	hosts := NewVirtualHosts()
+	hosts.Set(map[string]http.Handler{"example.org": server})
+
+	req := httptest.NewRequest("PUT", "http://EXAMPLE.org:8000/page", strings.NewReader("content"))
+	res := httptest.NewRecorder()
+	hosts.ServeHTTP(res, req)
+	if res.Code != http.StatusCreated {
+		t.Errorf("PUT: %d %s", res.Code, res.Body)
+	}
+	if !ask(t, endpoint, `ASK { GRAPH <http://example.org/site/page> { ?s ?p ?o } }`) {
+		t.Errorf("graph not stored under the graph prefix")
+	}
+
+	res = httptest.NewRecorder()
+	hosts.ServeHTTP(res, httptest.NewRequest("GET", "http://other.org/page", nil))
+	if res.Code != http.StatusMisdirectedRequest {
+		t.Errorf("unknown host: %d", res.Code)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	server, endpoint, done := newTestServer(t, false)
+	defer done()
+
+	req := httptest.NewRequest("PUT", "http://Example.org:8000/page", strings.NewReader("content"))
+	server.ServeHTTP(httptest.NewRecorder(), req)
+	if !ask(t, endpoint, `ASK { GRAPH <http://example.org/page> { ?s ?p ?o } }`) {
+		t.Errorf("graph not stored without the port")
+	}
+
+	req = httptest.NewRequest("GET", "https://example.org:8443/page", nil)
+	req.TLS = &tls.ConnectionState{}
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || res.Body.String() != "content" {
+		t.Errorf("GET over TLS on another port: %d %s", res.Code, res.Body)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	server, _, done := newTestServer(t, false)
+	defer done()
+
+	for _, name := range []string{"temp:123", "temp:456", "sha1:0001"} {
+		if err := ioutil.WriteFile(filepath.Join(server.Root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := RemoveTempFiles(server.Root)
+	if err != nil || n != 2 {
+		t.Errorf("RemoveTempFiles: %d %v", n, err)
+	}
+	files, _ := ioutil.ReadDir(server.Root)
+	if len(files) != 1 || files[0].Name() != "sha1:0001" {
+		t.Errorf("files left: %v", files)
+	}
+}
+
+func TestBackground(t *testing.T) {
+	var b Background
+	release := make(chan struct{})
+	if !b.Go(func() { <-release }) {
+		t.Fatalf("work not started")
+	}
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Errorf("closed with work in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+	if b.Go(func() {}) {
+		t.Errorf("work started after close")
+	}
+}
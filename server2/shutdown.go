@@ -0,0 +1,80 @@
+package server2
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Prefix of the files being written in the root directory, renamed after
+// their hash when complete
+const tempPrefix = "temp:"
+
+// Work started by requests that continues after the response, servers can
+// share it to wait for all of them at shutdown
+type Background struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// Run f in a new goroutine, unless the background work is closed. Return
+// false if f was not run.
+func (b *Background) Go(f func()) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Wait for the work in progress. No work must be started concurrently, use
+// Close while serving.
+func (b *Background) Wait() {
+	b.wg.Wait()
+}
+
+// Stop starting new work and wait for the work in progress
+func (b *Background) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// Run f after the response, unless the server is shutting down
+func (server SmartServer) background(f func()) {
+	if !server.Background.Go(f) {
+		log.Println("Shutting down, background work skipped")
+	}
+}
+
+// Remove the temporary files left in root by an interrupted server, must be
+// called before serving. Return the number of files removed.
+func RemoveTempFiles(root string) (int, error) {
+	files, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), tempPrefix) {
+			if err := os.Remove(filepath.Join(root, fi.Name())); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -1,7 +1,9 @@
 package server2
 
 import (
+	"github.com/mildred/SmartWeb/backend"
 	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/sparqlengine"
 	"net/http"
 	"net/url"
 	"io/ioutil"
@@ -55,11 +57,11 @@ func graphListCheck(allowedGraphs, graphList []string) ([]string, string) {
 	}
 }
 
-func listSubGraphs(dataSet *sparql.Client, u string) ([]string, error) {
+func listSubGraphs(b backend.Backend, u string) ([]string, error) {
 	var allowedGraphs []string
 	
 	if strings.HasSuffix(u, "/") {
-		result, err := dataSet.Select(sparql.MakeQuery(`
+		result, err := b.Select(sparql.MakeQuery(`
 			SELECT DISTINCT ?g
 			WHERE {
   				GRAPH ?g {?s ?p ?o}
@@ -79,15 +81,59 @@ func listSubGraphs(dataSet *sparql.Client, u string) ([]string, error) {
 	return allowedGraphs, nil;
 }
 
+// Graphs the client may read. The users graphs require the ACL action.
+func (server SmartServer) readableGraphs(req *http.Request, graphs []string) ([]string, error) {
+	var readable []string
+	for _, usersGraphs := range []bool{false, true} {
+		var names []string
+		var pages []*url.URL
+		for _, g := range graphs {
+			gu, err := url.Parse(g)
+			if err == nil && (gu.RawQuery == "users") == usersGraphs {
+				names = append(names, g)
+				pages = append(pages, gu)
+			}
+		}
+		if len(pages) == 0 {
+			continue
+		}
+		actions := []string{"GET", SmartWeb_Read}
+		if usersGraphs {
+			actions = []string{aclAction}
+		}
+		allowed, err := server.allowedPages(req, pages, actions...)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range names {
+			if allowed[i] {
+				readable = append(readable, g)
+			}
+		}
+	}
+	return readable, nil
+}
+
 func (server SmartServer) handleSPARQLQuery(u *url.URL, res http.ResponseWriter, req *http.Request, vars url.Values) {
-	// FIXME check that the sub graphs are allowed by ACL.
-	
-	allowedGraphs, err := listSubGraphs(server.dataSet, u.String());
+	allowedGraphs, err := listSubGraphs(server.backend, u.String());
 	if err != nil {
 		handleError(res, 500, err.Error())
 		return
 	}
 
+	if server.useAcl {
+		allowedGraphs, err = server.readableGraphs(req, allowedGraphs)
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+	}
+	if len(allowedGraphs) == 0 {
+		// The page itself is readable, an empty dataset would be the
+		// whole store
+		allowedGraphs = []string{u.String()}
+	}
+
 	defaultGraphs, g1 := graphListCheck(allowedGraphs, vars["default-graph-uri"])	
 	namedGraphs,   g2 := graphListCheck(allowedGraphs, vars["named-graph-uri"])
 
@@ -100,6 +146,11 @@ func (server SmartServer) handleSPARQLQuery(u *url.URL, res http.ResponseWriter,
 		handleError(res, 400, fmt.Sprintf("named-graph-uri not allowed for graph <%s>", g2))
 		return
 	}
+
+	if err := sparqlengine.CheckDataset(vars.Get("query"), namedGraphs); err != nil {
+		handleError(res, 400, err.Error())
+		return
+	}
 	
 	vars = url.Values{
 		"query": []string{vars.Get("query")},
@@ -107,7 +158,19 @@ func (server SmartServer) handleSPARQLQuery(u *url.URL, res http.ResponseWriter,
 		"default-graph-uri": defaultGraphs,
 	}
 	
-	sparql, err := http.NewRequest("POST", server.dataSet.QueryUrl, bytes.NewReader([]byte(vars.Encode())))
+	var client *sparql.Client
+	switch b := server.backend.(type) {
+	case *backend.Embedded:
+		handleEmbeddedQuery(b, res, req, vars)
+		return
+	case *backend.Sparql:
+		client = b.Client
+	default:
+		handleError(res, http.StatusNotImplemented, backend.ErrUnsupported.Error())
+		return
+	}
+
+	sparql, err := http.NewRequest("POST", client.QueryUrl, bytes.NewReader([]byte(vars.Encode())))
 	if err != nil {
 		handleError(res, 500, err.Error())
 		return
@@ -116,7 +179,7 @@ func (server SmartServer) handleSPARQLQuery(u *url.URL, res http.ResponseWriter,
 	sparql.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	sparql.Header.Add("Accept", req.Header.Get("Accept"))
 	
-	resp, err := server.dataSet.Do(sparql)
+	resp, err := client.Do(sparql)
 	
 	if err != nil {
 		handleError(res, 500, err.Error())
@@ -137,3 +200,37 @@ func (server SmartServer) handleSPARQLQuery(u *url.URL, res http.ResponseWriter,
 		log.Println(err);
 	}
 }
+
+// Evaluate a query with the built-in engine of the embedded store
+func handleEmbeddedQuery(b *backend.Embedded, res http.ResponseWriter, req *http.Request, vars url.Values) {
+	result, err := b.Engine.Query(vars.Get("query"), &sparqlengine.Dataset{
+		Default: vars["default-graph-uri"],
+		Named:   vars["named-graph-uri"],
+	})
+	if _, ok := err.(*sparqlengine.SyntaxError); ok {
+		handleError(res, 400, err.Error())
+		return
+	} else if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+
+	if result.Form != "CONSTRUCT" {
+		res.Header().Set("Content-Type", sparqlengine.ResultsMediaType)
+		res.WriteHeader(http.StatusOK)
+		err = result.WriteJSON(res)
+	} else {
+		mediatype, params := negotiateRDF(req.Header.Get("Accept"))
+		res.Header().Set("Vary", "Accept")
+		if mediatype == "" {
+			handleError(res, http.StatusNotAcceptable, fmt.Sprintf("Supported media types: %s", strings.Join(rdfMediaTypes, ", ")))
+			return
+		}
+		res.Header().Set("Content-Type", mediatype)
+		res.WriteHeader(http.StatusOK)
+		err = writeRDF(res, mediatype, params, "", result.Statements)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
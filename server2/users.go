@@ -0,0 +1,414 @@
+package server2
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/sparql"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	certificateUserPrefix = "x509-certificate-fingerprint:sha256:"
+)
+
+var (
+	userIdRegexp          = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	actionRegexp          = regexp.MustCompile(`^[A-Z]+$`)
+	certificateUserRegexp = regexp.MustCompile(`^` + certificateUserPrefix + `[0-9a-f]{64}$`)
+)
+
+// User granted or denied access to a page subtree, stored as a sw:ACL node
+// named <page?users=id> in the graph <page?users>. The actions are HTTP
+// methods, ACL to manage the users, Read or Write for the method classes, or
+// Default for any action. The user authenticates with the certificates or
+// with the WebIDs of its certificates. Members are other users of the page by
+// id, users of a parent page by IRI or Anonymous, a user without rights is a
+// group.
+type User struct {
+	Id           string     `json:"id"`
+	Label        string     `json:"label,omitempty"`
+	NotBefore    *time.Time `json:"notBefore,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Inherit      *bool      `json:"inherit,omitempty"`
+	Override     bool       `json:"override,omitempty"`
+	Allow        []string   `json:"allow,omitempty"`
+	Deny         []string   `json:"deny,omitempty"`
+	Certificates []string   `json:"certificates"`
+	WebIDs       []string   `json:"webids,omitempty"`
+	Members      []string   `json:"members,omitempty"`
+}
+
+// User IRI of the holder of a client certificate, identified by its public key
+func CertificateUser(cert *x509.Certificate) string {
+	return fmt.Sprintf("%s%x", certificateUserPrefix, SHA256Fingerprint(*cert))
+}
+
+// Graph holding the users of a page
+func usersGraph(page *url.URL) *url.URL {
+	graph := *page
+	graph.RawQuery = "users"
+	graph.Fragment = ""
+	return &graph
+}
+
+func userIri(page *url.URL, id string) string {
+	u := *page
+	u.RawQuery = "users=" + url.QueryEscape(id)
+	u.Fragment = ""
+	return u.String()
+}
+
+// Actions named after a SmartWeb IRI instead of a method
+var actionIris = map[string]string{
+	"Default": SmartWeb_Default,
+	"Read":    SmartWeb_Read,
+	"Write":   SmartWeb_Write,
+}
+
+func actionNode(action string) nquads.Node {
+	if iri, ok := actionIris[action]; ok {
+		return nquads.NewIri(iri)
+	}
+	return nquads.NewLiteral(action, "", "")
+}
+
+func actionName(n nquads.Node) string {
+	if iri, ok := n.(*nquads.IriNode); ok {
+		return strings.TrimPrefix(iri.Iri(), "tag:mildred.fr,2015-05:SmartWeb#")
+	}
+	if lit, ok := n.(*nquads.LiteralNode); ok {
+		return lit.Value()
+	}
+	return ""
+}
+
+// IRI of a member of a user of page
+func memberIri(page *url.URL, member string) (string, error) {
+	if member == "Anonymous" {
+		return SmartWeb_Anonymous, nil
+	} else if userIdRegexp.MatchString(member) {
+		return userIri(page, member), nil
+	}
+	m, err := url.Parse(member)
+	if err != nil || (m.Scheme != "http" && m.Scheme != "https") || !strings.HasPrefix(m.RawQuery, "users=") {
+		return "", fmt.Errorf("Invalid member %q, expected a user id, the IRI of a user or Anonymous", member)
+	}
+	return member, nil
+}
+
+// Check that the IRI is a WebID and not the IRI of a user
+func isWebID(iri string) bool {
+	u, err := url.Parse(iri)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && !strings.HasPrefix(u.RawQuery, "users=")
+}
+
+// Name of a member IRI, reverse of memberIri
+func memberName(page *url.URL, iri string) string {
+	prefix := userIri(page, "")
+	if iri == SmartWeb_Anonymous {
+		return "Anonymous"
+	} else if strings.HasPrefix(iri, prefix) {
+		if id, err := url.QueryUnescape(strings.TrimPrefix(iri, prefix)); err == nil {
+			return id
+		}
+	}
+	return iri
+}
+
+// Check the user of page and convert the PEM certificates and the members to
+// user IRIs
+func (u *User) normalize(page *url.URL) error {
+	if !userIdRegexp.MatchString(u.Id) {
+		return fmt.Errorf("Invalid user id %q", u.Id)
+	}
+	for _, action := range append(append([]string{}, u.Allow...), u.Deny...) {
+		if _, ok := actionIris[action]; !ok && !actionRegexp.MatchString(action) {
+			return fmt.Errorf("Invalid action %q, expected a method, ACL, Read, Write or Default", action)
+		}
+	}
+	for _, t := range []**time.Time{&u.NotBefore, &u.Expires} {
+		if *t != nil {
+			utc := (*t).UTC().Truncate(time.Second)
+			*t = &utc
+		}
+	}
+	for _, webid := range u.WebIDs {
+		if !isWebID(webid) {
+			return fmt.Errorf("Invalid WebID %q, expected an http or https IRI", webid)
+		}
+	}
+	for i, m := range u.Members {
+		iri, err := memberIri(page, m)
+		if err != nil {
+			return err
+		}
+		u.Members[i] = iri
+	}
+	for i, c := range u.Certificates {
+		if certificateUserRegexp.MatchString(c) {
+			continue
+		}
+		block, _ := pem.Decode([]byte(c))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("Invalid certificate %q, expected %s<hex> or a PEM certificate", c, certificateUserPrefix)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		u.Certificates[i] = CertificateUser(cert)
+	}
+	return nil
+}
+
+func (u *User) statements(page *url.URL) []*nquads.Statement {
+	s := nquads.NewIri(userIri(page, u.Id))
+	st := []*nquads.Statement{
+		nquads.NewStatement(s, nquads.NewIri(rdf_type), nquads.NewIri(SmartWeb_ACL), nil),
+		nquads.NewStatement(s, nquads.NewIri(SmartWeb_about), nquads.NewIri(page.String()), nil),
+	}
+	if u.Label != "" {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(rdfs_label), nquads.NewLiteral(u.Label, "", ""), nil))
+	}
+	if u.NotBefore != nil {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_notBefore), nquads.NewLiteral(u.NotBefore.Format(time.RFC3339), nquads.XsdNamespace+"dateTime", ""), nil))
+	}
+	if u.Expires != nil {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_expires), nquads.NewLiteral(u.Expires.Format(time.RFC3339), nquads.XsdNamespace+"dateTime", ""), nil))
+	}
+	if u.Inherit != nil {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_inherit), nquads.NewLiteral(strconv.FormatBool(*u.Inherit), nquads.XsdNamespace+"boolean", ""), nil))
+	}
+	if u.Override {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_override), nquads.NewLiteral("true", nquads.XsdNamespace+"boolean", ""), nil))
+	}
+	for _, c := range append(append(append([]string{}, u.Certificates...), u.WebIDs...), u.Members...) {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_user), nquads.NewIri(c), nil))
+	}
+	for _, a := range u.Allow {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_allow), actionNode(a), nil))
+	}
+	for _, a := range u.Deny {
+		st = append(st, nquads.NewStatement(s, nquads.NewIri(SmartWeb_deny), actionNode(a), nil))
+	}
+	return st
+}
+
+func literalTime(n nquads.Node) *time.Time {
+	if lit, ok := n.(*nquads.LiteralNode); ok {
+		if t, err := time.Parse(time.RFC3339, lit.Value()); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// Users of a page, sorted by id
+func (server SmartServer) listUsers(page *url.URL) ([]*User, error) {
+	triples, err := server.backend.Construct(sparql.MakeQuery(`
+		CONSTRUCT { ?s ?p ?o }
+		WHERE { GRAPH %1u { ?s ?p ?o } }
+	`, usersGraph(page)))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := userIri(page, "")
+	users := map[string]*User{}
+	for _, st := range triples {
+		s, ok := st.SubjectNode().(*nquads.IriNode)
+		if !ok || !strings.HasPrefix(s.Iri(), prefix) {
+			continue
+		}
+		id, err := url.QueryUnescape(strings.TrimPrefix(s.Iri(), prefix))
+		if err != nil {
+			continue
+		}
+		u := users[id]
+		if u == nil {
+			u = &User{Id: id, Certificates: []string{}}
+			users[id] = u
+		}
+		switch st.PredicateNode().(*nquads.IriNode).Iri() {
+		case rdfs_label:
+			if lit, ok := st.ObjectNode().(*nquads.LiteralNode); ok {
+				u.Label = lit.Value()
+			}
+		case SmartWeb_notBefore:
+			u.NotBefore = literalTime(st.ObjectNode())
+		case SmartWeb_expires:
+			u.Expires = literalTime(st.ObjectNode())
+		case SmartWeb_inherit:
+			if lit, ok := st.ObjectNode().(*nquads.LiteralNode); ok {
+				inherit := lit.Value() != "false"
+				u.Inherit = &inherit
+			}
+		case SmartWeb_override:
+			if lit, ok := st.ObjectNode().(*nquads.LiteralNode); ok {
+				u.Override = lit.Value() == "true"
+			}
+		case SmartWeb_user:
+			iri, ok := st.ObjectNode().(*nquads.IriNode)
+			if ok && certificateUserRegexp.MatchString(iri.Iri()) {
+				u.Certificates = append(u.Certificates, iri.Iri())
+			} else if ok && isWebID(iri.Iri()) {
+				u.WebIDs = append(u.WebIDs, iri.Iri())
+			} else if ok {
+				u.Members = append(u.Members, memberName(page, iri.Iri()))
+			}
+		case SmartWeb_allow:
+			u.Allow = append(u.Allow, actionName(st.ObjectNode()))
+		case SmartWeb_deny:
+			u.Deny = append(u.Deny, actionName(st.ObjectNode()))
+		}
+	}
+
+	var list []*User
+	for _, u := range users {
+		sort.Strings(u.Certificates)
+		sort.Strings(u.WebIDs)
+		sort.Strings(u.Members)
+		sort.Strings(u.Allow)
+		sort.Strings(u.Deny)
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (server SmartServer) getUser(page *url.URL, id string) (*User, error) {
+	users, err := server.listUsers(page)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Id == id {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+func (server SmartServer) deleteUser(page *url.URL, id string) error {
+	defer server.acl.invalidate()
+	return server.backend.Update(sparql.MakeQuery(`
+		DELETE WHERE { GRAPH %1u { %2u ?p ?o } }
+	`, usersGraph(page), userIri(page, id)))
+}
+
+// Create or replace a user
+func (server SmartServer) putUser(page *url.URL, u *User) error {
+	var data []string
+	for _, st := range u.statements(page) {
+		data = append(data, st.String())
+	}
+	defer server.acl.invalidate()
+	return server.backend.Update(sparql.MakeQuery(`
+		DELETE WHERE { GRAPH %1u { %2u ?p ?o } };
+		INSERT DATA {
+			GRAPH %1u {
+				%3q
+			}
+		}
+	`, usersGraph(page), userIri(page, u.Id), strings.Join(data, "\n\t\t\t\t")))
+}
+
+func writeJSON(res http.ResponseWriter, req *http.Request, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	if req.Method != "HEAD" {
+		json.NewEncoder(res).Encode(v)
+	}
+}
+
+// Manage the users of the page subtree on ?users (list), ?users=id (get, put
+// and delete). It requires the ACL action on the page.
+func (server SmartServer) handleUsers(u *url.URL, res http.ResponseWriter, req *http.Request) {
+	page := *u
+	page.RawQuery = ""
+	page.Fragment = ""
+
+	if server.useAcl && !server.authorize(res, req, &page, aclAction) {
+		return
+	}
+
+	id := u.Query().Get("users")
+	if id == "" {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			res.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		users, err := server.listUsers(&page)
+		if err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		if users == nil {
+			users = []*User{}
+		}
+		writeJSON(res, req, users)
+		return
+	}
+
+	existing, err := server.getUser(&page, id)
+	if err != nil {
+		handleError(res, 500, err.Error())
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		if existing == nil {
+			handleError(res, 404, "Not Found")
+			return
+		}
+		writeJSON(res, req, existing)
+	case "PUT":
+		user := &User{}
+		if err := json.NewDecoder(req.Body).Decode(user); err != nil {
+			handleError(res, 400, err.Error())
+			return
+		}
+		if user.Id == "" {
+			user.Id = id
+		} else if user.Id != id {
+			handleError(res, 400, fmt.Sprintf("User id %q does not match the URL", user.Id))
+			return
+		}
+		if err := user.normalize(&page); err != nil {
+			handleError(res, 400, err.Error())
+			return
+		}
+		if err := server.putUser(&page, user); err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		if existing == nil {
+			res.WriteHeader(http.StatusCreated)
+		} else {
+			res.WriteHeader(http.StatusNoContent)
+		}
+	case "DELETE":
+		if existing == nil {
+			handleError(res, 404, "Not Found")
+			return
+		}
+		if err := server.deleteUser(&page, id); err != nil {
+			handleError(res, 500, err.Error())
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
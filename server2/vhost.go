@@ -0,0 +1,45 @@
+package server2
+
+import (
+	"github.com/mildred/SmartWeb/config"
+	"net/http"
+	"sync"
+)
+
+// Dispatch requests to a handler chosen from the Host header. The handlers
+// can be replaced while serving, to reload the configuration.
+type VirtualHosts struct {
+	mu    sync.RWMutex
+	hosts map[string]http.Handler
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{hosts: make(map[string]http.Handler)}
+}
+
+// Replace the handlers, the handler for config.AnyHost serves the hosts not
+// found in the map
+func (v *VirtualHosts) Set(hosts map[string]http.Handler) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.hosts = hosts
+}
+
+// Handler for a host name, with or without port, nil if none
+func (v *VirtualHosts) Handler(host string) http.Handler {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if h, ok := v.hosts[config.NormalizeHost(host)]; ok {
+		return h
+	}
+	return v.hosts[config.AnyHost]
+}
+
+func (v *VirtualHosts) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	h := v.Handler(req.Host)
+	if h == nil {
+		handleError(res, http.StatusMisdirectedRequest, "Unknown host "+req.Host)
+		return
+	}
+	h.ServeHTTP(res, req)
+}
@@ -0,0 +1,252 @@
+package server2
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/mildred/SmartWeb/config"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/sparql"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	cert_key      = "http://www.w3.org/ns/auth/cert#key"
+	cert_modulus  = "http://www.w3.org/ns/auth/cert#modulus"
+	cert_exponent = "http://www.w3.org/ns/auth/cert#exponent"
+
+	// Lifetime of a WebID verification
+	webidCacheTTL = 5 * time.Minute
+	// Maximum size of a fetched WebID profile
+	maxWebIDProfileSize = 1 << 20
+	// Maximum number of redirects followed to fetch a WebID profile
+	maxWebIDRedirects = 3
+	// Maximum number of WebIDs verified per certificate, the others are
+	// ignored
+	maxCertificateWebIDs = 2
+	// Pseudo action caching the WebID verifications with the ACL decisions
+	webidAction = "WebID"
+)
+
+// Special purpose networks, not global unicast, private nor link-local, that
+// the profiles are not fetched from
+var webidReservedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// HTTP client fetching the WebID profiles. The WebIDs come from the client
+// certificates before any authentication, so the client only connects to
+// public addresses, checked after name resolution, does not use the proxy of
+// the environment and follows few redirects.
+func NewWebIDClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: checkPublicAddress}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:            dialer.DialContext,
+			TLSHandshakeTimeout:    timeout,
+			MaxResponseHeaderBytes: maxWebIDProfileSize,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxWebIDRedirects {
+				return errors.New("Too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// Dialer control refusing the loopback, private, link-local and other special
+// addresses
+func checkPublicAddress(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return fmt.Errorf("Refusing to connect to %s", address)
+	}
+	for _, prefix := range webidReservedNetworks {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("Refusing to connect to %s", address)
+		}
+	}
+	return nil
+}
+
+// RSA public key of a WebID profile, as written in the profile
+type webidKey struct {
+	modulus, exponent string
+}
+
+// Check the key against the certificate public key. The modulus is in
+// hexadecimal and the exponent in decimal.
+func (k webidKey) matches(pub *rsa.PublicKey) bool {
+	modulus, ok := new(big.Int).SetString(strings.Join(strings.Fields(k.modulus), ""), 16)
+	if !ok {
+		return false
+	}
+	exponent, err := strconv.Atoi(strings.TrimSpace(k.exponent))
+	return err == nil && modulus.Cmp(pub.N) == 0 && exponent == pub.E
+}
+
+// WebIDs of the subjectAltName URIs of a client certificate, verified
+// against their profile (WebID-TLS). Only RSA keys are supported. Only the
+// first WebIDs are verified and they share the timeout of the client.
+func (server SmartServer) webIDs(req *http.Request, cert *x509.Certificate) []string {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if server.WebIDClient == nil || !ok {
+		return nil
+	}
+	ctx := req.Context()
+	if server.WebIDClient.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, server.WebIDClient.Timeout)
+		defer cancel()
+	}
+	var webids []string
+	now := time.Now()
+	n := 0
+	for _, u := range cert.URIs {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		} else if n++; n > maxCertificateWebIDs {
+			break
+		}
+		webid := u.String()
+		key := aclKey{webid, webidAction, CertificateUser(cert)}
+		verified, ok, generation := server.acl.get(key, now)
+		if !ok {
+			if ctx.Err() != nil {
+				log.Printf("WebID %s: %v", webid, ctx.Err())
+				continue
+			}
+			verified = server.verifyWebID(ctx, req, u, pub)
+			if ctx.Err() == nil {
+				server.acl.set(key, verified, now.Add(webidCacheTTL), generation)
+			}
+		}
+		if verified {
+			webids = append(webids, webid)
+		}
+	}
+	return webids
+}
+
+func (server SmartServer) verifyWebID(ctx context.Context, req *http.Request, webid *url.URL, pub *rsa.PublicKey) bool {
+	keys, err := server.localWebIDKeys(req, webid)
+	if err == nil && keys == nil {
+		keys, err = server.fetchWebIDKeys(ctx, webid)
+	}
+	if err != nil {
+		log.Printf("WebID %s: %v", webid, err)
+		return false
+	}
+	for _, k := range keys {
+		if k.matches(pub) {
+			return true
+		}
+	}
+	log.Printf("WebID %s: no matching key in the profile", webid)
+	return false
+}
+
+// Keys of a WebID hosted on the requested site, read from the store
+func (server SmartServer) localWebIDKeys(req *http.Request, webid *url.URL) ([]webidKey, error) {
+	if config.NormalizeHost(webid.Host) != config.NormalizeHost(req.Host) {
+		return nil, nil
+	}
+	graph := server.requestUrl(&http.Request{URL: &url.URL{Path: webid.Path, RawQuery: webid.RawQuery}, Host: req.Host})
+	subject := *graph
+	subject.Fragment = webid.Fragment
+
+	res, err := server.backend.Select(sparql.MakeQuery(`
+		PREFIX cert: <http://www.w3.org/ns/auth/cert#>
+		SELECT ?modulus ?exponent
+		WHERE {
+			GRAPH %1u {
+				%2u cert:key ?key .
+				?key cert:modulus ?modulus ; cert:exponent ?exponent .
+			}
+		}
+	`, graph, &subject))
+	if err != nil {
+		return nil, err
+	}
+	var keys []webidKey
+	for _, binding := range res.Results.Bindings {
+		keys = append(keys, webidKey{binding["modulus"].Value, binding["exponent"].Value})
+	}
+	return keys, nil
+}
+
+// Keys of a WebID read from its profile document over HTTP
+func (server SmartServer) fetchWebIDKeys(ctx context.Context, webid *url.URL) ([]webidKey, error) {
+	doc := *webid
+	doc.Fragment = ""
+	req, err := http.NewRequestWithContext(ctx, "GET", doc.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/turtle, application/ld+json;q=0.9, application/n-triples;q=0.8")
+	res, err := server.WebIDClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received status %d", res.StatusCode)
+	}
+	statements, err := parseRDF(io.LimitReader(res.Body, maxWebIDProfileSize), res.Header.Get("Content-Type"), doc.String())
+	if err != nil {
+		return nil, err
+	}
+
+	subject := nquads.NewIri(webid.String()).Encode()
+	keyNodes := make(map[string]bool)
+	for _, st := range statements {
+		if st.SubjectNode().Encode() == subject && st.Predicate() == cert_key {
+			keyNodes[st.ObjectNode().Encode()] = true
+		}
+	}
+	moduli, exponents := make(map[string][]string), make(map[string][]string)
+	for _, st := range statements {
+		k := st.SubjectNode().Encode()
+		value, _, _, ok := st.ObjectLiteral()
+		if !keyNodes[k] || !ok {
+			continue
+		} else if st.Predicate() == cert_modulus {
+			moduli[k] = append(moduli[k], value)
+		} else if st.Predicate() == cert_exponent {
+			exponents[k] = append(exponents[k], value)
+		}
+	}
+	keys := []webidKey{}
+	for k := range keyNodes {
+		for _, m := range moduli[k] {
+			for _, e := range exponents[k] {
+				keys = append(keys, webidKey{m, e})
+			}
+		}
+	}
+	return keys, nil
+}
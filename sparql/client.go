@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"net/url"
 	"io/ioutil"
+	"github.com/mildred/SmartWeb/nquads"
 )
 
 type Client struct {
@@ -29,8 +30,10 @@ type Results struct {
 type Binding map[string]BindingValue
 
 type BindingValue struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Datatype string `json:"datatype,omitempty"`
+	Lang     string `json:"xml:lang,omitempty"`
 }
 
 type SparqlError struct {
@@ -142,6 +145,39 @@ func (c *Client) SelectNamedGraph(query string, namedGraph []string) (*Response,
 	return &result, nil
 }
 
+// Run a CONSTRUCT or DESCRIBE query, the resulting triples are returned in
+// the default graph
+func (c *Client) Construct(query string) ([]*nquads.Statement, error) {
+	vals := url.Values{
+		"query": []string{query},
+	}
+	
+	req, err := http.NewRequest("POST", c.QueryUrl, bytes.NewReader([]byte(vals.Encode())))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/n-triples, text/plain;q=0.5")
+	
+	resp, err := c.http.Do(req)
+	
+	if err != nil {
+		log.Printf("QUERY: %s Failed\n", query)
+		return nil, err
+	} else {
+		log.Printf("QUERY: %s [%s]\n", query, resp.Status)
+		defer resp.Body.Close();
+	}
+	
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.New(resp.Status)
+	}
+	
+	r := nquads.NewReader(resp.Body)
+	r.Triples = true
+	return r.ReadAll()
+}
+
 func (c *Client) Update(query string) (*Response, error) {
 	vals := url.Values{
 		"update": []string{query},
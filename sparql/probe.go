@@ -0,0 +1,105 @@
+package sparql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Triplestore implementation behind an endpoint
+type Dialect string
+
+const (
+	UnknownDialect Dialect = "unknown"
+	Blazegraph     Dialect = "Blazegraph"
+	Fuseki         Dialect = "Fuseki"
+	Sesame         Dialect = "Sesame"
+	FourStore      Dialect = "4store"
+)
+
+// Tell if the default graph of a query without FROM is the union of all the
+// graphs, as SmartWeb queries expect. Fuseki needs tdb:unionDefaultGraph for
+// that and unknown stores are assumed not to.
+func (d Dialect) UnionDefaultGraph() bool {
+	return d == Blazegraph || d == Sesame || d == FourStore
+}
+
+// Guess the dialect from the response of the query endpoint and its URL
+func detectDialect(resp *http.Response, queryUrl string) Dialect {
+	server := strings.ToLower(resp.Header.Get("Server"))
+	u := strings.ToLower(queryUrl)
+	switch {
+	case strings.Contains(server, "fuseki") || resp.Header.Get("Fuseki-Request-Id") != "":
+		return Fuseki
+	case strings.Contains(server, "4s-httpd"):
+		return FourStore
+	case strings.Contains(server, "blazegraph") || strings.Contains(u, "/blazegraph/") || strings.Contains(u, "/bigdata/"):
+		return Blazegraph
+	case strings.Contains(u, "/repositories/") || strings.Contains(server, "sesame") || strings.Contains(server, "rdf4j"):
+		return Sesame
+	}
+	return UnknownDialect
+}
+
+// Check that the query and update endpoints are usable with an ASK query and
+// an update that changes nothing, and detect the dialect of the endpoint.
+// Each request must complete within timeout.
+func (c *Client) Probe(timeout time.Duration) (Dialect, error) {
+	client := http.Client{Timeout: timeout}
+
+	vals := url.Values{"query": []string{"ASK {}"}}
+	req, err := http.NewRequest("POST", c.QueryUrl, bytes.NewReader([]byte(vals.Encode())))
+	if err != nil {
+		return UnknownDialect, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/sparql-results+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return UnknownDialect, fmt.Errorf("SPARQL query endpoint %s unreachable: %v", c.QueryUrl, err)
+	}
+	defer resp.Body.Close()
+
+	dialect := detectDialect(resp, c.QueryUrl)
+	if resp.StatusCode == http.StatusNotFound {
+		return dialect, fmt.Errorf("SPARQL query endpoint %s not found, check the namespace or repository exists", c.QueryUrl)
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return dialect, fmt.Errorf("SPARQL query endpoint %s: %s", c.QueryUrl, resp.Status)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return dialect, fmt.Errorf("SPARQL query endpoint %s: invalid JSON results: %v", c.QueryUrl, err)
+	}
+	if _, ok := result["boolean"].(bool); !ok {
+		return dialect, fmt.Errorf("SPARQL query endpoint %s: ASK did not return a boolean", c.QueryUrl)
+	}
+
+	if c.UpdateUrl == "" {
+		return dialect, fmt.Errorf("No SPARQL update endpoint")
+	}
+
+	vals = url.Values{"update": []string{"INSERT DATA { }"}}
+	resp, err = client.PostForm(c.UpdateUrl, vals)
+	if err != nil {
+		return dialect, fmt.Errorf("SPARQL update endpoint %s unreachable: %v", c.UpdateUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("SPARQL update endpoint %s: %s %s", c.UpdateUrl, resp.Status, strings.TrimSpace(string(msg)))
+		if dialect == Sesame && !strings.HasSuffix(c.UpdateUrl, "/statements") {
+			err = fmt.Errorf("%v (Sesame updates go to the /statements endpoint of the repository)", err)
+		}
+		return dialect, err
+	}
+
+	return dialect, nil
+}
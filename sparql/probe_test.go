@@ -0,0 +1,69 @@
+package sparql_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/sparqltest"
+)
+
+func TestProbe(t *testing.T) {
+	endpoint := sparqltest.NewServer()
+	defer endpoint.Close()
+
+	dialect, err := endpoint.SparqlClient().Probe(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialect != sparql.UnknownDialect {
+		t.Errorf("dialect %s", dialect)
+	}
+
+	_, err = sparql.NewClient(endpoint.URL+"/missing", endpoint.UpdateUrl).Probe(time.Second)
+	if err == nil {
+		t.Errorf("missing query endpoint accepted")
+	}
+	_, err = sparql.NewClient(endpoint.QueryUrl, endpoint.URL+"/missing").Probe(time.Second)
+	if err == nil {
+		t.Errorf("missing update endpoint accepted")
+	}
+	_, err = sparql.NewClient(endpoint.QueryUrl, "").Probe(time.Second)
+	if err == nil {
+		t.Errorf("missing update URL accepted")
+	}
+}
+
+func TestProbeDialect(t *testing.T) {
+	var server string
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Server", server)
+		if req.FormValue("query") != "" {
+			res.Header().Set("Content-Type", "application/sparql-results+json")
+			res.Write([]byte(`{"head":{},"boolean":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		server, path string
+		dialect      sparql.Dialect
+	}{
+		{"Apache Jena Fuseki (4.9.0)", "/ds/sparql", sparql.Fuseki},
+		{"4s-httpd/v1.1.5", "/sparql/", sparql.FourStore},
+		{"Jetty(9.4.z)", "/blazegraph/namespace/kb/sparql", sparql.Blazegraph},
+		{"Apache-Coyote/1.1", "/openrdf-sesame/repositories/smartweb", sparql.Sesame},
+		{"", "/sparql", sparql.UnknownDialect},
+	}
+	for _, test := range tests {
+		server = test.server
+		dialect, err := sparql.NewClient(ts.URL+test.path, ts.URL+test.path).Probe(time.Second)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+		} else if dialect != test.dialect {
+			t.Errorf("%s %s: dialect %s, expected %s", test.server, test.path, dialect, test.dialect)
+		}
+	}
+}
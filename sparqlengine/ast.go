@@ -0,0 +1,130 @@
+package sparqlengine
+
+import (
+	"github.com/mildred/SmartWeb/nquads"
+)
+
+// A term in a pattern is a nquads.Node, a variable or a blankTerm
+type term interface{}
+
+type variable string
+
+// Blank node in a query: a variable in patterns, a fresh blank node in
+// templates and data
+type blankTerm string
+
+type triplePattern struct {
+	s term
+	p interface{} // variable, *nquads.IriNode or a property path
+	o term
+}
+
+// Triple in a template, g is nil for the default graph
+type quadPattern struct {
+	s, p, o term
+	g       term
+}
+
+// Property paths
+type pathInverse struct{ p interface{} }
+type pathSeq struct{ a, b interface{} }
+type pathAlt struct{ a, b interface{} }
+type pathMod struct {
+	p        interface{}
+	min      int
+	infinite bool
+}
+type pathNegated struct {
+	iris    []string
+	inverse []string
+}
+
+type groupPattern struct {
+	elements []interface{}
+}
+
+type bgp []triplePattern
+type optionalPattern struct{ group *groupPattern }
+type minusPattern struct{ group *groupPattern }
+type unionPattern struct{ groups []*groupPattern }
+type graphPattern struct {
+	name  term
+	group *groupPattern
+}
+type filterPattern struct{ expr expression }
+type bindPattern struct {
+	expr expression
+	v    string
+}
+type valuesPattern struct {
+	vars []string
+	rows [][]nquads.Node // nil for UNDEF
+}
+
+type expression interface{}
+
+type exprTerm struct{ t term }
+type exprBinary struct {
+	op   string
+	a, b expression
+}
+type exprUnary struct {
+	op string
+	a  expression
+}
+type exprCall struct {
+	name      string // upper case built-in name or function IRI
+	args      []expression
+	distinct  bool
+	star      bool
+	separator string
+}
+type exprIn struct {
+	a    expression
+	list []expression
+	not  bool
+}
+type exprExists struct {
+	group *groupPattern
+	not   bool
+}
+
+type projection struct {
+	v    string
+	expr expression
+}
+
+type orderCondition struct {
+	expr expression
+	desc bool
+}
+
+type query struct {
+	form       string // SELECT, ASK or CONSTRUCT
+	distinct   bool
+	projection []projection // nil for SELECT *
+	template   []quadPattern
+	from       []string
+	fromNamed  []string
+	where      *groupPattern
+	groupBy    []projection
+	having     []expression
+	orderBy    []orderCondition
+	limit      int // -1 if not set
+	offset     int
+	values     *valuesPattern
+}
+
+type insertData struct{ quads []quadPattern }
+type deleteData struct{ quads []quadPattern }
+type modify struct {
+	with     string
+	del, ins []quadPattern
+	where    *groupPattern
+}
+type graphManagement struct {
+	op     string // CLEAR, DROP or CREATE
+	silent bool
+	target string // GRAPH, DEFAULT, NAMED or ALL
+	iri    string
+}
@@ -0,0 +1,156 @@
+// Package sparqlengine evaluates a subset of SPARQL 1.1 queries and updates
+// over an embedded quad store: basic graph patterns, GRAPH, OPTIONAL, UNION,
+// MINUS, FILTER, BIND, VALUES, property paths, aggregates, solution
+// modifiers, INSERT/DELETE DATA, DELETE/INSERT WHERE and graph management.
+//
+// Without FROM clause or protocol dataset, the default graph is the union of
+// all the graphs of the store.
+package sparqlengine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/quadstore"
+	"sync/atomic"
+)
+
+type Engine struct {
+	Store *quadstore.Store
+	// Base IRI to resolve relative IRIs in queries
+	Base string
+
+	blankPrefix string
+	blankCount  uint64
+}
+
+// RDF dataset of a query. Nil lists use the FROM and FROM NAMED clauses of
+// the query, or all the graphs of the store if absent.
+type Dataset struct {
+	Default []string // graphs merged in the default graph
+	Named   []string
+}
+
+type Result struct {
+	Form       string // SELECT, ASK or CONSTRUCT
+	Vars       []string
+	Bindings   []map[string]nquads.Node
+	Boolean    bool
+	Statements []*nquads.Statement
+}
+
+func NewEngine(store *quadstore.Store) *Engine {
+	var b [4]byte
+	rand.Read(b[:])
+	return &Engine{Store: store, blankPrefix: "e" + hex.EncodeToString(b[:]) + "b"}
+}
+
+func (e *Engine) newBlank() nquads.Node {
+	n := atomic.AddUint64(&e.blankCount, 1)
+	return nquads.NewBlank(fmt.Sprintf("%s%d", e.blankPrefix, n))
+}
+
+func (e *Engine) evaluator(defaults, named []string) *evaluator {
+	ev := &evaluator{engine: e, store: e.Store}
+	if defaults != nil {
+		ev.defaults = []nquads.Node{}
+		for _, g := range defaults {
+			ev.defaults = append(ev.defaults, nquads.NewIri(g))
+		}
+	}
+	if named != nil {
+		ev.named = make(map[string]nquads.Node)
+		for _, g := range named {
+			n := nquads.NewIri(g)
+			ev.named[n.Encode()] = n
+		}
+	}
+	return ev
+}
+
+// Run a SELECT, ASK or CONSTRUCT query. ds can be nil.
+func (e *Engine) Query(query string, ds *Dataset) (*Result, error) {
+	q, err := parseQuery(query, e.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults, named := q.from, q.fromNamed
+	if q.from == nil && q.fromNamed != nil {
+		// FROM NAMED only gives an empty default graph
+		defaults = []string{}
+	}
+	if q.fromNamed == nil && q.from != nil {
+		named = []string{}
+	}
+	if ds != nil && (ds.Default != nil || ds.Named != nil) {
+		defaults, named = ds.Default, ds.Named
+	}
+	ev := e.evaluator(defaults, named)
+
+	res := &Result{Form: q.form}
+	switch q.form {
+	case "ASK":
+		q.limit = 1
+		_, solutions, err := ev.evalSelect(q)
+		if err != nil {
+			return nil, err
+		}
+		res.Boolean = len(solutions) > 0
+	case "CONSTRUCT":
+		_, solutions, err := ev.evalSelect(q)
+		if err != nil {
+			return nil, err
+		}
+		res.Statements = ev.construct(q.template, solutions)
+	default:
+		vars, solutions, err := ev.evalSelect(q)
+		if err != nil {
+			return nil, err
+		}
+		res.Vars = vars
+		for _, s := range solutions {
+			res.Bindings = append(res.Bindings, map[string]nquads.Node(s))
+		}
+	}
+	return res, nil
+}
+
+// Check that a query only reads the graphs of its protocol dataset: it may not
+// call other endpoints with SERVICE, replace the dataset with FROM or FROM
+// NAMED, nor use GRAPH with a variable that some stores match against all
+// their graphs, or with an IRI that is not one of the named graphs.
+func CheckDataset(query string, named []string) error {
+	p, err := newParser(query, "")
+	if err != nil {
+		return err
+	}
+	if err := p.prologue(); err != nil {
+		return err
+	}
+	allowed := make(map[string]bool)
+	for _, g := range named {
+		allowed[g] = true
+	}
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		if t.kind != tokKeyword {
+			continue
+		} else if t.text == "SERVICE" {
+			return fmt.Errorf("SERVICE is not allowed at offset %d", t.pos)
+		} else if t.text == "FROM" {
+			return fmt.Errorf("FROM is not allowed at offset %d", t.pos)
+		} else if t.text == "GRAPH" && p.peek().kind == tokVar {
+			return fmt.Errorf("GRAPH ?%s is not allowed at offset %d", p.peek().text, t.pos)
+		} else if t.text == "GRAPH" && p.isIri() {
+			g, err := p.iri()
+			if err != nil {
+				return err
+			} else if !allowed[g] {
+				return fmt.Errorf("GRAPH <%s> is not allowed at offset %d", g, t.pos)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package sparqlengine
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/quadstore"
+)
+
+const data = `
+<http://ex.org/> <tag:mildred.fr,2015-05:SmartWeb#child> <http://ex.org/a> <http://ex.org/> .
+<http://ex.org/> <tag:mildred.fr,2015-05:SmartWeb#hash> <sha1:0001> <http://ex.org/> .
+<http://ex.org/a> <tag:mildred.fr,2015-05:SmartWeb#hash> <sha1:0002> <http://ex.org/a> .
+<http://ex.org/a> <tag:mildred.fr,2015-05:SmartWeb#contentType> "text/plain" <http://ex.org/a> .
+<http://ex.org/b> <tag:mildred.fr,2015-05:SmartWeb#hash> <sha1:0002> <http://ex.org/b> .
+_:acl <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <tag:mildred.fr,2015-05:SmartWeb#ACL> <http://ex.org/> .
+_:acl <tag:mildred.fr,2015-05:SmartWeb#about> <http://ex.org/> <http://ex.org/> .
+_:acl <tag:mildred.fr,2015-05:SmartWeb#user> _:group <http://ex.org/> .
+_:group <tag:mildred.fr,2015-05:SmartWeb#user> <http://ex.org/alice> <http://ex.org/> .
+_:acl <tag:mildred.fr,2015-05:SmartWeb#allow> "GET" <http://ex.org/> .
+_:acl <tag:mildred.fr,2015-05:SmartWeb#deny> <tag:mildred.fr,2015-05:SmartWeb#Default> <http://ex.org/> .
+<http://ex.org/a> <http://ex.org/size> "12"^^<http://www.w3.org/2001/XMLSchema#integer> <http://ex.org/a> .
+<http://ex.org/b> <http://ex.org/size> "30"^^<http://www.w3.org/2001/XMLSchema#integer> <http://ex.org/b> .
+`
+
+func newEngine(t *testing.T) *Engine {
+	quads, err := nquads.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := quadstore.NewMemoryStore()
+	if err := store.Add(quads...); err != nil {
+		t.Fatal(err)
+	}
+	return NewEngine(store)
+}
+
+// Encode the solutions as sorted lines of var=value
+func solutions(res *Result) string {
+	var lines []string
+	for _, b := range res.Bindings {
+		var line []string
+		for _, v := range res.Vars {
+			if n, ok := b[v]; ok {
+				line = append(line, v+"="+n.Encode())
+			}
+		}
+		lines = append(lines, strings.Join(line, " "))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestSelect(t *testing.T) {
+	e := newEngine(t)
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT ?hash ?type WHERE {
+		    GRAPH <http://ex.org/a> {
+		      OPTIONAL { <http://ex.org/a> sw:contentType ?type }
+		      <http://ex.org/a> sw:hash ?hash
+		    }
+		  } LIMIT 1`,
+			`hash=<sha1:0002> type="text/plain"`},
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT ?hash ?type WHERE {
+		    GRAPH <http://ex.org/b> {
+		      OPTIONAL { <http://ex.org/b> sw:contentType ?type }
+		      <http://ex.org/b> sw:hash ?hash
+		    }
+		  }`,
+			`hash=<sha1:0002>`},
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT (count(?subj) AS ?count) WHERE { ?subj sw:hash <sha1:0002> . }`,
+			`count="2"^^<http://www.w3.org/2001/XMLSchema#integer>`},
+		{`SELECT DISTINCT ?g WHERE {
+		    GRAPH ?g {?s ?p ?o}
+		    FILTER ( strstarts(str(?g), "http://ex.org/") && ?g != <http://ex.org/> )
+		  }`,
+			"g=<http://ex.org/a>\ng=<http://ex.org/b>"},
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT ?page ?user ?auth ?act
+		  FROM <http://ex.org/a>
+		  FROM <http://ex.org/>
+		  WHERE {
+		    VALUES ?page { <http://ex.org/a> <http://ex.org/> }
+		    ?acl a sw:ACL ; sw:about ?page ; sw:user+ ?user ; ?auth ?act .
+		    VALUES ?user { <http://ex.org/alice> sw:Anonymous }
+		    VALUES ?auth { sw:allow sw:deny }
+		    VALUES ?act { "GET" sw:Default }
+		  }`,
+			`page=<http://ex.org/> user=<http://ex.org/alice> auth=<tag:mildred.fr,2015-05:SmartWeb#allow> act="GET"` + "\n" +
+				`page=<http://ex.org/> user=<http://ex.org/alice> auth=<tag:mildred.fr,2015-05:SmartWeb#deny> act=<tag:mildred.fr,2015-05:SmartWeb#Default>`},
+		{`SELECT ?s WHERE { ?s <http://ex.org/size> ?size FILTER(?size > 20) }`,
+			`s=<http://ex.org/b>`},
+		{`SELECT ?s (?size * 2 AS ?double) WHERE { ?s <http://ex.org/size> ?size } ORDER BY DESC(?size) LIMIT 1`,
+			`s=<http://ex.org/b> double="60"^^<http://www.w3.org/2001/XMLSchema#integer>`},
+		{`SELECT (SUM(?size) AS ?total) WHERE { ?s <http://ex.org/size> ?size }`,
+			`total="42"^^<http://www.w3.org/2001/XMLSchema#integer>`},
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT ?hash (COUNT(?s) AS ?n) WHERE { ?s sw:hash ?hash } GROUP BY ?hash HAVING (COUNT(?s) > 1)`,
+			`hash=<sha1:0002> n="2"^^<http://www.w3.org/2001/XMLSchema#integer>`},
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT ?s WHERE { ?s sw:hash ?h MINUS { ?s sw:contentType ?t } FILTER NOT EXISTS { ?x sw:child ?s } }`,
+			"s=<http://ex.org/>\ns=<http://ex.org/b>"},
+		{`PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		  SELECT ?s ?o WHERE { { ?s sw:child ?o } UNION { ?s ^sw:child ?o } }`,
+			"s=<http://ex.org/> o=<http://ex.org/a>\ns=<http://ex.org/a> o=<http://ex.org/>"},
+		{`SELECT ?x WHERE { BIND(concat("a", ucase("b")) AS ?x) }`,
+			`x="aB"`},
+		{`SELECT ?s WHERE { ?s <http://ex.org/size> ?size FILTER(?size IN (1, 12)) }`,
+			`s=<http://ex.org/a>`},
+	}
+	for _, test := range tests {
+		res, err := e.Query(test.query, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if s := solutions(res); s != test.expected {
+			t.Errorf("%s:\n%s\nexpected:\n%s", test.query, s, test.expected)
+		}
+	}
+}
+
+// GROUP_CONCAT joins the values in the order of the matches, which the store
+// does not define
+func TestGroupConcat(t *testing.T) {
+	e := newEngine(t)
+	res, err := e.Query(`SELECT (GROUP_CONCAT(?size; separator=",") AS ?all) WHERE {
+	    ?s <http://ex.org/size> ?size }`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Bindings) != 1 {
+		t.Fatalf("solutions: %s", solutions(res))
+	}
+	lit, ok := res.Bindings[0]["all"].(*nquads.LiteralNode)
+	if !ok {
+		t.Fatalf("solutions: %s", solutions(res))
+	}
+	values := strings.Split(lit.Value(), ",")
+	sort.Strings(values)
+	if all := strings.Join(values, ","); all != "12,30" {
+		t.Errorf("all=%q", lit.Value())
+	}
+}
+
+func TestAskConstruct(t *testing.T) {
+	e := newEngine(t)
+	res, err := e.Query(`ASK { GRAPH <http://ex.org/a> { ?s ?p ?o } }`, &Dataset{Named: []string{"http://ex.org/b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Boolean {
+		t.Errorf("graph outside of the dataset is visible")
+	}
+
+	res, err = e.Query(`CONSTRUCT { ?s ?p ?o } WHERE { GRAPH <http://ex.org/a> { ?s ?p ?o } }`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Statements) != 3 {
+		t.Errorf("CONSTRUCT returned %d statements: %v", len(res.Statements), res.Statements)
+	}
+	for _, st := range res.Statements {
+		if st.GraphNode() != nil {
+			t.Errorf("CONSTRUCT returned a quad: %v", st)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	e := newEngine(t)
+	err := e.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		DROP SILENT GRAPH <http://ex.org/missing> ;
+		CLEAR SILENT GRAPH <http://ex.org/b>;
+		INSERT DATA {
+			GRAPH <http://ex.org/b> {
+				<http://ex.org/b> sw:hash <sha1:0003> ;
+					sw:contentType "text/html" .
+				<http://ex.org/> sw:child <http://ex.org/b> , <http://ex.org/c> .
+			}
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.Store.Match(nil, nil, nil, nquads.NewIri("http://ex.org/b"))); n != 4 {
+		t.Errorf("graph has %d quads after INSERT DATA", n)
+	}
+
+	err = e.Update(`
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+		DELETE { GRAPH <http://ex.org/b> { ?s ?p ?o } }
+		WHERE { GRAPH <http://ex.org/b> { ?s ?p ?o } FILTER (!(?p = sw:child || sameTerm(?s, <http://ex.org/b>) && ?p IN (sw:hash))) };
+		INSERT DATA { GRAPH <http://ex.org/b> { <http://ex.org/b> <http://ex.org/title> "B"@en } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quads []string
+	for _, q := range e.Store.Match(nil, nil, nil, nquads.NewIri("http://ex.org/b")) {
+		quads = append(quads, q.String())
+	}
+	sort.Strings(quads)
+	expected := `<http://ex.org/> <tag:mildred.fr,2015-05:SmartWeb#child> <http://ex.org/b> <http://ex.org/b> .
+<http://ex.org/> <tag:mildred.fr,2015-05:SmartWeb#child> <http://ex.org/c> <http://ex.org/b> .
+<http://ex.org/b> <http://ex.org/title> "B"@en <http://ex.org/b> .
+<http://ex.org/b> <tag:mildred.fr,2015-05:SmartWeb#hash> <sha1:0003> <http://ex.org/b> .`
+	if s := strings.Join(quads, "\n"); s != expected {
+		t.Errorf("DELETE WHERE:\n%s\nexpected:\n%s", s, expected)
+	}
+
+	if err := e.Update(`DROP GRAPH <http://ex.org/missing>`); err == nil {
+		t.Errorf("DROP of a missing graph without SILENT succeeded")
+	}
+	if err := e.Update(`DELETE WHERE { GRAPH <http://ex.org/a> { ?s ?p ?o } }`); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.Store.Match(nil, nil, nil, nquads.NewIri("http://ex.org/a"))); n != 0 {
+		t.Errorf("graph has %d quads after DELETE WHERE", n)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	e := newEngine(t)
+	for _, query := range []string{
+		`SELECT ?s WHERE { ?s ?p }`,
+		`SELECT ?s WHERE { ?s ?p ?o `,
+		`SELECT ?s WHERE { ?s unknown:p ?o }`,
+		`SELECT ?s WHERE { SERVICE <http://ex.org/sparql> { ?s ?p ?o } }`,
+	} {
+		if _, err := e.Query(query, nil); err == nil {
+			t.Errorf("%s: no error", query)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%s: %v is not a syntax error", query, err)
+		}
+	}
+}
+
+func TestCheckDataset(t *testing.T) {
+	named := []string{"http://ex.org/a", "http://ex.org/b"}
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{`SELECT ?s WHERE { ?s ?p ?o }`, true},
+		{`SELECT ?s WHERE { GRAPH <http://ex.org/a> { ?s ?p ?o } }`, true},
+		{`PREFIX ex: <http://ex.org/> SELECT ?s WHERE { GRAPH ex:b { ?s ?p ?o } }`, true},
+		{`BASE <http://ex.org/> SELECT ?s WHERE { GRAPH <a> { ?s ?p ?o } }`, true},
+		{`SELECT ?s WHERE { ?s <http://ex.org/graph> "GRAPH ?g" } # SERVICE`, true},
+		{`PREFIX ex: <http://ex.org/> SELECT ?s WHERE { ?s ex:service ?o }`, true},
+		{`SELECT ?s WHERE { GRAPH ?g { ?s ?p ?o } }`, false},
+		{`select ?s where { graph $g { ?s ?p ?o } }`, false},
+		{`SELECT ?s WHERE { GRAPH <http://ex.org/c> { ?s ?p ?o } }`, false},
+		{`PREFIX ex: <http://ex.org/> SELECT ?s WHERE { GRAPH ex:c { ?s ?p ?o } }`, false},
+		{`SELECT ?s WHERE { GRAPH ex:a { ?s ?p ?o } }`, false},
+		{`SELECT ?s FROM <http://ex.org/c> WHERE { ?s ?p ?o }`, false},
+		{`SELECT ?s FROM NAMED <http://ex.org/c> WHERE { ?s ?p ?o }`, false},
+		{`SELECT ?s WHERE { SERVICE <http://ex.org/sparql> { ?s ?p ?o } }`, false},
+		{`SELECT ?s WHERE { ?s ?p "unterminated }`, false},
+	}
+	for _, test := range tests {
+		if err := CheckDataset(test.query, named); (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.query, err)
+		}
+	}
+}
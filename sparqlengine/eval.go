@@ -0,0 +1,461 @@
+package sparqlengine
+
+import (
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/quadstore"
+)
+
+// Solution mapping from variable names to RDF terms
+type binding map[string]nquads.Node
+
+func (b binding) extend(v string, n nquads.Node) binding {
+	res := make(binding, len(b)+1)
+	for k, val := range b {
+		res[k] = val
+	}
+	res[v] = n
+	return res
+}
+
+// Tell if two solutions agree on their shared variables
+func compatible(a, b binding) bool {
+	for k, v := range a {
+		if w, ok := b[k]; ok && !sameTerm(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTerm(a, b nquads.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Encode() == b.Encode()
+}
+
+// Variable name for blank nodes in patterns, not visible in SELECT *
+func blankVariable(label blankTerm) string {
+	return "_:" + string(label)
+}
+
+type evaluator struct {
+	engine   *Engine
+	store    *quadstore.Store
+	defaults []nquads.Node // nil for the union of all graphs
+	named    map[string]nquads.Node
+}
+
+func (e *evaluator) namedGraphs() []nquads.Node {
+	if e.named == nil {
+		return e.store.Graphs()
+	}
+	var res []nquads.Node
+	for _, g := range e.named {
+		res = append(res, g)
+	}
+	return res
+}
+
+func (e *evaluator) isNamed(g nquads.Node) bool {
+	if e.named == nil {
+		for _, n := range e.store.Graphs() {
+			if sameTerm(n, g) {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := e.named[g.Encode()]
+	return ok
+}
+
+// Match triples in the active graph
+func (e *evaluator) match(s, p, o nquads.Node, graph nquads.Node) []*nquads.Statement {
+	if graph != nil {
+		return e.store.Match(s, p, o, graph)
+	}
+	var quads []*nquads.Statement
+	if e.defaults == nil {
+		quads = e.store.Match(s, p, o, nil)
+	} else {
+		for _, g := range e.defaults {
+			quads = append(quads, e.store.Match(s, p, o, g)...)
+		}
+	}
+	if len(quads) <= 1 {
+		return quads
+	}
+	// The default graph is a merge, remove duplicate triples
+	seen := make(map[string]bool)
+	var res []*nquads.Statement
+	for _, q := range quads {
+		t := nquads.NewStatement(q.SubjectNode(), q.PredicateNode(), q.ObjectNode(), nil)
+		key := t.String()
+		if !seen[key] {
+			seen[key] = true
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// Evaluate a group with each input solution, filters apply to the whole
+// group
+func (e *evaluator) evalGroup(group *groupPattern, graph nquads.Node, input []binding) ([]binding, error) {
+	solutions := input
+	var filters []expression
+	var err error
+	for _, elt := range group.elements {
+		switch elt := elt.(type) {
+		case bgp:
+			for _, t := range elt {
+				solutions, err = e.evalTriple(t, graph, solutions)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case *groupPattern:
+			solutions, err = e.evalGroup(elt, graph, solutions)
+		case *optionalPattern:
+			var res []binding
+			for _, s := range solutions {
+				opt, err := e.evalGroup(elt.group, graph, []binding{s})
+				if err != nil {
+					return nil, err
+				}
+				if len(opt) == 0 {
+					res = append(res, s)
+				} else {
+					res = append(res, opt...)
+				}
+			}
+			solutions = res
+		case *minusPattern:
+			var minus []binding
+			minus, err = e.evalGroup(elt.group, graph, []binding{{}})
+			var res []binding
+		solution:
+			for _, s := range solutions {
+				for _, m := range minus {
+					if compatible(s, m) && sharesVariable(s, m) {
+						continue solution
+					}
+				}
+				res = append(res, s)
+			}
+			solutions = res
+		case *unionPattern:
+			var res []binding
+			for _, g := range elt.groups {
+				sub, err := e.evalGroup(g, graph, solutions)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, sub...)
+			}
+			solutions = res
+		case *graphPattern:
+			solutions, err = e.evalGraph(elt, solutions)
+		case *filterPattern:
+			filters = append(filters, elt.expr)
+		case *bindPattern:
+			var res []binding
+			for _, s := range solutions {
+				if _, ok := s[elt.v]; ok {
+					return nil, &EvalError{"BIND to a variable already in scope: ?" + elt.v}
+				}
+				if val, err := e.eval(elt.expr, s, graph, nil); err == nil {
+					s = s.extend(elt.v, val)
+				}
+				res = append(res, s)
+			}
+			solutions = res
+		case *valuesPattern:
+			solutions = joinValues(solutions, elt)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(filters) == 0 {
+		return solutions, nil
+	}
+	var res []binding
+	for _, s := range solutions {
+		keep := true
+		for _, f := range filters {
+			val, err := e.eval(f, s, graph, nil)
+			if err != nil || !effectiveBoolean(val) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+func sharesVariable(a, b binding) bool {
+	for k := range a {
+		if _, ok := b[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func joinValues(solutions []binding, values *valuesPattern) []binding {
+	var res []binding
+	for _, s := range solutions {
+	row:
+		for _, row := range values.rows {
+			r := s
+			for i, v := range values.vars {
+				if row[i] == nil {
+					continue
+				}
+				if cur, ok := r[v]; ok {
+					if !sameTerm(cur, row[i]) {
+						continue row
+					}
+					continue
+				}
+				r = r.extend(v, row[i])
+			}
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (e *evaluator) evalGraph(g *graphPattern, solutions []binding) ([]binding, error) {
+	var res []binding
+	for _, s := range solutions {
+		var name nquads.Node
+		var v string
+		switch n := g.name.(type) {
+		case variable:
+			v = string(n)
+			name = s[v]
+		case nquads.Node:
+			name = n
+		}
+		if name != nil {
+			if !e.isNamed(name) {
+				continue
+			}
+			sub, err := e.evalGroup(g.group, name, []binding{s})
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, sub...)
+			continue
+		}
+		for _, name := range e.namedGraphs() {
+			sub, err := e.evalGroup(g.group, name, []binding{s.extend(v, name)})
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, sub...)
+		}
+	}
+	return res, nil
+}
+
+// Resolve a pattern term with a solution, returns the node if bound or the
+// variable name
+func resolve(t term, s binding) (nquads.Node, string) {
+	switch t := t.(type) {
+	case variable:
+		return s[string(t)], string(t)
+	case blankTerm:
+		v := blankVariable(t)
+		return s[v], v
+	case nquads.Node:
+		return t, ""
+	}
+	return nil, ""
+}
+
+// Bind a variable to a node, fails if the variable is bound to another node
+func bind(s binding, v string, n nquads.Node) (binding, bool) {
+	if v == "" {
+		return s, true
+	}
+	if cur, ok := s[v]; ok {
+		return s, sameTerm(cur, n)
+	}
+	return s.extend(v, n), true
+}
+
+func (e *evaluator) evalTriple(t triplePattern, graph nquads.Node, solutions []binding) ([]binding, error) {
+	var res []binding
+	for _, s := range solutions {
+		subj, sv := resolve(t.s, s)
+		obj, ov := resolve(t.o, s)
+		var pred nquads.Node
+		var pv string
+		switch p := t.p.(type) {
+		case variable:
+			pred, pv = resolve(p, s)
+		case *nquads.IriNode:
+			pred = p
+		default:
+			for _, pair := range e.evalPath(p, subj, obj, graph) {
+				r, ok := bind(s, sv, pair[0])
+				if ok {
+					r, ok = bind(r, ov, pair[1])
+				}
+				if ok {
+					res = append(res, r)
+				}
+			}
+			continue
+		}
+		if subj != nil {
+			if _, ok := subj.(*nquads.LiteralNode); ok {
+				continue
+			}
+		}
+		for _, q := range e.match(subj, pred, obj, graph) {
+			r, ok := bind(s, sv, q.SubjectNode())
+			if ok {
+				r, ok = bind(r, pv, q.PredicateNode())
+			}
+			if ok {
+				r, ok = bind(r, ov, q.ObjectNode())
+			}
+			if ok {
+				res = append(res, r)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Evaluate a property path, returns the (subject, object) pairs. Subject and
+// object are nil if unbound.
+func (e *evaluator) evalPath(path interface{}, subj, obj nquads.Node, graph nquads.Node) [][2]nquads.Node {
+	switch p := path.(type) {
+	case *nquads.IriNode:
+		var res [][2]nquads.Node
+		for _, q := range e.match(subj, p, obj, graph) {
+			res = append(res, [2]nquads.Node{q.SubjectNode(), q.ObjectNode()})
+		}
+		return res
+	case pathInverse:
+		var res [][2]nquads.Node
+		for _, pair := range e.evalPath(p.p, obj, subj, graph) {
+			res = append(res, [2]nquads.Node{pair[1], pair[0]})
+		}
+		return res
+	case pathAlt:
+		return append(e.evalPath(p.a, subj, obj, graph), e.evalPath(p.b, subj, obj, graph)...)
+	case pathSeq:
+		var res [][2]nquads.Node
+		if subj == nil && obj != nil {
+			for _, right := range e.evalPath(p.b, nil, obj, graph) {
+				for _, left := range e.evalPath(p.a, nil, right[0], graph) {
+					res = append(res, [2]nquads.Node{left[0], right[1]})
+				}
+			}
+			return res
+		}
+		for _, left := range e.evalPath(p.a, subj, nil, graph) {
+			for _, right := range e.evalPath(p.b, left[1], obj, graph) {
+				res = append(res, [2]nquads.Node{left[0], right[1]})
+			}
+		}
+		return res
+	case pathNegated:
+		var res [][2]nquads.Node
+		excluded := func(q *nquads.Statement, iris []string) bool {
+			for _, iri := range iris {
+				if pred, ok := q.PredicateNode().(*nquads.IriNode); ok && pred.Iri() == iri {
+					return true
+				}
+			}
+			return false
+		}
+		if len(p.iris) > 0 || len(p.inverse) == 0 {
+			for _, q := range e.match(subj, nil, obj, graph) {
+				if !excluded(q, p.iris) {
+					res = append(res, [2]nquads.Node{q.SubjectNode(), q.ObjectNode()})
+				}
+			}
+		}
+		if len(p.inverse) > 0 {
+			for _, q := range e.match(obj, nil, subj, graph) {
+				if !excluded(q, p.inverse) {
+					res = append(res, [2]nquads.Node{q.ObjectNode(), q.SubjectNode()})
+				}
+			}
+		}
+		return res
+	case pathMod:
+		return e.evalPathMod(p, subj, obj, graph)
+	}
+	return nil
+}
+
+func (e *evaluator) evalPathMod(p pathMod, subj, obj nquads.Node, graph nquads.Node) [][2]nquads.Node {
+	if subj == nil && obj != nil {
+		var res [][2]nquads.Node
+		for _, pair := range e.evalPathMod(pathMod{pathInverse{p.p}, p.min, p.infinite}, obj, nil, graph) {
+			res = append(res, [2]nquads.Node{pair[1], pair[0]})
+		}
+		return res
+	}
+
+	var starts []nquads.Node
+	if subj != nil {
+		starts = []nquads.Node{subj}
+	} else {
+		// All the nodes of the graph
+		seen := make(map[string]bool)
+		for _, q := range e.match(nil, nil, nil, graph) {
+			for _, n := range []nquads.Node{q.SubjectNode(), q.ObjectNode()} {
+				if !seen[n.Encode()] {
+					seen[n.Encode()] = true
+					starts = append(starts, n)
+				}
+			}
+		}
+	}
+
+	var res [][2]nquads.Node
+	for _, start := range starts {
+		seen := make(map[string]bool)
+		var reached []nquads.Node
+		if p.min == 0 {
+			seen[start.Encode()] = true
+			reached = append(reached, start)
+		}
+		frontier := []nquads.Node{start}
+		for len(frontier) > 0 {
+			var next []nquads.Node
+			for _, n := range frontier {
+				for _, pair := range e.evalPath(p.p, n, nil, graph) {
+					if !seen[pair[1].Encode()] {
+						seen[pair[1].Encode()] = true
+						reached = append(reached, pair[1])
+						next = append(next, pair[1])
+					}
+				}
+			}
+			if !p.infinite {
+				break
+			}
+			frontier = next
+		}
+		for _, n := range reached {
+			if obj == nil || sameTerm(n, obj) {
+				res = append(res, [2]nquads.Node{start, n})
+			}
+		}
+	}
+	return res
+}
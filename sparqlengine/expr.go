@@ -0,0 +1,587 @@
+package sparqlengine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/turtle"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error while evaluating a query
+type EvalError struct {
+	Msg string
+}
+
+func (e *EvalError) Error() string {
+	return "SPARQL evaluation error: " + e.Msg
+}
+
+// Expression type errors, they make the expression unbound or FILTER false
+var errType = errors.New("type error")
+var errUnbound = errors.New("unbound variable")
+
+var xsdFloat = nquads.XsdNamespace + "float"
+
+// Numeric type promotion order
+var numericRank = map[string]int{
+	turtle.XsdInteger:                          0,
+	nquads.XsdNamespace + "int":                0,
+	nquads.XsdNamespace + "long":               0,
+	nquads.XsdNamespace + "short":              0,
+	nquads.XsdNamespace + "byte":               0,
+	nquads.XsdNamespace + "nonNegativeInteger": 0,
+	nquads.XsdNamespace + "nonPositiveInteger": 0,
+	nquads.XsdNamespace + "positiveInteger":    0,
+	nquads.XsdNamespace + "negativeInteger":    0,
+	nquads.XsdNamespace + "unsignedInt":        0,
+	nquads.XsdNamespace + "unsignedLong":       0,
+	nquads.XsdNamespace + "unsignedShort":      0,
+	nquads.XsdNamespace + "unsignedByte":       0,
+	turtle.XsdDecimal:                          1,
+	xsdFloat:                                   2,
+	turtle.XsdDouble:                           3,
+}
+
+var numericTypes = []string{turtle.XsdInteger, turtle.XsdDecimal, xsdFloat, turtle.XsdDouble}
+
+func literal(n nquads.Node) (*nquads.LiteralNode, bool) {
+	lit, ok := n.(*nquads.LiteralNode)
+	return lit, ok
+}
+
+// Value and promotion rank of a numeric literal
+func numeric(n nquads.Node) (float64, int, bool) {
+	lit, ok := literal(n)
+	if !ok {
+		return 0, 0, false
+	}
+	rank, ok := numericRank[lit.Datatype()]
+	if !ok {
+		return 0, 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(lit.Value()), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return f, rank, true
+}
+
+func numberNode(f float64, rank int) nquads.Node {
+	typ := numericTypes[rank]
+	switch rank {
+	case 0:
+		return nquads.NewLiteral(strconv.FormatFloat(f, 'f', 0, 64), typ, "")
+	case 1:
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return nquads.NewLiteral(s, typ, "")
+	}
+	return nquads.NewLiteral(strconv.FormatFloat(f, 'E', -1, 64), typ, "")
+}
+
+func booleanNode(b bool) nquads.Node {
+	return nquads.NewLiteral(strconv.FormatBool(b), nquads.XsdBoolean, "")
+}
+
+// Tell if a literal is a simple literal, a xsd:string or a language tagged
+// string
+func stringLiteral(n nquads.Node) (*nquads.LiteralNode, bool) {
+	lit, ok := literal(n)
+	if !ok {
+		return nil, false
+	}
+	return lit, lit.Lang != "" || lit.Datatype() == nquads.XsdString
+}
+
+// Effective boolean value
+func ebv(n nquads.Node) (bool, error) {
+	lit, ok := literal(n)
+	if !ok {
+		return false, errType
+	}
+	if lit.Datatype() == nquads.XsdBoolean {
+		return lit.Value() == "true" || lit.Value() == "1", nil
+	}
+	if f, _, ok := numeric(n); ok {
+		return f != 0 && !math.IsNaN(f), nil
+	}
+	if _, ok := stringLiteral(n); ok {
+		return lit.Value() != "", nil
+	}
+	return false, errType
+}
+
+func effectiveBoolean(n nquads.Node) bool {
+	b, err := ebv(n)
+	return err == nil && b
+}
+
+// Compare two terms for the relational operators
+func compare(a, b nquads.Node) (int, error) {
+	if fa, _, ok := numeric(a); ok {
+		if fb, _, ok := numeric(b); ok {
+			switch {
+			case fa < fb:
+				return -1, nil
+			case fa > fb:
+				return 1, nil
+			}
+			return 0, nil
+		}
+		return 0, errType
+	}
+	la, ok1 := literal(a)
+	lb, ok2 := literal(b)
+	if !ok1 || !ok2 || la.Datatype() != lb.Datatype() || la.Lang != lb.Lang {
+		return 0, errType
+	}
+	switch la.Datatype() {
+	case nquads.XsdString, nquads.RdfLangString, nquads.XsdBoolean, nquads.XsdNamespace + "dateTime", nquads.XsdNamespace + "date":
+		return strings.Compare(la.Value(), lb.Value()), nil
+	}
+	return 0, errType
+}
+
+func equal(a, b nquads.Node) (bool, error) {
+	if sameTerm(a, b) {
+		return true, nil
+	}
+	c, err := compare(a, b)
+	if err == nil {
+		return c == 0, nil
+	}
+	_, ok1 := literal(a)
+	_, ok2 := literal(b)
+	if ok1 && ok2 {
+		if _, _, ok := numeric(a); !ok {
+			if _, _, ok := numeric(b); !ok {
+				// Literals with different or unknown datatypes
+				return false, nil
+			}
+		}
+		return false, errType
+	}
+	return false, nil
+}
+
+// Ordering of terms for ORDER BY: unbound, blank nodes, IRIs then literals
+func orderCompare(a, b nquads.Node) int {
+	kind := func(n nquads.Node) int {
+		switch n.(type) {
+		case nil:
+			return 0
+		case *nquads.BlankNode:
+			return 1
+		case *nquads.IriNode:
+			return 2
+		}
+		return 3
+	}
+	if ka, kb := kind(a), kind(b); ka != kb {
+		return ka - kb
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case *nquads.BlankNode:
+		return strings.Compare(a.Label(), b.(*nquads.BlankNode).Label())
+	case *nquads.IriNode:
+		return strings.Compare(a.Iri(), b.(*nquads.IriNode).Iri())
+	}
+	if c, err := compare(a, b); err == nil {
+		return c
+	}
+	la, _ := literal(a)
+	lb, _ := literal(b)
+	if c := strings.Compare(la.Value(), lb.Value()); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Encode(), b.Encode())
+}
+
+// Create a string literal with the language of another
+func stringLike(value string, like *nquads.LiteralNode) nquads.Node {
+	return nquads.NewLiteral(value, "", like.Lang)
+}
+
+// Evaluate an expression with a solution. group is the list of solutions of
+// the group for aggregates.
+func (e *evaluator) eval(expr expression, s binding, graph nquads.Node, group []binding) (nquads.Node, error) {
+	switch expr := expr.(type) {
+	case exprTerm:
+		n, v := resolve(expr.t, s)
+		if n == nil && v != "" {
+			return nil, errUnbound
+		}
+		return n, nil
+	case exprBinary:
+		return e.evalBinary(expr, s, graph, group)
+	case exprUnary:
+		a, err := e.eval(expr.a, s, graph, group)
+		if err != nil {
+			return nil, err
+		}
+		switch expr.op {
+		case "!":
+			b, err := ebv(a)
+			if err != nil {
+				return nil, err
+			}
+			return booleanNode(!b), nil
+		case "-":
+			f, rank, ok := numeric(a)
+			if !ok {
+				return nil, errType
+			}
+			return numberNode(-f, rank), nil
+		}
+		if _, _, ok := numeric(a); !ok {
+			return nil, errType
+		}
+		return a, nil
+	case exprIn:
+		a, err := e.eval(expr.a, s, graph, group)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, item := range expr.list {
+			b, err := e.eval(item, s, graph, group)
+			if err == nil {
+				var eq bool
+				eq, err = equal(a, b)
+				if err == nil && eq {
+					return booleanNode(!expr.not), nil
+				}
+			}
+			if err != nil {
+				lastErr = err
+			}
+		}
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return booleanNode(expr.not), nil
+	case exprExists:
+		res, err := e.evalGroup(expr.group, graph, []binding{s})
+		if err != nil {
+			return nil, err
+		}
+		return booleanNode((len(res) > 0) != expr.not), nil
+	case exprCall:
+		if aggregates[expr.name] {
+			return e.evalAggregate(expr, graph, group)
+		}
+		return e.evalCall(expr, s, graph, group)
+	}
+	return nil, errType
+}
+
+func (e *evaluator) evalBinary(expr exprBinary, s binding, graph nquads.Node, group []binding) (nquads.Node, error) {
+	a, errA := e.eval(expr.a, s, graph, group)
+	switch expr.op {
+	case "||", "&&":
+		var ba, bb bool
+		if errA == nil {
+			ba, errA = ebv(a)
+		}
+		b, errB := e.eval(expr.b, s, graph, group)
+		if errB == nil {
+			bb, errB = ebv(b)
+		}
+		short := expr.op == "||"
+		if errA == nil && ba == short || errB == nil && bb == short {
+			return booleanNode(short), nil
+		}
+		if errA != nil {
+			return nil, errA
+		}
+		if errB != nil {
+			return nil, errB
+		}
+		return booleanNode(!short), nil
+	}
+	if errA != nil {
+		return nil, errA
+	}
+	b, err := e.eval(expr.b, s, graph, group)
+	if err != nil {
+		return nil, err
+	}
+	switch expr.op {
+	case "=", "!=":
+		eq, err := equal(a, b)
+		if err != nil {
+			return nil, err
+		}
+		return booleanNode(eq == (expr.op == "=")), nil
+	case "<", ">", "<=", ">=":
+		c, err := compare(a, b)
+		if err != nil {
+			return nil, err
+		}
+		switch expr.op {
+		case "<":
+			return booleanNode(c < 0), nil
+		case ">":
+			return booleanNode(c > 0), nil
+		case "<=":
+			return booleanNode(c <= 0), nil
+		}
+		return booleanNode(c >= 0), nil
+	}
+	fa, ra, ok1 := numeric(a)
+	fb, rb, ok2 := numeric(b)
+	if !ok1 || !ok2 {
+		return nil, errType
+	}
+	rank := ra
+	if rb > rank {
+		rank = rb
+	}
+	switch expr.op {
+	case "+":
+		return numberNode(fa+fb, rank), nil
+	case "-":
+		return numberNode(fa-fb, rank), nil
+	case "*":
+		return numberNode(fa*fb, rank), nil
+	case "/":
+		if rank == 0 {
+			rank = 1
+		}
+		if fb == 0 && rank == 1 {
+			return nil, errType
+		}
+		return numberNode(fa/fb, rank), nil
+	}
+	return nil, errType
+}
+
+func (e *evaluator) evalCall(expr exprCall, s binding, graph nquads.Node, group []binding) (nquads.Node, error) {
+	switch expr.name {
+	case "BOUND":
+		_, err := e.eval(expr.args[0], s, graph, group)
+		return booleanNode(err == nil), nil
+	case "COALESCE":
+		for _, arg := range expr.args {
+			if val, err := e.eval(arg, s, graph, group); err == nil {
+				return val, nil
+			}
+		}
+		return nil, errType
+	case "IF":
+		cond, err := e.eval(expr.args[0], s, graph, group)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ebv(cond)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return e.eval(expr.args[1], s, graph, group)
+		}
+		return e.eval(expr.args[2], s, graph, group)
+	}
+
+	args := make([]nquads.Node, len(expr.args))
+	for i, arg := range expr.args {
+		val, err := e.eval(arg, s, graph, group)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = val
+	}
+
+	switch expr.name {
+	case "STR":
+		switch a := args[0].(type) {
+		case *nquads.IriNode:
+			return nquads.NewLiteral(a.Iri(), "", ""), nil
+		case *nquads.LiteralNode:
+			return nquads.NewLiteral(a.Value(), "", ""), nil
+		}
+		return nil, errType
+	case "LANG":
+		lit, ok := literal(args[0])
+		if !ok {
+			return nil, errType
+		}
+		return nquads.NewLiteral(lit.Lang, "", ""), nil
+	case "DATATYPE":
+		lit, ok := literal(args[0])
+		if !ok {
+			return nil, errType
+		}
+		return nquads.NewIri(lit.Datatype()), nil
+	case "IRI", "URI":
+		switch a := args[0].(type) {
+		case *nquads.IriNode:
+			return a, nil
+		case *nquads.LiteralNode:
+			if _, ok := stringLiteral(a); ok && a.Lang == "" {
+				return nquads.NewIri(a.Value()), nil
+			}
+		}
+		return nil, errType
+	case "SAMETERM":
+		return booleanNode(sameTerm(args[0], args[1])), nil
+	case "ISIRI", "ISURI":
+		_, ok := args[0].(*nquads.IriNode)
+		return booleanNode(ok), nil
+	case "ISBLANK":
+		_, ok := args[0].(*nquads.BlankNode)
+		return booleanNode(ok), nil
+	case "ISLITERAL":
+		_, ok := literal(args[0])
+		return booleanNode(ok), nil
+	case "ISNUMERIC":
+		_, _, ok := numeric(args[0])
+		return booleanNode(ok), nil
+	case "ABS", "CEIL", "FLOOR", "ROUND":
+		f, rank, ok := numeric(args[0])
+		if !ok {
+			return nil, errType
+		}
+		switch expr.name {
+		case "ABS":
+			f = math.Abs(f)
+		case "CEIL":
+			f = math.Ceil(f)
+		case "FLOOR":
+			f = math.Floor(f)
+		default:
+			f = math.Floor(f + 0.5)
+		}
+		return numberNode(f, rank), nil
+	case "STRLANG":
+		lit, ok := stringLiteral(args[0])
+		tag, ok2 := stringLiteral(args[1])
+		if !ok || !ok2 || lit.Lang != "" || tag.Value() == "" {
+			return nil, errType
+		}
+		return nquads.NewLiteral(lit.Value(), "", strings.ToLower(tag.Value())), nil
+	case "STRDT":
+		lit, ok := stringLiteral(args[0])
+		typ, ok2 := args[1].(*nquads.IriNode)
+		if !ok || !ok2 || lit.Lang != "" {
+			return nil, errType
+		}
+		return nquads.NewLiteral(lit.Value(), typ.Iri(), ""), nil
+	case "SUBSTR":
+		lit, ok := stringLiteral(args[0])
+		start, _, ok2 := numeric(args[1])
+		if !ok || !ok2 {
+			return nil, errType
+		}
+		runes := []rune(lit.Value())
+		from, to := int(math.Floor(start+0.5)), len(runes)+1
+		if len(args) > 2 {
+			length, _, ok := numeric(args[2])
+			if !ok {
+				return nil, errType
+			}
+			to = from + int(math.Floor(length+0.5))
+		}
+		// Positions start at 1
+		if from < 1 {
+			from = 1
+		}
+		if to > len(runes)+1 {
+			to = len(runes) + 1
+		}
+		if to < from {
+			to = from
+		}
+		if from > len(runes)+1 {
+			return stringLike("", lit), nil
+		}
+		return stringLike(string(runes[from-1:to-1]), lit), nil
+	}
+
+	// String functions
+	strs := make([]*nquads.LiteralNode, len(args))
+	for i, arg := range args {
+		lit, ok := stringLiteral(arg)
+		if !ok {
+			return nil, errType
+		}
+		strs[i] = lit
+	}
+	switch expr.name {
+	case "LANGMATCHES":
+		tag, rng := strings.ToLower(strs[0].Value()), strings.ToLower(strs[1].Value())
+		if rng == "*" {
+			return booleanNode(tag != ""), nil
+		}
+		return booleanNode(tag == rng || strings.HasPrefix(tag, rng+"-")), nil
+	case "CONCAT":
+		var res strings.Builder
+		lang := ""
+		for i, lit := range strs {
+			res.WriteString(lit.Value())
+			if i == 0 {
+				lang = lit.Lang
+			} else if lit.Lang != lang {
+				lang = ""
+			}
+		}
+		return nquads.NewLiteral(res.String(), "", lang), nil
+	case "STRLEN":
+		return nquads.NewLiteral(strconv.Itoa(utf8.RuneCountInString(strs[0].Value())), turtle.XsdInteger, ""), nil
+	case "UCASE":
+		return stringLike(strings.ToUpper(strs[0].Value()), strs[0]), nil
+	case "LCASE":
+		return stringLike(strings.ToLower(strs[0].Value()), strs[0]), nil
+	case "ENCODE_FOR_URI":
+		return nquads.NewLiteral(strings.Replace(url.QueryEscape(strs[0].Value()), "+", "%20", -1), "", ""), nil
+	case "CONTAINS":
+		return booleanNode(strings.Contains(strs[0].Value(), strs[1].Value())), nil
+	case "STRSTARTS":
+		return booleanNode(strings.HasPrefix(strs[0].Value(), strs[1].Value())), nil
+	case "STRENDS":
+		return booleanNode(strings.HasSuffix(strs[0].Value(), strs[1].Value())), nil
+	case "STRBEFORE":
+		i := strings.Index(strs[0].Value(), strs[1].Value())
+		if i < 0 {
+			return nquads.NewLiteral("", "", ""), nil
+		}
+		return stringLike(strs[0].Value()[:i], strs[0]), nil
+	case "STRAFTER":
+		i := strings.Index(strs[0].Value(), strs[1].Value())
+		if i < 0 {
+			return nquads.NewLiteral("", "", ""), nil
+		}
+		return stringLike(strs[0].Value()[i+len(strs[1].Value()):], strs[0]), nil
+	case "REGEX", "REPLACE":
+		flags := ""
+		if expr.name == "REGEX" && len(strs) == 3 || expr.name == "REPLACE" && len(strs) == 4 {
+			flags = strs[len(strs)-1].Value()
+		}
+		if strings.Trim(flags, "ims") != "" {
+			return nil, errType
+		}
+		pattern := strs[1].Value()
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errType
+		}
+		if expr.name == "REGEX" {
+			return booleanNode(re.MatchString(strs[0].Value())), nil
+		}
+		return stringLike(re.ReplaceAllString(strs[0].Value(), strs[2].Value()), strs[0]), nil
+	}
+	return nil, &EvalError{fmt.Sprintf("unsupported function %s", expr.name)}
+}
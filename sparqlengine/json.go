@@ -0,0 +1,66 @@
+package sparqlengine
+
+import (
+	"encoding/json"
+	"github.com/mildred/SmartWeb/nquads"
+	"io"
+)
+
+const ResultsMediaType = "application/sparql-results+json"
+
+type jsonTerm struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Datatype string `json:"datatype,omitempty"`
+	Lang     string `json:"xml:lang,omitempty"`
+}
+
+// Term in the SPARQL 1.1 Query Results JSON Format
+func jsonNode(n nquads.Node) jsonTerm {
+	switch n := n.(type) {
+	case *nquads.IriNode:
+		return jsonTerm{Type: "uri", Value: n.Iri()}
+	case *nquads.BlankNode:
+		return jsonTerm{Type: "bnode", Value: n.Label()}
+	case *nquads.LiteralNode:
+		t := jsonTerm{Type: "literal", Value: n.Value(), Lang: n.Lang}
+		if n.Lang == "" && n.Datatype() != nquads.XsdString {
+			t.Datatype = n.Datatype()
+		}
+		return t
+	}
+	return jsonTerm{}
+}
+
+type jsonResults struct {
+	Head struct {
+		Vars []string `json:"vars,omitempty"`
+	} `json:"head"`
+	Results *struct {
+		Bindings []map[string]jsonTerm `json:"bindings"`
+	} `json:"results,omitempty"`
+	Boolean *bool `json:"boolean,omitempty"`
+}
+
+// Write SELECT or ASK results in the SPARQL 1.1 Query Results JSON Format
+func (r *Result) WriteJSON(w io.Writer) error {
+	var res jsonResults
+	if r.Form == "ASK" {
+		res.Boolean = &r.Boolean
+	} else {
+		res.Head.Vars = r.Vars
+		res.Results = &struct {
+			Bindings []map[string]jsonTerm `json:"bindings"`
+		}{make([]map[string]jsonTerm, 0, len(r.Bindings))}
+		for _, b := range r.Bindings {
+			binding := make(map[string]jsonTerm, len(b))
+			for k, v := range b {
+				binding[k] = jsonNode(v)
+			}
+			res.Results.Bindings = append(res.Results.Bindings, binding)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(res)
+}
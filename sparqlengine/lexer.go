@@ -0,0 +1,239 @@
+package sparqlengine
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIri
+	tokPName
+	tokVar
+	tokString
+	tokLangTag
+	tokInteger
+	tokDecimal
+	tokDouble
+	tokBlank
+	tokAnon
+	tokNil
+	tokKeyword
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string // keyword in upper case, punctuation, or decoded value
+	pos  int
+}
+
+// Syntax error in a query, Pos is the byte offset in the query
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("SPARQL syntax error at offset %d: %s", e.Pos, e.Msg)
+}
+
+var (
+	iriRegexp     = regexp.MustCompile(`^<([^<>"{}|^` + "`" + `\\\x00-\x20]*)>`)
+	pnameRegexp   = regexp.MustCompile(`^([A-Za-z\x{00C0}-\x{FFFD}]([\w.\-\x{00B7}\x{00C0}-\x{FFFD}]*[\w\-\x{00B7}\x{00C0}-\x{FFFD}])?)?:((([\w:\x{00C0}-\x{FFFD}]|%[0-9A-Fa-f]{2}|\\[_~.\-!$&'()*+,;=/?#@%])(([\w.:\-\x{00B7}\x{00C0}-\x{FFFD}]|%[0-9A-Fa-f]{2}|\\[_~.\-!$&'()*+,;=/?#@%])*([\w:\-\x{00B7}\x{00C0}-\x{FFFD}]|%[0-9A-Fa-f]{2}|\\[_~.\-!$&'()*+,;=/?#@%]))?)?)`)
+	varRegexp     = regexp.MustCompile(`^[?$]([\w\x{00B7}\x{00C0}-\x{FFFD}]+)`)
+	blankRegexp   = regexp.MustCompile(`^_:([\w\x{00C0}-\x{FFFD}]([\w.\-\x{00B7}\x{00C0}-\x{FFFD}]*[\w\-\x{00B7}\x{00C0}-\x{FFFD}])?)`)
+	langRegexp    = regexp.MustCompile(`^@([a-zA-Z]+(-[a-zA-Z0-9]+)*)`)
+	doubleRegexp  = regexp.MustCompile(`^([0-9]+\.[0-9]*|\.[0-9]+|[0-9]+)[eE][+-]?[0-9]+`)
+	decimalRegexp = regexp.MustCompile(`^[0-9]*\.[0-9]+`)
+	integerRegexp = regexp.MustCompile(`^[0-9]+`)
+	wordRegexp    = regexp.MustCompile(`^[A-Za-z_][A-Za-z_0-9]*`)
+	anonRegexp    = regexp.MustCompile(`^\[[\x20\t\r\n]*\]`)
+	nilRegexp     = regexp.MustCompile(`^\([\x20\t\r\n]*\)`)
+	pnLocalEscape = regexp.MustCompile(`\\(.)`)
+)
+
+var punctuations = []string{"^^", "&&", "||", "!=", "<=", ">=", "{", "}", "(", ")", "[", "]", ".", ";", ",", "^", "/", "|", "*", "+", "?", "!", "=", "<", ">", "-"}
+
+func tokenize(query string) ([]token, error) {
+	var tokens []token
+	pos := 0
+	for {
+		// Skip white spaces and comments
+		for pos < len(query) {
+			c := query[pos]
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				pos++
+			} else if c == '#' {
+				for pos < len(query) && query[pos] != '\n' {
+					pos++
+				}
+			} else {
+				break
+			}
+		}
+		if pos >= len(query) {
+			tokens = append(tokens, token{tokEOF, "", pos})
+			return tokens, nil
+		}
+
+		s := query[pos:]
+		var tok token
+		tok.pos = pos
+		var n int
+		if m := iriRegexp.FindStringSubmatch(s); m != nil {
+			iri, err := unescapeUchar(m[1])
+			if err != nil {
+				return nil, &SyntaxError{pos, err.Error()}
+			}
+			tok.kind, tok.text, n = tokIri, iri, len(m[0])
+		} else if m := varRegexp.FindStringSubmatch(s); m != nil {
+			tok.kind, tok.text, n = tokVar, m[1], len(m[0])
+		} else if m := blankRegexp.FindStringSubmatch(s); m != nil {
+			tok.kind, tok.text, n = tokBlank, m[1], len(m[0])
+		} else if m := langRegexp.FindStringSubmatch(s); m != nil {
+			tok.kind, tok.text, n = tokLangTag, strings.ToLower(m[1]), len(m[0])
+		} else if s[0] == '"' || s[0] == '\'' {
+			str, l, err := lexString(s)
+			if err != nil {
+				return nil, &SyntaxError{pos, err.Error()}
+			}
+			tok.kind, tok.text, n = tokString, str, l
+		} else if m := doubleRegexp.FindString(s); m != "" {
+			tok.kind, tok.text, n = tokDouble, m, len(m)
+		} else if m := decimalRegexp.FindString(s); m != "" {
+			tok.kind, tok.text, n = tokDecimal, m, len(m)
+		} else if m := integerRegexp.FindString(s); m != "" {
+			tok.kind, tok.text, n = tokInteger, m, len(m)
+		} else if m := anonRegexp.FindString(s); m != "" {
+			tok.kind, tok.text, n = tokAnon, "[]", len(m)
+		} else if m := nilRegexp.FindString(s); m != "" {
+			tok.kind, tok.text, n = tokNil, "()", len(m)
+		} else if m := pnameRegexp.FindString(s); m != "" {
+			tok.kind, tok.text, n = tokPName, pnLocalEscape.ReplaceAllString(m, "$1"), len(m)
+		} else if m := wordRegexp.FindString(s); m != "" {
+			if m == "a" {
+				tok.kind, tok.text = tokKeyword, "a"
+			} else {
+				tok.kind, tok.text = tokKeyword, strings.ToUpper(m)
+			}
+			n = len(m)
+		} else {
+			for _, p := range punctuations {
+				if strings.HasPrefix(s, p) {
+					tok.kind, tok.text, n = tokPunct, p, len(p)
+					break
+				}
+			}
+			if n == 0 {
+				r, _ := utf8.DecodeRuneInString(s)
+				return nil, &SyntaxError{pos, fmt.Sprintf("unexpected character %q", r)}
+			}
+		}
+		tokens = append(tokens, tok)
+		pos += n
+	}
+}
+
+func unescapeUchar(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			res.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("invalid escape sequence")
+		}
+		var l int
+		switch s[i+1] {
+		case 'u':
+			l = 4
+		case 'U':
+			l = 8
+		default:
+			return "", fmt.Errorf("invalid escape sequence")
+		}
+		if i+2+l > len(s) {
+			return "", fmt.Errorf("invalid escape sequence")
+		}
+		r, err := strconv.ParseUint(s[i+2:i+2+l], 16, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence")
+		}
+		res.WriteRune(rune(r))
+		i += 1 + l
+	}
+	return res.String(), nil
+}
+
+// Decode a string literal at the start of s, return the value and the length
+// of the literal in s
+func lexString(s string) (string, int, error) {
+	quote := s[:1]
+	long := strings.HasPrefix(s, quote+quote+quote)
+	start := 1
+	if long {
+		quote = quote + quote + quote
+		start = 3
+	}
+	var res strings.Builder
+	for i := start; i < len(s); {
+		if strings.HasPrefix(s[i:], quote) {
+			return res.String(), i + len(quote), nil
+		}
+		c := s[i]
+		if !long && (c == '\n' || c == '\r') {
+			return "", 0, fmt.Errorf("unterminated string")
+		}
+		if c != '\\' {
+			res.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(s) {
+			break
+		}
+		switch s[i+1] {
+		case 't':
+			res.WriteByte('\t')
+		case 'b':
+			res.WriteByte('\b')
+		case 'n':
+			res.WriteByte('\n')
+		case 'r':
+			res.WriteByte('\r')
+		case 'f':
+			res.WriteByte('\f')
+		case '"', '\'', '\\':
+			res.WriteByte(s[i+1])
+		case 'u', 'U':
+			l := 4
+			if s[i+1] == 'U' {
+				l = 8
+			}
+			if i+2+l > len(s) {
+				return "", 0, fmt.Errorf("invalid escape sequence")
+			}
+			r, err := strconv.ParseUint(s[i+2:i+2+l], 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid escape sequence")
+			}
+			res.WriteRune(rune(r))
+			i += 2 + l
+			continue
+		default:
+			return "", 0, fmt.Errorf("invalid escape sequence")
+		}
+		i += 2
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,1348 @@
+package sparqlengine
+
+import (
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/turtle"
+	"strconv"
+	"strings"
+)
+
+type parser struct {
+	tokens   []token
+	pos      int
+	base     string
+	prefixes map[string]string
+	anon     int
+}
+
+func newParser(input, base string) (*parser, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens, base: base, prefixes: make(map[string]string)}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{p.peek().pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) isKeyword(kw ...string) bool {
+	t := p.peek()
+	if t.kind != tokKeyword {
+		return false
+	}
+	for _, k := range kw {
+		if t.text == k {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) isPunct(punct string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == punct
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptPunct(punct string) bool {
+	if p.isPunct(punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+// Tell if the next token is a built-in function or aggregate call
+func (p *parser) isCall() bool {
+	t := p.peek()
+	_, ok := builtins[t.text]
+	return t.kind == tokKeyword && (ok || aggregates[t.text] || t.text == "EXISTS" || t.text == "NOT")
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return p.errorf("expected %s", kw)
+	}
+	return nil
+}
+
+func (p *parser) expectPunct(punct string) error {
+	if !p.acceptPunct(punct) {
+		return p.errorf("expected '%s'", punct)
+	}
+	return nil
+}
+
+func (p *parser) newAnon() blankTerm {
+	p.anon++
+	return blankTerm(fmt.Sprintf(" anon%d", p.anon))
+}
+
+func (p *parser) prologue() error {
+	for {
+		if p.acceptKeyword("BASE") {
+			t := p.next()
+			if t.kind != tokIri {
+				return p.errorf("expected IRI after BASE")
+			}
+			p.base = turtle.ResolveIri(p.base, t.text)
+		} else if p.acceptKeyword("PREFIX") {
+			t := p.next()
+			if t.kind != tokPName || !strings.HasSuffix(t.text, ":") {
+				return p.errorf("expected prefix name after PREFIX")
+			}
+			iri := p.next()
+			if iri.kind != tokIri {
+				return p.errorf("expected IRI after PREFIX")
+			}
+			p.prefixes[t.text[:len(t.text)-1]] = turtle.ResolveIri(p.base, iri.text)
+		} else {
+			return nil
+		}
+	}
+}
+
+func (p *parser) iri() (string, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokIri:
+		p.next()
+		if p.base != "" {
+			return turtle.ResolveIri(p.base, t.text), nil
+		}
+		return t.text, nil
+	case tokPName:
+		p.next()
+		i := strings.IndexByte(t.text, ':')
+		ns, ok := p.prefixes[t.text[:i]]
+		if !ok {
+			return "", &SyntaxError{t.pos, fmt.Sprintf("undefined prefix %s", t.text[:i])}
+		}
+		return ns + t.text[i+1:], nil
+	}
+	return "", p.errorf("expected IRI")
+}
+
+func (p *parser) isIri() bool {
+	k := p.peek().kind
+	return k == tokIri || k == tokPName
+}
+
+// Parse a literal, after the string, number or boolean
+func (p *parser) literal() (nquads.Node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokString:
+		p.next()
+		if p.peek().kind == tokLangTag {
+			return nquads.NewLiteral(t.text, "", p.next().text), nil
+		}
+		if p.acceptPunct("^^") {
+			typ, err := p.iri()
+			if err != nil {
+				return nil, err
+			}
+			return nquads.NewLiteral(t.text, typ, ""), nil
+		}
+		return nquads.NewLiteral(t.text, "", ""), nil
+	case tokInteger:
+		p.next()
+		return nquads.NewLiteral(t.text, turtle.XsdInteger, ""), nil
+	case tokDecimal:
+		p.next()
+		return nquads.NewLiteral(t.text, turtle.XsdDecimal, ""), nil
+	case tokDouble:
+		p.next()
+		return nquads.NewLiteral(t.text, turtle.XsdDouble, ""), nil
+	case tokKeyword:
+		if t.text == "TRUE" || t.text == "FALSE" {
+			p.next()
+			return nquads.NewLiteral(strings.ToLower(t.text), nquads.XsdBoolean, ""), nil
+		}
+	case tokPunct:
+		// Signed numbers
+		if (t.text == "-" || t.text == "+") && p.peekAt(1).pos == t.pos+1 {
+			switch n := p.peekAt(1); n.kind {
+			case tokInteger, tokDecimal, tokDouble:
+				p.next()
+				lit, err := p.literal()
+				if err != nil {
+					return nil, err
+				}
+				l := lit.(*nquads.LiteralNode)
+				return nquads.NewLiteral(t.text+l.Value(), l.Datatype(), ""), nil
+			}
+		}
+	}
+	return nil, p.errorf("expected literal")
+}
+
+func (p *parser) isLiteral() bool {
+	t := p.peek()
+	switch t.kind {
+	case tokString, tokInteger, tokDecimal, tokDouble:
+		return true
+	case tokKeyword:
+		return t.text == "TRUE" || t.text == "FALSE"
+	case tokPunct:
+		if (t.text == "-" || t.text == "+") && p.peekAt(1).pos == t.pos+1 {
+			k := p.peekAt(1).kind
+			return k == tokInteger || k == tokDecimal || k == tokDouble
+		}
+	}
+	return false
+}
+
+// Parse a variable or a RDF term
+func (p *parser) varOrTerm() (term, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokVar:
+		p.next()
+		return variable(t.text), nil
+	case t.kind == tokBlank:
+		p.next()
+		return blankTerm(t.text), nil
+	case t.kind == tokAnon:
+		p.next()
+		return p.newAnon(), nil
+	case t.kind == tokNil:
+		p.next()
+		return nquads.NewIri(turtle.RdfNil), nil
+	case p.isIri():
+		iri, err := p.iri()
+		if err != nil {
+			return nil, err
+		}
+		return nquads.NewIri(iri), nil
+	case p.isLiteral():
+		return p.literal()
+	}
+	return nil, p.errorf("expected variable or RDF term")
+}
+
+func (p *parser) varOrIri() (term, error) {
+	if p.peek().kind == tokVar {
+		return variable(p.next().text), nil
+	}
+	iri, err := p.iri()
+	if err != nil {
+		return nil, err
+	}
+	return nquads.NewIri(iri), nil
+}
+
+// Parse a query
+func parseQuery(input, base string) (*query, error) {
+	p, err := newParser(input, base)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.prologue(); err != nil {
+		return nil, err
+	}
+
+	q := &query{limit: -1}
+	switch {
+	case p.acceptKeyword("SELECT"):
+		q.form = "SELECT"
+		if p.acceptKeyword("DISTINCT") || p.acceptKeyword("REDUCED") {
+			q.distinct = true
+		}
+		if !p.acceptPunct("*") {
+			for {
+				if p.peek().kind == tokVar {
+					q.projection = append(q.projection, projection{v: p.next().text})
+				} else if p.acceptPunct("(") {
+					expr, err := p.expression()
+					if err != nil {
+						return nil, err
+					}
+					if err := p.expectKeyword("AS"); err != nil {
+						return nil, err
+					}
+					v := p.next()
+					if v.kind != tokVar {
+						return nil, p.errorf("expected variable")
+					}
+					if err := p.expectPunct(")"); err != nil {
+						return nil, err
+					}
+					q.projection = append(q.projection, projection{v.text, expr})
+				} else {
+					break
+				}
+			}
+			if len(q.projection) == 0 {
+				return nil, p.errorf("expected projection")
+			}
+		}
+	case p.acceptKeyword("ASK"):
+		q.form = "ASK"
+	case p.acceptKeyword("CONSTRUCT"):
+		q.form = "CONSTRUCT"
+		if p.isPunct("{") {
+			q.template, err = p.quadTemplate(false)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case p.isKeyword("DESCRIBE"):
+		return nil, p.errorf("DESCRIBE is not supported")
+	default:
+		return nil, p.errorf("expected SELECT, ASK or CONSTRUCT")
+	}
+
+	for p.acceptKeyword("FROM") {
+		named := p.acceptKeyword("NAMED")
+		iri, err := p.iri()
+		if err != nil {
+			return nil, err
+		}
+		if named {
+			q.fromNamed = append(q.fromNamed, iri)
+		} else {
+			q.from = append(q.from, iri)
+		}
+	}
+
+	if q.form == "CONSTRUCT" && q.template == nil {
+		// CONSTRUCT WHERE { triples }
+		if err := p.expectKeyword("WHERE"); err != nil {
+			return nil, err
+		}
+		q.template, err = p.quadTemplate(false)
+		if err != nil {
+			return nil, err
+		}
+		var triples bgp
+		for _, t := range q.template {
+			triples = append(triples, triplePattern{t.s, t.p, t.o})
+		}
+		q.where = &groupPattern{[]interface{}{triples}}
+	} else {
+		p.acceptKeyword("WHERE")
+		q.where, err = p.group()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.solutionModifiers(q); err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("VALUES") {
+		q.values, err = p.dataBlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return q, nil
+}
+
+func (p *parser) solutionModifiers(q *query) error {
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return err
+		}
+		for {
+			if p.peek().kind == tokVar {
+				q.groupBy = append(q.groupBy, projection{v: p.next().text})
+			} else if p.acceptPunct("(") {
+				expr, err := p.expression()
+				if err != nil {
+					return err
+				}
+				var v string
+				if p.acceptKeyword("AS") {
+					t := p.next()
+					if t.kind != tokVar {
+						return p.errorf("expected variable")
+					}
+					v = t.text
+				}
+				if err := p.expectPunct(")"); err != nil {
+					return err
+				}
+				q.groupBy = append(q.groupBy, projection{v, expr})
+			} else if p.isCall() {
+				expr, err := p.primary()
+				if err != nil {
+					return err
+				}
+				q.groupBy = append(q.groupBy, projection{expr: expr})
+			} else {
+				break
+			}
+		}
+		if len(q.groupBy) == 0 {
+			return p.errorf("expected GROUP BY condition")
+		}
+	}
+	if p.acceptKeyword("HAVING") {
+		for p.isPunct("(") || p.isCall() {
+			expr, err := p.primary()
+			if err != nil {
+				return err
+			}
+			q.having = append(q.having, expr)
+		}
+	}
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return err
+		}
+		for {
+			var cond orderCondition
+			if p.isKeyword("ASC", "DESC") {
+				cond.desc = p.next().text == "DESC"
+				expr, err := p.primary()
+				if err != nil {
+					return err
+				}
+				cond.expr = expr
+			} else if p.peek().kind == tokVar {
+				cond.expr = exprTerm{variable(p.next().text)}
+			} else if p.isPunct("(") || p.isCall() {
+				expr, err := p.primary()
+				if err != nil {
+					return err
+				}
+				cond.expr = expr
+			} else {
+				break
+			}
+			q.orderBy = append(q.orderBy, cond)
+		}
+		if len(q.orderBy) == 0 {
+			return p.errorf("expected ORDER BY condition")
+		}
+	}
+	for {
+		if p.acceptKeyword("LIMIT") {
+			t := p.next()
+			n, err := strconv.Atoi(t.text)
+			if t.kind != tokInteger || err != nil {
+				return p.errorf("expected integer after LIMIT")
+			}
+			q.limit = n
+		} else if p.acceptKeyword("OFFSET") {
+			t := p.next()
+			n, err := strconv.Atoi(t.text)
+			if t.kind != tokInteger || err != nil {
+				return p.errorf("expected integer after OFFSET")
+			}
+			q.offset = n
+		} else {
+			return nil
+		}
+	}
+}
+
+func (p *parser) group() (*groupPattern, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("SELECT") {
+		return nil, p.errorf("sub-queries are not supported")
+	}
+	g := &groupPattern{}
+	var triples bgp
+	flush := func() {
+		if len(triples) > 0 {
+			g.elements = append(g.elements, triples)
+			triples = nil
+		}
+	}
+	for {
+		switch {
+		case p.acceptPunct("}"):
+			flush()
+			return g, nil
+		case p.peek().kind == tokEOF:
+			return nil, p.errorf("expected '}'")
+		case p.acceptKeyword("OPTIONAL"):
+			flush()
+			sub, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			g.elements = append(g.elements, &optionalPattern{sub})
+		case p.acceptKeyword("MINUS"):
+			flush()
+			sub, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			g.elements = append(g.elements, &minusPattern{sub})
+		case p.acceptKeyword("GRAPH"):
+			flush()
+			name, err := p.varOrIri()
+			if err != nil {
+				return nil, err
+			}
+			sub, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			g.elements = append(g.elements, &graphPattern{name, sub})
+		case p.acceptKeyword("SERVICE"):
+			return nil, p.errorf("SERVICE is not supported")
+		case p.acceptKeyword("FILTER"):
+			flush()
+			var expr expression
+			var err error
+			if p.isPunct("(") {
+				p.next()
+				expr, err = p.expression()
+				if err == nil {
+					err = p.expectPunct(")")
+				}
+			} else {
+				expr, err = p.primary()
+			}
+			if err != nil {
+				return nil, err
+			}
+			g.elements = append(g.elements, &filterPattern{expr})
+		case p.acceptKeyword("BIND"):
+			flush()
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			expr, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectKeyword("AS"); err != nil {
+				return nil, err
+			}
+			v := p.next()
+			if v.kind != tokVar {
+				return nil, p.errorf("expected variable")
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+			g.elements = append(g.elements, &bindPattern{expr, v.text})
+		case p.acceptKeyword("VALUES"):
+			flush()
+			values, err := p.dataBlock()
+			if err != nil {
+				return nil, err
+			}
+			g.elements = append(g.elements, values)
+		case p.isPunct("{"):
+			flush()
+			sub, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			if p.isKeyword("UNION") {
+				union := &unionPattern{[]*groupPattern{sub}}
+				for p.acceptKeyword("UNION") {
+					sub, err := p.group()
+					if err != nil {
+						return nil, err
+					}
+					union.groups = append(union.groups, sub)
+				}
+				g.elements = append(g.elements, union)
+			} else {
+				g.elements = append(g.elements, sub)
+			}
+		default:
+			more, err := p.triplesSameSubject(&triples, true)
+			if err != nil {
+				return nil, err
+			}
+			if !more {
+				continue
+			}
+		}
+		p.acceptPunct(".")
+	}
+}
+
+// Parse a VALUES data block
+func (p *parser) dataBlock() (*valuesPattern, error) {
+	values := &valuesPattern{}
+	single := false
+	if p.peek().kind == tokVar {
+		values.vars = []string{p.next().text}
+		single = true
+	} else if p.acceptPunct("(") {
+		for p.peek().kind == tokVar {
+			values.vars = append(values.vars, p.next().text)
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+	} else if p.peek().kind == tokNil {
+		p.next()
+	} else {
+		return nil, p.errorf("expected variables")
+	}
+
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	for !p.acceptPunct("}") {
+		var row []nquads.Node
+		if single {
+			v, err := p.dataValue()
+			if err != nil {
+				return nil, err
+			}
+			row = []nquads.Node{v}
+		} else if p.peek().kind == tokNil {
+			p.next()
+		} else {
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			for !p.acceptPunct(")") {
+				v, err := p.dataValue()
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, v)
+			}
+		}
+		if len(row) != len(values.vars) {
+			return nil, p.errorf("expected %d values", len(values.vars))
+		}
+		values.rows = append(values.rows, row)
+	}
+	return values, nil
+}
+
+func (p *parser) dataValue() (nquads.Node, error) {
+	if p.acceptKeyword("UNDEF") {
+		return nil, nil
+	}
+	if p.isIri() {
+		iri, err := p.iri()
+		if err != nil {
+			return nil, err
+		}
+		return nquads.NewIri(iri), nil
+	}
+	return p.literal()
+}
+
+// Parse triples with the same subject and append them to triples. Paths are
+// allowed if paths is set. Returns false if there was nothing to parse.
+func (p *parser) triplesSameSubject(triples *bgp, paths bool) (bool, error) {
+	var subject term
+	var err error
+	if p.isPunct("[") {
+		subject, err = p.blankNodePropertyList(triples, paths)
+		if err != nil {
+			return false, err
+		}
+		if p.isPunct(".") || p.isPunct("}") || p.peek().kind == tokEOF {
+			return true, nil
+		}
+	} else if p.isPunct("(") {
+		subject, err = p.collection(triples, paths)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		subject, err = p.varOrTerm()
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, p.propertyList(subject, triples, paths)
+}
+
+func (p *parser) propertyList(subject term, triples *bgp, paths bool) error {
+	for {
+		var verb interface{}
+		if p.peek().kind == tokVar {
+			verb = variable(p.next().text)
+		} else if paths {
+			path, err := p.path()
+			if err != nil {
+				return err
+			}
+			verb = path
+		} else if p.acceptKeyword("a") {
+			verb = nquads.NewIri(turtle.RdfType)
+		} else {
+			iri, err := p.iri()
+			if err != nil {
+				return err
+			}
+			verb = nquads.NewIri(iri)
+		}
+
+		for {
+			object, err := p.object(triples, paths)
+			if err != nil {
+				return err
+			}
+			*triples = append(*triples, triplePattern{subject, verb, object})
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+
+		if !p.acceptPunct(";") {
+			return nil
+		}
+		for p.acceptPunct(";") {
+		}
+		if p.isPunct(".") || p.isPunct("]") || p.isPunct("}") || p.peek().kind == tokEOF {
+			return nil
+		}
+	}
+}
+
+func (p *parser) object(triples *bgp, paths bool) (term, error) {
+	if p.isPunct("[") {
+		return p.blankNodePropertyList(triples, paths)
+	} else if p.isPunct("(") {
+		return p.collection(triples, paths)
+	}
+	return p.varOrTerm()
+}
+
+func (p *parser) blankNodePropertyList(triples *bgp, paths bool) (term, error) {
+	if err := p.expectPunct("["); err != nil {
+		return nil, err
+	}
+	node := p.newAnon()
+	if err := p.propertyList(node, triples, paths); err != nil {
+		return nil, err
+	}
+	return node, p.expectPunct("]")
+}
+
+func (p *parser) collection(triples *bgp, paths bool) (term, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var head, last term = nquads.NewIri(turtle.RdfNil), nil
+	for !p.acceptPunct(")") {
+		item, err := p.object(triples, paths)
+		if err != nil {
+			return nil, err
+		}
+		cell := p.newAnon()
+		if last == nil {
+			head = cell
+		} else {
+			*triples = append(*triples, triplePattern{last, nquads.NewIri(turtle.RdfRest), cell})
+		}
+		*triples = append(*triples, triplePattern{cell, nquads.NewIri(turtle.RdfFirst), item})
+		last = cell
+	}
+	if last != nil {
+		*triples = append(*triples, triplePattern{last, nquads.NewIri(turtle.RdfRest), nquads.NewIri(turtle.RdfNil)})
+	}
+	return head, nil
+}
+
+func (p *parser) path() (interface{}, error) {
+	a, err := p.pathSequence()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct("|") {
+		b, err := p.pathSequence()
+		if err != nil {
+			return nil, err
+		}
+		a = pathAlt{a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) pathSequence() (interface{}, error) {
+	a, err := p.pathElt()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct("/") {
+		b, err := p.pathElt()
+		if err != nil {
+			return nil, err
+		}
+		a = pathSeq{a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) pathElt() (interface{}, error) {
+	inverse := p.acceptPunct("^")
+	var elt interface{}
+	switch {
+	case p.acceptKeyword("a"):
+		elt = nquads.NewIri(turtle.RdfType)
+	case p.acceptPunct("("):
+		path, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		elt = path
+	case p.acceptPunct("!"):
+		neg, err := p.negatedPropertySet()
+		if err != nil {
+			return nil, err
+		}
+		elt = neg
+	default:
+		iri, err := p.iri()
+		if err != nil {
+			return nil, err
+		}
+		elt = nquads.NewIri(iri)
+	}
+	switch {
+	case p.acceptPunct("*"):
+		elt = pathMod{elt, 0, true}
+	case p.acceptPunct("+"):
+		elt = pathMod{elt, 1, true}
+	case p.acceptPunct("?"):
+		elt = pathMod{elt, 0, false}
+	}
+	if inverse {
+		elt = pathInverse{elt}
+	}
+	return elt, nil
+}
+
+func (p *parser) negatedPropertySet() (interface{}, error) {
+	var neg pathNegated
+	one := func() error {
+		inverse := p.acceptPunct("^")
+		var iri string
+		if p.acceptKeyword("a") {
+			iri = turtle.RdfType
+		} else {
+			var err error
+			iri, err = p.iri()
+			if err != nil {
+				return err
+			}
+		}
+		if inverse {
+			neg.inverse = append(neg.inverse, iri)
+		} else {
+			neg.iris = append(neg.iris, iri)
+		}
+		return nil
+	}
+	if p.acceptPunct("(") {
+		if !p.acceptPunct(")") {
+			for {
+				if err := one(); err != nil {
+					return nil, err
+				}
+				if !p.acceptPunct("|") {
+					break
+				}
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := one(); err != nil {
+		return nil, err
+	}
+	return neg, nil
+}
+
+// Parse a quad template or quad data: triples and GRAPH blocks
+func (p *parser) quadTemplate(graphs bool) ([]quadPattern, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var quads []quadPattern
+	addTriples := func(graph term) error {
+		var triples bgp
+		for !p.isPunct("}") && !p.isKeyword("GRAPH") && p.peek().kind != tokEOF {
+			if _, err := p.triplesSameSubject(&triples, false); err != nil {
+				return err
+			}
+			if !p.acceptPunct(".") {
+				break
+			}
+		}
+		for _, t := range triples {
+			quads = append(quads, quadPattern{t.s, t.p, t.o, graph})
+		}
+		return nil
+	}
+	for !p.acceptPunct("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf("expected '}'")
+		}
+		if graphs && p.acceptKeyword("GRAPH") {
+			name, err := p.varOrIri()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("{"); err != nil {
+				return nil, err
+			}
+			if err := addTriples(name); err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("}"); err != nil {
+				return nil, err
+			}
+			p.acceptPunct(".")
+		} else {
+			before := p.pos
+			if err := addTriples(nil); err != nil {
+				return nil, err
+			}
+			if p.pos == before {
+				return nil, p.errorf("unexpected %q", p.peek().text)
+			}
+		}
+	}
+	return quads, nil
+}
+
+// Parse an update request
+func parseUpdate(input, base string) ([]interface{}, error) {
+	p, err := newParser(input, base)
+	if err != nil {
+		return nil, err
+	}
+	var ops []interface{}
+	for {
+		if err := p.prologue(); err != nil {
+			return nil, err
+		}
+		if p.peek().kind == tokEOF {
+			return ops, nil
+		}
+		op, err := p.updateOperation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+		if !p.acceptPunct(";") {
+			if p.peek().kind != tokEOF {
+				return nil, p.errorf("unexpected %q", p.peek().text)
+			}
+			return ops, nil
+		}
+	}
+}
+
+func (p *parser) updateOperation() (interface{}, error) {
+	switch {
+	case p.isKeyword("INSERT") && p.peekAt(1).text == "DATA":
+		p.next()
+		p.next()
+		quads, err := p.quadTemplate(true)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range quads {
+			if hasVariable(q) {
+				return nil, p.errorf("variables are not allowed in INSERT DATA")
+			}
+		}
+		return &insertData{quads}, nil
+	case p.isKeyword("DELETE") && p.peekAt(1).text == "DATA":
+		p.next()
+		p.next()
+		quads, err := p.quadTemplate(true)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range quads {
+			if hasVariable(q) || hasBlank(q) {
+				return nil, p.errorf("variables and blank nodes are not allowed in DELETE DATA")
+			}
+		}
+		return &deleteData{quads}, nil
+	case p.isKeyword("DELETE") && p.peekAt(1).text == "WHERE":
+		p.next()
+		p.next()
+		quads, err := p.quadTemplate(true)
+		if err != nil {
+			return nil, err
+		}
+		return &modify{del: quads, where: quadsToGroup(quads)}, nil
+	case p.isKeyword("WITH", "DELETE", "INSERT"):
+		m := &modify{}
+		if p.acceptKeyword("WITH") {
+			iri, err := p.iri()
+			if err != nil {
+				return nil, err
+			}
+			m.with = iri
+		}
+		var err error
+		if p.acceptKeyword("DELETE") {
+			m.del, err = p.quadTemplate(true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if p.acceptKeyword("INSERT") {
+			m.ins, err = p.quadTemplate(true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if m.del == nil && m.ins == nil {
+			return nil, p.errorf("expected DELETE or INSERT")
+		}
+		if p.isKeyword("USING") {
+			return nil, p.errorf("USING is not supported")
+		}
+		if err := p.expectKeyword("WHERE"); err != nil {
+			return nil, err
+		}
+		m.where, err = p.group()
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case p.isKeyword("CLEAR", "DROP", "CREATE"):
+		op := &graphManagement{op: p.next().text}
+		op.silent = p.acceptKeyword("SILENT")
+		if op.op == "CREATE" || p.isKeyword("GRAPH") {
+			if err := p.expectKeyword("GRAPH"); err != nil {
+				return nil, err
+			}
+			iri, err := p.iri()
+			if err != nil {
+				return nil, err
+			}
+			op.target, op.iri = "GRAPH", iri
+		} else if p.isKeyword("DEFAULT", "NAMED", "ALL") {
+			op.target = p.next().text
+		} else {
+			return nil, p.errorf("expected GRAPH, DEFAULT, NAMED or ALL")
+		}
+		return op, nil
+	case p.isKeyword("LOAD", "ADD", "MOVE", "COPY"):
+		return nil, p.errorf("%s is not supported", p.peek().text)
+	}
+	return nil, p.errorf("expected update operation")
+}
+
+func hasVariable(q quadPattern) bool {
+	for _, t := range []term{q.s, q.p, q.o, q.g} {
+		if _, ok := t.(variable); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBlank(q quadPattern) bool {
+	for _, t := range []term{q.s, q.o} {
+		if _, ok := t.(blankTerm); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Group pattern matching a quad template, for DELETE WHERE
+func quadsToGroup(quads []quadPattern) *groupPattern {
+	g := &groupPattern{}
+	var triples bgp
+	for _, q := range quads {
+		if q.g == nil {
+			triples = append(triples, triplePattern{q.s, q.p, q.o})
+		} else {
+			g.elements = append(g.elements, &graphPattern{q.g, &groupPattern{[]interface{}{bgp{{q.s, q.p, q.o}}}}})
+		}
+	}
+	if len(triples) > 0 {
+		g.elements = append(g.elements, triples)
+	}
+	return g
+}
+
+var aggregates = map[string]bool{"COUNT": true, "SUM": true, "MIN": true, "MAX": true, "AVG": true, "SAMPLE": true, "GROUP_CONCAT": true}
+
+// Number of arguments of built-in functions, -1 for variable arguments
+var builtins = map[string][2]int{
+	"STR": {1, 1}, "LANG": {1, 1}, "LANGMATCHES": {2, 2}, "DATATYPE": {1, 1},
+	"BOUND": {1, 1}, "IRI": {1, 1}, "URI": {1, 1}, "ABS": {1, 1}, "CEIL": {1, 1},
+	"FLOOR": {1, 1}, "ROUND": {1, 1}, "CONCAT": {0, -1}, "STRLEN": {1, 1},
+	"UCASE": {1, 1}, "LCASE": {1, 1}, "ENCODE_FOR_URI": {1, 1}, "CONTAINS": {2, 2},
+	"STRSTARTS": {2, 2}, "STRENDS": {2, 2}, "STRBEFORE": {2, 2}, "STRAFTER": {2, 2},
+	"SUBSTR": {2, 3}, "REGEX": {2, 3}, "REPLACE": {3, 4}, "COALESCE": {0, -1},
+	"IF": {3, 3}, "STRLANG": {2, 2}, "STRDT": {2, 2}, "SAMETERM": {2, 2},
+	"ISIRI": {1, 1}, "ISURI": {1, 1}, "ISBLANK": {1, 1}, "ISLITERAL": {1, 1},
+	"ISNUMERIC": {1, 1},
+}
+
+func (p *parser) expression() (expression, error) {
+	a, err := p.andExpression()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct("||") {
+		b, err := p.andExpression()
+		if err != nil {
+			return nil, err
+		}
+		a = exprBinary{"||", a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) andExpression() (expression, error) {
+	a, err := p.relationalExpression()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct("&&") {
+		b, err := p.relationalExpression()
+		if err != nil {
+			return nil, err
+		}
+		a = exprBinary{"&&", a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) relationalExpression() (expression, error) {
+	a, err := p.additiveExpression()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "!=", "<=", ">=", "<", ">"} {
+		if p.acceptPunct(op) {
+			b, err := p.additiveExpression()
+			if err != nil {
+				return nil, err
+			}
+			return exprBinary{op, a, b}, nil
+		}
+	}
+	not := false
+	if p.isKeyword("NOT") && p.peekAt(1).text == "IN" {
+		p.next()
+		not = true
+	}
+	if p.acceptKeyword("IN") {
+		in := exprIn{a: a, not: not}
+		if p.peek().kind == tokNil {
+			p.next()
+			return in, nil
+		}
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, e)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+		return in, p.expectPunct(")")
+	}
+	return a, nil
+}
+
+func (p *parser) additiveExpression() (expression, error) {
+	a, err := p.multiplicativeExpression()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("+") || p.isPunct("-") {
+		op := p.next().text
+		b, err := p.multiplicativeExpression()
+		if err != nil {
+			return nil, err
+		}
+		a = exprBinary{op, a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) multiplicativeExpression() (expression, error) {
+	a, err := p.unaryExpression()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("*") || p.isPunct("/") {
+		op := p.next().text
+		b, err := p.unaryExpression()
+		if err != nil {
+			return nil, err
+		}
+		a = exprBinary{op, a, b}
+	}
+	return a, nil
+}
+
+func (p *parser) unaryExpression() (expression, error) {
+	if !p.isLiteral() && (p.isPunct("!") || p.isPunct("-") || p.isPunct("+")) {
+		op := p.next().text
+		a, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op, a}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expression, error) {
+	t := p.peek()
+	switch {
+	case p.acceptPunct("("):
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectPunct(")")
+	case t.kind == tokVar:
+		p.next()
+		return exprTerm{variable(t.text)}, nil
+	case p.isLiteral():
+		lit, err := p.literal()
+		return exprTerm{lit}, err
+	case p.isIri():
+		iri, err := p.iri()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct("(") || p.peek().kind == tokNil {
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("unsupported function <%s>", iri)}
+		}
+		return exprTerm{nquads.NewIri(iri)}, nil
+	case p.isKeyword("EXISTS") || p.isKeyword("NOT") && p.peekAt(1).text == "EXISTS":
+		not := p.acceptKeyword("NOT")
+		p.next()
+		group, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+		return exprExists{group, not}, nil
+	case t.kind == tokKeyword && aggregates[t.text]:
+		return p.aggregate()
+	case t.kind == tokKeyword && t.text != "a":
+		arity, ok := builtins[t.text]
+		if !ok {
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("unsupported function %s", t.text)}
+		}
+		p.next()
+		call := exprCall{name: t.text}
+		if p.peek().kind == tokNil {
+			p.next()
+		} else {
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			for !p.acceptPunct(")") {
+				if len(call.args) > 0 {
+					if err := p.expectPunct(","); err != nil {
+						return nil, err
+					}
+				}
+				if t.text == "BOUND" {
+					v := p.next()
+					if v.kind != tokVar {
+						return nil, p.errorf("expected variable")
+					}
+					call.args = append(call.args, exprTerm{variable(v.text)})
+					continue
+				}
+				e, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, e)
+			}
+		}
+		if len(call.args) < arity[0] || arity[1] >= 0 && len(call.args) > arity[1] {
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("wrong number of arguments to %s", t.text)}
+		}
+		return call, nil
+	}
+	return nil, p.errorf("expected expression")
+}
+
+func (p *parser) aggregate() (expression, error) {
+	call := exprCall{name: p.next().text}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	call.distinct = p.acceptKeyword("DISTINCT")
+	if call.name == "COUNT" && p.acceptPunct("*") {
+		call.star = true
+	} else {
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		call.args = []expression{e}
+	}
+	if call.name == "GROUP_CONCAT" {
+		call.separator = " "
+		if p.acceptPunct(";") {
+			if err := p.expectKeyword("SEPARATOR"); err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct("="); err != nil {
+				return nil, err
+			}
+			t := p.next()
+			if t.kind != tokString {
+				return nil, p.errorf("expected string")
+			}
+			call.separator = t.text
+		}
+	}
+	return call, p.expectPunct(")")
+}
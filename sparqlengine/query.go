@@ -0,0 +1,400 @@
+package sparqlengine
+
+import (
+	"github.com/mildred/SmartWeb/nquads"
+	"sort"
+	"strings"
+)
+
+func hasAggregate(expr expression) bool {
+	switch expr := expr.(type) {
+	case exprCall:
+		if aggregates[expr.name] {
+			return true
+		}
+		for _, arg := range expr.args {
+			if hasAggregate(arg) {
+				return true
+			}
+		}
+	case exprBinary:
+		return hasAggregate(expr.a) || hasAggregate(expr.b)
+	case exprUnary:
+		return hasAggregate(expr.a)
+	case exprIn:
+		if hasAggregate(expr.a) {
+			return true
+		}
+		for _, item := range expr.list {
+			if hasAggregate(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *query) isAggregate() bool {
+	if len(q.groupBy) > 0 || len(q.having) > 0 {
+		return true
+	}
+	for _, p := range q.projection {
+		if p.expr != nil && hasAggregate(p.expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Variables in scope in a group, in order of appearance
+func patternVariables(group *groupPattern, vars []string, seen map[string]bool) []string {
+	add := func(t term) {
+		if v, ok := t.(variable); ok && !seen[string(v)] {
+			seen[string(v)] = true
+			vars = append(vars, string(v))
+		}
+	}
+	for _, elt := range group.elements {
+		switch elt := elt.(type) {
+		case bgp:
+			for _, t := range elt {
+				add(t.s)
+				add(t.p)
+				add(t.o)
+			}
+		case *groupPattern:
+			vars = patternVariables(elt, vars, seen)
+		case *optionalPattern:
+			vars = patternVariables(elt.group, vars, seen)
+		case *unionPattern:
+			for _, g := range elt.groups {
+				vars = patternVariables(g, vars, seen)
+			}
+		case *graphPattern:
+			add(elt.name)
+			vars = patternVariables(elt.group, vars, seen)
+		case *bindPattern:
+			add(variable(elt.v))
+		case *valuesPattern:
+			for _, v := range elt.vars {
+				add(variable(v))
+			}
+		}
+	}
+	return vars
+}
+
+// Evaluate the WHERE clause and the solution modifiers, returns the
+// projected variables and solutions
+func (e *evaluator) evalSelect(q *query) ([]string, []binding, error) {
+	solutions, err := e.evalGroup(q.where, nil, []binding{{}})
+	if err != nil {
+		return nil, nil, err
+	}
+	if q.values != nil {
+		solutions = joinValues(solutions, q.values)
+	}
+
+	// Groups of solutions for aggregates, one per solution otherwise
+	var groups [][]binding
+	if q.isAggregate() {
+		solutions, groups = e.group(q, solutions)
+	}
+	groupOf := func(i int) []binding {
+		if groups == nil {
+			return nil
+		}
+		return groups[i]
+	}
+
+	var vars []string
+	if q.projection == nil {
+		vars = patternVariables(q.where, nil, make(map[string]bool))
+	} else {
+		for _, p := range q.projection {
+			vars = append(vars, p.v)
+		}
+	}
+
+	// Projection expressions, they can be used in ORDER BY
+	for _, p := range q.projection {
+		if p.expr == nil {
+			continue
+		}
+		for i, s := range solutions {
+			if _, ok := s[p.v]; ok {
+				return nil, nil, &EvalError{"projection to a variable already in scope: ?" + p.v}
+			}
+			if val, err := e.eval(p.expr, s, nil, groupOf(i)); err == nil {
+				solutions[i] = s.extend(p.v, val)
+			}
+		}
+	}
+
+	if len(q.orderBy) > 0 {
+		type row struct {
+			s    binding
+			keys []nquads.Node
+		}
+		rows := make([]row, len(solutions))
+		for i, s := range solutions {
+			rows[i].s = s
+			for _, cond := range q.orderBy {
+				val, _ := e.eval(cond.expr, s, nil, groupOf(i))
+				rows[i].keys = append(rows[i].keys, val)
+			}
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			for k, cond := range q.orderBy {
+				c := orderCompare(rows[i].keys[k], rows[j].keys[k])
+				if cond.desc {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+		for i := range rows {
+			solutions[i] = rows[i].s
+		}
+	}
+
+	projected := make([]binding, 0, len(solutions))
+	seen := make(map[string]bool)
+	for _, s := range solutions {
+		p := make(binding, len(vars))
+		var key strings.Builder
+		for _, v := range vars {
+			if val, ok := s[v]; ok {
+				p[v] = val
+				key.WriteString(val.Encode())
+			}
+			key.WriteByte(0)
+		}
+		if q.distinct {
+			if seen[key.String()] {
+				continue
+			}
+			seen[key.String()] = true
+		}
+		projected = append(projected, p)
+	}
+
+	if q.offset > 0 {
+		if q.offset >= len(projected) {
+			projected = nil
+		} else {
+			projected = projected[q.offset:]
+		}
+	}
+	if q.limit >= 0 && q.limit < len(projected) {
+		projected = projected[:q.limit]
+	}
+	return vars, projected, nil
+}
+
+// Group solutions for aggregation, returns a solution with the group keys
+// and the solutions of each group. Groups not matching HAVING are removed.
+func (e *evaluator) group(q *query, solutions []binding) ([]binding, [][]binding) {
+	var keys []binding
+	var groups [][]binding
+	index := make(map[string]int)
+	for _, s := range solutions {
+		k := make(binding)
+		var id strings.Builder
+		for _, g := range q.groupBy {
+			var val nquads.Node
+			var err error
+			if g.expr != nil {
+				val, err = e.eval(g.expr, s, nil, nil)
+			} else {
+				val, err = e.eval(exprTerm{variable(g.v)}, s, nil, nil)
+			}
+			if err == nil {
+				if g.v != "" {
+					k[g.v] = val
+				}
+				id.WriteString(val.Encode())
+			}
+			id.WriteByte(0)
+		}
+		i, ok := index[id.String()]
+		if !ok {
+			i = len(keys)
+			index[id.String()] = i
+			keys = append(keys, k)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], s)
+	}
+	// Without GROUP BY, there is a single group even without solutions
+	if len(q.groupBy) == 0 && len(keys) == 0 {
+		keys = []binding{{}}
+		groups = [][]binding{nil}
+	}
+
+	if len(q.having) == 0 {
+		return keys, groups
+	}
+	var resKeys []binding
+	var resGroups [][]binding
+group:
+	for i, k := range keys {
+		for _, h := range q.having {
+			val, err := e.eval(h, k, nil, groups[i])
+			if err != nil || !effectiveBoolean(val) {
+				continue group
+			}
+		}
+		resKeys = append(resKeys, k)
+		resGroups = append(resGroups, groups[i])
+	}
+	return resKeys, resGroups
+}
+
+func (e *evaluator) evalAggregate(expr exprCall, graph nquads.Node, group []binding) (nquads.Node, error) {
+	var values []nquads.Node
+	seen := make(map[string]bool)
+	for _, s := range group {
+		var val nquads.Node
+		if expr.star {
+			var key strings.Builder
+			var vars []string
+			for v := range s {
+				vars = append(vars, v)
+			}
+			sort.Strings(vars)
+			for _, v := range vars {
+				key.WriteString(v + "=" + s[v].Encode() + "\x00")
+			}
+			val = nquads.NewLiteral(key.String(), "", "")
+		} else {
+			var err error
+			val, err = e.eval(expr.args[0], s, graph, nil)
+			if err != nil {
+				continue
+			}
+		}
+		if expr.distinct {
+			if seen[val.Encode()] {
+				continue
+			}
+			seen[val.Encode()] = true
+		}
+		values = append(values, val)
+	}
+
+	switch expr.name {
+	case "COUNT":
+		return numberNode(float64(len(values)), 0), nil
+	case "SUM", "AVG":
+		var sum float64
+		rank := 0
+		for _, v := range values {
+			f, r, ok := numeric(v)
+			if !ok {
+				return nil, errType
+			}
+			sum += f
+			if r > rank {
+				rank = r
+			}
+		}
+		if expr.name == "SUM" {
+			return numberNode(sum, rank), nil
+		}
+		if len(values) == 0 {
+			return numberNode(0, 0), nil
+		}
+		if rank == 0 {
+			rank = 1
+		}
+		return numberNode(sum/float64(len(values)), rank), nil
+	case "MIN", "MAX":
+		if len(values) == 0 {
+			return nil, errType
+		}
+		res := values[0]
+		for _, v := range values[1:] {
+			c := orderCompare(v, res)
+			if expr.name == "MIN" && c < 0 || expr.name == "MAX" && c > 0 {
+				res = v
+			}
+		}
+		return res, nil
+	case "SAMPLE":
+		if len(values) == 0 {
+			return nil, errType
+		}
+		return values[0], nil
+	case "GROUP_CONCAT":
+		var parts []string
+		for _, v := range values {
+			lit, ok := stringLiteral(v)
+			if !ok {
+				if lit, ok := literal(v); ok {
+					parts = append(parts, lit.Value())
+					continue
+				}
+				return nil, errType
+			}
+			parts = append(parts, lit.Value())
+		}
+		return nquads.NewLiteral(strings.Join(parts, expr.separator), "", ""), nil
+	}
+	return nil, errType
+}
+
+// Instantiate a template with the solutions
+func (e *evaluator) construct(template []quadPattern, solutions []binding) []*nquads.Statement {
+	var res []*nquads.Statement
+	seen := make(map[string]bool)
+	for _, s := range solutions {
+		// Fresh blank nodes for each solution
+		blanks := make(map[blankTerm]nquads.Node)
+		instantiate := func(t term) nquads.Node {
+			if b, ok := t.(blankTerm); ok {
+				n, ok := blanks[b]
+				if !ok {
+					n = e.engine.newBlank()
+					blanks[b] = n
+				}
+				return n
+			}
+			n, _ := resolve(t, s)
+			return n
+		}
+		for _, q := range template {
+			subj, pred, obj := instantiate(q.s), instantiate(q.p), instantiate(q.o)
+			var graph nquads.Node
+			if q.g != nil {
+				graph = instantiate(q.g)
+				if graph == nil {
+					continue
+				}
+			}
+			if !validTriple(subj, pred, obj) {
+				continue
+			}
+			st := nquads.NewStatement(subj, pred, obj, graph)
+			if key := st.String(); !seen[key] {
+				seen[key] = true
+				res = append(res, st)
+			}
+		}
+	}
+	return res
+}
+
+func validTriple(s, p, o nquads.Node) bool {
+	if s == nil || p == nil || o == nil {
+		return false
+	}
+	if _, ok := s.(*nquads.LiteralNode); ok {
+		return false
+	}
+	_, ok := p.(*nquads.IriNode)
+	return ok
+}
@@ -0,0 +1,146 @@
+package sparqlengine
+
+import (
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"github.com/mildred/SmartWeb/quadstore"
+)
+
+// Run a SPARQL update request. Operations are applied in order, the request
+// stops at the first failing operation.
+func (e *Engine) Update(update string) error {
+	ops, err := parseUpdate(update, e.Base)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := e.updateOperation(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Statements from quad data, blank nodes get fresh labels
+func (e *Engine) quadData(quads []quadPattern, graph nquads.Node) []*nquads.Statement {
+	blanks := make(map[blankTerm]nquads.Node)
+	node := func(t term) nquads.Node {
+		if b, ok := t.(blankTerm); ok {
+			n, ok := blanks[b]
+			if !ok {
+				n = e.newBlank()
+				blanks[b] = n
+			}
+			return n
+		}
+		return t.(nquads.Node)
+	}
+	var res []*nquads.Statement
+	for _, q := range quads {
+		g := graph
+		if q.g != nil {
+			g = node(q.g)
+		}
+		res = append(res, nquads.NewStatement(node(q.s), node(q.p), node(q.o), g))
+	}
+	return res
+}
+
+func (e *Engine) updateOperation(op interface{}) error {
+	switch op := op.(type) {
+	case *insertData:
+		return e.Store.Add(e.quadData(op.quads, nil)...)
+	case *deleteData:
+		return e.Store.Remove(e.quadData(op.quads, nil)...)
+	case *modify:
+		return e.modify(op)
+	case *graphManagement:
+		return e.graphManagement(op)
+	}
+	return fmt.Errorf("unsupported update operation %T", op)
+}
+
+func (e *Engine) modify(op *modify) error {
+	var ev *evaluator
+	var with nquads.Node
+	if op.with != "" {
+		with = nquads.NewIri(op.with)
+		ev = e.evaluator([]string{op.with}, nil)
+	} else {
+		ev = e.evaluator(nil, nil)
+	}
+	solutions, err := ev.evalGroup(op.where, nil, []binding{{}})
+	if err != nil {
+		return err
+	}
+
+	// Triples without GRAPH go to the WITH graph, or the default graph
+	withGraph := func(template []quadPattern) []quadPattern {
+		if with == nil {
+			return template
+		}
+		res := make([]quadPattern, len(template))
+		for i, q := range template {
+			res[i] = q
+			if q.g == nil {
+				res[i].g = with
+			}
+		}
+		return res
+	}
+
+	var del []*nquads.Statement
+	if op.del != nil {
+		del = ev.construct(withGraph(op.del), solutions)
+	}
+	var ins []*nquads.Statement
+	if op.ins != nil {
+		ins = ev.construct(withGraph(op.ins), solutions)
+	}
+	if err := e.Store.Remove(del...); err != nil {
+		return err
+	}
+	return e.Store.Add(ins...)
+}
+
+func (e *Engine) graphManagement(op *graphManagement) error {
+	var graphs []nquads.Node
+	switch op.target {
+	case "GRAPH":
+		g := nquads.NewIri(op.iri)
+		exists := false
+		for _, n := range e.Store.Graphs() {
+			if sameTerm(n, g) {
+				exists = true
+				break
+			}
+		}
+		if op.op == "CREATE" {
+			// Empty graphs are not stored
+			if exists && !op.silent {
+				return &EvalError{fmt.Sprintf("graph <%s> already exists", op.iri)}
+			}
+			return nil
+		}
+		if !exists {
+			if op.silent {
+				return nil
+			}
+			return &EvalError{fmt.Sprintf("graph <%s> does not exist", op.iri)}
+		}
+		graphs = []nquads.Node{g}
+	case "DEFAULT":
+		graphs = []nquads.Node{quadstore.DefaultGraph}
+	case "NAMED":
+		graphs = e.Store.Graphs()
+	case "ALL":
+		graphs = append(e.Store.Graphs(), quadstore.DefaultGraph)
+	}
+	// Graphs are not kept without quads, DROP and CLEAR are the same
+	for _, g := range graphs {
+		if err := e.Store.ClearGraph(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Package sparqltest provides a SPARQL 1.1 protocol endpoint backed by an
+// in-memory quad store, to test code talking to a triplestore without
+// running one.
+package sparqltest
+
+import (
+	"github.com/mildred/SmartWeb/backend"
+	"github.com/mildred/SmartWeb/sparql"
+	"github.com/mildred/SmartWeb/sparqlengine"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+// Test SPARQL endpoint, the query endpoint is at /query and the update
+// endpoint at /update. Close must be called when done.
+type Server struct {
+	*httptest.Server
+	// Storage of the endpoint, can be used to add data or check the result
+	// of updates directly
+	Backend   *backend.Embedded
+	QueryUrl  string
+	UpdateUrl string
+}
+
+func NewServer() *Server {
+	s := &Server{Backend: backend.NewMemory()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", s.handleQuery)
+	mux.HandleFunc("/update", s.handleUpdate)
+	s.Server = httptest.NewServer(mux)
+	s.QueryUrl = s.URL + "/query"
+	s.UpdateUrl = s.URL + "/update"
+	return s
+}
+
+// SPARQL client for the endpoint
+func (s *Server) SparqlClient() *sparql.Client {
+	return sparql.NewClient(s.QueryUrl, s.UpdateUrl)
+}
+
+// Read the protocol parameters, the operation is either in the body with
+// the given media type or in the form parameter
+func readOperation(req *http.Request, param, mediaType string) (string, url.Values, int) {
+	vars := req.URL.Query()
+	switch req.Method {
+	case "GET":
+		if param == "update" {
+			return "", nil, http.StatusMethodNotAllowed
+		}
+	case "POST":
+		mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mt == mediaType {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return "", nil, http.StatusBadRequest
+			}
+			return string(body), vars, 0
+		} else if mt != "application/x-www-form-urlencoded" {
+			return "", nil, http.StatusUnsupportedMediaType
+		}
+		if err := req.ParseForm(); err != nil {
+			return "", nil, http.StatusBadRequest
+		}
+		vars = req.Form
+	default:
+		return "", nil, http.StatusMethodNotAllowed
+	}
+	if vars.Get(param) == "" {
+		return "", nil, http.StatusBadRequest
+	}
+	return vars.Get(param), vars, 0
+}
+
+func handleError(res http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if _, ok := err.(*sparqlengine.SyntaxError); ok {
+		status = http.StatusBadRequest
+	}
+	http.Error(res, err.Error(), status)
+}
+
+func (s *Server) handleQuery(res http.ResponseWriter, req *http.Request) {
+	query, vars, status := readOperation(req, "query", "application/sparql-query")
+	if status != 0 {
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+
+	result, err := s.Backend.Engine.Query(query, &sparqlengine.Dataset{
+		Default: vars["default-graph-uri"],
+		Named:   vars["named-graph-uri"],
+	})
+	if err != nil {
+		handleError(res, err)
+		return
+	}
+
+	if result.Form != "CONSTRUCT" {
+		res.Header().Set("Content-Type", sparqlengine.ResultsMediaType)
+		result.WriteJSON(res)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/n-triples")
+	for _, st := range result.Statements {
+		res.Write([]byte(st.String() + "\n"))
+	}
+}
+
+func (s *Server) handleUpdate(res http.ResponseWriter, req *http.Request) {
+	update, _, status := readOperation(req, "update", "application/sparql-update")
+	if status != 0 {
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+
+	if err := s.Backend.Update(update); err != nil {
+		handleError(res, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+package turtle
+
+import (
+	"strings"
+)
+
+type iriParts struct {
+	scheme, authority, path, query, fragment string
+	hasAuthority, hasQuery, hasFragment      bool
+}
+
+// RFC 3986 section 3, without percent decoding or normalization
+func splitIri(iri string) iriParts {
+	var p iriParts
+
+	if i := strings.IndexByte(iri, '#'); i >= 0 {
+		p.fragment = iri[i+1:]
+		p.hasFragment = true
+		iri = iri[:i]
+	}
+	if i := strings.IndexByte(iri, '?'); i >= 0 {
+		p.query = iri[i+1:]
+		p.hasQuery = true
+		iri = iri[:i]
+	}
+	if i := strings.IndexByte(iri, ':'); i > 0 && !strings.ContainsAny(iri[:i], "/") && isScheme(iri[:i]) {
+		p.scheme = iri[:i]
+		iri = iri[i+1:]
+	}
+	if strings.HasPrefix(iri, "//") {
+		iri = iri[2:]
+		p.hasAuthority = true
+		if i := strings.IndexByte(iri, '/'); i >= 0 {
+			p.authority = iri[:i]
+			iri = iri[i:]
+		} else {
+			p.authority = iri
+			iri = ""
+		}
+	}
+	p.path = iri
+	return p
+}
+
+func isScheme(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func (p iriParts) String() string {
+	var res string
+	if p.scheme != "" {
+		res += p.scheme + ":"
+	}
+	if p.hasAuthority {
+		res += "//" + p.authority
+	}
+	res += p.path
+	if p.hasQuery {
+		res += "?" + p.query
+	}
+	if p.hasFragment {
+		res += "#" + p.fragment
+	}
+	return res
+}
+
+// RFC 3986 section 5.2.4
+func removeDotSegments(path string) string {
+	var out []string
+	for len(path) > 0 {
+		switch {
+		case strings.HasPrefix(path, "../"):
+			path = path[3:]
+		case strings.HasPrefix(path, "./"):
+			path = path[2:]
+		case strings.HasPrefix(path, "/./"):
+			path = path[2:]
+		case path == "/.":
+			path = "/"
+		case strings.HasPrefix(path, "/../"):
+			path = path[3:]
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case path == "/..":
+			path = "/"
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case path == "." || path == "..":
+			path = ""
+		default:
+			start := 0
+			if path[0] == '/' {
+				start = 1
+			}
+			end := strings.IndexByte(path[start:], '/')
+			if end < 0 {
+				end = len(path)
+			} else {
+				end += start
+			}
+			out = append(out, path[:end])
+			path = path[end:]
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// Resolve an IRI reference against a base IRI following RFC 3986 section
+// 5.2.2. Unlike net/url, IRIs are not escaped.
+func ResolveIri(base, ref string) string {
+	r := splitIri(ref)
+	if r.scheme != "" {
+		r.path = removeDotSegments(r.path)
+		return r.String()
+	}
+
+	b := splitIri(base)
+	var t iriParts
+	t.scheme = b.scheme
+	if r.hasAuthority {
+		t.authority, t.hasAuthority = r.authority, true
+		t.path = removeDotSegments(r.path)
+		t.query, t.hasQuery = r.query, r.hasQuery
+	} else {
+		t.authority, t.hasAuthority = b.authority, b.hasAuthority
+		if r.path == "" {
+			t.path = b.path
+			if r.hasQuery {
+				t.query, t.hasQuery = r.query, true
+			} else {
+				t.query, t.hasQuery = b.query, b.hasQuery
+			}
+		} else {
+			if r.path[0] == '/' {
+				t.path = removeDotSegments(r.path)
+			} else {
+				var merged string
+				if b.hasAuthority && b.path == "" {
+					merged = "/" + r.path
+				} else if i := strings.LastIndexByte(b.path, '/'); i >= 0 {
+					merged = b.path[:i+1] + r.path
+				} else {
+					merged = r.path
+				}
+				t.path = removeDotSegments(merged)
+			}
+			t.query, t.hasQuery = r.query, r.hasQuery
+		}
+	}
+	t.fragment, t.hasFragment = r.fragment, r.hasFragment
+	return t.String()
+}
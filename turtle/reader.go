@@ -0,0 +1,923 @@
+package turtle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+var RdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+var RdfType = RdfNamespace + "type"
+var RdfFirst = RdfNamespace + "first"
+var RdfRest = RdfNamespace + "rest"
+var RdfNil = RdfNamespace + "nil"
+
+var XsdInteger = nquads.XsdNamespace + "integer"
+var XsdDecimal = nquads.XsdNamespace + "decimal"
+var XsdDouble = nquads.XsdNamespace + "double"
+
+var ErrUnexpectedEOF = errors.New("Unexpected end of file")
+var ErrUnexpectedCharacter = errors.New("Unexpected character")
+var ErrExpectedDot = errors.New("Expected '.'")
+var ErrExpectedIri = errors.New("Expected IRI")
+var ErrExpectedPrefix = errors.New("Expected prefix name")
+var ErrUndefinedPrefix = errors.New("Undefined prefix")
+var ErrInvalidIri = errors.New("Invalid character in IRI")
+var ErrInvalidEscape = errors.New("Invalid escape sequence")
+var ErrInvalidString = errors.New("Invalid string")
+var ErrInvalidLanguageTag = errors.New("Invalid language tag")
+var ErrInvalidBlankNode = errors.New("Invalid blank node label")
+var ErrExpectedSubject = errors.New("Expected subject")
+var ErrExpectedPredicate = errors.New("Expected predicate")
+var ErrExpectedObject = errors.New("Expected object")
+var ErrInvalidGraph = errors.New("Graph not allowed here")
+var ErrExpectedBrace = errors.New("Expected '}'")
+
+// Read Turtle or TriG documents and return the statements they contain as
+// nquads statements. Relative IRIs are resolved against Base and blank node
+// labels are renamed to be unique in the document.
+type Reader struct {
+	Base     string
+	Prefixes map[string]string
+	TriG     bool
+
+	input io.Reader
+	p     *parser
+	queue []*nquads.Statement
+	err   error
+}
+
+func NewReader(r io.Reader, base string) *Reader {
+	return &Reader{
+		Base:     base,
+		Prefixes: make(map[string]string),
+		input:    r,
+	}
+}
+
+func NewTriGReader(r io.Reader, base string) *Reader {
+	reader := NewReader(r, base)
+	reader.TriG = true
+	return reader
+}
+
+// Read the next statement, returns nil at the end of the document. Syntax
+// errors are returned as *nquads.ParseError.
+func (r *Reader) ReadStatement() (*nquads.Statement, error) {
+	if r.p == nil {
+		data, err := ioutil.ReadAll(r.input)
+		if err != nil {
+			return nil, err
+		}
+		r.p = &parser{Reader: r, s: string(data), bnodes: make(map[string]string)}
+	}
+
+	for len(r.queue) == 0 && r.err == nil {
+		var more bool
+		more, r.err = r.p.statement()
+		if r.err != nil {
+			r.err = r.p.errorAt(r.err)
+		} else if !more {
+			return nil, nil
+		}
+	}
+
+	if len(r.queue) > 0 {
+		st := r.queue[0]
+		r.queue = r.queue[1:]
+		return st, nil
+	}
+	return nil, r.err
+}
+
+func (r *Reader) ReadAll() ([]*nquads.Statement, error) {
+	var res []*nquads.Statement
+	for {
+		st, err := r.ReadStatement()
+		if err != nil {
+			return res, err
+		} else if st == nil {
+			return res, nil
+		}
+		res = append(res, st)
+	}
+}
+
+type parser struct {
+	*Reader
+	s      string
+	pos    int
+	graph  nquads.Node
+	bnodes map[string]string
+	nextId int
+}
+
+func (p *parser) errorAt(err error) error {
+	if _, ok := err.(*nquads.ParseError); ok {
+		return err
+	}
+	before := p.s[:p.pos]
+	line := strings.Count(before, "\n") + 1
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	lineEnd := strings.IndexByte(p.s[lineStart:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(p.s)
+	} else {
+		lineEnd += lineStart
+	}
+	return &nquads.ParseError{
+		Line:   line,
+		Column: utf8.RuneCountInString(before[lineStart:]) + 1,
+		Err:    err,
+		Text:   p.s[lineStart:lineEnd],
+	}
+}
+
+func (p *parser) emit(s, pred, o nquads.Node) {
+	p.queue = append(p.queue, nquads.NewStatement(s, pred, o, p.graph))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) peekAt(n int) byte {
+	if p.pos+n < len(p.s) {
+		return p.s[p.pos+n]
+	}
+	return 0
+}
+
+func (p *parser) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.s[p.pos:])
+	return r
+}
+
+// Skip white space and comments
+func (p *parser) ws() {
+	for !p.eof() {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '#':
+			for !p.eof() && p.s[p.pos] != '\n' && p.s[p.pos] != '\r' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) expect(c byte, err error) error {
+	p.ws()
+	if p.peek() != c {
+		return err
+	}
+	p.pos++
+	return nil
+}
+
+// Case insensitive keyword followed by a delimiter
+func (p *parser) keyword(kw string) bool {
+	if len(p.s)-p.pos < len(kw) || !strings.EqualFold(p.s[p.pos:p.pos+len(kw)], kw) {
+		return false
+	}
+	next := p.peekAt(len(kw))
+	if next == ':' || next == '-' || next == '_' || next >= 'a' && next <= 'z' || next >= 'A' && next <= 'Z' || next >= '0' && next <= '9' {
+		return false
+	}
+	p.pos += len(kw)
+	return true
+}
+
+func (p *parser) freshBlank() *nquads.BlankNode {
+	p.nextId++
+	return nquads.NewBlank(fmt.Sprintf("b%d", p.nextId))
+}
+
+// Parse a directive or a block of triples, returns false at the end of input
+func (p *parser) statement() (bool, error) {
+	p.ws()
+	if p.eof() {
+		return false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(p.s[p.pos:], "@prefix"):
+		p.pos += len("@prefix")
+		if err := p.prefixDirective(); err != nil {
+			return true, err
+		}
+		return true, p.expect('.', ErrExpectedDot)
+	case strings.HasPrefix(p.s[p.pos:], "@base"):
+		p.pos += len("@base")
+		if err := p.baseDirective(); err != nil {
+			return true, err
+		}
+		return true, p.expect('.', ErrExpectedDot)
+	case p.keyword("PREFIX"):
+		return true, p.prefixDirective()
+	case p.keyword("BASE"):
+		return true, p.baseDirective()
+	}
+
+	if p.TriG {
+		return true, p.block()
+	}
+
+	if err := p.triples(); err != nil {
+		return true, err
+	}
+	return true, p.expect('.', ErrExpectedDot)
+}
+
+func (p *parser) prefixDirective() error {
+	p.ws()
+	start := p.pos
+	if p.peek() != ':' {
+		if err := p.pnPrefix(); err != nil {
+			return err
+		}
+	}
+	prefix := p.s[start:p.pos]
+	if p.peek() != ':' {
+		return ErrExpectedPrefix
+	}
+	p.pos++
+	p.ws()
+	if p.peek() != '<' {
+		return ErrExpectedIri
+	}
+	iri, err := p.iriRef()
+	if err != nil {
+		return err
+	}
+	p.Prefixes[prefix] = iri
+	return nil
+}
+
+func (p *parser) baseDirective() error {
+	p.ws()
+	if p.peek() != '<' {
+		return ErrExpectedIri
+	}
+	iri, err := p.iriRef()
+	if err != nil {
+		return err
+	}
+	p.Base = iri
+	return nil
+}
+
+// TriG block: triples, or a graph
+func (p *parser) block() error {
+	p.graph = nil
+
+	if p.keyword("GRAPH") {
+		p.ws()
+		label, err := p.graphLabel()
+		if err != nil {
+			return err
+		}
+		return p.wrappedGraph(label)
+	}
+
+	if p.peek() == '{' {
+		return p.wrappedGraph(nil)
+	}
+
+	if p.peek() == '[' || p.peek() == '(' {
+		start := p.pos
+		if p.peek() == '[' {
+			p.pos++
+			p.ws()
+			if p.peek() == ']' {
+				p.pos++
+				p.ws()
+				if p.peek() == '{' {
+					return p.wrappedGraph(p.freshBlank())
+				}
+			}
+		}
+		p.pos = start
+		if err := p.triples(); err != nil {
+			return err
+		}
+		return p.expect('.', ErrExpectedDot)
+	}
+
+	subject, err := p.graphLabel()
+	if err != nil {
+		return err
+	}
+	p.ws()
+	if p.peek() == '{' {
+		return p.wrappedGraph(subject)
+	}
+	if err := p.predicateObjectList(subject); err != nil {
+		return err
+	}
+	return p.expect('.', ErrExpectedDot)
+}
+
+func (p *parser) graphLabel() (nquads.Node, error) {
+	switch p.peek() {
+	case '[':
+		p.pos++
+		if err := p.expect(']', ErrInvalidGraph); err != nil {
+			return nil, err
+		}
+		return p.freshBlank(), nil
+	case '_':
+		return p.blankNodeLabel()
+	default:
+		return p.iri()
+	}
+}
+
+func (p *parser) wrappedGraph(label nquads.Node) error {
+	p.ws()
+	p.pos++ // '{'
+	p.graph = label
+	defer func() { p.graph = nil }()
+
+	for {
+		p.ws()
+		if p.peek() == '}' {
+			p.pos++
+			return nil
+		} else if p.eof() {
+			return ErrExpectedBrace
+		}
+		if err := p.triples(); err != nil {
+			return err
+		}
+		p.ws()
+		if p.peek() == '.' {
+			p.pos++
+		} else if p.peek() != '}' {
+			return ErrExpectedBrace
+		}
+	}
+}
+
+// triples ::= subject predicateObjectList | blankNodePropertyList predicateObjectList?
+func (p *parser) triples() error {
+	p.ws()
+	switch p.peek() {
+	case '[':
+		subject, err := p.blankNodePropertyList()
+		if err != nil {
+			return err
+		}
+		p.ws()
+		if c := p.peek(); c == '.' || c == '}' || c == 0 {
+			return nil
+		}
+		return p.predicateObjectList(subject)
+	case '(':
+		subject, err := p.collection()
+		if err != nil {
+			return err
+		}
+		return p.predicateObjectList(subject)
+	case '_':
+		subject, err := p.blankNodeLabel()
+		if err != nil {
+			return err
+		}
+		return p.predicateObjectList(subject)
+	default:
+		subject, err := p.iri()
+		if err == ErrExpectedIri {
+			return ErrExpectedSubject
+		} else if err != nil {
+			return err
+		}
+		return p.predicateObjectList(subject)
+	}
+}
+
+// predicateObjectList ::= verb objectList (';' (verb objectList)?)*
+func (p *parser) predicateObjectList(subject nquads.Node) error {
+	for {
+		p.ws()
+		predicate, err := p.verb()
+		if err != nil {
+			return err
+		}
+		if err := p.objectList(subject, predicate); err != nil {
+			return err
+		}
+		p.ws()
+		if p.peek() != ';' {
+			return nil
+		}
+		for p.peek() == ';' {
+			p.pos++
+			p.ws()
+		}
+		if c := p.peek(); c == '.' || c == ']' || c == '}' || c == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *parser) verb() (nquads.Node, error) {
+	if p.peek() == 'a' {
+		next := p.peekAt(1)
+		if next == ' ' || next == '\t' || next == '\r' || next == '\n' || next == '<' || next == '[' || next == '(' || next == '"' || next == '\'' || next == '_' || next == '#' {
+			p.pos++
+			return nquads.NewIri(RdfType), nil
+		}
+	}
+	iri, err := p.iri()
+	if err == ErrExpectedIri {
+		return nil, ErrExpectedPredicate
+	}
+	return iri, err
+}
+
+func (p *parser) objectList(subject, predicate nquads.Node) error {
+	for {
+		p.ws()
+		object, err := p.object()
+		if err != nil {
+			return err
+		}
+		p.emit(subject, predicate, object)
+		p.ws()
+		if p.peek() != ',' {
+			return nil
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) object() (nquads.Node, error) {
+	c := p.peek()
+	switch {
+	case c == '<':
+		return p.iri()
+	case c == '_' && p.peekAt(1) == ':':
+		return p.blankNodeLabel()
+	case c == '[':
+		return p.blankNodePropertyList()
+	case c == '(':
+		return p.collection()
+	case c == '"' || c == '\'':
+		return p.rdfLiteral()
+	case c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.':
+		return p.numericLiteral()
+	case p.keyword("true"):
+		return nquads.NewLiteral("true", nquads.XsdBoolean, ""), nil
+	case p.keyword("false"):
+		return nquads.NewLiteral("false", nquads.XsdBoolean, ""), nil
+	default:
+		iri, err := p.iri()
+		if err == ErrExpectedIri {
+			return nil, ErrExpectedObject
+		}
+		return iri, err
+	}
+}
+
+func (p *parser) blankNodeLabel() (nquads.Node, error) {
+	if !strings.HasPrefix(p.s[p.pos:], "_:") {
+		return nil, ErrInvalidBlankNode
+	}
+	p.pos += 2
+	start := p.pos
+	r := p.peekRune()
+	if !isPnCharsU(r) && !(r >= '0' && r <= '9') {
+		return nil, ErrInvalidBlankNode
+	}
+	p.pos += utf8.RuneLen(r)
+	end := p.pos
+	for !p.eof() {
+		r := p.peekRune()
+		if isPnChars(r) {
+			p.pos += utf8.RuneLen(r)
+			end = p.pos
+		} else if r == '.' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	p.pos = end
+	label := p.s[start:end]
+	id, ok := p.bnodes[label]
+	if !ok {
+		id = p.freshBlank().Label()
+		p.bnodes[label] = id
+	}
+	return nquads.NewBlank(id), nil
+}
+
+func (p *parser) blankNodePropertyList() (nquads.Node, error) {
+	p.pos++ // '['
+	node := p.freshBlank()
+	p.ws()
+	if p.peek() == ']' {
+		p.pos++
+		return node, nil
+	}
+	if err := p.predicateObjectList(node); err != nil {
+		return nil, err
+	}
+	if err := p.expect(']', ErrUnexpectedCharacter); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *parser) collection() (nquads.Node, error) {
+	p.pos++ // '('
+	var head, last nquads.Node
+	for {
+		p.ws()
+		if p.peek() == ')' {
+			p.pos++
+			break
+		} else if p.eof() {
+			return nil, ErrUnexpectedEOF
+		}
+		item, err := p.object()
+		if err != nil {
+			return nil, err
+		}
+		node := p.freshBlank()
+		if last == nil {
+			head = node
+		} else {
+			p.emit(last, nquads.NewIri(RdfRest), node)
+		}
+		p.emit(node, nquads.NewIri(RdfFirst), item)
+		last = node
+	}
+	if last == nil {
+		return nquads.NewIri(RdfNil), nil
+	}
+	p.emit(last, nquads.NewIri(RdfRest), nquads.NewIri(RdfNil))
+	return head, nil
+}
+
+func (p *parser) rdfLiteral() (nquads.Node, error) {
+	value, err := p.stringLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '@' {
+		p.pos++
+		start := p.pos
+		subtag := 0
+		first := true
+		for !p.eof() {
+			c := p.s[p.pos]
+			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9' {
+				subtag++
+			} else if c == '-' && subtag > 0 {
+				subtag = 0
+				first = false
+			} else {
+				break
+			}
+			p.pos++
+		}
+		if subtag == 0 {
+			return nil, ErrInvalidLanguageTag
+		}
+		return nquads.NewLiteral(value, "", p.s[start:p.pos]), nil
+	}
+	if strings.HasPrefix(p.s[p.pos:], "^^") {
+		p.pos += 2
+		typ, err := p.iri()
+		if err != nil {
+			return nil, err
+		}
+		return nquads.NewLiteral(value, typ.(*nquads.IriNode).Iri(), ""), nil
+	}
+	return nquads.NewLiteral(value, "", ""), nil
+}
+
+func (p *parser) stringLiteral() (string, error) {
+	quote := p.s[p.pos : p.pos+1]
+	long := strings.HasPrefix(p.s[p.pos:], quote+quote+quote)
+	if long {
+		quote = quote + quote + quote
+	}
+	p.pos += len(quote)
+
+	var res []rune
+	for {
+		if p.eof() {
+			return "", ErrUnexpectedEOF
+		}
+		if strings.HasPrefix(p.s[p.pos:], quote) {
+			// A long string can end with quotes
+			if long {
+				for strings.HasPrefix(p.s[p.pos+1:], quote) {
+					res = append(res, rune(quote[0]))
+					p.pos++
+				}
+			}
+			p.pos += len(quote)
+			return string(res), nil
+		}
+		r, n := utf8.DecodeRuneInString(p.s[p.pos:])
+		if r == utf8.RuneError && n <= 1 {
+			return "", nquads.ErrInvalidUTF8
+		}
+		if !long && (r == '\n' || r == '\r') {
+			return "", ErrInvalidString
+		}
+		p.pos += n
+		if r == '\\' {
+			r, err := p.escape(true)
+			if err != nil {
+				return "", err
+			}
+			res = append(res, r)
+		} else {
+			res = append(res, r)
+		}
+	}
+}
+
+// Assume \ has already been read
+func (p *parser) escape(echar bool) (rune, error) {
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		var res rune
+		for i := 0; i < n; i++ {
+			h := p.peek()
+			switch {
+			case h >= '0' && h <= '9':
+				res = res<<4 | rune(h-'0')
+			case h >= 'a' && h <= 'f':
+				res = res<<4 | rune(h-'a'+10)
+			case h >= 'A' && h <= 'F':
+				res = res<<4 | rune(h-'A'+10)
+			default:
+				return 0, ErrInvalidEscape
+			}
+			p.pos++
+		}
+		if res > utf8.MaxRune {
+			return 0, ErrInvalidEscape
+		}
+		return res, nil
+	}
+	if echar {
+		switch c {
+		case 't':
+			return '\t', nil
+		case 'b':
+			return '\b', nil
+		case 'n':
+			return '\n', nil
+		case 'r':
+			return '\r', nil
+		case 'f':
+			return '\f', nil
+		case '"', '\'', '\\':
+			return rune(c), nil
+		}
+	}
+	p.pos--
+	return 0, ErrInvalidEscape
+}
+
+func (p *parser) numericLiteral() (nquads.Node, error) {
+	start := p.pos
+	digits := func() int {
+		n := 0
+		for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	exponent := func() bool {
+		if c := p.peek(); c != 'e' && c != 'E' {
+			return false
+		}
+		save := p.pos
+		p.pos++
+		if c := p.peek(); c == '+' || c == '-' {
+			p.pos++
+		}
+		if digits() == 0 {
+			p.pos = save
+			return false
+		}
+		return true
+	}
+
+	if c := p.peek(); c == '+' || c == '-' {
+		p.pos++
+	}
+	intDigits := digits()
+	typ := XsdInteger
+	if p.peek() == '.' {
+		save := p.pos
+		p.pos++
+		fracDigits := digits()
+		if exponent() {
+			typ = XsdDouble
+		} else if fracDigits > 0 {
+			typ = XsdDecimal
+		} else {
+			// The dot ends the statement
+			p.pos = save
+		}
+	} else if intDigits > 0 && exponent() {
+		typ = XsdDouble
+	}
+	if intDigits == 0 && typ == XsdInteger {
+		p.pos = start
+		return nil, ErrExpectedObject
+	}
+	return nquads.NewLiteral(p.s[start:p.pos], typ, ""), nil
+}
+
+// iri ::= IRIREF | PrefixedName
+func (p *parser) iri() (nquads.Node, error) {
+	if p.peek() == '<' {
+		iri, err := p.iriRef()
+		if err != nil {
+			return nil, err
+		}
+		return nquads.NewIri(iri), nil
+	}
+	return p.prefixedName()
+}
+
+// IRIREF, resolved against the base IRI
+func (p *parser) iriRef() (string, error) {
+	p.pos++ // '<'
+	var res []rune
+	for {
+		if p.eof() {
+			return "", ErrUnexpectedEOF
+		}
+		r, n := utf8.DecodeRuneInString(p.s[p.pos:])
+		if r == '>' {
+			p.pos++
+			break
+		}
+		if r == utf8.RuneError && n <= 1 {
+			return "", nquads.ErrInvalidUTF8
+		}
+		if r <= 0x20 || strings.ContainsRune("<\"{}|^`", r) {
+			return "", ErrInvalidIri
+		}
+		p.pos += n
+		if r == '\\' {
+			var err error
+			r, err = p.escape(false)
+			if err != nil {
+				return "", err
+			}
+		}
+		res = append(res, r)
+	}
+	return ResolveIri(p.Base, string(res)), nil
+}
+
+// PN_PREFIX ::= PN_CHARS_BASE ((PN_CHARS | '.')* PN_CHARS)?
+func (p *parser) pnPrefix() error {
+	r := p.peekRune()
+	if !isPnCharsBase(r) {
+		return ErrExpectedPrefix
+	}
+	p.pos += utf8.RuneLen(r)
+	end := p.pos
+	for !p.eof() {
+		r := p.peekRune()
+		if isPnChars(r) {
+			p.pos += utf8.RuneLen(r)
+			end = p.pos
+		} else if r == '.' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	p.pos = end
+	return nil
+}
+
+func (p *parser) prefixedName() (nquads.Node, error) {
+	start := p.pos
+	if p.peek() != ':' {
+		if err := p.pnPrefix(); err != nil {
+			return nil, ErrExpectedIri
+		}
+	}
+	prefix := p.s[start:p.pos]
+	if p.peek() != ':' {
+		p.pos = start
+		return nil, ErrExpectedIri
+	}
+	ns, ok := p.Prefixes[prefix]
+	if !ok {
+		p.pos = start
+		return nil, ErrUndefinedPrefix
+	}
+	p.pos++
+
+	local, err := p.pnLocal()
+	if err != nil {
+		return nil, err
+	}
+	return nquads.NewIri(ns + local), nil
+}
+
+// PN_LOCAL ::= (PN_CHARS_U | ':' | [0-9] | PLX) ((PN_CHARS | '.' | ':' | PLX)* (PN_CHARS | ':' | PLX))?
+func (p *parser) pnLocal() (string, error) {
+	var res, pending []rune
+	first := true
+	for !p.eof() {
+		r := p.peekRune()
+		switch {
+		case r == '\\':
+			c := p.peekAt(1)
+			if c == 0 || !strings.ContainsRune("_~.-!$&'()*+,;=/?#@%", rune(c)) {
+				return "", ErrInvalidEscape
+			}
+			res = append(append(res, pending...), rune(c))
+			pending = nil
+			p.pos += 2
+		case r == '%':
+			if !isHex(p.peekAt(1)) || !isHex(p.peekAt(2)) {
+				return "", ErrInvalidEscape
+			}
+			res = append(append(res, pending...), '%', rune(p.peekAt(1)), rune(p.peekAt(2)))
+			pending = nil
+			p.pos += 3
+		case r == '.' && !first:
+			pending = append(pending, r)
+			p.pos++
+		case r == ':' || first && (isPnCharsU(r) || r >= '0' && r <= '9') || !first && isPnChars(r):
+			res = append(append(res, pending...), r)
+			pending = nil
+			p.pos += utf8.RuneLen(r)
+		default:
+			p.pos -= len(string(pending))
+			return string(res), nil
+		}
+		first = false
+	}
+	p.pos -= len(string(pending))
+	return string(res), nil
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isPnCharsBase(r rune) bool {
+	return r >= 'A' && r <= 'Z' ||
+		r >= 'a' && r <= 'z' ||
+		r >= 0x00C0 && r <= 0x00D6 ||
+		r >= 0x00D8 && r <= 0x00F6 ||
+		r >= 0x00F8 && r <= 0x02FF ||
+		r >= 0x0370 && r <= 0x037D ||
+		r >= 0x037F && r <= 0x1FFF ||
+		r >= 0x200C && r <= 0x200D ||
+		r >= 0x2070 && r <= 0x218F ||
+		r >= 0x2C00 && r <= 0x2FEF ||
+		r >= 0x3001 && r <= 0xD7FF ||
+		r >= 0xF900 && r <= 0xFDCF ||
+		r >= 0xFDF0 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0xEFFFF
+}
+
+func isPnCharsU(r rune) bool {
+	return isPnCharsBase(r) || r == '_'
+}
+
+func isPnChars(r rune) bool {
+	return isPnCharsU(r) || r == '-' || r >= '0' && r <= '9' || r == 0x00B7 ||
+		r >= 0x0300 && r <= 0x036F || r >= 0x203F && r <= 0x2040
+}
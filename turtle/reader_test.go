@@ -0,0 +1,172 @@
+package turtle
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mildred/SmartWeb/nquads"
+)
+
+func encodeAll(sts []*nquads.Statement) []string {
+	var res []string
+	for _, st := range sts {
+		res = append(res, st.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestResolveIri(t *testing.T) {
+	base := "http://a/b/c/d;p?q"
+	tests := map[string]string{
+		"g:h":        "g:h",
+		"g":          "http://a/b/c/g",
+		"./g":        "http://a/b/c/g",
+		"g/":         "http://a/b/c/g/",
+		"/g":         "http://a/g",
+		"//g":        "http://g",
+		"?y":         "http://a/b/c/d;p?y",
+		"g?y":        "http://a/b/c/g?y",
+		"#s":         "http://a/b/c/d;p?q#s",
+		"":           "http://a/b/c/d;p?q",
+		"..":         "http://a/b/",
+		"../g":       "http://a/b/g",
+		"../../g":    "http://a/g",
+		"../../../g": "http://a/g",
+		"g;x=1/../y": "http://a/b/c/y",
+		"é":          "http://a/b/c/é",
+	}
+	for ref, expected := range tests {
+		if res := ResolveIri(base, ref); res != expected {
+			t.Errorf("ResolveIri(%#v) = %#v, expected %#v", ref, res, expected)
+		}
+	}
+}
+
+func TestTurtle(t *testing.T) {
+	input := `
+		@base <http://example.org/dir/> .
+		@prefix : <http://example.org/ns#> .
+		PREFIX sw: <tag:mildred.fr,2015-05:SmartWeb#>
+
+		<page.html> a sw:Page ; # comment
+			:title "Title"@en, 'Titre'@fr ;
+			:count 42 ; :ratio 1.5 ; :big 1e3 ; :ok true ;
+			:text """multi
+"line" text""" ;
+			:list ( 1 <a> ) ;
+			:author [ :name "Me" ] ;
+			:esc :local\-name, :a.b .
+		_:x :p _:x .
+		[ :q :r ] .
+	`
+	sts, err := NewReader(strings.NewReader(input), "").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`<http://example.org/dir/page.html> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <tag:mildred.fr,2015-05:SmartWeb#Page> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#title> "Title"@en .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#title> "Titre"@fr .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#count> "42"^^<http://www.w3.org/2001/XMLSchema#integer> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#ratio> "1.5"^^<http://www.w3.org/2001/XMLSchema#decimal> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#big> "1e3"^^<http://www.w3.org/2001/XMLSchema#double> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#ok> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#text> "multi\n\"line\" text" .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#list> _:b1 .`,
+		`_:b1 <http://www.w3.org/1999/02/22-rdf-syntax-ns#first> "1"^^<http://www.w3.org/2001/XMLSchema#integer> .`,
+		`_:b1 <http://www.w3.org/1999/02/22-rdf-syntax-ns#rest> _:b2 .`,
+		`_:b2 <http://www.w3.org/1999/02/22-rdf-syntax-ns#first> <http://example.org/dir/a> .`,
+		`_:b2 <http://www.w3.org/1999/02/22-rdf-syntax-ns#rest> <http://www.w3.org/1999/02/22-rdf-syntax-ns#nil> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#author> _:b3 .`,
+		`_:b3 <http://example.org/ns#name> "Me" .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#esc> <http://example.org/ns#local-name> .`,
+		`<http://example.org/dir/page.html> <http://example.org/ns#esc> <http://example.org/ns#a.b> .`,
+		`_:b4 <http://example.org/ns#p> _:b4 .`,
+		`_:b5 <http://example.org/ns#q> <http://example.org/ns#r> .`,
+	}
+	sort.Strings(expected)
+	res := encodeAll(sts)
+	if strings.Join(res, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(res, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestTriG(t *testing.T) {
+	input := `
+		@prefix : <http://example.org/> .
+		:s :p :o .
+		:g1 { :s :p :o1 . :s :p :o2 }
+		GRAPH :g2 { :s :p "x" . }
+		{ :s :p :o3 }
+	`
+	sts, err := NewTriGReader(strings.NewReader(input), "").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`<http://example.org/s> <http://example.org/p> <http://example.org/o> .`,
+		`<http://example.org/s> <http://example.org/p> <http://example.org/o1> <http://example.org/g1> .`,
+		`<http://example.org/s> <http://example.org/p> <http://example.org/o2> <http://example.org/g1> .`,
+		`<http://example.org/s> <http://example.org/p> "x" <http://example.org/g2> .`,
+		`<http://example.org/s> <http://example.org/p> <http://example.org/o3> .`,
+	}
+	sort.Strings(expected)
+	res := encodeAll(sts)
+	if strings.Join(res, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(res, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []string{
+		`<http://example/s> <http://example/p> <http://example/o>`,
+		`<http://example/s> <http://example/p> .`,
+		`<http://example/s> undefined:p <http://example/o> .`,
+		`<http://example/s> <http://example/p> "unterminated .`,
+		`<http://example/s> <http://example/p> "x"@ .`,
+		`<http://example/s> <http://example/p> <http://example/o> { } .`,
+		`<http://example/s> <http://example/p> ( <http://example/o> .`,
+		`<http://example/s> <http://example/p> "\q" .`,
+		`<http://example/ s> <http://example/p> <http://example/o> .`,
+	}
+	for _, input := range tests {
+		_, err := NewReader(strings.NewReader(input), "").ReadAll()
+		if _, ok := err.(*nquads.ParseError); !ok {
+			t.Errorf("%s: expected *nquads.ParseError, got %#v", input, err)
+		}
+	}
+
+	_, err := NewReader(strings.NewReader("\n\n  <a> <b> ."), "http://example/").ReadAll()
+	if perr, ok := err.(*nquads.ParseError); !ok || perr.Line != 3 || perr.Column != 11 {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	input := `
+		@prefix : <http://example.org/> .
+		:s a :Type ; :p :o1, :o2 ; :q "l\"it"@en, 12, 1.5, true, "x"^^:dt, [ :r :t ] .
+		:g { :s :p "in graph" }
+	`
+	sts, err := NewTriGReader(strings.NewReader(input), "").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := NewTriGWriter(&buf, []Prefix{{"ex", "http://example.org/"}})
+	if err := w.WriteStatements(sts); err != nil {
+		t.Fatal(err)
+	}
+
+	sts2, err := NewTriGReader(&buf, "").ReadAll()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	if strings.Join(encodeAll(sts), "\n") != strings.Join(encodeAll(sts2), "\n") {
+		t.Errorf("round trip failed:\n%s\n%s", strings.Join(encodeAll(sts), "\n"), strings.Join(encodeAll(sts2), "\n"))
+	}
+}
@@ -0,0 +1,208 @@
+package turtle
+
+import (
+	"fmt"
+	"github.com/mildred/SmartWeb/nquads"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type Prefix struct {
+	Name string
+	Iri  string
+}
+
+// Serialize statements in Turtle, or in TriG if TriG is set. Statements are
+// grouped by graph, subject and predicate. With Turtle, the graph of the
+// statements is ignored.
+type Writer struct {
+	io.Writer
+	Prefixes []Prefix
+	Base     string
+	TriG     bool
+}
+
+func NewWriter(w io.Writer, prefixes []Prefix) *Writer {
+	return &Writer{Writer: w, Prefixes: prefixes}
+}
+
+func NewTriGWriter(w io.Writer, prefixes []Prefix) *Writer {
+	return &Writer{Writer: w, Prefixes: prefixes, TriG: true}
+}
+
+// Prefixes commonly used in SmartWeb graphs
+var DefaultPrefixes = []Prefix{
+	{"rdf", RdfNamespace},
+	{"rdfs", "http://www.w3.org/2000/01/rdf-schema#"},
+	{"xsd", nquads.XsdNamespace},
+	{"sw", "tag:mildred.fr,2015-05:SmartWeb#"},
+}
+
+var localNameRegexp = regexp.MustCompile(`^([A-Za-z_0-9]([A-Za-z_0-9.-]*[A-Za-z_0-9-])?)?$`)
+var integerRegexp = regexp.MustCompile(`^[+-]?[0-9]+$`)
+var decimalRegexp = regexp.MustCompile(`^[+-]?[0-9]*\.[0-9]+$`)
+var doubleRegexp = regexp.MustCompile(`^[+-]?([0-9]+\.[0-9]*|\.?[0-9]+)[eE][+-]?[0-9]+$`)
+
+func (w *Writer) encodeIri(iri string) string {
+	for _, p := range w.Prefixes {
+		if strings.HasPrefix(iri, p.Iri) && localNameRegexp.MatchString(iri[len(p.Iri):]) {
+			return p.Name + ":" + iri[len(p.Iri):]
+		}
+	}
+	if w.Base != "" && strings.HasPrefix(iri, w.Base) && !strings.ContainsAny(iri[len(w.Base):], ":/") {
+		return nquads.EncodeIri(iri[len(w.Base):])
+	}
+	return nquads.EncodeIri(iri)
+}
+
+func (w *Writer) encode(node nquads.Node) string {
+	switch n := node.(type) {
+	case *nquads.IriNode:
+		return w.encodeIri(n.Iri())
+	case *nquads.LiteralNode:
+		value, typ := n.Value(), n.Datatype()
+		switch {
+		case n.Lang != "":
+			return nquads.EncodeLocString(value, n.Lang)
+		case typ == "" || typ == nquads.XsdString:
+			return nquads.EncodeString(value)
+		case typ == nquads.XsdBoolean && (value == "true" || value == "false"):
+			return value
+		case typ == XsdInteger && integerRegexp.MatchString(value):
+			return value
+		case typ == XsdDecimal && decimalRegexp.MatchString(value):
+			return value
+		case typ == XsdDouble && doubleRegexp.MatchString(value):
+			return value
+		default:
+			return nquads.EncodeString(value) + "^^" + w.encodeIri(typ)
+		}
+	default:
+		return node.Encode()
+	}
+}
+
+func (w *Writer) writePrefixes() error {
+	if w.Base != "" {
+		if _, err := fmt.Fprintf(w, "@base %s .\n", nquads.EncodeIri(w.Base)); err != nil {
+			return err
+		}
+	}
+	for _, p := range w.Prefixes {
+		if _, err := fmt.Fprintf(w, "@prefix %s: %s .\n", p.Name, nquads.EncodeIri(p.Iri)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func nodeKey(n nquads.Node) string {
+	if n == nil {
+		return ""
+	}
+	return n.Encode()
+}
+
+// Write a whole document
+func (w *Writer) WriteStatements(statements []*nquads.Statement) error {
+	if err := w.writePrefixes(); err != nil {
+		return err
+	}
+
+	var graphs []string
+	byGraph := make(map[string][]*nquads.Statement)
+	graphNodes := make(map[string]nquads.Node)
+	for _, st := range statements {
+		g := ""
+		if w.TriG {
+			g = nodeKey(st.GraphNode())
+			graphNodes[g] = st.GraphNode()
+		}
+		if _, ok := byGraph[g]; !ok {
+			graphs = append(graphs, g)
+		}
+		byGraph[g] = append(byGraph[g], st)
+	}
+	sort.Strings(graphs)
+
+	for _, g := range graphs {
+		indent := ""
+		if g != "" {
+			indent = "\t"
+			if _, err := fmt.Fprintf(w, "%s {\n", w.encode(graphNodes[g])); err != nil {
+				return err
+			}
+		}
+		if err := w.writeTriples(byGraph[g], indent); err != nil {
+			return err
+		}
+		if g != "" {
+			if _, err := fmt.Fprintf(w, "}\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeTriples(statements []*nquads.Statement, indent string) error {
+	var subjects []string
+	bySubject := make(map[string][]*nquads.Statement)
+	for _, st := range statements {
+		s := nodeKey(st.SubjectNode())
+		if _, ok := bySubject[s]; !ok {
+			subjects = append(subjects, s)
+		}
+		bySubject[s] = append(bySubject[s], st)
+	}
+	sort.Strings(subjects)
+
+	for i, s := range subjects {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		sts := bySubject[s]
+		sort.SliceStable(sts, func(i, j int) bool {
+			pi, pj := nodeKey(sts[i].PredicateNode()), nodeKey(sts[j].PredicateNode())
+			// rdf:type first
+			if (pi == "<"+RdfType+">") != (pj == "<"+RdfType+">") {
+				return pi == "<"+RdfType+">"
+			}
+			return pi < pj
+		})
+
+		line := indent + w.encode(sts[0].SubjectNode())
+		var lastPredicate string
+		for i, st := range sts {
+			p := nodeKey(st.PredicateNode())
+			if i > 0 && p == lastPredicate {
+				line += ",\n" + indent + "\t\t"
+			} else {
+				if i > 0 {
+					line += " ;\n" + indent + "\t"
+				} else {
+					line += " "
+				}
+				if p == "<"+RdfType+">" {
+					line += "a "
+				} else {
+					line += w.encode(st.PredicateNode()) + " "
+				}
+			}
+			line += w.encode(st.ObjectNode())
+			lastPredicate = p
+		}
+		if _, err := fmt.Fprintf(w, "%s .\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}